@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// batchOp is a single Set, Del, DeleteRange or Merge operation of a WriteBatch.
+// A range tombstone is stored with its start key as key and its end key as value.
+type batchOp struct {
+	family string // Name of the column family, empty for the one the batch is written to
+	key    string
+	value
+}
+
+// WriteBatch accumulates Set, Del, DeleteRange and Merge operations to be applied atomically by fileDB.Write.
+// The zero value is an empty batch ready to use.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+// NewWriteBatch creates an empty WriteBatch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Set adds the storage of a key-value pair to the batch.
+func (b *WriteBatch) Set(key string, val []byte) {
+	b.ops = append(b.ops, batchOp{"", key, value{set, val, 0}})
+}
+
+// SetWithTTL adds the storage of a key-value pair expiring after ttl to the batch.
+// The expiry time is computed when the operation is added.
+func (b *WriteBatch) SetWithTTL(key string, val []byte, ttl time.Duration) {
+	b.ops = append(b.ops, batchOp{"", key, value{set, val, time.Now().Add(ttl).UnixNano()}})
+}
+
+// Del adds the deletion of a key to the batch. Unlike fileDB.Del, deleting a missing key is not an error.
+func (b *WriteBatch) Del(key string) {
+	b.ops = append(b.ops, batchOp{"", key, value{del, nil, 0}})
+}
+
+// SetCF adds the storage of a key-value pair in the column family cf to the batch.
+func (b *WriteBatch) SetCF(cf *fileDB, key string, val []byte) {
+	b.ops = append(b.ops, batchOp{cf.name, key, value{set, val, 0}})
+}
+
+// DelCF adds the deletion of a key of the column family cf to the batch.
+func (b *WriteBatch) DelCF(cf *fileDB, key string) {
+	b.ops = append(b.ops, batchOp{cf.name, key, value{del, nil, 0}})
+}
+
+// DeleteRange adds the deletion of all the keys from start, included, to end, excluded, to the batch.
+// It is recorded as a single range tombstone, whatever the number of keys in the range.
+func (b *WriteBatch) DeleteRange(start, end string) {
+	b.ops = append(b.ops, batchOp{"", start, value{rangeDel, []byte(end), 0}})
+}
+
+// Merge adds a merge operand for a key to the batch.
+func (b *WriteBatch) Merge(key string, operand []byte) {
+	b.ops = append(b.ops, batchOp{"", key, value{merge, operand, 0}})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Clear removes all the operations from the batch, so that it can be reused.
+func (b *WriteBatch) Clear() {
+	b.ops = b.ops[:0]
+}
+
+// Write applies all the operations of the batch atomically.
+// The batch is appended to the Write-Ahead Log as a single checksummed record, so that after a crash
+// either all of its operations are recovered or none of them. Its operations get consecutive sequence numbers.
+// Operations added without a column family apply to mem; the others may target any column family of the database.
+// Returns any encountered error during the process.
+func (mem *fileDB) Write(b *WriteBatch) error {
+	return mem.WriteContext(context.Background(), b)
+}
+
+// WriteContext is like Write, but gives up with the error of ctx if it is done before the batch is logged.
+// Once logged, the batch is applied whatever ctx.
+func (mem *fileDB) WriteContext(ctx context.Context, b *WriteBatch) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.write(ctx, b)
+}
+
+// write is the lock-free implementation of Write. The caller must hold mem.mu.
+func (mem *fileDB) write(ctx context.Context, b *WriteBatch) error {
+	if mem.closed {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	if mem.follower != nil || mem.raft != nil {
+		return ErrReadOnly
+	}
+	bound, err := mem.bind(b)
+	if err != nil {
+		return err
+	}
+	return mem.commit(mem.seq+1, bound)
+}
+
+// commit logs a batch, whose operations are numbered from the sequence number first and name their column family,
+// applies it to the Memtables and publishes it to the change feed, then flushes the Memtables if needed.
+// The caller must hold mem.mu.
+// Returns any encountered error.
+func (mem *fileDB) commit(first uint64, b *WriteBatch) error {
+	if err := mem.openBatchFamilies(b); err != nil {
+		return err
+	}
+	if err := mem.appendBatchToWAL(first, b); err != nil {
+		return err
+	}
+	mem.applyBatch(first, b)
+	mem.feed.publish(first, b)
+
+	if mem.needsFlush() {
+		if err := mem.flush(); err != nil {
+			return fmt.Errorf("Error while flushing Memtable to disk: %w", err)
+		}
+	}
+	return nil
+}
+
+// bind returns a copy of the batch in which the operations added without a column family target mem.
+// The caller must hold mem.mu.
+// Returns the copy, or an error if an operation targets a column family that does not exist or is too large.
+func (mem *fileDB) bind(b *WriteBatch) (*WriteBatch, error) {
+	bound := &WriteBatch{ops: make([]batchOp, len(b.ops))}
+	for i, op := range b.ops {
+		if len(op.key) > maxKeySize || len(op.val) > maxValueSize {
+			return nil, fmt.Errorf("%w: %d-byte key, %d-byte value", ErrTooLarge, len(op.key), len(op.val))
+		}
+		if op.family == "" {
+			op.family = mem.name
+		} else if _, ok := mem.families[op.family]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, op.family)
+		}
+		bound.ops[i] = op
+	}
+	return bound, nil
+}
+
+// openBatchFamilies opens the column families named by the operations of a batch replayed from the Write-Ahead Log,
+// the primary or the Raft log, registering those that are not open with openReplayedColumnFamily.
+// The caller must hold mem.mu.
+// Returns any encountered error.
+func (mem *fileDB) openBatchFamilies(b *WriteBatch) error {
+	for _, op := range b.ops {
+		if op.family != "" && op.family != mem.name {
+			if _, err := mem.openReplayedColumnFamily(op.family); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyBatch writes the operations of a batch to the Memtables of their column families,
+// numbered from the sequence number first. Operations without a column family apply to mem.
+// The column families must have been opened by openBatchFamilies. The caller must hold mem.mu.
+func (mem *fileDB) applyBatch(first uint64, b *WriteBatch) {
+	for i, op := range b.ops {
+		family := mem
+		if op.family != "" && op.family != mem.name {
+			family = mem.families[op.family]
+		}
+		family.put(internalKey{op.key, first + uint64(i)}, op.value)
+	}
+	mem.seq = max(mem.seq, first+uint64(b.Len())-1)
+}
+
+// put writes a version to the Memtable, range tombstones being kept apart from the point entries.
+// The caller must hold mem.mu.
+func (mem *fileDB) put(ik internalKey, v value) {
+	if v.flag == rangeDel {
+		mem.rangeDels = append(mem.rangeDels, kvEntry{ik, v})
+		return
+	}
+	mem.values.Put(ik, v)
+}
+
+// needsFlush reports whether the Memtable of a column family reached its limit. The caller must hold mem.mu.
+func (mem *fileDB) needsFlush() bool {
+	for _, family := range mem.families {
+		if family.memSize() >= family.memLimit {
+			return true
+		}
+	}
+	return false
+}
+
+// memSize returns the number of entries of the Memtable, range tombstones included. The caller must hold mem.mu.
+func (mem *fileDB) memSize() int {
+	return mem.values.Size() + len(mem.rangeDels)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.Set("old", []byte("value")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+
+	// Normal case: all operations are applied with consecutive sequence numbers
+	b := NewWriteBatch()
+	b.Set("a", []byte("1"))
+	b.Set("b", []byte("2"))
+	b.Del("old")
+	b.Del("missing")
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Error writing batch: %s", err)
+	}
+	if db.seq != 5 {
+		t.Fatalf("Expected sequence number 5, got %d", db.seq)
+	}
+	if val, err := db.Get("b"); err != nil || string(val) != "2" {
+		t.Fatalf("Expected value 2, got %s (%v)", val, err)
+	}
+	if _, err := db.Get("old"); err == nil {
+		t.Fatal("Expected deleted key to be missing")
+	}
+
+	// Edge case: an empty batch is a no-op
+	b.Clear()
+	if err := db.Write(b); err != nil || db.seq != 5 {
+		t.Fatalf("Expected empty batch to be a no-op, got sequence number %d (%v)", db.seq, err)
+	}
+}
+
+func TestRecoverWALTornBatch(t *testing.T) {
+	db := newTestDB(t)
+
+	first := NewWriteBatch()
+	first.Set("a", []byte("1"))
+	first.Set("b", []byte("2"))
+	if err := db.Write(first); err != nil {
+		t.Fatalf("Error writing batch: %s", err)
+	}
+	// Simulate a crash in the middle of appending a second batch
+	second := NewWriteBatch()
+	second.Set("c", []byte("3"))
+	second.Del("a")
+	record := batchToRecord(db.seq+1, second)
+	if _, err := db.wal.Write(record[:len(record)-3]); err != nil {
+		t.Fatalf("Error writing WAL: %s", err)
+	}
+	db.wal.Close()
+
+	reopened, err := newDB()
+	if err != nil {
+		t.Fatal("Error reopening the DB:", err)
+	}
+	defer reopened.wal.Close()
+	if err := reopened.recoverWAL(); err != nil {
+		t.Fatalf("Error recovering the WAL: %s", err)
+	}
+
+	// The first batch is fully recovered, the torn one not at all
+	if val, err := reopened.Get("a"); err != nil || string(val) != "1" {
+		t.Fatalf("Expected value 1, got %s (%v)", val, err)
+	}
+	if _, err := reopened.Get("c"); err == nil {
+		t.Fatal("Expected torn batch to be ignored")
+	}
+
+	// New writes are recovered after the torn batch was dropped
+	if err := reopened.Set("d", []byte("4")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	reopened.wal.Close()
+	again, err := newDB()
+	if err != nil {
+		t.Fatal("Error reopening the DB:", err)
+	}
+	defer again.wal.Close()
+	if err := again.recoverWAL(); err != nil {
+		t.Fatalf("Error recovering the WAL: %s", err)
+	}
+	if val, err := again.Get("d"); err != nil || string(val) != "4" {
+		t.Fatalf("Expected value 4, got %s (%v)", val, err)
+	}
+}
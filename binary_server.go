@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Operations of the binary protocol. A key entry is an entry encoded by kvToEntry with the del flag,
+// which only holds a key; the other entries carry their flag, value and expiry time like in the WAL.
+const (
+	opPing     = byte(0) // Empty payload; answers an empty payload
+	opGet      = byte(1) // One key entry; answers the entry of the value, whose sequence number is its version
+	opMultiGet = byte(2) // Key entries; answers the entries of the keys that exist
+	opWrite    = byte(3) // Entries applied atomically as a WriteBatch; answers the 8-byte sequence number of the last one
+	opWriteIf  = byte(4) // One entry applied if the version of its key is the sequence number of the entry, 0 for a missing key
+	opDel      = byte(5) // One key entry deleted if it exists; answers the entry of its last value
+	opScan     = byte(6) // 4-byte limit and a range entry from its key, included, to its value, excluded; answers the entries
+)
+
+// Statuses of the responses of the binary protocol.
+const (
+	statusOK       = byte(0)
+	statusNotFound = byte(1) // Empty payload
+	statusError    = byte(2) // 1-byte code length, code (as in the HTTP error responses), and message
+)
+
+const (
+	frameHeaderSize    = 4 + 8 + 1    // Length of the rest of the frame, request id, and operation or status
+	maxFrameSize       = 64 << 20     // Largest frame, in bytes
+	maxInFlight        = 256          // Requests of a connection processed concurrently
+	maxBinaryScanLimit = maxScanLimit // Largest number of entries answered by opScan
+)
+
+// binaryServer serves a compact binary protocol over TCP, for callers for which HTTP and JSON are too costly.
+// Requests and responses are length-prefixed frames: a 4-byte length of the rest of the frame, an 8-byte request id
+// chosen by the client, an operation (requests) or a status (responses), and a payload of entries encoded by kvToEntry.
+// Integers are little-endian. Clients may send many requests without waiting for the responses: requests are
+// processed concurrently and each response carries the id of its request, so responses may come out of order.
+type binaryServer struct {
+	db      *fileDB
+	timeout time.Duration // Maximum duration of a request, 0 for no limit
+}
+
+// newBinaryServer creates a binaryServer for db, whose requests give up after timeout.
+func newBinaryServer(db *fileDB, timeout time.Duration) *binaryServer {
+	return &binaryServer{db, timeout}
+}
+
+// serve accepts connections on ln and serves each of them in its own goroutine.
+// Returns when ln is closed, with the error of Accept.
+func (srv *binaryServer) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.handleConn(conn)
+	}
+}
+
+// handleConn reads the requests of a connection and processes up to maxInFlight of them concurrently.
+// A single goroutine writes the responses, flushing them once no other response is pending.
+// The requests still running are cancelled when the connection is closed or a malformed frame is received.
+func (srv *binaryServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	responses := make(chan []byte, maxInFlight)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		w := bufio.NewWriter(conn)
+		broken := false
+		for frame := range responses {
+			if broken {
+				continue // Drain the responses so that the requests can end
+			}
+			w.Write(frame)
+			if len(responses) == 0 && w.Flush() != nil {
+				broken = true
+				conn.Close()
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	inFlight := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+	for {
+		id, op, payload, err := readFrame(r)
+		if err != nil {
+			break
+		}
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses <- srv.handle(ctx, id, op, payload)
+			<-inFlight
+		}()
+	}
+	cancel()
+	wg.Wait()
+	close(responses)
+	<-written
+}
+
+// readFrame reads a frame from r.
+// Returns the request id, the operation or status, the payload and any encountered error.
+func readFrame(r io.Reader) (uint64, byte, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length < 8+1 || length > maxFrameSize {
+		return 0, 0, nil, fmt.Errorf("%w: invalid frame length %d", ErrInvalidArgument, length)
+	}
+	payload := make([]byte, length-8-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return binary.LittleEndian.Uint64(header[4:12]), header[12], payload, nil
+}
+
+// encodeFrame builds a frame from a request id, an operation or status, and a payload.
+func encodeFrame(id uint64, kind byte, payload []byte) []byte {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(8+1+len(payload))) // 4 bytes for the length of the rest
+	binary.LittleEndian.PutUint64(frame[4:12], id)                      // 8 bytes for the request id
+	frame[12] = kind                                                    // 1 byte for the operation or status
+	return append(frame, payload...)
+}
+
+// handle processes a request within the request timeout of the server.
+// Returns the response frame.
+func (srv *binaryServer) handle(ctx context.Context, id uint64, op byte, payload []byte) []byte {
+	if srv.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.timeout)
+		defer cancel()
+	}
+	status, res, err := srv.apply(ctx, op, payload)
+	if err != nil {
+		_, code := errorStatus(err)
+		message := err.Error()
+		res = append(append([]byte{byte(len(code))}, code...), message...)
+		status = statusError
+	}
+	return encodeFrame(id, status, res)
+}
+
+// apply runs an operation.
+// Returns the status, the payload of the response and any encountered error.
+func (srv *binaryServer) apply(ctx context.Context, op byte, payload []byte) (byte, []byte, error) {
+	db := srv.db
+	switch op {
+	case opPing:
+		return statusOK, nil, nil
+
+	case opGet, opDel:
+		entries, err := decodeEntries(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(entries) != 1 {
+			return 0, nil, fmt.Errorf("%w: expected one key", ErrInvalidArgument)
+		}
+		key := entries[0].key
+		var val []byte
+		var version uint64
+		if op == opGet {
+			val, version, err = db.GetVersionContext(ctx, key)
+		} else {
+			val, err = db.DelContext(ctx, key)
+		}
+		if errors.Is(err, ErrNotFound) {
+			return statusNotFound, nil, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return statusOK, kvToEntry(key, version, value{set, val, 0}), nil
+
+	case opMultiGet:
+		entries, err := decodeEntries(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		keys := make([]string, len(entries))
+		for i, entry := range entries {
+			keys[i] = entry.key
+		}
+		values, err := db.MultiGetContext(ctx, keys)
+		if err != nil {
+			return 0, nil, err
+		}
+		var res []byte
+		for _, key := range keys {
+			if val, ok := values[key]; ok {
+				res = append(res, kvToEntry(key, 0, value{set, val, 0})...)
+				delete(values, key) // Duplicate keys are answered once
+			}
+		}
+		return statusOK, res, nil
+
+	case opWrite:
+		entries, err := decodeEntries(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		b := WriteBatch{}
+		for _, entry := range entries {
+			if entry.flag == rangeDel && entry.key >= string(entry.val) {
+				return 0, nil, fmt.Errorf("%w: start must be less than end", ErrInvalidArgument)
+			}
+			b.ops = append(b.ops, batchOp{"", entry.key, entry.value})
+		}
+		version, err := srv.write(ctx, &b)
+		if err != nil {
+			return 0, nil, err
+		}
+		return statusOK, binary.LittleEndian.AppendUint64(nil, version), nil
+
+	case opWriteIf:
+		entries, err := decodeEntries(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(entries) != 1 || (entries[0].flag != set && entries[0].flag != del) {
+			return 0, nil, fmt.Errorf("%w: expected one set or del entry", ErrInvalidArgument)
+		}
+		entry := entries[0]
+		version, err := db.writeIf(ctx, entry.key, entry.value, func(_ []byte, current uint64, exists bool) bool {
+			return exists == (entry.seq != 0) && current == entry.seq
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		return statusOK, binary.LittleEndian.AppendUint64(nil, version), nil
+
+	case opScan:
+		if len(payload) < 4 {
+			return 0, nil, fmt.Errorf("%w: missing scan limit", ErrInvalidArgument)
+		}
+		limit := int(binary.LittleEndian.Uint32(payload[0:4]))
+		if limit <= 0 || limit > maxBinaryScanLimit {
+			limit = maxBinaryScanLimit
+		}
+		entries, err := decodeEntries(payload[4:])
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(entries) != 1 || entries[0].flag != rangeDel {
+			return 0, nil, fmt.Errorf("%w: expected one range entry", ErrInvalidArgument)
+		}
+		it, err := db.NewIteratorContext(ctx, &IterOptions{LowerBound: entries[0].key, UpperBound: string(entries[0].val)})
+		if err != nil {
+			return 0, nil, err
+		}
+		defer it.Close()
+		var res []byte
+		for ok, n := it.First(), 0; ok && n < limit; ok, n = it.Next(), n+1 {
+			res = append(res, kvToEntry(it.Key(), 0, value{set, it.Value(), 0})...)
+		}
+		if err := it.Err(); err != nil {
+			return 0, nil, err
+		}
+		return statusOK, res, nil
+	}
+	return 0, nil, fmt.Errorf("%w: unknown operation %d", ErrInvalidArgument, op)
+}
+
+// write applies a batch atomically.
+// Returns the sequence number of its last operation and any encountered error.
+func (srv *binaryServer) write(ctx context.Context, b *WriteBatch) (uint64, error) {
+	srv.db.mu.Lock()
+	defer srv.db.mu.Unlock()
+	if err := srv.db.write(ctx, b); err != nil {
+		return 0, err
+	}
+	return srv.db.seq, nil
+}
+
+// decodeEntries decodes a sequence of entries encoded by kvToEntry, checking their lengths first,
+// since they come from the network rather than from a checksummed file.
+// Returns the entries, or an error wrapping ErrInvalidArgument if the payload is malformed.
+func decodeEntries(payload []byte) ([]kvEntry, error) {
+	var entries []kvEntry
+	for position := 0; position < len(payload); {
+		if err := checkEntry(payload[position:]); err != nil {
+			return nil, err
+		}
+		flag, seq, key, val, expiry := entryToKv(payload, &position)
+		entries = append(entries, kvEntry{internalKey{string(key), seq}, value{flag, val, expiry}})
+	}
+	return entries, nil
+}
+
+// checkEntry checks that entry starts with a complete entry encoded by kvToEntry, with a known flag.
+func checkEntry(entry []byte) error {
+	malformed := fmt.Errorf("%w: malformed entry", ErrInvalidArgument)
+	if len(entry) < 1+8+4 {
+		return malformed
+	}
+	flag := entry[0]
+	if flag != set && flag != del && flag != merge && flag != setWithExpiry && flag != rangeDel {
+		return fmt.Errorf("%w: unknown entry flag %d", ErrInvalidArgument, flag)
+	}
+	size := 1 + 8 + 4 + int(binary.LittleEndian.Uint32(entry[9:13]))
+	if flag == del {
+		if size > len(entry) {
+			return malformed
+		}
+		return nil
+	}
+	if flag == setWithExpiry {
+		size += 8
+	}
+	if size+4 > len(entry) {
+		return malformed
+	}
+	size += 4 + int(binary.LittleEndian.Uint32(entry[size:size+4]))
+	if size > len(entry) {
+		return malformed
+	}
+	return nil
+}
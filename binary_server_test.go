@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// binaryClient is a client of the binary protocol sharing one connection between goroutines:
+// requests are pipelined and the responses are dispatched to their callers by request id.
+type binaryClient struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	nextID  atomic.Uint64
+
+	mu      sync.Mutex
+	pending map[uint64]chan binaryResponse
+}
+
+// binaryResponse is a response of the binary protocol.
+type binaryResponse struct {
+	status  byte
+	payload []byte
+}
+
+// newBinaryClient starts a binary protocol server for db on a random port and connects to it.
+func newBinaryClient(tb testing.TB, db *fileDB) *binaryClient {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go newBinaryServer(db, time.Second).serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	c := &binaryClient{conn: conn, pending: make(map[uint64]chan binaryResponse)}
+	go c.readResponses()
+	return c
+}
+
+// readResponses dispatches the responses to the pending requests until the connection is closed.
+func (c *binaryClient) readResponses() {
+	r := bufio.NewReader(c.conn)
+	for {
+		id, status, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		ch <- binaryResponse{status, payload}
+	}
+}
+
+// call sends a request and waits for its response.
+func (c *binaryClient) call(op byte, payload []byte) binaryResponse {
+	id := c.nextID.Add(1)
+	ch := make(chan binaryResponse, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	c.conn.Write(encodeFrame(id, op, payload))
+	c.writeMu.Unlock()
+	return <-ch
+}
+
+// keyEntries encodes keys as key entries.
+func keyEntries(keys ...string) []byte {
+	var payload []byte
+	for _, key := range keys {
+		payload = append(payload, kvToEntry(key, 0, value{del, nil, 0})...)
+	}
+	return payload
+}
+
+// errorCode returns the code of an error response, or an empty string for other responses.
+func (res binaryResponse) errorCode() string {
+	if res.status != statusError {
+		return ""
+	}
+	return string(res.payload[1 : 1+res.payload[0]])
+}
+
+func TestBinaryProtocol(t *testing.T) {
+	db := newTestDB(t)
+	c := newBinaryClient(t, db)
+
+	if res := c.call(opPing, nil); res.status != statusOK {
+		t.Fatalf("Unexpected ping status %d", res.status)
+	}
+
+	// A batch of writes
+	var batch []byte
+	batch = append(batch, kvToEntry("a", 0, value{set, []byte("1"), 0})...)
+	batch = append(batch, kvToEntry("b", 0, value{set, []byte("2"), time.Now().Add(time.Hour).UnixNano()})...)
+	batch = append(batch, kvToEntry("c", 0, value{set, []byte("3"), 0})...)
+	res := c.call(opWrite, batch)
+	if res.status != statusOK || binary.LittleEndian.Uint64(res.payload) != db.seq {
+		t.Fatalf("Unexpected write response %d %q", res.status, res.payload)
+	}
+	if ttl, expires, err := db.TTL("b"); err != nil || !expires || ttl < 59*time.Minute {
+		t.Fatalf("Expected about an hour, got %s, %v (%v)", ttl, expires, err)
+	}
+
+	// Get answers the version of the value
+	res = c.call(opGet, keyEntries("a"))
+	entries, err := decodeEntries(res.payload)
+	if err != nil || res.status != statusOK || len(entries) != 1 || string(entries[0].val) != "1" {
+		t.Fatalf("Unexpected get response %d %v (%v)", res.status, entries, err)
+	}
+	version := entries[0].seq
+	if res := c.call(opGet, keyEntries("missing")); res.status != statusNotFound {
+		t.Fatalf("Expected not found, got %d", res.status)
+	}
+
+	// Conditional writes
+	if res := c.call(opWriteIf, kvToEntry("a", version+1, value{set, []byte("x"), 0})); res.errorCode() != "condition_failed" {
+		t.Fatalf("Expected condition_failed, got %d %q", res.status, res.payload)
+	}
+	if res := c.call(opWriteIf, kvToEntry("a", version, value{set, []byte("x"), 0})); res.status != statusOK {
+		t.Fatalf("Unexpected status %d %q", res.status, res.payload)
+	}
+	if res := c.call(opWriteIf, kvToEntry("new", 0, value{set, []byte("y"), 0})); res.status != statusOK {
+		t.Fatalf("Unexpected status %d %q", res.status, res.payload)
+	}
+
+	// Multi-get answers the existing keys only
+	res = c.call(opMultiGet, keyEntries("c", "missing", "a", "c"))
+	if entries, err := decodeEntries(res.payload); err != nil || len(entries) != 2 || string(entries[1].val) != "x" {
+		t.Fatalf("Unexpected multi-get response %v (%v)", entries, err)
+	}
+
+	// Deletions, of a key and of a range
+	if res := c.call(opDel, keyEntries("new")); res.status != statusOK {
+		t.Fatalf("Unexpected status %d", res.status)
+	}
+	if res := c.call(opDel, keyEntries("new")); res.status != statusNotFound {
+		t.Fatalf("Expected not found, got %d", res.status)
+	}
+	if res := c.call(opWrite, kvToEntry("b", 0, value{rangeDel, []byte("c"), 0})); res.status != statusOK {
+		t.Fatalf("Unexpected status %d %q", res.status, res.payload)
+	}
+
+	// Scan of a range, with a limit
+	scan := binary.LittleEndian.AppendUint32(nil, 10)
+	scan = append(scan, kvToEntry("a", 0, value{rangeDel, []byte("z"), 0})...)
+	res = c.call(opScan, scan)
+	entries, err = decodeEntries(res.payload)
+	if err != nil || len(entries) != 2 || entries[0].key != "a" || entries[1].key != "c" {
+		t.Fatalf("Unexpected scan response %v (%v)", entries, err)
+	}
+
+	// Edge cases: malformed requests
+	if res := c.call(opGet, []byte{set, 1, 2}); res.errorCode() != "invalid_argument" {
+		t.Fatalf("Expected invalid_argument, got %d %q", res.status, res.payload)
+	}
+	if res := c.call(42, nil); res.errorCode() != "invalid_argument" {
+		t.Fatalf("Expected invalid_argument, got %d %q", res.status, res.payload)
+	}
+}
+
+func TestBinaryPipelining(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 5; i++ {
+		if err := db.Set(fmt.Sprintf("key%d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go newBinaryServer(db, time.Second).serve(ln)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// All the requests are written before any response is read
+	const n = 1000
+	var requests []byte
+	for id := uint64(0); id < n; id++ {
+		requests = append(requests, encodeFrame(id, opGet, keyEntries(fmt.Sprintf("key%d", id%5)))...)
+	}
+	go conn.Write(requests)
+
+	r := bufio.NewReader(conn)
+	seen := make(map[uint64]bool)
+	for i := 0; i < n; i++ {
+		id, status, payload, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("Error reading response %d: %s", i, err)
+		}
+		entries, err := decodeEntries(payload)
+		if err != nil || status != statusOK || len(entries) != 1 || string(entries[0].val) != fmt.Sprint(id%5) {
+			t.Fatalf("Unexpected response to %d: %d %v (%v)", id, status, entries, err)
+		}
+		if seen[id] {
+			t.Fatalf("Duplicate response to %d", id)
+		}
+		seen[id] = true
+	}
+
+	// Edge case: a frame with an invalid length closes the connection
+	conn.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, opPing})
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+// benchmarkKeys are read by the Get benchmarks. They fit in the Memtable, so that the benchmarks measure the protocols.
+var benchmarkKeys = []string{"key0", "key1", "key2", "key3", "key4"}
+
+// newBenchmarkDB creates a database holding benchmarkKeys.
+func newBenchmarkDB(b *testing.B) *fileDB {
+	db := newTestDB(b)
+	for _, key := range benchmarkKeys {
+		if err := db.Set(key, []byte(strings.Repeat("v", 100))); err != nil {
+			b.Fatalf("Error setting key: %s", err)
+		}
+	}
+	return db
+}
+
+func BenchmarkBinaryGet(b *testing.B) {
+	c := newBinaryClient(b, newBenchmarkDB(b))
+	var i atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := benchmarkKeys[i.Add(1)%uint64(len(benchmarkKeys))]
+			if res := c.call(opGet, keyEntries(key)); res.status != statusOK {
+				b.Fatalf("Unexpected status %d", res.status)
+			}
+		}
+	})
+}
+
+func BenchmarkHTTPGet(b *testing.B) {
+	srv := httptest.NewServer(handleFunction(newBenchmarkDB(b), nil))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 256}}
+	var i atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := benchmarkKeys[i.Add(1)%uint64(len(benchmarkKeys))]
+			resp, err := client.Get(srv.URL + "/get?key=" + key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				b.Fatalf("Unexpected status %d", resp.StatusCode)
+			}
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrConditionFailed is returned by conditional writes whose condition does not hold.
+var ErrConditionFailed = errors.New("Condition failed")
+
+// writeCondition decides whether a conditional write may proceed, given the current value and version of its key.
+// The version of a key is the sequence number of its newest version, or 0 if the key does not exist.
+type writeCondition func(current []byte, version uint64, exists bool) bool
+
+// writeIf atomically checks cond against the current state of key and, if it holds, applies the write v.
+// No other write can happen between the check and the write, which is not started once ctx is done.
+// Returns the new version of the key, or ErrConditionFailed if cond does not hold, or any encountered error.
+func (mem *fileDB) writeIf(ctx context.Context, key string, v value, cond writeCondition) (uint64, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	entry, exists, err := mem.resolveAt(ctx, key, mem.seq)
+	if err != nil {
+		return 0, err
+	}
+	if !cond(entry.val, entry.seq, exists) {
+		return 0, ErrConditionFailed
+	}
+
+	b := WriteBatch{ops: []batchOp{{"", key, v}}}
+	if err := mem.write(ctx, &b); err != nil {
+		return 0, err
+	}
+	return mem.seq, nil
+}
+
+// conditional converts the result of writeIf to the one of the value-based conditional writes.
+func conditional(_ uint64, err error) (bool, error) {
+	if errors.Is(err, ErrConditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetVersion retrieves the value for a given key along with its version,
+// the sequence number of the write that produced it.
+// Returns the value, its version and any encountered error.
+func (mem *fileDB) GetVersion(key string) ([]byte, uint64, error) {
+	return mem.GetVersionContext(context.Background(), key)
+}
+
+// GetVersionContext is like GetVersion, but stops looking up the SST files with the error of ctx once it is done.
+func (mem *fileDB) GetVersionContext(ctx context.Context, key string) ([]byte, uint64, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	entry, found, err := mem.resolveAt(ctx, key, mem.seq)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		return nil, 0, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return entry.val, entry.seq, nil
+}
+
+// CompareAndSwap atomically replaces the value of key by newVal if its current value is expected.
+// Returns whether the value was swapped and any encountered error.
+func (mem *fileDB) CompareAndSwap(key string, expected, newVal []byte) (bool, error) {
+	return mem.CompareAndSwapContext(context.Background(), key, expected, newVal)
+}
+
+// CompareAndSwapContext is like CompareAndSwap, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) CompareAndSwapContext(ctx context.Context, key string, expected, newVal []byte) (bool, error) {
+	return conditional(mem.writeIf(ctx, key, value{set, newVal, 0}, func(current []byte, _ uint64, exists bool) bool {
+		return exists && bytes.Equal(current, expected)
+	}))
+}
+
+// SetIfAbsent atomically stores a key-value pair if the key does not exist.
+// Returns whether the pair was stored and any encountered error.
+func (mem *fileDB) SetIfAbsent(key string, val []byte) (bool, error) {
+	return mem.SetIfAbsentContext(context.Background(), key, val)
+}
+
+// SetIfAbsentContext is like SetIfAbsent, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) SetIfAbsentContext(ctx context.Context, key string, val []byte) (bool, error) {
+	return conditional(mem.writeIf(ctx, key, value{set, val, 0}, func(_ []byte, _ uint64, exists bool) bool {
+		return !exists
+	}))
+}
+
+// DeleteIfEquals atomically deletes key if its current value is expected.
+// Returns whether the key was deleted and any encountered error.
+func (mem *fileDB) DeleteIfEquals(key string, expected []byte) (bool, error) {
+	return mem.DeleteIfEqualsContext(context.Background(), key, expected)
+}
+
+// DeleteIfEqualsContext is like DeleteIfEquals, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) DeleteIfEqualsContext(ctx context.Context, key string, expected []byte) (bool, error) {
+	return conditional(mem.writeIf(ctx, key, value{del, nil, 0}, func(current []byte, _ uint64, exists bool) bool {
+		return exists && bytes.Equal(current, expected)
+	}))
+}
+
+// SetIfVersion atomically stores a key-value pair if the current version of the key is version.
+// A version of 0 requires the key not to exist.
+// Returns the new version of the key, or ErrConditionFailed if the version does not match, or any encountered error.
+func (mem *fileDB) SetIfVersion(key string, val []byte, version uint64) (uint64, error) {
+	return mem.SetIfVersionContext(context.Background(), key, val, version)
+}
+
+// SetIfVersionContext is like SetIfVersion, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) SetIfVersionContext(ctx context.Context, key string, val []byte, version uint64) (uint64, error) {
+	return mem.writeIf(ctx, key, value{set, val, 0}, func(_ []byte, current uint64, exists bool) bool {
+		return exists == (version != 0) && current == version
+	})
+}
+
+// DeleteIfVersion atomically deletes key if its current version is version.
+// Returns ErrConditionFailed if the key does not exist or the version does not match, or any encountered error.
+func (mem *fileDB) DeleteIfVersion(key string, version uint64) error {
+	return mem.DeleteIfVersionContext(context.Background(), key, version)
+}
+
+// DeleteIfVersionContext is like DeleteIfVersion, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) DeleteIfVersionContext(ctx context.Context, key string, version uint64) error {
+	_, err := mem.writeIf(ctx, key, value{del, nil, 0}, func(_ []byte, current uint64, exists bool) bool {
+		return exists && current == version
+	})
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	db := newTestDB(t)
+
+	// SetIfAbsent only stores missing keys
+	if ok, err := db.SetIfAbsent("k", []byte("1")); !ok || err != nil {
+		t.Fatalf("Expected SetIfAbsent to store a missing key, got %v (%v)", ok, err)
+	}
+	if ok, err := db.SetIfAbsent("k", []byte("2")); ok || err != nil {
+		t.Fatalf("Expected SetIfAbsent to fail on an existing key, got %v (%v)", ok, err)
+	}
+
+	// CompareAndSwap only replaces the expected value
+	if ok, err := db.CompareAndSwap("k", []byte("0"), []byte("2")); ok || err != nil {
+		t.Fatalf("Expected CompareAndSwap to fail, got %v (%v)", ok, err)
+	}
+	if ok, err := db.CompareAndSwap("k", []byte("1"), []byte("2")); !ok || err != nil {
+		t.Fatalf("Expected CompareAndSwap to succeed, got %v (%v)", ok, err)
+	}
+	if ok, _ := db.CompareAndSwap("missing", nil, []byte("2")); ok {
+		t.Fatal("Expected CompareAndSwap to fail on a missing key")
+	}
+
+	// Versions follow the sequence numbers
+	val, version, err := db.GetVersion("k")
+	if err != nil || string(val) != "2" || version != db.seq {
+		t.Fatalf("Unexpected version %d of value %s (%v)", version, val, err)
+	}
+	if _, err := db.SetIfVersion("k", []byte("3"), version-1); err != ErrConditionFailed {
+		t.Fatalf("Expected ErrConditionFailed, got %v", err)
+	}
+	newVersion, err := db.SetIfVersion("k", []byte("3"), version)
+	if err != nil || newVersion != version+1 {
+		t.Fatalf("Expected new version %d, got %d (%v)", version+1, newVersion, err)
+	}
+
+	// DeleteIfEquals only deletes the expected value
+	if ok, _ := db.DeleteIfEquals("k", []byte("2")); ok {
+		t.Fatal("Expected DeleteIfEquals to fail")
+	}
+	if ok, err := db.DeleteIfEquals("k", []byte("3")); !ok || err != nil {
+		t.Fatalf("Expected DeleteIfEquals to succeed, got %v (%v)", ok, err)
+	}
+
+	// Edge case: a deleted key is absent again
+	if err := db.DeleteIfVersion("k", newVersion); err != ErrConditionFailed {
+		t.Fatalf("Expected ErrConditionFailed, got %v", err)
+	}
+	if _, err := db.SetIfVersion("k", []byte("4"), 0); err != nil {
+		t.Fatalf("Expected SetIfVersion 0 to store a deleted key, got %v", err)
+	}
+}
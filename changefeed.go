@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchBufferSize is the number of changes buffered for a Watcher. A Watcher falling further behind is closed,
+// so that slow readers never hold up the writers.
+const watchBufferSize = 1024
+
+// ErrTrimmed is returned by Watch when the changes to resume from are no longer in the retained Write-Ahead Logs.
+var ErrTrimmed = errors.New("Changes no longer retained")
+
+// ErrLagging is returned by Watcher.Next once the Watcher fell more than watchBufferSize changes behind.
+var ErrLagging = errors.New("Watcher fell behind")
+
+// Operations of a Change.
+const (
+	ChangeSet         = "set"
+	ChangeDelete      = "del"
+	ChangeMerge       = "merge"
+	ChangeDeleteRange = "delrange"
+)
+
+// Change is a committed write, as delivered to the watchers of the change feed.
+type Change struct {
+	Seq    uint64    // Sequence number of the write
+	Family string    // Column family of the key
+	Op     string    // ChangeSet, ChangeDelete, ChangeMerge or ChangeDeleteRange
+	Key    string    // Key written, or start of the range deleted
+	Value  []byte    // Value set, merge operand, or end of the range deleted; nil for a deletion
+	Expiry time.Time // Expiry time of a value set with a TTL, zero otherwise
+}
+
+// batchChanges converts a batch, whose operations are numbered from the sequence number first and name their
+// column family, to the list of its changes.
+func batchChanges(first uint64, b *WriteBatch) []Change {
+	changes := make([]Change, len(b.ops))
+	for i, op := range b.ops {
+		c := Change{first + uint64(i), op.family, ChangeSet, op.key, op.val, time.Time{}}
+		switch op.flag {
+		case del:
+			c.Op, c.Value = ChangeDelete, nil
+		case merge:
+			c.Op = ChangeMerge
+		case rangeDel:
+			c.Op = ChangeDeleteRange
+		}
+		if op.expiry != 0 {
+			c.Expiry = time.Unix(0, op.expiry)
+		}
+		changes[i] = c
+	}
+	return changes
+}
+
+// changeFeed publishes the committed writes of a database to its watchers and to its replication streams.
+type changeFeed struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+	tails    map[*logTail]struct{}
+}
+
+// newChangeFeed creates a changeFeed without watchers.
+func newChangeFeed() *changeFeed {
+	return &changeFeed{watchers: make(map[*Watcher]struct{}), tails: make(map[*logTail]struct{})}
+}
+
+// publish delivers a batch to the replication streams and its changes to the watchers interested in them.
+// The caller must hold the write lock of the database, so that changes are published in order.
+// Watchers and streams whose buffer is full are closed with ErrLagging.
+func (feed *changeFeed) publish(first uint64, b *WriteBatch) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	for t := range feed.tails {
+		select {
+		case t.batches <- walBatch{first, b}:
+		default:
+			feed.removeTail(t, ErrLagging)
+		}
+	}
+	if len(feed.watchers) == 0 {
+		return
+	}
+	for _, c := range batchChanges(first, b) {
+		for w := range feed.watchers {
+			if !w.matches(c) {
+				continue
+			}
+			select {
+			case w.changes <- c:
+			default:
+				feed.remove(w, ErrLagging)
+			}
+		}
+	}
+}
+
+// remove unregisters a Watcher, whose Next then fails with err once its buffered changes are read.
+// The caller must hold feed.mu.
+func (feed *changeFeed) remove(w *Watcher, err error) {
+	if _, ok := feed.watchers[w]; !ok {
+		return
+	}
+	delete(feed.watchers, w)
+	w.err = err
+	close(w.done)
+}
+
+// closeAll unregisters every Watcher and replication stream with err.
+func (feed *changeFeed) closeAll(err error) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	for w := range feed.watchers {
+		feed.remove(w, err)
+	}
+	for t := range feed.tails {
+		feed.removeTail(t, err)
+	}
+}
+
+// Watcher receives the changes to the keys of a column family starting with a prefix, in the order of their
+// sequence numbers. A Watcher must be closed once it is no longer needed.
+type Watcher struct {
+	feed    *changeFeed
+	family  string
+	prefix  string
+	backlog []Change    // Changes replayed from the Write-Ahead Logs, delivered before the new ones
+	changes chan Change // New changes
+	done    chan struct{}
+	err     error // Reason why the Watcher was unregistered, set before done is closed
+}
+
+// matches reports whether c is a change to a key watched by w. A range deletion matches if its range holds
+// keys starting with the prefix.
+func (w *Watcher) matches(c Change) bool {
+	if c.Family != w.family {
+		return false
+	}
+	if c.Op != ChangeDeleteRange {
+		return strings.HasPrefix(c.Key, w.prefix)
+	}
+	end := prefixEnd(w.prefix)
+	return string(c.Value) > w.prefix && (end == "" || c.Key < end)
+}
+
+// Next returns the next change, waiting for it until ctx is done.
+// Returns ErrLagging if the Watcher fell behind, ErrClosed if it or the database was closed, or the error of ctx.
+func (w *Watcher) Next(ctx context.Context) (Change, error) {
+	if len(w.backlog) > 0 {
+		c := w.backlog[0]
+		w.backlog = w.backlog[1:]
+		return c, nil
+	}
+	select {
+	case c := <-w.changes:
+		return c, nil
+	case <-w.done:
+		// Deliver the changes buffered before the Watcher was unregistered first
+		select {
+		case c := <-w.changes:
+			return c, nil
+		default:
+			return Change{}, w.err
+		}
+	case <-ctx.Done():
+		return Change{}, ctx.Err()
+	}
+}
+
+// Close unregisters the Watcher. Changes are no longer delivered to it.
+func (w *Watcher) Close() {
+	w.feed.mu.Lock()
+	defer w.feed.mu.Unlock()
+	w.feed.remove(w, ErrClosed)
+}
+
+// Watch returns a Watcher of the changes to the keys of the column family starting with prefix.
+// If after is not 0, the changes committed after the sequence number after are replayed first from the current
+// and archived Write-Ahead Logs, so that a watcher can resume where it stopped; otherwise only the changes
+// committed from now on are delivered.
+// Returns the Watcher, or an error wrapping ErrTrimmed if the changes after after are no longer retained.
+func (mem *fileDB) Watch(prefix string, after uint64) (*Watcher, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	if mem.closed {
+		return nil, ErrClosed
+	}
+	if after > mem.seq {
+		return nil, fmt.Errorf("%w: sequence number %d is after the last write %d", ErrInvalidArgument, after, mem.seq)
+	}
+
+	w := &Watcher{mem.feed, mem.name, prefix, nil, make(chan Change, watchBufferSize), make(chan struct{}), nil}
+	if after != 0 && after < mem.seq {
+		changes, err := mem.retainedChanges(after)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range changes {
+			if w.matches(c) {
+				w.backlog = append(w.backlog, c)
+			}
+		}
+	}
+
+	// Holding mem.mu keeps writers out, so that no change is missed or repeated between the replay and now
+	mem.feed.mu.Lock()
+	mem.feed.watchers[w] = struct{}{}
+	mem.feed.mu.Unlock()
+	return w, nil
+}
+
+// retainedChanges reads the changes committed after the sequence number after from the archived and current
+// Write-Ahead Logs. The caller must hold mem.mu.
+// Returns the changes of all the column families, or an error wrapping ErrTrimmed if some of them were not retained.
+func (core *dbCore) retainedChanges(after uint64) ([]Change, error) {
+	batches, err := core.retainedBatches(after)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	for _, wb := range batches {
+		for _, c := range batchChanges(wb.first, wb.b) {
+			if c.Seq > after {
+				changes = append(changes, c)
+			}
+		}
+	}
+	return changes, nil
+}
+
+// walBatch is a batch as logged to a Write-Ahead Log: its operations are numbered from the sequence number first
+// and name their column family.
+type walBatch struct {
+	first uint64
+	b     *WriteBatch
+}
+
+// last returns the sequence number of the last operation of the batch.
+func (wb walBatch) last() uint64 {
+	return wb.first + uint64(wb.b.Len()) - 1
+}
+
+// retainedBatches reads the batches holding changes committed after the sequence number after from the archived
+// and current Write-Ahead Logs. The caller must hold mem.mu.
+// Returns the batches, or an error wrapping ErrTrimmed if some of the changes were not retained.
+func (core *dbCore) retainedBatches(after uint64) ([]walBatch, error) {
+	archives, err := core.archivedWALs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the archives whose changes all come at or before after: the next one then starts right after it
+	covered := false
+	paths := make([]string, 0, len(archives)+1)
+	for _, path := range archives {
+		if archivedWALSeq(path) <= after {
+			covered = true
+			continue
+		}
+		paths = append(paths, path)
+	}
+	paths = append(paths, core.path(walFileName))
+
+	var batches []walBatch
+	first := uint64(0)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		walBatches(data, func(wb walBatch) {
+			if first == 0 {
+				first = wb.first
+			}
+			if wb.last() > after {
+				batches = append(batches, wb)
+			}
+		})
+	}
+	if !covered && (first == 0 || first > after+1) {
+		return nil, fmt.Errorf("%w: the oldest retained change is %d", ErrTrimmed, first)
+	}
+	return batches, nil
+}
+
+// walBatches calls fn with each batch recorded in a Write-Ahead Log, in order, single entries being turned into
+// batches of one operation.
+// A log without a header is skipped, and the reading stops at a truncated or corrupted record.
+func walBatches(wal []byte, fn func(walBatch)) {
+	if len(wal) < walHeaderSize || binary.LittleEndian.Uint32(wal[0:4]) != magicNumber {
+		return
+	}
+	for position := walHeaderSize; position < len(wal); {
+		if wal[position] == batch || wal[position] == cfBatch {
+			first, b, err := recordToBatch(wal, &position)
+			if err != nil {
+				return
+			}
+			fn(walBatch{first, b})
+			continue
+		}
+		if checkEntry(wal[position:]) != nil {
+			return
+		}
+		flag, seq, key, val, expiry := entryToKv(wal, &position)
+		fn(walBatch{seq, &WriteBatch{ops: []batchOp{{defaultColumnFamily, string(key), value{flag, val, expiry}}}}})
+	}
+}
+
+// archiveWAL moves the Write-Ahead Log, whose entries have all been flushed, to the WAL archive under the sequence
+// number of its last entry, and removes the oldest archived logs beyond walArchiveRetention, unless they hold
+// changes after a pinned sequence number. The caller must hold mem.mu.
+// Archived logs are only read to replay changes to the watchers. A log without entries is removed.
+// Returns any encountered error.
+func (core *dbCore) archiveWAL(lastSeq uint64) error {
+	info, err := os.Stat(core.path(walFileName))
+	if err != nil {
+		return err
+	}
+	if info.Size() <= walHeaderSize {
+		return os.Remove(core.path(walFileName))
+	}
+	if err := os.MkdirAll(core.path(walArchiveDir), 0755); err != nil {
+		return err
+	}
+	archived := core.path(filepath.Join(walArchiveDir, fmt.Sprintf(archivedWALFileName, lastSeq)))
+	if err := os.Rename(core.path(walFileName), archived); err != nil {
+		return err
+	}
+
+	archives, err := core.archivedWALs()
+	if err != nil {
+		return err
+	}
+	pinned := uint64(math.MaxUint64)
+	for _, after := range core.walPins {
+		pinned = min(pinned, after)
+	}
+	// A log whose last entry is at or before the pinned sequence number is not needed: the next one starts right after it
+	for len(archives) > walArchiveRetention && archivedWALSeq(archives[0]) <= pinned {
+		if err := os.Remove(archives[0]); err != nil {
+			return err
+		}
+		archives = archives[1:]
+	}
+	return nil
+}
+
+// pinWAL keeps the archived Write-Ahead Logs holding the changes committed after the sequence number after,
+// on behalf of owner, until owner pins another sequence number or unpins it.
+func (core *dbCore) pinWAL(owner string, after uint64) {
+	core.mu.Lock()
+	defer core.mu.Unlock()
+	core.walPins[owner] = after
+}
+
+// unpinWAL lets the archived Write-Ahead Logs pinned by owner be removed.
+func (core *dbCore) unpinWAL(owner string) {
+	core.mu.Lock()
+	defer core.mu.Unlock()
+	delete(core.walPins, owner)
+}
+
+// archivedWALs returns the paths of the archived Write-Ahead Logs, sorted from the oldest to the newest one.
+func (core *dbCore) archivedWALs() ([]string, error) {
+	return filepath.Glob(core.path(filepath.Join(walArchiveDir, "db_*.wal"))) // Sequence numbers are zero-padded, so they sort
+}
+
+// archivedWALSeq returns the sequence number of the last entry of an archived Write-Ahead Log, from its name.
+func archivedWALSeq(path string) uint64 {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "db_"), ".wal")
+	seq, _ := strconv.ParseUint(name, 10, 64)
+	return seq
+}
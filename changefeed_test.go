@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextChanges reads n changes from w, failing the test if they do not come within a second.
+func nextChanges(t *testing.T, w *Watcher, n int) []Change {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	changes := make([]Change, n)
+	for i := range changes {
+		c, err := w.Next(ctx)
+		if err != nil {
+			t.Fatalf("Error reading change %d: %s", i, err)
+		}
+		changes[i] = c
+	}
+	return changes
+}
+
+func TestWatch(t *testing.T) {
+	db := newTestDB(t)
+	w, err := db.Watch("user:", 0)
+	if err != nil {
+		t.Fatalf("Error watching: %s", err)
+	}
+	defer w.Close()
+
+	// Only the changes to the watched keys are delivered, in order
+	db.Set("user:1", []byte("bob"))
+	db.Set("other", []byte("x"))
+	db.SetWithTTL("user:2", []byte("alice"), time.Hour)
+	db.Del("user:1")
+	db.DeleteRange("a", "z")
+	db.DeleteRange("a", "b")
+	changes := nextChanges(t, w, 4)
+	for i, want := range []struct {
+		op, key, value string
+	}{
+		{ChangeSet, "user:1", "bob"},
+		{ChangeSet, "user:2", "alice"},
+		{ChangeDelete, "user:1", ""},
+		{ChangeDeleteRange, "a", "z"},
+	} {
+		c := changes[i]
+		if c.Op != want.op || c.Key != want.key || string(c.Value) != want.value || c.Family != defaultColumnFamily {
+			t.Fatalf("Unexpected change %d: %+v", i, c)
+		}
+	}
+	if changes[0].Seq != 1 || changes[3].Seq != 5 || changes[0].Expiry != (time.Time{}) || changes[1].Expiry.Before(time.Now()) {
+		t.Fatalf("Unexpected changes %+v", changes)
+	}
+
+	// Changes to other column families are not delivered
+	users, err := db.CreateColumnFamily("users", Options{})
+	if err != nil {
+		t.Fatalf("Error creating column family: %s", err)
+	}
+	users.Set("user:3", []byte("carol"))
+	b := NewWriteBatch()
+	b.SetCF(users, "user:4", []byte("dave"))
+	b.Set("user:5", []byte("eve"))
+	db.Write(b)
+	if c := nextChanges(t, w, 1)[0]; c.Key != "user:5" {
+		t.Fatalf("Expected user:5, got %+v", c)
+	}
+
+	// Closing the database ends the watchers
+	db.Close()
+	if _, err := w.Next(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 3*memLimit; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	if archives, _ := db.archivedWALs(); len(archives) != 3 {
+		t.Fatalf("Expected 3 archived WALs, got %v", archives)
+	}
+
+	// The changes are replayed from the archived WALs and the current one, then followed live
+	db.Set("key99", []byte("live"))
+	w, err := db.Watch("key", 5)
+	if err != nil {
+		t.Fatalf("Error watching: %s", err)
+	}
+	defer w.Close()
+	db.Set("key100", []byte("new"))
+	changes := nextChanges(t, w, 3*memLimit-5+2)
+	for i, c := range changes {
+		if c.Seq != uint64(6+i) {
+			t.Fatalf("Expected change %d to have sequence number %d, got %+v", i, 6+i, c)
+		}
+	}
+	if last := changes[len(changes)-1]; last.Key != "key100" || string(last.Value) != "new" {
+		t.Fatalf("Unexpected last change %+v", last)
+	}
+
+	// The archives survive a restart
+	db.Close()
+	db, err = newDB()
+	if err != nil {
+		t.Fatalf("Error reopening the database: %s", err)
+	}
+	defer db.Close()
+	w, err = db.Watch("", 3*memLimit)
+	if err != nil {
+		t.Fatalf("Error watching: %s", err)
+	}
+	defer w.Close()
+	if changes := nextChanges(t, w, 2); changes[0].Key != "key99" || changes[1].Key != "key100" {
+		t.Fatalf("Unexpected changes %+v", changes)
+	}
+
+	// Edge cases: trimmed and future sequence numbers
+	archives, _ := db.archivedWALs()
+	os.Remove(archives[0])
+	if _, err := db.Watch("", 5); !errors.Is(err, ErrTrimmed) {
+		t.Fatalf("Expected ErrTrimmed, got %v", err)
+	}
+	if _, err := db.Watch("", memLimit); err != nil {
+		t.Fatalf("Expected the changes after %d to be retained, got %v", memLimit, err)
+	}
+	if _, err := db.Watch("", 1000); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestWatchLagging(t *testing.T) {
+	db := newTestDB(t)
+	db.memLimit = 10 * watchBufferSize
+	w, err := db.Watch("", 0)
+	if err != nil {
+		t.Fatalf("Error watching: %s", err)
+	}
+	defer w.Close()
+
+	for i := 0; i <= watchBufferSize; i++ {
+		db.Set("key", []byte("v"))
+	}
+	// The buffered changes are still delivered, followed by the error
+	nextChanges(t, w, watchBufferSize)
+	if _, err := w.Next(context.Background()); !errors.Is(err, ErrLagging) {
+		t.Fatalf("Expected ErrLagging, got %v", err)
+	}
+}
+
+func TestArchiveWALRetention(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < (walArchiveRetention+2)*memLimit; i++ {
+		db.Set("key", []byte("v"))
+	}
+	archives, err := db.archivedWALs()
+	if err != nil || len(archives) != walArchiveRetention {
+		t.Fatalf("Expected %d archived WALs, got %d (%v)", walArchiveRetention, len(archives), err)
+	}
+	if name := filepath.Base(archives[0]); name != fmt.Sprintf(archivedWALFileName, 3*memLimit) {
+		t.Fatalf("Expected the 2 oldest archives to be removed, got %s", name)
+	}
+}
@@ -0,0 +1,557 @@
+// Package client is a Go client for the HTTP API of goDB.
+//
+// A Client implements the same DB interface as the database itself (Set, Get, Del and their Context variants)
+// against a remote server, along with scans, atomic batches, multi-gets and version-based conditional writes.
+// Connections are pooled, every attempt of a request has a timeout, and idempotent requests are retried with
+// exponential backoff when the server is unreachable or temporarily unavailable. Errors answered by the server
+// are *Error values matching the sentinel errors of this package with errors.Is.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout      = 10 * time.Second
+	defaultMaxRetries   = 3
+	defaultMinBackoff   = 50 * time.Millisecond
+	defaultMaxBackoff   = 2 * time.Second
+	defaultMaxIdleConns = 16
+	keysV2Prefix        = "/v2/keys/"
+)
+
+// Options configures a Client. The zero value gives sensible defaults.
+type Options struct {
+	Timeout      time.Duration // Maximum duration of each attempt of a request, 10 seconds by default
+	MaxRetries   int           // Retries of the idempotent requests, 3 by default, none if negative
+	MinBackoff   time.Duration // Delay before the first retry, doubled at each retry, 50 milliseconds by default
+	MaxBackoff   time.Duration // Longest delay between two retries, 2 seconds by default
+	MaxIdleConns int           // Idle connections kept open to the server, 16 by default
+	HTTPClient   *http.Client  // HTTP client sending the requests, replacing the connection pool of the Client if set
+}
+
+// Client is a client of a goDB server, safe for concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	opts    Options
+	family  string // Column family of the requests, the default one if empty
+}
+
+// New creates a Client for the server at baseURL, such as "http://localhost:8080", configured by opts, which may be nil.
+// Returns the Client, or an error wrapping ErrInvalidArgument if baseURL is not an HTTP URL.
+func New(baseURL string, opts *Options) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: invalid base URL %q", ErrInvalidArgument, baseURL)
+	}
+
+	c := &Client{baseURL: strings.TrimSuffix(u.String(), "/")}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.Timeout <= 0 {
+		c.opts.Timeout = defaultTimeout
+	}
+	if c.opts.MaxRetries == 0 {
+		c.opts.MaxRetries = defaultMaxRetries
+	}
+	if c.opts.MinBackoff <= 0 {
+		c.opts.MinBackoff = defaultMinBackoff
+	}
+	if c.opts.MaxBackoff < c.opts.MinBackoff {
+		c.opts.MaxBackoff = max(defaultMaxBackoff, c.opts.MinBackoff)
+	}
+	if c.opts.MaxIdleConns <= 0 {
+		c.opts.MaxIdleConns = defaultMaxIdleConns
+	}
+
+	c.http = c.opts.HTTPClient
+	if c.http == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = c.opts.MaxIdleConns
+		transport.MaxIdleConnsPerHost = c.opts.MaxIdleConns
+		c.http = &http.Client{Transport: transport}
+	}
+	return c, nil
+}
+
+// ColumnFamily returns a Client sharing the connections of c whose requests apply to the column family name.
+// The column family is not checked: requests fail with ErrColumnFamilyNotFound if the server does not have it.
+func (c *Client) ColumnFamily(name string) *Client {
+	family := *c
+	family.family = name
+	return &family
+}
+
+// request describes an HTTP request to the server. It is built again for every attempt.
+type request struct {
+	method     string
+	path       string // Escaped path of the endpoint
+	query      url.Values
+	header     http.Header
+	body       []byte
+	idempotent bool // Whether the request may be retried, since sending it twice has the same effect as once
+}
+
+// response is a response of the server, whose body has been read.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// do sends a request, retrying it with exponential backoff if it is idempotent and failed with a transient error.
+// Returns the response of the last attempt, or an error if it did not succeed.
+func (c *Client) do(ctx context.Context, r request) (*response, error) {
+	if r.query == nil {
+		r.query = url.Values{}
+	}
+	if c.family != "" {
+		r.query.Set("cf", c.family)
+	}
+
+	retries := max(c.opts.MaxRetries, 0)
+	for attempt := 0; ; attempt++ {
+		res, err := c.attempt(ctx, r)
+		if err == nil || !r.idempotent || attempt >= retries || ctx.Err() != nil || !retryable(err) {
+			return res, err
+		}
+
+		timer := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends a request once, within the timeout of an attempt.
+// Returns the response, or an *Error if the server answered with an error status.
+// Other errors wrap ErrTimeout if the attempt timed out and ErrUnavailable if the server could not be reached.
+func (c *Client) attempt(ctx context.Context, r request) (*response, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	target := c.baseURL + r.path
+	if len(r.query) > 0 {
+		target += "?" + r.query.Encode()
+	}
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequestWithContext(attemptCtx, r.method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidArgument, err)
+	}
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+
+	resp, err := c.http.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		var data []byte
+		if data, err = io.ReadAll(resp.Body); err == nil {
+			res := &response{resp.StatusCode, resp.Header, data}
+			if res.status >= http.StatusBadRequest {
+				return nil, parseError(res)
+			}
+			return res, nil
+		}
+	}
+	switch {
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case attemptCtx.Err() != nil:
+		return nil, fmt.Errorf("%w: %s", ErrTimeout, err)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+}
+
+// parseError builds the *Error of an error response, from its JSON body if it has one.
+func parseError(res *response) *Error {
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(res.body, &body); err == nil && body.Error.Code != "" {
+		return &Error{res.status, body.Error.Code, body.Error.Message}
+	}
+	message := strings.TrimSpace(string(res.body))
+	if message == "" {
+		message = http.StatusText(res.status)
+	}
+	return &Error{res.status, "", message}
+}
+
+// retryable reports whether a request that failed with err may succeed if sent again.
+func retryable(err error) bool {
+	var serverErr *Error
+	if errors.As(err, &serverErr) {
+		return serverErr.retryable()
+	}
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnavailable)
+}
+
+// backoff returns the delay before the retry following the given attempt: MinBackoff doubled at each attempt,
+// up to MaxBackoff, with a random jitter of up to half of it so that clients do not retry in lockstep.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.opts.MaxBackoff
+	if attempt < 32 {
+		d = min(c.opts.MinBackoff<<attempt, c.opts.MaxBackoff)
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// keyPath returns the path of key in the v2 API.
+func keyPath(key string) string {
+	return keysV2Prefix + url.PathEscape(key)
+}
+
+// formatETag returns the ETag of a version.
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseETag parses the version in an ETag header.
+// Returns the version, or an error if the header is missing or invalid.
+func parseETag(etag string) (uint64, error) {
+	version, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(etag, "W/"), `"`), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid ETag %q in response", etag)
+	}
+	return version, nil
+}
+
+// checkKey returns an error wrapping ErrInvalidArgument if key is empty.
+func checkKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty key", ErrInvalidArgument)
+	}
+	return nil
+}
+
+// Set sets the value of key.
+func (c *Client) Set(key string, value []byte) error {
+	return c.SetContext(context.Background(), key, value)
+}
+
+// SetContext is like Set, giving up once ctx is done.
+func (c *Client) SetContext(ctx context.Context, key string, value []byte) error {
+	_, err := c.put(ctx, key, value, 0, nil, true)
+	return err
+}
+
+// SetWithTTL sets the value of key, which expires after ttl.
+func (c *Client) SetWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: TTL must be positive", ErrInvalidArgument)
+	}
+	_, err := c.put(ctx, key, value, ttl, nil, true)
+	return err
+}
+
+// SetIfVersion sets the value of key only if its current version is version, or if it does not exist when version is 0.
+// Conditional writes are never retried, since the retry of a write that succeeded would fail.
+// Returns the new version of key, or an error wrapping ErrConditionFailed if the condition does not hold.
+func (c *Client) SetIfVersion(ctx context.Context, key string, value []byte, version uint64) (uint64, error) {
+	header := http.Header{}
+	if version == 0 {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", formatETag(version))
+	}
+	return c.put(ctx, key, value, 0, header, false)
+}
+
+// put writes the value of key with a PUT request to the v2 API.
+// Returns the new version of key and any encountered error.
+func (c *Client) put(ctx context.Context, key string, value []byte, ttl time.Duration, header http.Header, idempotent bool) (uint64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "application/octet-stream")
+	query := url.Values{}
+	if ttl > 0 {
+		query.Set("ttl", ttl.String())
+	}
+	if value == nil {
+		value = []byte{}
+	}
+
+	res, err := c.do(ctx, request{http.MethodPut, keyPath(key), query, header, value, idempotent})
+	if err != nil {
+		return 0, err
+	}
+	return parseETag(res.header.Get("ETag"))
+}
+
+// Get returns the value of key, or an error wrapping ErrNotFound if it does not exist.
+func (c *Client) Get(key string) ([]byte, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, giving up once ctx is done.
+func (c *Client) GetContext(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := c.GetVersion(ctx, key)
+	return value, err
+}
+
+// GetVersion returns the value of key and its version, to be passed to SetIfVersion or DeleteIfVersion,
+// or an error wrapping ErrNotFound if it does not exist.
+func (c *Client) GetVersion(ctx context.Context, key string) ([]byte, uint64, error) {
+	if err := checkKey(key); err != nil {
+		return nil, 0, err
+	}
+	res, err := c.do(ctx, request{http.MethodGet, keyPath(key), nil, nil, nil, true})
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := parseETag(res.header.Get("ETag"))
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.body, version, nil
+}
+
+// Del deletes key.
+// Returns the deleted value, or an error wrapping ErrNotFound if key does not exist.
+func (c *Client) Del(key string) ([]byte, error) {
+	return c.DelContext(context.Background(), key)
+}
+
+// DelContext is like Del, giving up once ctx is done.
+// The value is read first and the key is then deleted only if it still has the version read, so that the value
+// returned is exactly the one deleted; both steps are repeated if the key was written in between.
+func (c *Client) DelContext(ctx context.Context, key string) ([]byte, error) {
+	for {
+		value, version, err := c.GetVersion(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		err = c.DeleteIfVersion(ctx, key, version)
+		if errors.Is(err, ErrConditionFailed) || errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+}
+
+// DeleteIfVersion deletes key only if its current version is version.
+// Returns an error wrapping ErrNotFound if key does not exist, or ErrConditionFailed if it has another version.
+func (c *Client) DeleteIfVersion(ctx context.Context, key string, version uint64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("If-Match", formatETag(version))
+	_, err := c.do(ctx, request{http.MethodDelete, keyPath(key), nil, header, nil, false})
+	return err
+}
+
+// MultiGet looks up several keys at once.
+// Returns the values of the keys that exist, by key, and any encountered error.
+func (c *Client) MultiGet(ctx context.Context, keys []string) (map[string][]byte, error) {
+	body, err := json.Marshal(keys)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	res, err := c.do(ctx, request{http.MethodPost, "/mget", nil, header, body, true})
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		Values map[string]string `json:"values"`
+	}
+	if err := json.Unmarshal(res.body, &data); err != nil {
+		return nil, fmt.Errorf("Invalid multi-get response: %w", err)
+	}
+	values := make(map[string][]byte, len(data.Values))
+	for key, val := range data.Values {
+		values[key] = []byte(val)
+	}
+	return values, nil
+}
+
+// ScanOptions selects the keys listed by Scan.
+type ScanOptions struct {
+	Start    string // Smallest key listed, included
+	End      string // Largest key listed, excluded; no bound if empty
+	Prefix   string // Only keys starting with Prefix are listed
+	Limit    int    // Maximum number of items of the page, the default of the server if 0
+	Cursor   string // Next of the previous page, to resume a scan
+	Reverse  bool   // Whether keys are listed in descending order
+	KeysOnly bool   // Whether values are left out
+}
+
+// Item is a key and its value, as listed by Scan.
+type Item struct {
+	Key   string
+	Value []byte // Nil if the scan was KeysOnly
+}
+
+// ScanPage is a page of the keys listed by Scan.
+type ScanPage struct {
+	Items []Item
+	Next  string // Cursor of the next page, empty if the scan is over
+}
+
+// Scan lists a page of the keys selected by opts.
+// Pass the Next cursor of a page back in opts.Cursor, with the same other options, to get the following page.
+func (c *Client) Scan(ctx context.Context, opts ScanOptions) (*ScanPage, error) {
+	query := url.Values{}
+	for name, param := range map[string]string{"start": opts.Start, "end": opts.End, "prefix": opts.Prefix, "cursor": opts.Cursor} {
+		if param != "" {
+			query.Set(name, param)
+		}
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Reverse {
+		query.Set("reverse", "true")
+	}
+	if opts.KeysOnly {
+		query.Set("keysOnly", "true")
+	}
+
+	res, err := c.do(ctx, request{http.MethodGet, "/scan", query, nil, nil, true})
+	if err != nil {
+		return nil, err
+	}
+
+	var data struct {
+		Items []struct {
+			Key   string  `json:"key"`
+			Value *string `json:"value"`
+		} `json:"items"`
+		Next *string `json:"next"`
+	}
+	if err := json.Unmarshal(res.body, &data); err != nil {
+		return nil, fmt.Errorf("Invalid scan response: %w", err)
+	}
+	page := &ScanPage{Items: make([]Item, len(data.Items))}
+	for i, item := range data.Items {
+		page.Items[i].Key = item.Key
+		if item.Value != nil {
+			page.Items[i].Value = []byte(*item.Value)
+		}
+	}
+	if data.Next != nil {
+		page.Next = *data.Next
+	}
+	return page, nil
+}
+
+// Batch is a list of writes applied atomically by Write.
+type Batch struct {
+	ops []batchOp
+}
+
+// batchOp is an operation of a Batch, in the JSON format of the "/batch" endpoint.
+type batchOp struct {
+	Op    string  `json:"op"`
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	CF    string  `json:"cf,omitempty"`
+}
+
+// Set adds the write of the value of key to the batch.
+func (b *Batch) Set(key string, value []byte) {
+	val := string(value)
+	b.ops = append(b.ops, batchOp{"set", key, &val, ""})
+}
+
+// Del adds the deletion of key to the batch.
+func (b *Batch) Del(key string) {
+	b.ops = append(b.ops, batchOp{"del", key, nil, ""})
+}
+
+// SetCF adds the write of the value of key in the column family name to the batch.
+func (b *Batch) SetCF(name, key string, value []byte) {
+	b.Set(key, value)
+	b.ops[len(b.ops)-1].CF = name
+}
+
+// DelCF adds the deletion of key in the column family name to the batch.
+func (b *Batch) DelCF(name, key string) {
+	b.Del(key)
+	b.ops[len(b.ops)-1].CF = name
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Write applies the operations of b atomically. Operations without a column family apply to the one of c.
+// Batches are never retried, since the server may have applied one whose response was lost.
+func (c *Client) Write(ctx context.Context, b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	body, err := json.Marshal(b.ops)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	_, err = c.do(ctx, request{http.MethodPost, "/batch", nil, header, body, false})
+	return err
+}
+
+// Stats describes the state of the database of the server.
+type Stats struct {
+	Sequence       uint64        `json:"sequence"`  // Sequence number of the last write
+	Snapshots      int           `json:"snapshots"` // Live snapshots
+	ColumnFamilies []FamilyStats `json:"columnFamilies"`
+}
+
+// FamilyStats describes the state of a column family of the server.
+type FamilyStats struct {
+	Name            string `json:"name"`
+	MemtableEntries int    `json:"memtableEntries"`
+	RangeTombstones int    `json:"rangeTombstones"`
+	SSTFiles        int    `json:"sstFiles"`
+	SSTBytes        int64  `json:"sstBytes"`
+}
+
+// Stats returns the state of the database of the server and of all its column families.
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	res, err := c.do(ctx, request{http.MethodGet, "/stats", nil, nil, nil, true})
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{}
+	if err := json.Unmarshal(res.body, stats); err != nil {
+		return nil, fmt.Errorf("Invalid stats response: %w", err)
+	}
+	return stats, nil
+}
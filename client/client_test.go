@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyServer starts a server failing the first failures requests with 503 Service Unavailable
+// and answering the following ones with the value "v" and version 7.
+// Returns a Client of the server, with short backoffs, and the number of requests received.
+func newFlakyServer(t *testing.T, failures int64) (*Client, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) <= failures {
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			resp.Write([]byte(`{"error":{"code":"closed","message":"Database is closed"}}`))
+			return
+		}
+		resp.Header().Set("ETag", `"7"`)
+		resp.Write([]byte("v"))
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := New(srv.URL, &Options{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Error creating the client: %s", err)
+	}
+	return c, &requests
+}
+
+func TestRetries(t *testing.T) {
+	// Idempotent requests are retried
+	c, requests := newFlakyServer(t, 2)
+	val, version, err := c.GetVersion(context.Background(), "k")
+	if err != nil || string(val) != "v" || version != 7 {
+		t.Fatalf("Expected v at version 7, got %q at %d (%v)", val, version, err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("Expected 3 requests, got %d", n)
+	}
+
+	// Up to MaxRetries times
+	c, requests = newFlakyServer(t, 10)
+	_, err = c.Get("k")
+	var serverErr *Error
+	if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusServiceUnavailable || !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Expected a 503 error, got %v", err)
+	}
+	if n := requests.Load(); n != 1+defaultMaxRetries {
+		t.Fatalf("Expected %d requests, got %d", 1+defaultMaxRetries, n)
+	}
+
+	// Conditional writes and batches are not
+	c, requests = newFlakyServer(t, 1)
+	if _, err := c.SetIfVersion(context.Background(), "k", []byte("x"), 7); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Expected ErrUnavailable, got %v", err)
+	}
+	b := &Batch{}
+	b.Set("k", []byte("x"))
+	if err := c.Write(context.Background(), b); err != nil {
+		t.Fatalf("Error writing batch: %s", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("Expected 2 requests, got %d", n)
+	}
+
+	// Edge case: a cancelled context stops the retries
+	c, requests = newFlakyServer(t, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetContext(ctx, "k"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("Expected no request, got %d", n)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, &Options{Timeout: 20 * time.Millisecond, MaxRetries: -1})
+	if err != nil {
+		t.Fatalf("Error creating the client: %s", err)
+	}
+	start := time.Now()
+	if _, err := c.Get("k"); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the request to time out after 20ms, took %s", elapsed)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err      *Error
+		sentinel error
+	}{
+		{&Error{404, "not_found", "Key not found"}, ErrNotFound},
+		{&Error{404, "column_family_not_found", "Column family not found"}, ErrColumnFamilyNotFound},
+		{&Error{412, "condition_failed", "Condition failed"}, ErrConditionFailed},
+		{&Error{409, "overflow", "Counter overflow"}, ErrConflict},
+		{&Error{504, "timeout", "Request timed out"}, ErrTimeout},
+		{&Error{413, "", "Request Entity Too Large"}, ErrTooLarge},
+		{&Error{502, "", "Bad Gateway"}, ErrUnavailable},
+	} {
+		if !errors.Is(tc.err, tc.sentinel) {
+			t.Fatalf("Expected %v to match %v", tc.err, tc.sentinel)
+		}
+	}
+	if errors.Is(&Error{404, "column_family_not_found", ""}, ErrNotFound) {
+		t.Fatalf("Expected a missing column family not to match ErrNotFound")
+	}
+
+	// Edge cases: invalid base URLs
+	for _, baseURL := range []string{"", "localhost:8080", "ftp://localhost", "http://"} {
+		if _, err := New(baseURL, nil); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("Expected ErrInvalidArgument for %q, got %v", baseURL, err)
+		}
+	}
+}
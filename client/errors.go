@@ -0,0 +1,86 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors returned by the client, to be tested with errors.Is. Errors answered by the server are *Error values,
+// which match the sentinel of their code.
+var (
+	ErrNotFound             = errors.New("Key not found")
+	ErrColumnFamilyNotFound = errors.New("Column family not found")
+	ErrInvalidArgument      = errors.New("Invalid argument")
+	ErrTooLarge             = errors.New("Key or value too large")
+	ErrConditionFailed      = errors.New("Condition failed")
+	ErrConflict             = errors.New("Conflict")
+	ErrReadOnly             = errors.New("Read-only follower")
+	ErrNotLeader            = errors.New("Not the leader")
+	ErrUnavailable          = errors.New("Server unavailable")
+	ErrTimeout              = errors.New("Server timeout")
+)
+
+// codeErrors maps the codes of the JSON error responses of the server to the sentinel errors.
+var codeErrors = map[string]error{
+	"not_found":               ErrNotFound,
+	"column_family_not_found": ErrColumnFamilyNotFound,
+	"invalid_argument":        ErrInvalidArgument,
+	"too_large":               ErrTooLarge,
+	"condition_failed":        ErrConditionFailed,
+	"conflict":                ErrConflict,
+	"txn_conflict":            ErrConflict,
+	"txn_done":                ErrConflict,
+	"overflow":                ErrConflict,
+	"not_a_counter":           ErrConflict,
+	"column_family_exists":    ErrConflict,
+	"read_only":               ErrReadOnly,
+	"not_leader":              ErrNotLeader,
+	"closed":                  ErrUnavailable,
+	"timeout":                 ErrTimeout,
+}
+
+// statusErrors maps HTTP statuses to the sentinel errors, for the responses without a known code,
+// such as the ones written by a proxy in front of the server.
+var statusErrors = map[int]error{
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusBadRequest:            ErrInvalidArgument,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusPreconditionFailed:    ErrConditionFailed,
+	http.StatusConflict:              ErrConflict,
+	http.StatusBadGateway:            ErrUnavailable,
+	http.StatusServiceUnavailable:    ErrUnavailable,
+	http.StatusGatewayTimeout:        ErrTimeout,
+}
+
+// Error is an error response of the server.
+type Error struct {
+	StatusCode int    // HTTP status of the response
+	Code       string // Stable code of the error, such as "not_found", empty if the response had none
+	Message    string // Human-readable message of the server
+}
+
+// Error returns the message of the server along with the status and the code.
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s (status %d)", e.Message, e.StatusCode)
+	}
+	return fmt.Sprintf("%s (status %d, %s)", e.Message, e.StatusCode, e.Code)
+}
+
+// Is reports whether target is the sentinel error of the code of e, or of its status if the code is unknown.
+func (e *Error) Is(target error) bool {
+	if sentinel, ok := codeErrors[e.Code]; ok {
+		return sentinel == target
+	}
+	return statusErrors[e.StatusCode] == target
+}
+
+// retryable reports whether a request answered with this error may succeed if sent again.
+func (e *Error) retryable() bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kvproject/client"
+)
+
+// The client implements the same interface as the database.
+var _ DB = (*client.Client)(nil)
+
+// newTestClient starts an HTTP server for db and returns a client of it.
+func newTestClient(t *testing.T, db *fileDB) *client.Client {
+	t.Helper()
+	srv := httptest.NewServer(handleFunction(db, nil))
+	t.Cleanup(srv.Close)
+	c, err := client.New(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("Error creating the client: %s", err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	db := newTestDB(t)
+	c := newTestClient(t, db)
+	ctx := context.Background()
+
+	// Keys and values are binary-safe
+	key, val := "a/b c?d", []byte("x\x00\r\ny")
+	if err := c.Set(key, val); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if got, err := db.Get(key); err != nil || string(got) != string(val) {
+		t.Fatalf("Expected %q, got %q (%v)", val, got, err)
+	}
+	if got, err := c.Get(key); err != nil || string(got) != string(val) {
+		t.Fatalf("Expected %q, got %q (%v)", val, got, err)
+	}
+	if _, err := c.Get("missing"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Conditional writes
+	_, version, err := c.GetVersion(ctx, key)
+	if err != nil {
+		t.Fatalf("Error getting version: %s", err)
+	}
+	newVersion, err := c.SetIfVersion(ctx, key, []byte("v2"), version)
+	if err != nil || newVersion <= version {
+		t.Fatalf("Expected a version after %d, got %d (%v)", version, newVersion, err)
+	}
+	if _, err := c.SetIfVersion(ctx, key, []byte("v3"), version); !errors.Is(err, client.ErrConditionFailed) {
+		t.Fatalf("Expected ErrConditionFailed, got %v", err)
+	}
+	if _, err := c.SetIfVersion(ctx, "new", []byte("v"), 0); err != nil {
+		t.Fatalf("Error setting new key: %s", err)
+	}
+	if _, err := c.SetIfVersion(ctx, "new", []byte("v"), 0); !errors.Is(err, client.ErrConditionFailed) {
+		t.Fatalf("Expected ErrConditionFailed, got %v", err)
+	}
+	if err := c.DeleteIfVersion(ctx, key, version); !errors.Is(err, client.ErrConditionFailed) {
+		t.Fatalf("Expected ErrConditionFailed, got %v", err)
+	}
+
+	// Del returns the deleted value
+	if got, err := c.Del(key); err != nil || string(got) != "v2" {
+		t.Fatalf("Expected v2, got %q (%v)", got, err)
+	}
+	if _, err := c.Del(key); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	// TTL
+	if err := c.SetWithTTL(ctx, "session", []byte("s"), time.Hour); err != nil {
+		t.Fatalf("Error setting key with TTL: %s", err)
+	}
+	if ttl, expires, err := db.TTL("session"); err != nil || !expires || ttl < 59*time.Minute {
+		t.Fatalf("Expected about an hour, got %s, %v (%v)", ttl, expires, err)
+	}
+
+	// Batches and multi-gets
+	b := &client.Batch{}
+	b.Set("k1", []byte("1"))
+	b.Set("k2", []byte("2"))
+	b.Del("new")
+	if err := c.Write(ctx, b); err != nil {
+		t.Fatalf("Error writing batch: %s", err)
+	}
+	values, err := c.MultiGet(ctx, []string{"k1", "k2", "new"})
+	if err != nil || len(values) != 2 || string(values["k1"]) != "1" || string(values["k2"]) != "2" {
+		t.Fatalf("Unexpected values %q (%v)", values, err)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 25; i++ {
+		if err := db.Set(fmt.Sprintf("user:%02d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	c := newTestClient(t, db)
+
+	// Follow the cursors until the scan is over
+	var items []client.Item
+	opts := client.ScanOptions{Prefix: "user:", Limit: 10, Reverse: true}
+	for pages := 1; ; pages++ {
+		page, err := c.Scan(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("Error scanning: %s", err)
+		}
+		items = append(items, page.Items...)
+		if page.Next == "" {
+			if pages != 3 {
+				t.Fatalf("Expected 3 pages, got %d", pages)
+			}
+			break
+		}
+		opts.Cursor = page.Next
+	}
+	if len(items) != 25 || items[0].Key != "user:24" || string(items[0].Value) != "24" || items[24].Key != "user:00" {
+		t.Fatalf("Unexpected items %v", items)
+	}
+
+	page, err := c.Scan(context.Background(), client.ScanOptions{Start: "user:10", End: "user:12", KeysOnly: true})
+	if err != nil || len(page.Items) != 2 || page.Items[1].Key != "user:11" || page.Items[1].Value != nil {
+		t.Fatalf("Unexpected page %v (%v)", page, err)
+	}
+}
+
+func TestClientColumnFamily(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.CreateColumnFamily("users", Options{}); err != nil {
+		t.Fatalf("Error creating column family: %s", err)
+	}
+	c := newTestClient(t, db)
+
+	users := c.ColumnFamily("users")
+	if err := users.Set("k", []byte("user")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if _, err := c.Get("k"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected the default column family not to hold k, got %v", err)
+	}
+	if val, err := db.ColumnFamily("users").Get("k"); err != nil || string(val) != "user" {
+		t.Fatalf("Expected user, got %q (%v)", val, err)
+	}
+
+	// A batch writes to several column families atomically
+	b := &client.Batch{}
+	b.Set("k", []byte("default"))
+	b.DelCF("users", "k")
+	if err := c.Write(context.Background(), b); err != nil {
+		t.Fatalf("Error writing batch: %s", err)
+	}
+	if _, err := users.Get("k"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+
+	if _, err := c.ColumnFamily("missing").Get("k"); !errors.Is(err, client.ErrColumnFamilyNotFound) {
+		t.Fatalf("Expected ErrColumnFamilyNotFound, got %v", err)
+	}
+
+	// Stats cover every column family
+	stats, err := c.Stats(context.Background())
+	if err != nil || stats.Sequence != db.seq || len(stats.ColumnFamilies) != 2 {
+		t.Fatalf("Unexpected stats %+v (%v)", stats, err)
+	}
+	if users := stats.ColumnFamilies[1]; users.Name != "users" || users.MemtableEntries != 2 || users.SSTFiles != 0 {
+		t.Fatalf("Unexpected stats of users %+v", users)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kvproject/client"
+)
+
+// maxLineSize is the size of the longest command line, enough for a value of the largest size allowed by the server.
+const maxLineSize = 17 << 20
+
+// errExit is returned by the exit command to end the REPL.
+var errExit = errors.New("exit")
+
+// session is the state of the CLI: the server, the current column family and output format, and the history.
+type session struct {
+	base    *client.Client // Client of the default column family
+	client  *client.Client // Client of the current column family
+	family  string         // Current column family, empty for the default one
+	format  string
+	out     io.Writer
+	history *history // History of the REPL, nil if disabled
+}
+
+// newSession creates a session sending its commands to c and printing their results to out in the given format.
+func newSession(c *client.Client, format string, out io.Writer) *session {
+	return &session{base: c, client: c, format: format, out: out}
+}
+
+// prompt returns the prompt of the REPL, naming the current column family.
+func (s *session) prompt() string {
+	if s.family == "" {
+		return "godb> "
+	}
+	return fmt.Sprintf("godb[%s]> ", s.family)
+}
+
+// use switches to the column family name, or to the default one if name is empty.
+func (s *session) use(name string) {
+	s.family, s.client = name, s.base
+	if name != "" {
+		s.client = s.base.ColumnFamily(name)
+	}
+}
+
+// exec runs a command line. Empty lines and comments, starting with #, are ignored.
+func (s *session) exec(line string) error {
+	if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	args, err := splitArgs(line)
+	if err != nil {
+		return err
+	}
+	return s.run(args)
+}
+
+// run runs the command args[0] with the arguments args[1:] and prints its result.
+func (s *session) run(args []string) error {
+	name := strings.ToLower(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, try help", args[0])
+	}
+	if len(args)-1 < cmd.minArgs || (cmd.maxArgs >= 0 && len(args)-1 > cmd.maxArgs) {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	out, err := cmd.run(context.Background(), s, args[1:])
+	if err != nil || out == nil {
+		return err
+	}
+	return formatters[s.format](s.out, out)
+}
+
+// command is a command of the CLI.
+type command struct {
+	usage   string
+	help    string
+	minArgs int
+	maxArgs int // -1 for no limit
+	run     func(ctx context.Context, s *session, args []string) (*output, error)
+}
+
+// commands are the commands of the CLI, by lowercase name. They are set by init, since the help command lists them.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":     {"get KEY", "Print the value of a key and its version", 1, 1, cmdGet},
+		"set":     {"set KEY VALUE [TTL]", "Set the value of a key, expiring after TTL (such as 30s or 1h) if given", 2, 3, cmdSet},
+		"del":     {"del KEY", "Delete a key and print its last value", 1, 1, cmdDel},
+		"scan":    {"scan [prefix=P] [start=S] [end=E] [limit=N] [cursor=C] [reverse] [keys]", "List keys in order, with their values unless keys is given", 0, -1, cmdScan},
+		"batch":   {"batch (set KEY VALUE | del KEY)...", "Apply several writes atomically", 2, -1, cmdBatch},
+		"stats":   {"stats", "Print the state of the database and of its column families", 0, 0, cmdStats},
+		"use":     {"use [CF]", "Switch to a column family, or back to the default one", 0, 1, cmdUse},
+		"format":  {"format table|json|raw", "Change the output format", 1, 1, cmdFormat},
+		"history": {"history [N]", "Print the last N commands of the history, all of them by default", 0, 1, cmdHistory},
+		"help":    {"help", "Print this help", 0, 0, cmdHelp},
+		"exit":    {"exit", "Leave the REPL", 0, 0, cmdExit},
+		"quit":    {"quit", "Leave the REPL", 0, 0, cmdExit},
+	}
+}
+
+// cmdGet prints the value of a key and its version.
+func cmdGet(ctx context.Context, s *session, args []string) (*output, error) {
+	val, version, err := s.client.GetVersion(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return &output{
+		header: []string{"KEY", "VALUE", "VERSION"},
+		rows:   [][]string{{args[0], string(val), strconv.FormatUint(version, 10)}},
+		raw:    val,
+		data:   map[string]interface{}{"key": args[0], "value": string(val), "version": version},
+	}, nil
+}
+
+// cmdSet sets the value of a key, with an optional TTL.
+func cmdSet(ctx context.Context, s *session, args []string) (*output, error) {
+	if len(args) == 3 {
+		ttl, err := time.ParseDuration(args[2])
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid TTL %q", args[2])
+		}
+		if err := s.client.SetWithTTL(ctx, args[0], []byte(args[1]), ttl); err != nil {
+			return nil, err
+		}
+	} else if err := s.client.SetContext(ctx, args[0], []byte(args[1])); err != nil {
+		return nil, err
+	}
+	return message("OK"), nil
+}
+
+// cmdDel deletes a key and prints its last value.
+func cmdDel(ctx context.Context, s *session, args []string) (*output, error) {
+	val, err := s.client.DelContext(ctx, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return &output{
+		header: []string{"KEY", "DELETED VALUE"},
+		rows:   [][]string{{args[0], string(val)}},
+		raw:    val,
+		data:   map[string]interface{}{"key": args[0], "deleted": string(val)},
+	}, nil
+}
+
+// cmdScan lists a page of keys, printing the cursor of the next page if there is one.
+func cmdScan(ctx context.Context, s *session, args []string) (*output, error) {
+	var opts client.ScanOptions
+	for _, arg := range args {
+		name, param, _ := strings.Cut(arg, "=")
+		switch strings.ToLower(name) {
+		case "prefix":
+			opts.Prefix = param
+		case "start":
+			opts.Start = param
+		case "end":
+			opts.End = param
+		case "cursor":
+			opts.Cursor = param
+		case "limit":
+			n, err := strconv.Atoi(param)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid limit %q", param)
+			}
+			opts.Limit = n
+		case "reverse":
+			opts.Reverse = true
+		case "keys":
+			opts.KeysOnly = true
+		default:
+			return nil, fmt.Errorf("unknown scan option %q", arg)
+		}
+	}
+
+	page, err := s.client.Scan(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	out := &output{header: []string{"KEY", "VALUE"}}
+	if opts.KeysOnly {
+		out.header = out.header[:1]
+	}
+	items := make([]map[string]string, len(page.Items))
+	for i, item := range page.Items {
+		items[i] = map[string]string{"key": item.Key}
+		row := []string{item.Key}
+		if !opts.KeysOnly {
+			items[i]["value"] = string(item.Value)
+			row = append(row, string(item.Value))
+		}
+		out.rows = append(out.rows, row)
+	}
+	data := map[string]interface{}{"items": items, "next": nil}
+	if page.Next != "" {
+		data["next"] = page.Next
+		out.footer = "next: scan cursor=" + page.Next
+	}
+	out.data = data
+	return out, nil
+}
+
+// cmdBatch applies a list of set and del operations atomically.
+func cmdBatch(ctx context.Context, s *session, args []string) (*output, error) {
+	b := &client.Batch{}
+	for i := 0; i < len(args); {
+		switch strings.ToLower(args[i]) {
+		case "set":
+			if i+2 >= len(args) {
+				return nil, errors.New("set needs a key and a value")
+			}
+			b.Set(args[i+1], []byte(args[i+2]))
+			i += 3
+		case "del":
+			if i+1 >= len(args) {
+				return nil, errors.New("del needs a key")
+			}
+			b.Del(args[i+1])
+			i += 2
+		default:
+			return nil, fmt.Errorf("unknown batch operation %q", args[i])
+		}
+	}
+	if err := s.client.Write(ctx, b); err != nil {
+		return nil, err
+	}
+	return message(fmt.Sprintf("OK, %d operations applied", b.Len())), nil
+}
+
+// cmdStats prints the state of the database and of its column families.
+func cmdStats(ctx context.Context, s *session, _ []string) (*output, error) {
+	stats, err := s.base.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := &output{
+		header: []string{"COLUMN FAMILY", "MEMTABLE ENTRIES", "RANGE TOMBSTONES", "SST FILES", "SST BYTES"},
+		footer: fmt.Sprintf("sequence: %d, snapshots: %d", stats.Sequence, stats.Snapshots),
+		data:   stats,
+	}
+	for _, family := range stats.ColumnFamilies {
+		out.rows = append(out.rows, []string{
+			family.Name,
+			strconv.Itoa(family.MemtableEntries),
+			strconv.Itoa(family.RangeTombstones),
+			strconv.Itoa(family.SSTFiles),
+			strconv.FormatInt(family.SSTBytes, 10),
+		})
+	}
+	return out, nil
+}
+
+// cmdUse switches to a column family.
+func cmdUse(_ context.Context, s *session, args []string) (*output, error) {
+	name := ""
+	if len(args) == 1 {
+		name = args[0]
+	}
+	s.use(name)
+	return nil, nil
+}
+
+// cmdFormat changes the output format.
+func cmdFormat(_ context.Context, s *session, args []string) (*output, error) {
+	if _, ok := formatters[args[0]]; !ok {
+		return nil, fmt.Errorf("unknown output format %q", args[0])
+	}
+	s.format = args[0]
+	return nil, nil
+}
+
+// cmdHistory prints the numbered entries of the history, to be run again with !N.
+func cmdHistory(_ context.Context, s *session, args []string) (*output, error) {
+	if s.history == nil {
+		return nil, errors.New("the history is disabled")
+	}
+	first := 0
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid number of entries %q", args[0])
+		}
+		first = max(len(s.history.entries)-n, 0)
+	}
+	out := &output{header: []string{"#", "COMMAND"}}
+	var entries []map[string]interface{}
+	for i := first; i < len(s.history.entries); i++ {
+		out.rows = append(out.rows, []string{strconv.Itoa(i + 1), s.history.entries[i]})
+		entries = append(entries, map[string]interface{}{"number": i + 1, "command": s.history.entries[i]})
+	}
+	out.data = entries
+	return out, nil
+}
+
+// cmdHelp prints the usage of every command.
+func cmdHelp(_ context.Context, _ *session, _ []string) (*output, error) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := &output{header: []string{"COMMAND", "DESCRIPTION"}}
+	for _, name := range names {
+		out.rows = append(out.rows, []string{commands[name].usage, commands[name].help})
+	}
+	out.data = out.rows
+	return out, nil
+}
+
+// cmdExit ends the REPL.
+func cmdExit(_ context.Context, _ *session, _ []string) (*output, error) {
+	return nil, errExit
+}
+
+// splitArgs splits a command line into arguments separated by spaces or tabs.
+// Double-quoted arguments may hold Go escape sequences such as \n or \x00; single-quoted ones are taken literally.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case ' ', '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		case '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			arg.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case '"':
+			end := i + 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, errors.New("unterminated double quote")
+			}
+			unquoted, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string %s", line[i:end+1])
+			}
+			arg.WriteString(unquoted)
+			i = end
+			inArg = true
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"kvproject/client"
+)
+
+// newFakeServer starts a server implementing the v2 keys, "/scan" and "/batch" endpoints over a map,
+// enough for the commands of the CLI, and returns a session printing to the returned builder.
+func newFakeServer(t *testing.T) (*session, *strings.Builder) {
+	t.Helper()
+	var mu sync.Mutex
+	values := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/v2/keys/"):
+			key, _ := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), "/v2/keys/"))
+			val, ok := values[key]
+			if req.Method == http.MethodPut {
+				body, _ := io.ReadAll(req.Body)
+				values[key] = string(body)
+				resp.Header().Set("ETag", `"1"`)
+				resp.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if !ok {
+				resp.WriteHeader(http.StatusNotFound)
+				resp.Write([]byte(`{"error":{"code":"not_found","message":"Key not found: ` + key + `"}}`))
+				return
+			}
+			if req.Method == http.MethodDelete {
+				delete(values, key)
+				resp.WriteHeader(http.StatusNoContent)
+				return
+			}
+			resp.Header().Set("ETag", `"1"`)
+			resp.Write([]byte(val))
+		case req.URL.Path == "/scan":
+			var items []map[string]string
+			for key, val := range values {
+				if strings.HasPrefix(key, req.URL.Query().Get("prefix")) {
+					items = append(items, map[string]string{"key": key, "value": val})
+				}
+			}
+			json.NewEncoder(resp).Encode(map[string]interface{}{"items": items, "next": "abc"})
+		case req.URL.Path == "/batch":
+			var ops []map[string]string
+			json.NewDecoder(req.Body).Decode(&ops)
+			for _, op := range ops {
+				if op["op"] == "set" {
+					values[op["key"]] = op["value"]
+				} else {
+					delete(values, op["key"])
+				}
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := client.New(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("Error creating the client: %s", err)
+	}
+	out := &strings.Builder{}
+	return newSession(c, "table", out), out
+}
+
+func TestCommands(t *testing.T) {
+	s, out := newFakeServer(t)
+	check := func(line, want string) {
+		t.Helper()
+		out.Reset()
+		if err := s.exec(line); err != nil {
+			t.Fatalf("Error running %q: %s", line, err)
+		}
+		if out.String() != want {
+			t.Fatalf("Expected %q for %q, got %q", want, line, out.String())
+		}
+	}
+
+	check(`set user:1 "bob smith"`, "OK\n")
+	check("get user:1", "KEY     VALUE      VERSION\nuser:1  bob smith  1\n")
+	check(`set bin "a\tb"`, "OK\n")
+	check("get bin", "KEY  VALUE   VERSION\nbin  \"a\\tb\"  1\n")
+	check("scan prefix=user:", "KEY     VALUE\nuser:1  bob smith\nnext: scan cursor=abc\n")
+
+	check("format raw", "")
+	check("get bin", "a\tb\n")
+	check("del bin", "a\tb\n")
+
+	check("format json", "")
+	check("get user:1", "{\n  \"key\": \"user:1\",\n  \"value\": \"bob smith\",\n  \"version\": 1\n}\n")
+	check("batch set a 1 del user:1", "{\n  \"result\": \"OK, 2 operations applied\"\n}\n")
+
+	// Errors
+	for line, want := range map[string]string{
+		"get user:1":        "Key not found: user:1 (status 404, not_found)",
+		"get":               "usage: get KEY",
+		"batch set a":       "set needs a key and a value",
+		"scan limit=zero":   `invalid limit "zero"`,
+		"flush":             `unknown command "flush", try help`,
+		`get "unterminated`: "unterminated double quote",
+	} {
+		if err := s.exec(line); err == nil || err.Error() != want {
+			t.Fatalf("Expected %q for %q, got %v", want, line, err)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	for line, want := range map[string][]string{
+		"get key":                 {"get", "key"},
+		"  set  k \t v  ":         {"set", "k", "v"},
+		`set k "a b\n\x00"`:       {"set", "k", "a b\n\x00"},
+		`set k 'a "b" \n'`:        {"set", "k", `a "b" \n`},
+		`set "k"'1' "say \"hi\""`: {"set", "k1", `say "hi"`},
+		`set k ""`:                {"set", "k", ""},
+		"":                        nil,
+	} {
+		if got, err := splitArgs(line); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("Expected %q for %q, got %q (%v)", want, line, got, err)
+		}
+	}
+}
+
+func TestScriptAndHistory(t *testing.T) {
+	s, out := newFakeServer(t)
+	dir := t.TempDir()
+
+	// A script stops at its first error
+	script := filepath.Join(dir, "script.godb")
+	os.WriteFile(script, []byte("# fixtures\nset a 1\n\nget missing\nset b 2\n"), 0600)
+	if err := runScript(s, script); err == nil || !strings.HasPrefix(err.Error(), "line 4: ") {
+		t.Fatalf("Expected an error at line 4, got %v", err)
+	}
+	if err := s.exec("get b"); err == nil {
+		t.Fatalf("Expected the script to stop before setting b")
+	}
+
+	// The REPL records its commands, which can be run again
+	path := filepath.Join(dir, "history")
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatalf("Error opening the history: %s", err)
+	}
+	s.history = h
+	out.Reset()
+	repl(s, strings.NewReader("set c 3\nget nothing\n!1\n!!\nexit\nset d 4\n"))
+	if !reflect.DeepEqual(h.entries, []string{"set c 3", "get nothing", "set c 3", "exit"}) {
+		t.Fatalf("Unexpected history %q", h.entries)
+	}
+	if n := strings.Count(out.String(), "(error) Key not found"); n != 1 {
+		t.Fatalf("Expected one error, got %d in %q", n, out.String())
+	}
+
+	// The history survives the session, trimmed to maxHistory entries
+	for i := 0; i < maxHistory; i++ {
+		h.add("get " + strings.Repeat("k", i%2+1))
+	}
+	h.file.Close()
+	h, err = openHistory(path)
+	if err != nil || len(h.entries) != maxHistory || h.entries[maxHistory-1] != "get kk" {
+		t.Fatalf("Unexpected history of %d entries (%v)", len(h.entries), err)
+	}
+	h.file.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxHistory is the number of commands kept in the history file.
+const maxHistory = 1000
+
+// history is the list of the commands run in the REPL, persisted to a file shared by all the sessions.
+type history struct {
+	entries []string
+	file    *os.File // History file, opened in append mode
+}
+
+// openHistory loads the history file at path, creating it if needed, and drops its oldest entries beyond maxHistory.
+// Returns the history, or nil if path is empty, and any encountered error.
+func openHistory(path string) (*history, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	h := &history{}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, maxLineSize)
+		for scanner.Scan() {
+			h.entries = append(h.entries, scanner.Text())
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+		if err := os.WriteFile(path, []byte(strings.Join(h.entries, "\n")+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	h.file = file
+	return h, nil
+}
+
+// add appends a command to the history, unless it repeats the last one.
+func (h *history) add(line string) error {
+	if len(h.entries) > 0 && h.entries[len(h.entries)-1] == line {
+		return nil
+	}
+	h.entries = append(h.entries, line)
+	_, err := h.file.WriteString(line + "\n")
+	return err
+}
+
+// expandHistory replaces "!!" by the last command of the history and "!N" by its Nth command, printing the result.
+// Returns the command to run, or an error if the history has no such command.
+func (s *session) expandHistory(line string) (string, error) {
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+	if s.history == nil {
+		return "", fmt.Errorf("the history is disabled")
+	}
+	n := len(s.history.entries)
+	if line != "!!" {
+		var err error
+		if n, err = strconv.Atoi(line[1:]); err != nil {
+			return "", fmt.Errorf("invalid history reference %q", line)
+		}
+	}
+	if n <= 0 || n > len(s.history.entries) {
+		return "", fmt.Errorf("no command %d in the history", n)
+	}
+	line = s.history.entries[n-1]
+	fmt.Fprintln(s.out, line)
+	return line, nil
+}
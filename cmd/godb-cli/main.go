@@ -0,0 +1,136 @@
+// Command godb-cli is a command-line client of a goDB server.
+//
+// Without arguments it starts an interactive session reading one command per line, with a persistent history.
+// A command given as arguments is run once, and the -f flag runs the commands of a script file, "-" for the
+// standard input. Results are printed as aligned tables, JSON, or raw values, as selected by the -o flag:
+//
+//	godb-cli -addr http://localhost:8080
+//	godb-cli -o raw get users/1
+//	godb-cli -f fixtures.godb
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kvproject/client"
+)
+
+const historyFileName = ".godb_history"
+
+// main parses the flags, connects to the server and runs the commands of the arguments, of a script or of the REPL.
+// Exits with status 1 if a command fails outside of the REPL.
+func main() {
+	addr := flag.String("addr", "http://localhost:8080", "Base URL of the server")
+	family := flag.String("cf", "", "Column family of the commands, the default one if empty")
+	format := flag.String("o", "table", "Output format: table, json or raw")
+	script := flag.String("f", "", "Script file whose commands are run, - for the standard input")
+	timeout := flag.Duration("timeout", 10*time.Second, "Maximum duration of a request")
+	historyPath := flag.String("history", defaultHistoryPath(), "History file of the REPL, empty to disable it")
+	flag.Parse()
+
+	if _, ok := formatters[*format]; !ok {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", *format)
+		os.Exit(2)
+	}
+	c, err := client.New(*addr, &client.Options{Timeout: *timeout})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	s := newSession(c, *format, os.Stdout)
+	if *family != "" {
+		s.use(*family)
+	}
+
+	switch {
+	case flag.NArg() > 0:
+		if err := s.run(flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, "(error)", err)
+			os.Exit(1)
+		}
+	case *script != "":
+		if err := runScript(s, *script); err != nil {
+			fmt.Fprintln(os.Stderr, "(error)", err)
+			os.Exit(1)
+		}
+	default:
+		h, err := openHistory(*historyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening the history:", err)
+		}
+		s.history = h
+		repl(s, os.Stdin)
+	}
+}
+
+// defaultHistoryPath returns the path of the history file in the home directory, or an empty string if there is none.
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, historyFileName)
+}
+
+// runScript runs the commands of the script file at path, or of the standard input if path is "-".
+// Returns the first error, prefixed with its line number; the remaining commands are not run.
+func runScript(s *session, path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		if err := s.exec(scanner.Text()); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// repl reads commands from r until the end of the input or the exit command, printing a prompt before each of them.
+// Errors are printed and do not end the session. Commands are added to the history of the session.
+func repl(s *session, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineSize)
+	for {
+		fmt.Fprint(s.out, s.prompt())
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		line, err := s.expandHistory(line)
+		if err == nil && s.history != nil {
+			if err := s.history.add(line); err != nil {
+				fmt.Fprintln(s.out, "Error writing the history:", err)
+			}
+		}
+		if err == nil {
+			err = s.exec(line)
+		}
+		if err == errExit {
+			return
+		}
+		if err != nil {
+			fmt.Fprintln(s.out, "(error)", err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+)
+
+// output is the result of a command, in the forms needed by every output format.
+type output struct {
+	header []string    // Column names of the table, none for a message
+	rows   [][]string  // Cells of the table
+	footer string      // Line printed after the table, such as the cursor of the next page of a scan
+	raw    []byte      // Raw form of a single value, printed as is; the rows are printed if nil
+	data   interface{} // JSON form
+}
+
+// message returns the output of a command whose result is a message.
+func message(msg string) *output {
+	return &output{rows: [][]string{{msg}}, data: map[string]string{"result": msg}}
+}
+
+// formatters print an output, by output format.
+var formatters = map[string]func(w io.Writer, out *output) error{
+	"table": printTable,
+	"json":  printJSON,
+	"raw":   printRaw,
+}
+
+// printTable prints the rows of out as aligned columns under the header, quoting the cells that are not printable.
+func printTable(w io.Writer, out *output) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if out.header != nil {
+		fmt.Fprintln(tw, strings.Join(out.header, "\t"))
+	}
+	for _, row := range out.rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = displayCell(cell)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	if out.header != nil && len(out.rows) == 0 {
+		fmt.Fprintln(tw, "(empty)")
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if out.footer != "" {
+		_, err := fmt.Fprintln(w, out.footer)
+		return err
+	}
+	return nil
+}
+
+// displayCell returns cell as is if it is printable text, or quoted with Go escape sequences otherwise,
+// so that binary values and values holding tabs or newlines do not break the table.
+func displayCell(cell string) string {
+	if !utf8.ValidString(cell) || strings.IndexFunc(cell, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+		return strconv.Quote(cell)
+	}
+	return cell
+}
+
+// printJSON prints the JSON form of out, indented.
+func printJSON(w io.Writer, out *output) error {
+	data, err := json.MarshalIndent(out.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// printRaw prints the raw value of out followed by a newline, or its rows with tab-separated cells and no header.
+func printRaw(w io.Writer, out *output) error {
+	if out.raw != nil {
+		_, err := w.Write(append(out.raw[:len(out.raw):len(out.raw)], '\n'))
+		return err
+	}
+	for _, row := range out.rows {
+		if _, err := fmt.Fprintln(w, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
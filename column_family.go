@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/emirpasic/gods/maps/treemap"
+)
+
+const (
+	defaultColumnFamily   = "default"
+	columnFamilyDirPrefix = "cf_" // The SST files of a column family are stored in the directory cf_<name>
+)
+
+// newColumnFamily creates a column family with an empty Memtable and registers it in core.
+// Options left to zero take their default values.
+// Returns the column family.
+func newColumnFamily(core *dbCore, name, dir string, opts Options) *fileDB {
+	family := &fileDB{
+		dbCore: core,
+		name:   name,
+		dir:    dir,
+		values: treemap.NewWith(internalKeyComparator),
+	}
+	family.configure(opts)
+	core.families[name] = family
+	return family
+}
+
+// configure applies opts to the column family, options left to zero taking their default values.
+func (mem *fileDB) configure(opts Options) {
+	mem.mergeOperator = opts.MergeOperator
+	mem.memLimit, mem.compactingSize = memLimit, compactingSize
+	if opts.MemLimit > 0 {
+		mem.memLimit = opts.MemLimit
+	}
+	if opts.CompactingSize > 0 {
+		mem.compactingSize = opts.CompactingSize
+	}
+}
+
+// ErrColumnFamilyExists is returned by CreateColumnFamily when the column family already exists.
+var ErrColumnFamilyExists = errors.New("Column family already exists")
+
+// ErrColumnFamilyNotFound is returned when writing a batch to a column family that does not exist.
+var ErrColumnFamilyNotFound = errors.New("Column family not found")
+
+// OpenColumnFamily opens the column family called name with the given options, creating it if it does not exist.
+// Names are made of letters, digits, '-' and '_'. Column families are independent keyspaces, sharing the
+// Write-Ahead Log and the sequence numbers of the database: a WriteBatch may write to several of them atomically.
+// Column families found on disk are opened with the default options when the database is created,
+// OpenColumnFamily applies opts to them.
+// Returns the column family, on which all the operations of a fileDB are available, and any encountered error.
+func (mem *fileDB) OpenColumnFamily(name string, opts Options) (*fileDB, error) {
+	return mem.openColumnFamily(name, opts, true)
+}
+
+// CreateColumnFamily creates the column family called name with the given options, like OpenColumnFamily.
+// Returns the column family, or ErrColumnFamilyExists if it already exists, or any encountered error.
+func (mem *fileDB) CreateColumnFamily(name string, opts Options) (*fileDB, error) {
+	return mem.openColumnFamily(name, opts, false)
+}
+
+// openColumnFamily creates the column family called name, or configures it if it exists and reopen is true.
+// Returns the column family and any encountered error.
+func (mem *fileDB) openColumnFamily(name string, opts Options, reopen bool) (*fileDB, error) {
+	if !validColumnFamilyName(name) {
+		return nil, fmt.Errorf("%w: invalid column family name %q", ErrInvalidArgument, name)
+	}
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if family, ok := mem.families[name]; ok {
+		if !reopen {
+			return nil, ErrColumnFamilyExists
+		}
+		family.configure(opts)
+		return family, nil
+	}
+	if mem.follower != nil || mem.raft != nil {
+		return nil, ErrReadOnly // Column families come from the primary, or from the Raft log
+	}
+	dir := mem.path(columnFamilyDirPrefix + name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return newColumnFamily(mem.dbCore, name, dir, opts), nil
+}
+
+// openReplayedColumnFamily returns the column family called name, named by a batch replayed from the Write-Ahead Log,
+// the primary or the Raft log, or by a checkpoint. If it is not open, because it was created by the primary or its
+// directory was removed since the batch was written, it is created with the default options and registered in
+// mem.families, so that it is served like the column families opened by OpenColumnFamily. The caller must hold mem.mu.
+// Returns the column family, or an error wrapping ErrCorruption if name is not a valid column family name, or any
+// encountered error creating its directory.
+func (mem *fileDB) openReplayedColumnFamily(name string) (*fileDB, error) {
+	if family, ok := mem.families[name]; ok {
+		return family, nil
+	}
+	if !validColumnFamilyName(name) {
+		return nil, fmt.Errorf("%w: invalid column family name %q", ErrCorruption, name)
+	}
+	dir := mem.path(columnFamilyDirPrefix + name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return newColumnFamily(mem.dbCore, name, dir, Options{}), nil
+}
+
+// ColumnFamily returns the column family called name, or nil if it does not exist.
+func (mem *fileDB) ColumnFamily(name string) *fileDB {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	return mem.families[name]
+}
+
+// ColumnFamilies returns the names of all the column families, sorted.
+func (mem *fileDB) ColumnFamilies() []string {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	names := make([]string, 0, len(mem.families))
+	for name := range mem.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validColumnFamilyName reports whether name can be used as a column family name, and so as part of a directory name.
+func validColumnFamilyName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestColumnFamilies(t *testing.T) {
+	db := newTestDB(t)
+	sessions, err := db.OpenColumnFamily("sessions", Options{MemLimit: 4, CompactingSize: 2})
+	if err != nil {
+		t.Fatalf("Error opening column family: %s", err)
+	}
+
+	// The same key lives independently in each column family
+	if err := db.Set("user1", []byte("profile")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if err := sessions.Set("user1", []byte("token")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if val, err := db.Get("user1"); err != nil || string(val) != "profile" {
+		t.Fatalf("Expected profile, got %s (%v)", val, err)
+	}
+	if val, err := sessions.Get("user1"); err != nil || string(val) != "token" {
+		t.Fatalf("Expected token, got %s (%v)", val, err)
+	}
+	if _, err := sessions.Del("user1"); err != nil {
+		t.Fatalf("Error deleting key: %s", err)
+	}
+	if _, err := db.Get("user1"); err != nil {
+		t.Fatalf("Expected user1 to be kept in the default column family: %s", err)
+	}
+
+	// The column family flushes and compacts on its own settings, into its own directory
+	for i := 0; i < 20; i++ {
+		if err := sessions.Set(fmt.Sprintf("s%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(columnFamilyDirPrefix+"sessions", "db_*.sst"))
+	if err != nil || len(files) == 0 || len(files) >= 2 {
+		t.Fatalf("Expected compacted SST files in the column family directory, got %v (%v)", files, err)
+	}
+	it, err := sessions.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("Error creating iterator: %s", err)
+	}
+	defer it.Close()
+	count := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		count++
+	}
+	if count != 20 {
+		t.Fatalf("Expected 20 keys in the column family, got %d", count)
+	}
+	if val, err := db.Get("user1"); err != nil || string(val) != "profile" {
+		t.Fatalf("Expected profile after the flush, got %s (%v)", val, err)
+	}
+
+	if names := db.ColumnFamilies(); fmt.Sprint(names) != "[default sessions]" {
+		t.Fatalf("Unexpected column families %v", names)
+	}
+
+	// Edge cases: invalid names and existing column families
+	if _, err := db.OpenColumnFamily("../x", Options{}); err == nil {
+		t.Fatal("Expected an error for an invalid name")
+	}
+	if _, err := db.CreateColumnFamily("sessions", Options{}); err != ErrColumnFamilyExists {
+		t.Fatalf("Expected ErrColumnFamilyExists, got %v", err)
+	}
+}
+
+func TestColumnFamilyBatchRecovery(t *testing.T) {
+	db := newTestDB(t)
+	counters, err := db.OpenColumnFamily("counters", Options{})
+	if err != nil {
+		t.Fatalf("Error opening column family: %s", err)
+	}
+
+	// A batch writes to both column families atomically, in a single WAL record
+	b := NewWriteBatch()
+	b.Set("page", []byte("home"))
+	b.SetCF(counters, "page", []byte("1"))
+	b.DelCF(counters, "old")
+	if err := db.Write(b); err != nil {
+		t.Fatalf("Error writing batch: %s", err)
+	}
+	db.wal.Close()
+
+	// The column family is found again on disk and its entries are recovered from the shared WAL
+	reopened, err := newDB()
+	if err != nil {
+		t.Fatal("Error reopening the DB:", err)
+	}
+	defer reopened.wal.Close()
+	if err := reopened.recoverWAL(); err != nil {
+		t.Fatalf("Error recovering the WAL: %s", err)
+	}
+	family := reopened.ColumnFamily("counters")
+	if family == nil {
+		t.Fatal("Expected the column family to be reopened")
+	}
+	if val, err := family.Get("page"); err != nil || string(val) != "1" {
+		t.Fatalf("Expected 1, got %s (%v)", val, err)
+	}
+	if val, err := reopened.Get("page"); err != nil || string(val) != "home" {
+		t.Fatalf("Expected home, got %s (%v)", val, err)
+	}
+	if reopened.seq != 3 {
+		t.Fatalf("Expected sequence number 3, got %d", reopened.seq)
+	}
+
+	// Edge case: a batch naming an unknown column family is rejected
+	b = NewWriteBatch()
+	b.SetCF(&fileDB{name: "missing"}, "k", []byte("v"))
+	if err := reopened.Write(b); err == nil {
+		t.Fatal("Expected an error for an unknown column family")
+	}
+
+	// Edge case: a replayed batch naming an invalid column family creates no directory
+	b = &WriteBatch{ops: []batchOp{{"../outside", "k", value{set, []byte("v"), 0}}}}
+	if err := reopened.applyReplicated(reopened.seq+1, b); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"io"
 )
 
@@ -39,3 +40,39 @@ func decompress(data []byte) ([]byte, error) {
 
 	return decompressedData, nil
 }
+
+// compressSST compresses the content of an SST file written by writeToBuffer block by block, each block being a gzip
+// member, so that the entries of a block can be decompressed without the preceding ones. The file starts with
+// sstBlockMagic and the offset of the sparse index of the blocks, stored after them as another gzip member.
+// Decompressing the blocks one after the other gives the content back.
+// Returns the compressed file and any encountered error.
+func compressSST(content []byte, blocks []sstBlock) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(sstBlockMagic)
+	buf.Write(make([]byte, 8)) // Offset of the index, known once the blocks are written
+
+	// The header, then each block
+	bounds := []int{0}
+	for _, block := range blocks {
+		bounds = append(bounds, block.start)
+	}
+	bounds = append(bounds, len(content))
+	for i := 0; i+1 < len(bounds); i++ {
+		if i > 0 {
+			blocks[i-1].offset = int64(buf.Len())
+		}
+		member, err := compress(content[bounds[i]:bounds[i+1]])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(member)
+	}
+
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint64(data[len(sstBlockMagic):], uint64(len(data)))
+	index, err := compress(sstIndexToBytes(blocks))
+	if err != nil {
+		return nil, err
+	}
+	return append(data, index...), nil
+}
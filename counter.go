@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrOverflow is returned by Increment when the new value of a counter does not fit in a signed 64-bit integer.
+var ErrOverflow = errors.New("Counter overflow")
+
+// ErrNotACounter is returned by Increment when the current value of a key is not a decimal integer.
+var ErrNotACounter = errors.New("Value is not an integer")
+
+// Increment atomically adds by, which may be negative, to the counter stored at key as a decimal string.
+// A missing key starts from initial. The new value keeps the expiry time of the counter, if any,
+// and is logged to the Write-Ahead Log like any other write.
+// Returns the new value, or ErrNotACounter, ErrOverflow or any encountered error.
+func (mem *fileDB) Increment(key string, by int64, initial int64) (int64, error) {
+	return mem.IncrementContext(context.Background(), key, by, initial)
+}
+
+// IncrementContext is like Increment, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) IncrementContext(ctx context.Context, key string, by int64, initial int64) (int64, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	current := initial
+	entry, found, err := mem.resolveAt(ctx, key, mem.seq)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		if current, err = strconv.ParseInt(string(entry.val), 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrNotACounter, key)
+		}
+	}
+
+	next, ok := addInt64(current, by)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrOverflow, key)
+	}
+	// The counter keeps its expiry time, if any
+	b := WriteBatch{ops: []batchOp{{"", key, value{set, []byte(strconv.FormatInt(next, 10)), entry.expiry}}}}
+	if err := mem.write(ctx, &b); err != nil {
+		return 0, err
+	}
+	return next, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestIncrementConcurrent(t *testing.T) {
+	db := newTestDB(t)
+
+	// Concurrent increments are never lost, across flushes and compactions
+	const workers, increments = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				if _, err := db.Increment("hits", 1, 0); err != nil {
+					t.Errorf("Error incrementing: %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, err := db.Get("hits"); err != nil || string(val) != strconv.Itoa(workers*increments) {
+		t.Fatalf("Expected %d hits, got %s (%v)", workers*increments, val, err)
+	}
+
+	// A missing key starts from the initial value
+	if n, err := db.Increment("fresh", -3, 10); err != nil || n != 7 {
+		t.Fatalf("Expected 7, got %d (%v)", n, err)
+	}
+
+	// Edge cases: overflow and non-integer values are rejected and leave the value untouched
+	if _, err := db.Increment("fresh", math.MaxInt64, 0); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("Expected ErrOverflow, got %v", err)
+	}
+	if val, _ := db.Get("fresh"); string(val) != "7" {
+		t.Fatalf("Expected 7, got %s", val)
+	}
+	db.Set("text", []byte("abc"))
+	if _, err := db.Increment("text", 1, 0); !errors.Is(err, ErrNotACounter) {
+		t.Fatalf("Expected ErrNotACounter, got %v", err)
+	}
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -12,131 +10,165 @@ import (
 	"github.com/emirpasic/gods/maps/treemap"
 )
 
-// flush writes the Memtable content to an SST file on disk, clears the Memtable,
-// removes the Write-Ahead Log, and triggers compaction if the SST file count exceeds compactingSize.
+// flush writes the Memtable content of every column family to an SST file on disk, clears the Memtables,
+// moves the Write-Ahead Log they share to the WAL archive, and triggers compaction if needed.
+// All the column families are flushed together, since the Write-Ahead Log can only be removed once none of its
+// entries is left in a Memtable. Empty Memtables are skipped.
 // Returns any encountered error during the process.
 func (mem *fileDB) flush() error {
-	buffer := writeToBuffer(mem.values, true)
-	compressedData, _ := compress(buffer.Bytes()) // Compress the buffer
-	// Create the SST file
-	sstFileName := fmt.Sprintf(sstFileName, strconv.FormatInt(time.Now().UnixNano(), 10))
-	sstFile, err := os.Create(sstFileName)
-	if err != nil {
-		return err
-	}
-	// Write the entire buffer to the file in a single operation
-	if _, err := sstFile.Write(compressedData); err != nil {
-		return err
+	for _, family := range mem.families {
+		if family.memSize() == 0 {
+			continue
+		}
+		buffer, blocks := writeToBuffer(family.values, family.rangeDels)
+		compressedData, _ := compressSST(buffer.Bytes(), blocks) // Compress the buffer
+		// Create the SST file
+		sstFile, err := os.Create(family.newSSTFileName())
+		if err != nil {
+			return err
+		}
+		// Write the entire buffer to the file in a single operation
+		if _, err := sstFile.Write(compressedData); err != nil {
+			return err
+		}
+		sstFile.Close()
 	}
-	sstFile.Close()
-	// If the program crashes while writing to the SST file, the WAL won't be deleted
+	// If the program crashes while writing to the SST file, the WAL won't be archived
 	// When starting the program, the first thing to check is the existence of the WAL
 	// If it exists, we call recoverWAL()
 	mem.wal.Close()
-	if err := os.Remove(walFileName); err != nil {
+	if err := mem.archiveWAL(mem.seq); err != nil {
 		return nil
 	}
 
-	// Clear the MemTable
-	mem.values.Clear()
+	// Clear the MemTables
+	for _, family := range mem.families {
+		family.values.Clear()
+		family.rangeDels = nil
+	}
 
 	// Check if SST files need to be compacted
-	pattern := "db_*.sst"
-	matchingFiles, err := filepath.Glob(pattern)
+	for _, family := range mem.families {
+		if err := family.maybeCompact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the Memtables of all the column families to disk and closes the Write-Ahead Log.
+// Every later operation on the database, through any column family, fails with ErrClosed.
+// Closing a database twice has no effect.
+// Returns any encountered error while flushing.
+func (mem *fileDB) Close() error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if mem.closed {
+		return nil
+	}
+	mem.closed = true
+	mem.feed.closeAll(ErrClosed)
+	if mem.follower != nil {
+		mem.follower.cancel()
+	}
+	err := mem.flush()
+	mem.wal.Close()
+	return err
+}
+
+// newSSTFileName returns the name of a new SST file of the column family.
+func (mem *fileDB) newSSTFileName() string {
+	return filepath.Join(mem.dir, fmt.Sprintf(sstFileName, strconv.FormatInt(time.Now().UnixNano(), 10)))
+}
+
+// maybeCompact triggers compaction if the SST file count of the column family exceeds its compacting size.
+// The versions still visible to live snapshots are preserved by the compaction.
+// Returns any encountered error during the process.
+func (mem *fileDB) maybeCompact() error {
+	matchingFiles, err := mem.sstFiles()
 	if err != nil {
 		return err
 	}
-	if len(matchingFiles) >= compactingSize {
-		if err := compact(matchingFiles); err != nil {
+	if len(matchingFiles) >= mem.compactingSize {
+		if err := compact(matchingFiles, mem.newSSTFileName(), mem.snapshotSeqs(), mem.mergeOperator); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// compact merges multiple SST files into one, removing duplicates and deleted keys.
-// It reads each SST file, builds a new treemap, and writes the compacted data to a new SST file.
+// snapshotSeqs returns the sequence numbers pinned by the live snapshots. The caller must hold mem.mu.
+func (mem *fileDB) snapshotSeqs() []uint64 {
+	seqs := make([]uint64, 0, len(mem.snapshots))
+	for snap := range mem.snapshots {
+		seqs = append(seqs, snap.seq)
+	}
+	return seqs
+}
+
+// compact merges multiple SST files into one, removing the versions that can no longer be read.
+// It reads each SST file, builds a new treemap, and writes the compacted data to a new SST file called output.
+// For each key, the newest version is kept, as well as the newest version visible to each snapshot in snapshots.
+// Merge operands are combined by op, expired values are deleted, and deletions are dropped once no older version
+// of their key is kept. Range tombstones are turned into deletions of the keys they cover, then dropped: every older
+// version is in the compacted files.
 // Returns any encountered error during the compaction process.
-func compact(matchingFiles []string) error {
+func compact(matchingFiles []string, output string, snapshots []uint64, op MergeOperator) error {
 	// Since insertion in a sorted key-value treemap is in O(log(n)), the complexity of this compaction is O(nlog(n))
 
 	// Create a new temporary map
-	tmp := treemap.NewWithStringComparator()
+	tmp := treemap.NewWith(internalKeyComparator)
+	var rangeDels []kvEntry
+	now := time.Now().UnixNano()
 
 	// Iterate through the SST files from the oldest SST to the newest one
 	for i := 0; i < len(matchingFiles); i++ {
-		file := matchingFiles[i]
-		fileContent, err := os.ReadFile(file)
+		table, err := readSST(matchingFiles[i])
 		if err != nil {
 			fmt.Println("Error in reading file")
 			return err
 		}
 
-		// Decompress the file content
-		fileContent, _ = decompress(fileContent)
-
-		position := 0
-		// Check the magic number
-		retrievedMag := binary.LittleEndian.Uint32(fileContent[position : position+4])
-		position += 4
-		if retrievedMag != magicNumber {
-			fmt.Println("This file should not be considered")
-			continue // Move to the next file
-		}
-
-		// Check the checksum
-		checksum := calculateChecksum(fileContent[0 : len(fileContent)-4])
-		retrievedChecksum := fileContent[len(fileContent)-4:]
-
-		if !bytes.Equal(checksum, retrievedChecksum) {
-			fmt.Println("This was was corrupted")
-			continue // Corrupted file
-		}
-
-		entryCount := binary.LittleEndian.Uint32(fileContent[position : position+4])
-		position += 4
-		sKeyLength := binary.LittleEndian.Uint32(fileContent[position : position+4])
-		position += 4 + int(sKeyLength) // Skip the smallest key
-		lKeyLength := binary.LittleEndian.Uint32(fileContent[position : position+4])
-		position += 4 + int(lKeyLength) // Skip the largest key
-
-		// Check the checksum
-		retrievedVersion := binary.LittleEndian.Uint16(fileContent[position : position+2])
-		position += 2
-		if retrievedVersion != version {
-			fmt.Println("This file is of an old version")
-			continue // Old version
+		// Gather every version in the temporary map, expired values becoming deletions
+		for _, entry := range table.entries {
+			if entry.expired(now) {
+				entry.value = value{del, nil, 0}
+			}
+			tmp.Put(entry.internalKey, entry.value)
 		}
+		rangeDels = append(rangeDels, table.rangeDels...)
+	}
 
-		// Simulate the execution of the SST file in the temporary map
-		for i := 0; i < int(entryCount); i++ {
-
-			flag, keyBytes, valueBytes := entryToKv(fileContent, &position)
-
-			if flag == del {
-				tmp.Remove(string(keyBytes))
-			} else {
-				tmp.Put(string(keyBytes), value{
-					set,
-					valueBytes,
-				})
+	// Keep the versions that are still visible, key by key
+	compacted := treemap.NewWith(internalKeyComparator)
+	var versions []kvEntry
+	iterator := tmp.Iterator()
+	for iterator.Next() {
+		entry := kvEntry{iterator.Key().(internalKey), iterator.Value().(value)}
+		if len(versions) > 0 && versions[0].key != entry.key {
+			if err := keepVisibleVersions(compacted, withRangeDels(versions, rangeDels), snapshots, op); err != nil {
+				return err
 			}
-
+			versions = versions[:0]
 		}
+		versions = append(versions, entry)
+	}
+	if err := keepVisibleVersions(compacted, withRangeDels(versions, rangeDels), snapshots, op); err != nil {
+		return err
 	}
 
-	// Write the temporary map to the buffer
-	buffer := writeToBuffer(tmp, false)
+	// Write the compacted map to the buffer
+	buffer, blocks := writeToBuffer(compacted, nil)
 
 	// Create a new compacted SST file
-	sstFileName := fmt.Sprintf(sstFileName, strconv.FormatInt(time.Now().UnixNano(), 10))
-	sstFile, err := os.Create(sstFileName)
+	sstFile, err := os.Create(output)
 	if err != nil {
 		fmt.Println("Error in creating SST file")
 		return err
 	}
 	// Compress the buffer
-	compressedData, _ := compress(buffer.Bytes())
+	compressedData, _ := compressSST(buffer.Bytes(), blocks)
 	// Write the entire buffer to the file in a single operation
 	if _, err := sstFile.Write(compressedData); err != nil {
 		return err
@@ -152,3 +184,68 @@ func compact(matchingFiles []string) error {
 
 	return nil
 }
+
+// keepVisibleVersions puts the versions of a key selected by visibleVersions into the compacted treemap.
+// Returns any encountered error while merging.
+func keepVisibleVersions(compacted *treemap.Map, versions []kvEntry, snapshots []uint64, op MergeOperator) error {
+	kept, err := visibleVersions(versions, snapshots, op)
+	if err != nil {
+		return err
+	}
+	for _, v := range kept {
+		compacted.Put(v.internalKey, v.value)
+	}
+	return nil
+}
+
+// visibleVersions selects, among the versions of a key sorted from the newest to the oldest one,
+// the newest version and the newest version visible to each snapshot.
+// Selected merge operands are combined with the older versions into a single value by op. Without op,
+// they are kept along with the older versions they apply to.
+// Deletions at the bottom of the selection are dropped, since reading nothing has the same effect.
+// Returns the selected versions, from the newest to the oldest one, and any encountered error while merging.
+func visibleVersions(versions []kvEntry, snapshots []uint64, op MergeOperator) ([]kvEntry, error) {
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	keep := make([]bool, len(versions))
+	keep[0] = true
+	for _, seq := range snapshots {
+		for i, v := range versions {
+			if v.seq <= seq {
+				keep[i] = true
+				break
+			}
+		}
+	}
+
+	var kept []kvEntry
+	for i := 0; i < len(versions); i++ {
+		if !keep[i] {
+			continue
+		}
+		v := versions[i]
+		if v.flag == merge {
+			if op == nil {
+				// Keep the operands and the value they apply to
+				for ; i+1 < len(versions) && versions[i].flag == merge; i++ {
+					kept = append(kept, versions[i])
+				}
+				v = versions[i]
+			} else {
+				merged, found, err := mergeVersions(op, versions[i:], 0)
+				if err != nil {
+					return nil, err
+				}
+				if found {
+					v = merged
+				}
+			}
+		}
+		kept = append(kept, v)
+	}
+	for len(kept) > 0 && kept[len(kept)-1].flag == del {
+		kept = kept[:len(kept)-1]
+	}
+	return kept, nil
+}
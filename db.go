@@ -1,48 +1,189 @@
 package main
 
 import (
+	"context"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/emirpasic/gods/maps/treemap"
 )
 
-// value represents a key-value pair with a flag indicating the operation type (set or del).
+// value represents a key-value pair with a flag indicating the operation type (set, del, merge or rangeDel).
+// A set may carry an absolute expiry time, in Unix nanoseconds, after which the key reads as not found.
 type value struct {
-	flag byte
-	val  []byte
+	flag   byte
+	val    []byte
+	expiry int64 // 0 if the value never expires
+}
+
+// expired reports whether the value has an expiry time that has passed at now, in Unix nanoseconds.
+func (v value) expired(now int64) bool {
+	return v.expiry != 0 && v.expiry <= now
+}
+
+// internalKey identifies a version of a key by the sequence number of the write that produced it.
+// Internal keys are sorted by key, then from the newest version to the oldest one.
+type internalKey struct {
+	key string
+	seq uint64
+}
+
+// compareInternalKeys compares two internal keys.
+// Returns a negative number if a sorts before b, a positive number if it sorts after b, and 0 if they are equal.
+func compareInternalKeys(a, b internalKey) int {
+	switch {
+	case a.key < b.key:
+		return -1
+	case a.key > b.key:
+		return 1
+	case a.seq > b.seq:
+		return -1
+	case a.seq < b.seq:
+		return 1
+	}
+	return 0
+}
+
+// internalKeyComparator is the TreeMap comparator of the Memtable, whose keys are internal keys.
+func internalKeyComparator(a, b interface{}) int {
+	return compareInternalKeys(a.(internalKey), b.(internalKey))
 }
 
 // DB is an interface that defines basic operations for a key-value store.
+// The Context variants give up with the error of their context once it is done.
 type DB interface {
 	Set(key string, value []byte) error
 
 	Get(key string) ([]byte, error)
 
 	Del(key string) ([]byte, error)
+
+	SetContext(ctx context.Context, key string, value []byte) error
+
+	GetContext(ctx context.Context, key string) ([]byte, error)
+
+	DelContext(ctx context.Context, key string) ([]byte, error)
+}
+
+// dbCore is the state shared by all the column families of a database.
+type dbCore struct {
+	mu        sync.RWMutex           // Guards the Memtables and the SST files: writers lock exclusively, readers share it
+	wal       *os.File               // Write-Ahead Log shared by all the column families
+	seq       uint64                 // Sequence number of the last write, in any column family
+	snapshots map[*Snapshot]struct{} // Live snapshots
+	walPins   map[string]uint64      // Sequence numbers whose later changes are owed to a webhook, by webhook id
+	families  map[string]*fileDB     // Column families, by name
+	feed      *changeFeed            // Watchers of the committed writes
+	dir       string                 // Directory of the database files, empty for the working directory
+	follower  *follower              // Replication from a primary, set while the database is a read-only follower
+	raft      *raftNode              // Node of a Raft cluster, set while the writes go through its log
+	closed    bool
+}
+
+// path returns the path of a file or directory of the database, given relative to its directory.
+func (core *dbCore) path(name string) string {
+	return filepath.Join(core.dir, name)
 }
 
 // fileDB is a key-value store that uses a TreeMap for in-memory storage and
 // maintains a Write-Ahead Log (WAL) file for durability.
+// Every write is stamped with a sequence number, and the Memtable and SST files keep one entry per version.
+// A fileDB is a column family of the database: an independent keyspace with its own Memtable, SST files and settings.
+// All the column families of a database share a dbCore, and so the Write-Ahead Log and the sequence numbers.
 type fileDB struct {
-	values *treemap.Map
-	wal    *os.File
+	*dbCore
+	name      string // Name of the column family
+	dir       string // Directory of the SST files, empty for the working directory
+	values    *treemap.Map
+	rangeDels []kvEntry // Range tombstones of the Memtable, kept apart from the point entries
+
+	mergeOperator  MergeOperator
+	memLimit       int // Number of Memtable entries triggering a flush
+	compactingSize int // Number of SST files triggering a compaction
 }
 
-// newDB creates a new fileDB instance with an empty Memtable and an open Write-Ahead Log file.
+// Options configures a fileDB or a column family.
+type Options struct {
+	// MergeOperator combines the operands written by Merge. Reading a key with merge operands requires it.
+	MergeOperator MergeOperator
+
+	// MemLimit is the number of Memtable entries triggering a flush. Defaults to memLimit.
+	MemLimit int
+
+	// CompactingSize is the number of SST files triggering a compaction. Defaults to compactingSize.
+	CompactingSize int
+}
+
+// newDB creates a new fileDB instance with the default options.
 // Returns the initialized fileDB and any encountered error.
 func newDB() (*fileDB, error) {
-	// Create a TreeMap with a string comparator for in-memory storage
-	values := treemap.NewWithStringComparator()
+	return newDBWithOptions(Options{})
+}
 
+// newDBWithOptions creates a new fileDB instance in the working directory, like openDB.
+func newDBWithOptions(opts Options) (*fileDB, error) {
+	return openDB("", opts)
+}
+
+// openDB creates a new fileDB instance storing its files in dir, or in the working directory if dir is empty,
+// with an empty Memtable and an open Write-Ahead Log file.
+// opts configures the default column family; the other column families found on disk are opened with the default options.
+// The sequence number resumes from the largest one found in the SST files.
+// Returns the initialized fileDB, which is the default column family, and any encountered error.
+func openDB(dir string, opts Options) (*fileDB, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
 	// Create the WAL file in append-only mode if it does not exist
-	wal, err := os.OpenFile(walFileName, os.O_APPEND|os.O_CREATE, 0755)
+	wal, err := openWAL(filepath.Join(dir, walFileName))
 	if err != nil {
 		return nil, err
 	}
 
-	// Return the initialized fileDB instance
-	return &fileDB{
-		values: values,
-		wal:    wal,
-	}, nil
+	core := &dbCore{
+		wal:       wal,
+		snapshots: make(map[*Snapshot]struct{}),
+		walPins:   make(map[string]uint64),
+		families:  make(map[string]*fileDB),
+		feed:      newChangeFeed(),
+		dir:       dir,
+	}
+	db := newColumnFamily(core, defaultColumnFamily, dir, opts)
+
+	// Open the column families created before
+	dirs, err := filepath.Glob(core.path(columnFamilyDirPrefix + "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			newColumnFamily(core, strings.TrimPrefix(filepath.Base(dir), columnFamilyDirPrefix), dir, Options{})
+		}
+	}
+
+	// Resume the sequence numbers after the last flushed write
+	for _, family := range core.families {
+		matchingFiles, err := family.sstFiles()
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range matchingFiles {
+			table, err := readSST(file)
+			if err != nil {
+				return nil, err
+			}
+			core.seq = max(core.seq, table.maxSeq)
+		}
+	}
+	return db, nil
+}
+
+// sstFiles returns the names of the SST files of the column family, sorted from the oldest to the newest one.
+func (mem *fileDB) sstFiles() ([]string, error) {
+	pattern := filepath.Join(mem.dir, "db_*.sst")
+	return filepath.Glob(pattern) // Glob() returns a sorted []string.
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+)
+
+// Errors returned by the database, to be tested with errors.Is: they are usually wrapped with more context.
+var (
+	// ErrNotFound is returned when reading a key that does not exist, was deleted or expired.
+	ErrNotFound = errors.New("Key not found")
+
+	// ErrCorruption is returned when data read from the disk fails its checksum or cannot be decoded.
+	ErrCorruption = errors.New("Corrupted data")
+
+	// ErrClosed is returned when using a database after Close.
+	ErrClosed = errors.New("Database closed")
+
+	// ErrTooLarge is returned when writing a key longer than maxKeySize or a value longer than maxValueSize.
+	ErrTooLarge = errors.New("Key or value too large")
+
+	// ErrInvalidArgument is returned when an operation is called with invalid parameters.
+	ErrInvalidArgument = errors.New("Invalid argument")
+
+	// ErrNotSupported is returned when an operation is not available in the mode the server runs in.
+	ErrNotSupported = errors.New("Not supported")
+)
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSentinelErrors(t *testing.T) {
+	db := newTestDB(t)
+
+	if _, err := db.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.Del("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	if err := db.Set("big", make([]byte, maxValueSize+1)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Expected ErrTooLarge, got %v", err)
+	}
+	if err := db.DeleteRange("b", "a"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Expected ErrInvalidArgument, got %v", err)
+	}
+
+	if err := db.Set("key", []byte("value")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Error closing the DB: %s", err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+	if err := db.Set("key", []byte("value")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+	// Edge case: closing twice is harmless
+	if err := db.Close(); err != nil {
+		t.Fatalf("Error closing the DB again: %s", err)
+	}
+}
+
+func TestCorruptedSST(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < memLimit; i++ {
+		if err := db.Set(strings.Repeat("k", i+1), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	files, err := filepath.Glob("db_*.sst")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one SST file, got %v (%v)", files, err)
+	}
+	if err := os.WriteFile(files[0], []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("k"); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
+	}
+}
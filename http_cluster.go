@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// raftPath is the endpoint receiving the messages of the other nodes of a cluster.
+const raftPath = "/raft"
+
+// httpRaftTransport sends the messages of a node to the other nodes of its cluster over HTTP: the id of each
+// node is the base URL of its server, and messages are POSTed as JSON to raftPath.
+type httpRaftTransport struct {
+	client *http.Client
+}
+
+// newHTTPRaftTransport creates an httpRaftTransport. The calls are bounded by the context of each message.
+func newHTTPRaftTransport() *httpRaftTransport {
+	return &httpRaftTransport{client: &http.Client{}}
+}
+
+// call POSTs msg to the node to and decodes its response.
+// Returns the response and any encountered error.
+func (t *httpRaftTransport) call(ctx context.Context, to string, msg *raftMessage) (*raftMessage, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(to, "/")+raftPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Node %s answered %s", to, resp.Status)
+	}
+	var reply raftMessage
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// handleCluster returns an http.HandlerFunc serving a node of a Raft cluster. "/raft" receives the messages of the
+// other nodes; "/set", "/del", "/batch", "/delrange" and the PUT and DELETE requests of "/v2/keys/{key}" write
+// through the Raft log, and "/get", "/mget", "/scan", "/ttl" and the GET requests of "/v2/keys/{key}" read once
+// the node applied it, with the formats and the cf parameter of the endpoints of a single database; conditional
+// writes fail with ErrInvalidArgument. "/incr", "/decr", the "/txn/" endpoints and the creation of column families
+// fail with ErrNotSupported, as they would need to read and write atomically through the log. "/cluster/status"
+// describes the node and "/cluster/members" changes the membership. The other endpoints are served by handler on
+// the database of the node, which rejects writes.
+// Requests reaching a node that is not the leader fail with 421 Misdirected Request, the X-GoDB-Leader header
+// naming the leader when it is known.
+func handleCluster(node *raftNode, handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, keysV2Prefix) {
+			handleClusterKeyV2(resp, req, node, handler)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/txn/") {
+			writeError(resp, fmt.Errorf("%w: transactions are not supported by a cluster", ErrNotSupported))
+			return
+		}
+		switch req.URL.Path {
+		case raftPath:
+			handleRaftMessage(resp, req, node)
+		case "/get", "/mget", "/scan", "/ttl":
+			handleClusterRead(resp, req, node, handler)
+		case "/set":
+			handleClusterSet(resp, req, node)
+		case "/del":
+			handleClusterDelete(resp, req, node)
+		case "/batch":
+			handleClusterBatch(resp, req, node)
+		case "/delrange":
+			handleClusterDeleteRange(resp, req, node)
+		case "/incr", "/decr":
+			writeError(resp, fmt.Errorf("%w: counters are not supported by a cluster", ErrNotSupported))
+		case "/cf":
+			if req.Method == http.MethodPost {
+				writeError(resp, fmt.Errorf("%w: column families cannot be created in a cluster", ErrNotSupported))
+				return
+			}
+			handler(resp, req)
+		case "/cluster/status":
+			resp.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(resp).Encode(node.Status())
+		case "/cluster/members":
+			handleClusterMembers(resp, req, node)
+		default:
+			handler(resp, req)
+		}
+	}
+}
+
+// writeClusterError writes the error response of err, naming the leader in the X-GoDB-Leader header when the
+// node is not the leader.
+func writeClusterError(resp http.ResponseWriter, node *raftNode, err error) {
+	if errors.Is(err, ErrNotLeader) {
+		if leader := node.Leader(); leader != "" {
+			resp.Header().Set("X-GoDB-Leader", leader)
+		}
+	}
+	writeError(resp, err)
+}
+
+// handleRaftMessage is an HTTP handler function for the "/raft" endpoint.
+// Decodes a message of another node, handles it and writes the response as JSON.
+func handleRaftMessage(resp http.ResponseWriter, req *http.Request, node *raftNode) {
+	if req.Method != http.MethodPost {
+		httpError(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var msg raftMessage
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		httpError(resp, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	reply, err := node.handle(req.Context(), &msg)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(reply)
+}
+
+// handleClusterRead serves a read with handler once the node applied every write committed before the request,
+// so that the read sees every write acknowledged before it.
+func handleClusterRead(resp http.ResponseWriter, req *http.Request, node *raftNode, handler http.HandlerFunc) {
+	ctx, cancel := context.WithTimeout(req.Context(), node.opts.proposalTimeout)
+	defer cancel()
+	if err := node.ReadBarrier(ctx); err != nil {
+		writeClusterError(resp, node, err)
+		return
+	}
+	handler(resp, req)
+}
+
+// clusterFamily returns the column family named by the cf parameter of a request, or the database of the node
+// without it. Writes an error response and returns nil if the column family does not exist.
+func clusterFamily(resp http.ResponseWriter, req *http.Request, node *raftNode) *fileDB {
+	name := req.URL.Query().Get("cf")
+	if name == "" {
+		return node.db
+	}
+	family := node.db.ColumnFamily(name)
+	if family == nil {
+		writeError(resp, fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, name))
+	}
+	return family
+}
+
+// rejectConditionalWrite writes an error response and returns true if a write request has an If-Match or an
+// If-None-Match header: the condition would be checked against the versions of a single node.
+func rejectConditionalWrite(resp http.ResponseWriter, req *http.Request) bool {
+	if req.Header.Get("If-Match") == "" && req.Header.Get("If-None-Match") == "" {
+		return false
+	}
+	writeError(resp, fmt.Errorf("%w: conditional writes are not supported by a cluster", ErrInvalidArgument))
+	return true
+}
+
+// handleClusterSet is an HTTP handler function for the "/set" endpoint of a cluster.
+// Parses JSON input and writes the key-value pair through the Raft log.
+func handleClusterSet(resp http.ResponseWriter, req *http.Request, node *raftNode) {
+	family := clusterFamily(resp, req, node)
+	if family == nil || rejectConditionalWrite(resp, req) {
+		return
+	}
+	key, v, ok := decodeSetRequest(resp, req)
+	if !ok {
+		return
+	}
+
+	b := WriteBatch{ops: []batchOp{{family.name, key, v}}}
+	if err := node.WriteContext(req.Context(), &b); err != nil {
+		writeClusterError(resp, node, fmt.Errorf("Error setting key: %w", err))
+		return
+	}
+	resp.Write([]byte("Key set successfully"))
+}
+
+// handleClusterDelete is an HTTP handler function for the "/del" endpoint of a cluster.
+// Deletes a key through the Raft log and writes the deleted value to the response.
+func handleClusterDelete(resp http.ResponseWriter, req *http.Request, node *raftNode) {
+	family := clusterFamily(resp, req, node)
+	if family == nil || rejectConditionalWrite(resp, req) {
+		return
+	}
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		httpError(resp, "Key parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	b := WriteBatch{}
+	b.DelCF(family, key)
+	r := node.proposeBatch(req.Context(), &b)
+	if r.err != nil {
+		writeClusterError(resp, node, r.err)
+		return
+	}
+	resp.Write([]byte(fmt.Sprintf("Key deleted successfully. Value: %s", r.prev)))
+}
+
+// handleClusterBatch is an HTTP handler function for the "/batch" endpoint of a cluster.
+// Decodes a batch like the "/batch" endpoint of a single database and applies it atomically through the Raft log.
+func handleClusterBatch(resp http.ResponseWriter, req *http.Request, node *raftNode) {
+	family := clusterFamily(resp, req, node)
+	if family == nil {
+		return
+	}
+	b, ok := decodeBatchRequest(resp, req, family)
+	if !ok {
+		return
+	}
+
+	if err := node.WriteContext(req.Context(), b); err != nil {
+		writeClusterError(resp, node, fmt.Errorf("Error applying batch: %w", err))
+		return
+	}
+	resp.Write([]byte(fmt.Sprintf("Batch of %d operations applied successfully", b.Len())))
+}
+
+// handleClusterDeleteRange is an HTTP handler function for the "/delrange" endpoint of a cluster.
+// Deletes the keys from start, included, to end, excluded, with a range tombstone written through the Raft log.
+func handleClusterDeleteRange(resp http.ResponseWriter, req *http.Request, node *raftNode) {
+	family := clusterFamily(resp, req, node)
+	if family == nil {
+		return
+	}
+	start, end, ok := decodeRangeRequest(resp, req)
+	if !ok {
+		return
+	}
+
+	b := WriteBatch{ops: []batchOp{{family.name, start, value{rangeDel, []byte(end), 0}}}}
+	if err := node.WriteContext(req.Context(), &b); err != nil {
+		writeClusterError(resp, node, fmt.Errorf("Error deleting range: %w", err))
+		return
+	}
+	resp.Write([]byte("Range deleted successfully"))
+}
+
+// handleClusterKeyV2 is an HTTP handler function for the "/v2/keys/{key}" endpoint of a cluster.
+// GET and HEAD requests are served by handler once the node applied the log; PUT and DELETE requests write
+// through the Raft log with the responses of a single database, the ETag header holding the version of the key
+// on the node.
+func handleClusterKeyV2(resp http.ResponseWriter, req *http.Request, node *raftNode, handler http.HandlerFunc) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		handleClusterRead(resp, req, node, handler)
+		return
+	case http.MethodPut, http.MethodDelete:
+	default:
+		handler(resp, req)
+		return
+	}
+	family := clusterFamily(resp, req, node)
+	if family == nil || rejectConditionalWrite(resp, req) {
+		return
+	}
+	key, ok := parseKeyV2(resp, req)
+	if !ok {
+		return
+	}
+
+	if req.Method == http.MethodDelete {
+		b := WriteBatch{}
+		b.DelCF(family, key)
+		if r := node.proposeBatch(req.Context(), &b); r.err != nil {
+			writeClusterError(resp, node, fmt.Errorf("Error deleting key: %w", r.err))
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+	v, ok := decodePutV2(resp, req)
+	if !ok {
+		return
+	}
+	b := WriteBatch{ops: []batchOp{{family.name, key, v}}}
+	r := node.proposeBatch(req.Context(), &b)
+	if r.err != nil {
+		writeClusterError(resp, node, fmt.Errorf("Error setting key: %w", r.err))
+		return
+	}
+	writePutV2(resp, key, r.version, r.existed)
+}
+
+// handleClusterMembers is an HTTP handler function for the "/cluster/members" endpoint.
+// A GET request writes the members as a JSON array; a POST request adds the node given by the id parameter and
+// a DELETE request removes it, on the leader.
+func handleClusterMembers(resp http.ResponseWriter, req *http.Request, node *raftNode) {
+	if req.Method == http.MethodGet {
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(node.Status().Members)
+		return
+	}
+
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		httpError(resp, "Id parameter is missing", http.StatusBadRequest)
+		return
+	}
+	var err error
+	switch req.Method {
+	case http.MethodPost:
+		err = node.AddMember(req.Context(), id)
+	case http.MethodDelete:
+		err = node.RemoveMember(req.Context(), id)
+	default:
+		httpError(resp, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeClusterError(resp, node, err)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(node.Status().Members)
+}
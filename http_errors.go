@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// statusClientClosedRequest is the non-standard status of the requests whose client went away before the response.
+const statusClientClosedRequest = 499
+
+// errorResponse is the JSON body of the error responses: {"error": {"code": "not_found", "message": "..."}}.
+// Codes are stable and meant for programs, messages are meant for humans and may change.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+// errorBody describes an error in an errorResponse.
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorStatuses maps the errors of the database to the HTTP status and the code of their responses.
+// The first error matching with errors.Is wins.
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrNotFound, http.StatusNotFound, "not_found"},
+	{ErrColumnFamilyNotFound, http.StatusNotFound, "column_family_not_found"},
+	{ErrInvalidArgument, http.StatusBadRequest, "invalid_argument"},
+	{ErrTooLarge, http.StatusRequestEntityTooLarge, "too_large"},
+	{ErrConditionFailed, http.StatusPreconditionFailed, "condition_failed"},
+	{ErrTxnConflict, http.StatusConflict, "txn_conflict"},
+	{ErrTxnDone, http.StatusConflict, "txn_done"},
+	{ErrOverflow, http.StatusConflict, "overflow"},
+	{ErrNotACounter, http.StatusConflict, "not_a_counter"},
+	{ErrColumnFamilyExists, http.StatusConflict, "column_family_exists"},
+	{ErrReadOnly, http.StatusForbidden, "read_only"},
+	{ErrNotLeader, http.StatusMisdirectedRequest, "not_leader"},
+	{ErrNotSupported, http.StatusNotImplemented, "not_supported"},
+	{ErrTrimmed, http.StatusGone, "trimmed"},
+	{ErrLagging, http.StatusServiceUnavailable, "lagging"},
+	{ErrClosed, http.StatusServiceUnavailable, "closed"},
+	{ErrCorruption, http.StatusInternalServerError, "corruption"},
+	{context.DeadlineExceeded, http.StatusGatewayTimeout, "timeout"},
+	{context.Canceled, statusClientClosedRequest, "canceled"},
+}
+
+// statusCodes gives the code of the errors detected by the HTTP layer itself, such as invalid parameters, by status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_argument",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "condition_failed",
+	http.StatusRequestEntityTooLarge: "too_large",
+}
+
+// errorStatus returns the status and the code of the first entry of errorStatuses matching err,
+// or 500 Internal Server Error and the "internal" code.
+func errorStatus(err error) (int, string) {
+	for _, e := range errorStatuses {
+		if errors.Is(err, e.err) {
+			return e.status, e.code
+		}
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
+// writeError writes the JSON error response of an error returned by the database, with its errorStatus.
+func writeError(resp http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	writeErrorResponse(resp, status, code, err.Error())
+}
+
+// httpError writes the JSON error response of an error detected by the HTTP layer, with the code of its status.
+func httpError(resp http.ResponseWriter, message string, status int) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = "internal"
+	}
+	writeErrorResponse(resp, status, code, message)
+}
+
+// writeErrorResponse writes a JSON error response.
+func writeErrorResponse(resp http.ResponseWriter, status int, code, message string) {
+	resp.Header().Del("Content-Length")
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Header().Set("X-Content-Type-Options", "nosniff")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(errorResponse{errorBody{code, message}})
+}
@@ -1,15 +1,87 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 10000
+	maxMultiGetKeys  = 10000
+
+	defaultRequestTimeout = 30 * time.Second
+	shutdownTimeout       = 5 * time.Second // Longest wait for the requests in progress when the HTTP server stops
+)
+
+// withTimeout returns an http.HandlerFunc running handler with a request context that expires after timeout,
+// so that the database operations of a request give up once it is exceeded. A timeout of 0 sets no limit.
+// The request context is also cancelled when the client goes away. The "/watch" and replication streams, the
+// checkpoints and the messages of the Raft nodes, which set their own timeouts, are not limited.
+func withTimeout(handler http.HandlerFunc, timeout time.Duration) http.HandlerFunc {
+	if timeout <= 0 {
+		return handler
+	}
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/watch" || req.URL.Path == replicationStreamPath || req.URL.Path == replicationCheckpointPath || req.URL.Path == raftPath {
+			handler(resp, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		handler(resp, req.WithContext(ctx))
+	}
+}
+
 // handleFunction returns an http.HandlerFunc that routes requests to specific handler functions based on the URL path.
-// Supported paths include "/get", "/set", and "/del".
-func handleFunction(db *fileDB) http.HandlerFunc {
+// Supported paths include "/get", "/set", "/del", "/scan", "/mget", "/delrange", "/batch", "/incr", "/decr", "/ttl",
+// "/stats", "/watch", "/cf", the "/txn/", "/webhooks" and "/replication/" endpoints and the "/v2/keys/{key}" REST endpoint.
+// Every endpoint operates on the default column family, or on the one named by the cf parameter.
+// The "/webhooks" endpoints manage the webhooks delivered by hooks; without hooks, they fail with ErrNotSupported.
+func handleFunction(db *fileDB, hooks *webhookManager) http.HandlerFunc {
+	txns := newTxnRegistry()
 	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/cf" {
+			handleColumnFamilies(resp, req, db)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/webhooks") {
+			if hooks == nil {
+				writeError(resp, fmt.Errorf("%w: webhooks are not delivered by this server", ErrNotSupported))
+				return
+			}
+			handleWebhooks(resp, req, hooks)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/replication/") {
+			handleReplication(resp, req, db)
+			return
+		}
+		db := db
+		if name := req.URL.Query().Get("cf"); name != "" {
+			if db = db.ColumnFamily(name); db == nil {
+				writeError(resp, fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, name))
+				return
+			}
+		}
+
+		if strings.HasPrefix(req.URL.Path, keysV2Prefix) {
+			handleKeyV2(resp, req, db)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/txn/") {
+			handleTxn(resp, req, db, txns)
+			return
+		}
 		switch req.URL.Path {
 		case "/get":
 			handleGet(resp, req, db)
@@ -17,73 +89,617 @@ func handleFunction(db *fileDB) http.HandlerFunc {
 			handleSet(resp, req, db)
 		case "/del":
 			handleDelete(resp, req, db)
+		case "/scan":
+			handleScan(resp, req, db)
+		case "/batch":
+			handleBatch(resp, req, db)
+		case "/incr":
+			handleIncrement(resp, req, db, 1)
+		case "/decr":
+			handleIncrement(resp, req, db, -1)
+		case "/mget":
+			handleMultiGet(resp, req, db)
+		case "/delrange":
+			handleDeleteRange(resp, req, db)
+		case "/ttl":
+			handleTTL(resp, req, db)
+		case "/stats":
+			handleStats(resp, req, db)
+		case "/watch":
+			handleWatch(resp, req, db)
 		default:
-			http.Error(resp, "Not Found", http.StatusNotFound)
+			httpError(resp, "Not Found", http.StatusNotFound)
 		}
 	}
 }
 
+// handleColumnFamilies is an HTTP handler function for the "/cf" endpoint.
+// A GET request writes the names of the column families as a JSON array; a POST request creates the column family
+// given by the name parameter, failing with 409 Conflict if it already exists.
+func handleColumnFamilies(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	if req.Method != http.MethodPost {
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(db.ColumnFamilies())
+		return
+	}
+
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		httpError(resp, "Name parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if !validColumnFamilyName(name) {
+		httpError(resp, "Invalid column family name", http.StatusBadRequest)
+		return
+	}
+	if _, err := db.CreateColumnFamily(name, Options{}); err != nil {
+		writeError(resp, fmt.Errorf("Error creating column family: %w", err))
+		return
+	}
+	resp.Write([]byte("Column family created successfully"))
+}
+
 // handleGet is an HTTP handler function for the "/get" endpoint.
-// Retrieves the value for a given key and writes it to the response.
+// Retrieves the value for a given key and writes it to the response, along with its version as the ETag header.
 func handleGet(resp http.ResponseWriter, req *http.Request, db *fileDB) {
 	key := req.URL.Query().Get("key")
 	if key == "" {
-		http.Error(resp, "Key parameter is missing", http.StatusBadRequest)
+		httpError(resp, "Key parameter is missing", http.StatusBadRequest)
 		return
 	}
 
-	value, err := db.Get(key)
+	value, version, err := db.GetVersionContext(req.Context(), key)
 	if err != nil {
-		http.Error(resp, err.Error(), http.StatusNotFound)
+		writeError(resp, err)
 		return
 	}
 
+	resp.Header().Set("ETag", formatETag(version))
 	resp.Write(value)
 }
 
 // handleSet is an HTTP handler function for the "/set" endpoint.
 // Parses JSON input, sets the key-value pair in the Memtable, and writes the result to the response.
+// The write is conditional when the request has an If-Match header (the key must exist, with the given version
+// unless it is "*") or an If-None-Match: * header (the key must not exist). It fails with 412 Precondition Failed
+// when the condition does not hold. The new version is returned as the ETag header.
+// An optional "ttl" field, in seconds or as a Go duration such as "1m30s", makes the key expire.
 func handleSet(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	key, v, ok := decodeSetRequest(resp, req)
+	if !ok {
+		return
+	}
+
+	cond, err := parseWriteCondition(req)
+	if err != nil {
+		httpError(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version, err := db.writeIf(req.Context(), key, v, cond)
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error setting key: %w", err))
+		return
+	}
+
+	resp.Header().Set("ETag", formatETag(version))
+	resp.Write([]byte("Key set successfully"))
+}
+
+// decodeSetRequest decodes the JSON body of a "/set" request: the key, the value and an optional ttl.
+// Returns the key, the value to write and true, or writes an error response and returns false.
+func decodeSetRequest(resp http.ResponseWriter, req *http.Request) (string, value, bool) {
 	var data map[string]string
 	if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
-		http.Error(resp, "Invalid JSON format", http.StatusBadRequest)
-		return
+		httpError(resp, "Invalid JSON format", http.StatusBadRequest)
+		return "", value{}, false
 	}
 
 	key, ok := data["key"]
 	if !ok || key == "" {
-		http.Error(resp, "Key parameter is missing", http.StatusBadRequest)
-		return
+		httpError(resp, "Key parameter is missing", http.StatusBadRequest)
+		return "", value{}, false
 	}
 
-	value, ok := data["value"]
-	if !ok || value == "" {
-		http.Error(resp, "Value parameter is missing", http.StatusBadRequest)
-		return
+	val, ok := data["value"]
+	if !ok || val == "" {
+		httpError(resp, "Value parameter is missing", http.StatusBadRequest)
+		return "", value{}, false
 	}
 
-	if err := db.Set(key, []byte(value)); err != nil {
-		http.Error(resp, fmt.Sprintf("Error setting key: %s", err), http.StatusInternalServerError)
-		return
+	v := value{set, []byte(val), 0}
+	if ttl, ok := data["ttl"]; ok {
+		d, err := parseTTL(ttl)
+		if err != nil {
+			httpError(resp, "Invalid ttl parameter", http.StatusBadRequest)
+			return "", value{}, false
+		}
+		v.expiry = time.Now().Add(d).UnixNano()
 	}
-
-	resp.Write([]byte("Key set successfully"))
+	return key, v, true
 }
 
 // handleDelete is an HTTP handler function for the "/del" endpoint.
 // Deletes a key-value pair and writes the result to the response.
+// With an If-Match header, the key is only deleted if its version matches, otherwise 412 Precondition Failed is returned.
 func handleDelete(resp http.ResponseWriter, req *http.Request, db *fileDB) {
 	key := req.URL.Query().Get("key")
 	if key == "" {
-		http.Error(resp, "Key parameter is missing", http.StatusBadRequest)
+		httpError(resp, "Key parameter is missing", http.StatusBadRequest)
 		return
 	}
 
-	value, err := db.Del(key)
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		expected, ok := parseETag(ifMatch)
+		if !ok {
+			httpError(resp, "Invalid If-Match header", http.StatusBadRequest)
+			return
+		}
+		if err := db.DeleteIfVersionContext(req.Context(), key, expected); err != nil {
+			writeError(resp, fmt.Errorf("Error deleting key: %w", err))
+			return
+		}
+		resp.Write([]byte("Key deleted successfully"))
+		return
+	}
+
+	value, err := db.DelContext(req.Context(), key)
 	if err != nil {
-		http.Error(resp, "Key not found", http.StatusNotFound)
+		writeError(resp, err)
 		return
 	}
 
 	resp.Write([]byte(fmt.Sprintf("Key deleted successfully. Value: %s", value)))
 }
+
+// handleDeleteRange is an HTTP handler function for the "/delrange" endpoint.
+// Deletes all the keys from the start parameter, included, to the end parameter, excluded, with a single range tombstone.
+func handleDeleteRange(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	start, end, ok := decodeRangeRequest(resp, req)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteRangeContext(req.Context(), start, end); err != nil {
+		writeError(resp, fmt.Errorf("Error deleting range: %w", err))
+		return
+	}
+	resp.Write([]byte("Range deleted successfully"))
+}
+
+// decodeRangeRequest reads the start and end parameters of a "/delrange" request.
+// Returns them and true, or writes an error response and returns false.
+func decodeRangeRequest(resp http.ResponseWriter, req *http.Request) (string, string, bool) {
+	query := req.URL.Query()
+	start, end := query.Get("start"), query.Get("end")
+	if start == "" || end == "" {
+		httpError(resp, "Start or end parameter is missing", http.StatusBadRequest)
+		return "", "", false
+	}
+	if start >= end {
+		httpError(resp, "Start must be less than end", http.StatusBadRequest)
+		return "", "", false
+	}
+	return start, end, true
+}
+
+// handleIncrement is an HTTP handler function for the "/incr" and "/decr" endpoints.
+// Atomically adds the by parameter (1 by default) to the counter stored at key, subtracting it when sign is -1.
+// A missing key starts from the initial parameter (0 by default). Writes the new value to the response.
+func handleIncrement(resp http.ResponseWriter, req *http.Request, db *fileDB, sign int64) {
+	query := req.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		httpError(resp, "Key parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	by, initial := int64(1), int64(0)
+	var err error
+	if b := query.Get("by"); b != "" {
+		if by, err = strconv.ParseInt(b, 10, 64); err != nil || by == math.MinInt64 {
+			httpError(resp, "Invalid by parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if i := query.Get("initial"); i != "" {
+		if initial, err = strconv.ParseInt(i, 10, 64); err != nil {
+			httpError(resp, "Invalid initial parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	counter, err := db.IncrementContext(req.Context(), key, sign*by, initial)
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error incrementing key: %w", err))
+		return
+	}
+
+	resp.Write([]byte(strconv.FormatInt(counter, 10)))
+}
+
+// handleStats is an HTTP handler function for the "/stats" endpoint.
+// Writes the state of the database and of its column families as a JSON object.
+func handleStats(resp http.ResponseWriter, _ *http.Request, db *fileDB) {
+	stats, err := db.Stats()
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error getting stats: %w", err))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(stats)
+}
+
+// handleTTL is an HTTP handler function for the "/ttl" endpoint.
+// Writes the remaining lifetime of the key parameter to the response, in seconds rounded up, or -1 if the key
+// never expires.
+func handleTTL(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		httpError(resp, "Key parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	ttl, expires, err := db.TTLContext(req.Context(), key)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+	if !expires {
+		resp.Write([]byte("-1"))
+		return
+	}
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	resp.Write([]byte(strconv.FormatInt(seconds, 10)))
+}
+
+// parseTTL parses a time-to-live given either as a number of seconds or as a Go duration such as "1m30s".
+// Returns the duration, or an error if it is invalid or not positive.
+func parseTTL(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if n, convErr := strconv.ParseInt(s, 10, 64); convErr == nil {
+		if n > math.MaxInt64/int64(time.Second) {
+			return 0, errors.New("TTL too large")
+		}
+		d, err = time.Duration(n)*time.Second, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("TTL must be positive")
+	}
+	return d, nil
+}
+
+// parseWriteCondition builds the condition of a write from the If-Match and If-None-Match headers of a request.
+// If-Match requires the key to exist, with the given version unless it is "*"; If-None-Match: * requires it not to exist.
+// Returns the condition, which always holds without these headers, or an error if a header is invalid.
+func parseWriteCondition(req *http.Request) (writeCondition, error) {
+	ifMatch, ifNoneMatch := req.Header.Get("If-Match"), req.Header.Get("If-None-Match")
+	switch {
+	case ifNoneMatch == "*":
+		return func(_ []byte, _ uint64, exists bool) bool { return !exists }, nil
+	case ifNoneMatch != "":
+		return nil, errors.New("Only If-None-Match: * is supported")
+	case ifMatch == "*":
+		return func(_ []byte, _ uint64, exists bool) bool { return exists }, nil
+	case ifMatch != "":
+		expected, ok := parseETag(ifMatch)
+		if !ok {
+			return nil, errors.New("Invalid If-Match header")
+		}
+		return func(_ []byte, version uint64, exists bool) bool { return exists && version == expected }, nil
+	}
+	return func([]byte, uint64, bool) bool { return true }, nil
+}
+
+// formatETag formats the version of a key as an ETag header value.
+func formatETag(version uint64) string {
+	return strconv.Quote(strconv.FormatUint(version, 10))
+}
+
+// parseETag parses an ETag header value built by formatETag, quoted or not.
+// Returns the version and whether the value is valid.
+func parseETag(etag string) (uint64, bool) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if unquoted, err := strconv.Unquote(etag); err == nil {
+		etag = unquoted
+	}
+	version, err := strconv.ParseUint(etag, 10, 64)
+	return version, err == nil
+}
+
+// multiGetResponse is the JSON response of the "/mget" endpoint.
+type multiGetResponse struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// handleMultiGet is an HTTP handler function for the "/mget" endpoint.
+// Parses a JSON array of keys, looks them all up at once with MultiGet, and writes the values of the keys found
+// along with the list of the missing keys, in the order of the request.
+func handleMultiGet(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	var keys []string
+	if err := json.NewDecoder(req.Body).Decode(&keys); err != nil {
+		httpError(resp, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if len(keys) > maxMultiGetKeys {
+		httpError(resp, fmt.Sprintf("Too many keys, the maximum is %d", maxMultiGetKeys), http.StatusBadRequest)
+		return
+	}
+
+	values, err := db.MultiGetContext(req.Context(), keys)
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error getting keys: %w", err))
+		return
+	}
+
+	res := multiGetResponse{Values: make(map[string]string, len(values)), Missing: []string{}}
+	for _, key := range keys {
+		if val, ok := values[key]; ok {
+			res.Values[key] = string(val)
+		} else {
+			res.Missing = append(res.Missing, key)
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(res)
+}
+
+// batchRequestOp is an operation of the JSON array accepted by the "/batch" endpoint.
+type batchRequestOp struct {
+	Op    string  `json:"op"`
+	Key   string  `json:"key"`
+	Value *string `json:"value"`
+	CF    string  `json:"cf"` // Column family of the operation, the one of the request if empty
+}
+
+// handleBatch is an HTTP handler function for the "/batch" endpoint.
+// Parses a JSON array of operations such as {"op": "set", "key": "k", "value": "v"} or {"op": "del", "key": "k"},
+// and applies them atomically as a single WriteBatch. An operation with a "cf" field applies to that column family,
+// so that a batch can write to several of them atomically.
+func handleBatch(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	b, ok := decodeBatchRequest(resp, req, db)
+	if !ok {
+		return
+	}
+
+	if err := db.WriteContext(req.Context(), b); err != nil {
+		writeError(resp, fmt.Errorf("Error applying batch: %w", err))
+		return
+	}
+
+	resp.Write([]byte(fmt.Sprintf("Batch of %d operations applied successfully", b.Len())))
+}
+
+// decodeBatchRequest decodes the JSON array of operations of a "/batch" request into a WriteBatch, whose
+// operations without a cf apply to db.
+// Returns the batch and true, or writes an error response and returns false.
+func decodeBatchRequest(resp http.ResponseWriter, req *http.Request, db *fileDB) (*WriteBatch, bool) {
+	var ops []batchRequestOp
+	if err := json.NewDecoder(req.Body).Decode(&ops); err != nil {
+		httpError(resp, "Invalid JSON format", http.StatusBadRequest)
+		return nil, false
+	}
+
+	b := NewWriteBatch()
+	for i, op := range ops {
+		if op.Key == "" {
+			httpError(resp, fmt.Sprintf("Key parameter is missing in operation %d", i), http.StatusBadRequest)
+			return nil, false
+		}
+		family := db
+		if op.CF != "" {
+			if family = db.ColumnFamily(op.CF); family == nil {
+				httpError(resp, fmt.Sprintf("Column family not found in operation %d", i), http.StatusBadRequest)
+				return nil, false
+			}
+		}
+		switch op.Op {
+		case "set":
+			if op.Value == nil {
+				httpError(resp, fmt.Sprintf("Value parameter is missing in operation %d", i), http.StatusBadRequest)
+				return nil, false
+			}
+			b.SetCF(family, op.Key, []byte(*op.Value))
+		case "del":
+			b.DelCF(family, op.Key)
+		default:
+			httpError(resp, fmt.Sprintf("Unknown operation %q in operation %d", op.Op, i), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	return b, true
+}
+
+// scanItem is a key-value pair as returned by the "/scan" endpoint.
+type scanItem struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+}
+
+// handleScan is an HTTP handler function for the "/scan" endpoint.
+// Lists the keys in [start, end) or starting with prefix, in ascending order or descending if reverse is set.
+// At most limit items are written, as a JSON object or as newline-delimited JSON when format=ndjson.
+// When more keys remain, a continuation token is returned; passing it back as the cursor parameter resumes the scan.
+// Items are streamed to the response as they are iterated.
+func handleScan(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	query := req.URL.Query()
+	opts := &IterOptions{
+		LowerBound: query.Get("start"),
+		UpperBound: query.Get("end"),
+		Prefix:     query.Get("prefix"),
+	}
+	reverse := query.Get("reverse") == "true"
+	keysOnly := query.Get("keysOnly") == "true"
+	ndjson := query.Get("format") == "ndjson" || strings.Contains(req.Header.Get("Accept"), "application/x-ndjson")
+
+	limit := defaultScanLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			httpError(resp, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxScanLimit)
+	}
+
+	var after string
+	resuming := false
+	if token := query.Get("cursor"); token != "" {
+		cursor, err := decodeScanCursor(token)
+		if err != nil || cursor.reverse != reverse || cursor.start != opts.LowerBound || cursor.end != opts.UpperBound || cursor.prefix != opts.Prefix {
+			httpError(resp, "Invalid cursor parameter", http.StatusBadRequest)
+			return
+		}
+		after, resuming = cursor.after, true
+		// The iterator only needs to see the keys left to return
+		if reverse {
+			opts.UpperBound = after
+		} else {
+			opts.LowerBound = after
+		}
+	}
+
+	it, err := db.NewIteratorContext(req.Context(), opts)
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error scanning keys: %w", err))
+		return
+	}
+	defer it.Close()
+
+	// Position the iterator on the first key to return
+	var ok bool
+	switch {
+	case !resuming && !reverse:
+		ok = it.First()
+	case !resuming && reverse:
+		ok = it.Last()
+	case !reverse:
+		if ok = it.Seek(after); ok && it.Key() == after {
+			ok = it.Next()
+		}
+	default:
+		if ok = it.SeekForPrev(after); ok && it.Key() == after {
+			ok = it.Prev()
+		}
+	}
+
+	if !ok && it.Err() != nil {
+		writeError(resp, fmt.Errorf("Error scanning keys: %w", it.Err()))
+		return
+	}
+
+	if ndjson {
+		resp.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write([]byte(`{"items":[`))
+	}
+	flusher, _ := resp.(http.Flusher)
+	encoder := json.NewEncoder(resp)
+
+	count := 0
+	for ; ok && count < limit; count++ {
+		item := scanItem{Key: it.Key()}
+		if !keysOnly {
+			val := string(it.Value())
+			item.Value = &val
+		}
+		if !ndjson && count > 0 {
+			resp.Write([]byte(","))
+		}
+		encoder.Encode(item)
+		if flusher != nil && count%defaultScanLimit == defaultScanLimit-1 {
+			flusher.Flush()
+		}
+		last := it.Key()
+		if reverse {
+			ok = it.Prev()
+		} else {
+			ok = it.Next()
+		}
+		after = last
+	}
+
+	// The status is already sent: an interrupted scan ends with an error item, or leaves the JSON object unterminated
+	if !ok && it.Err() != nil {
+		if ndjson {
+			_, code := errorStatus(it.Err())
+			encoder.Encode(errorResponse{errorBody{code, fmt.Sprintf("Error scanning keys: %s", it.Err())}})
+		}
+		return
+	}
+
+	// A continuation token is only returned when keys remain
+	next := ""
+	if ok && count > 0 {
+		next = encodeScanCursor(scanCursor{query.Get("start"), query.Get("end"), query.Get("prefix"), reverse, after})
+	}
+	if ndjson {
+		if next != "" {
+			encoder.Encode(map[string]string{"next": next})
+		}
+		return
+	}
+	if next == "" {
+		resp.Write([]byte(`],"next":null}`))
+		return
+	}
+	resp.Write([]byte(`],"next":`))
+	encoder.Encode(next)
+	resp.Write([]byte("}"))
+}
+
+// scanCursor is the position of a scan between two pages, along with the parameters of the scan it belongs to,
+// so that a continuation token cannot resume a scan with other parameters.
+type scanCursor struct {
+	start   string
+	end     string
+	prefix  string
+	reverse bool
+	after   string // Last key returned by the previous page
+}
+
+// encodeScanCursor builds the opaque continuation token of a scan: its direction, then the start, end and prefix
+// parameters and the last key returned, each preceded by its length.
+func encodeScanCursor(cursor scanCursor) string {
+	direction := byte('f')
+	if cursor.reverse {
+		direction = 'r'
+	}
+	raw := []byte{direction}
+	for _, field := range []string{cursor.start, cursor.end, cursor.prefix, cursor.after} {
+		raw = binary.AppendUvarint(raw, uint64(len(field)))
+		raw = append(raw, field...)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeScanCursor decodes a continuation token built by encodeScanCursor.
+// Returns the cursor and any encountered error.
+func decodeScanCursor(token string) (scanCursor, error) {
+	var cursor scanCursor
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, err
+	}
+	if len(raw) == 0 || (raw[0] != 'f' && raw[0] != 'r') {
+		return cursor, errors.New("Invalid cursor")
+	}
+	cursor.reverse = raw[0] == 'r'
+	raw = raw[1:]
+	for _, field := range []*string{&cursor.start, &cursor.end, &cursor.prefix, &cursor.after} {
+		length, n := binary.Uvarint(raw)
+		if n <= 0 || uint64(len(raw)-n) < length {
+			return cursor, errors.New("Invalid cursor")
+		}
+		*field = string(raw[n : n+int(length)])
+		raw = raw[n+int(length):]
+	}
+	if len(raw) != 0 {
+		return cursor, errors.New("Invalid cursor")
+	}
+	return cursor, nil
+}
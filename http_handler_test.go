@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleScanPagination(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 25; i++ {
+		if err := db.Set(fmt.Sprintf("user/%02d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	if err := db.Set("other", []byte("x")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+
+	// Page through the prefix in reverse, 10 keys at a time
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("Too many pages")
+		}
+		query := url.Values{"prefix": {"user/"}, "limit": {"10"}, "reverse": {"true"}, "cursor": {cursor}}
+		rec := httptest.NewRecorder()
+		handleFunction(db, nil)(rec, httptest.NewRequest("GET", "/scan?"+query.Encode(), nil))
+		if rec.Code != 200 {
+			t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+		}
+
+		var page struct {
+			Items []scanItem `json:"items"`
+			Next  *string    `json:"next"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Invalid JSON response: %s", err)
+		}
+		for _, item := range page.Items {
+			keys = append(keys, item.Key)
+		}
+		if page.Next == nil {
+			break
+		}
+		cursor = *page.Next
+	}
+	if len(keys) != 25 || keys[0] != "user/24" || keys[24] != "user/00" {
+		t.Fatalf("Unexpected scanned keys: %v", keys)
+	}
+
+	// NDJSON, keys only
+	rec := httptest.NewRecorder()
+	handleFunction(db, nil)(rec, httptest.NewRequest("GET", "/scan?start=user/20&keysOnly=true&format=ndjson", nil))
+	scanner := bufio.NewScanner(rec.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 5 || lines[0] != `{"key":"user/20"}` || lines[4] != `{"key":"user/24"}` {
+		t.Fatalf("Unexpected NDJSON lines: %v", lines)
+	}
+
+	// Edge case: a cursor for the other direction is rejected
+	rec = httptest.NewRecorder()
+	handleFunction(db, nil)(rec, httptest.NewRequest("GET", "/scan?prefix=user/&cursor="+encodeScanCursor(scanCursor{prefix: "user/", reverse: true, after: "user/05"}), nil))
+	if rec.Code != 400 {
+		t.Fatalf("Expected status 400, got %d", rec.Code)
+	}
+
+	// Edge case: a cursor is bound to the range of its scan
+	first := httptest.NewRecorder()
+	handleFunction(db, nil)(first, httptest.NewRequest("GET", "/scan?prefix=user/&limit=2", nil))
+	var page struct {
+		Next string `json:"next"`
+	}
+	if err := json.Unmarshal(first.Body.Bytes(), &page); err != nil || page.Next == "" {
+		t.Fatalf("Unexpected first page: %s", first.Body)
+	}
+	for _, query := range []string{"prefix=other", "start=a&prefix=user/", "prefix=user/&end=user/10", ""} {
+		rec = httptest.NewRecorder()
+		handleFunction(db, nil)(rec, httptest.NewRequest("GET", "/scan?"+query+"&cursor="+page.Next, nil))
+		if rec.Code != 400 {
+			t.Fatalf("Expected status 400 for %q, got %d", query, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	handleFunction(db, nil)(rec, httptest.NewRequest("GET", "/scan?prefix=user/&keysOnly=true&limit=1&cursor="+page.Next, nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `{"key":"user/02"}`) {
+		t.Fatalf("Unexpected resumed page: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestHandleTxn(t *testing.T) {
+	db := newTestDB(t)
+	handler := handleFunction(db, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do("POST", "/txn/begin?timeout=10", "")
+	var begin struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &begin); err != nil || begin.Id == "" {
+		t.Fatalf("Unexpected begin response: %s", rec.Body)
+	}
+
+	if rec := do("POST", "/txn/set?id="+begin.Id, `{"key": "k", "value": "v"}`); rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("GET", "/txn/get?id="+begin.Id+"&key=k", ""); rec.Body.String() != "v" {
+		t.Fatalf("Expected own write, got %s", rec.Body)
+	}
+	// A concurrent write makes the commit fail
+	if err := db.Set("k", []byte("other")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if rec := do("POST", "/txn/commit?id="+begin.Id, ""); rec.Code != 409 {
+		t.Fatalf("Expected status 409, got %d", rec.Code)
+	}
+
+	// Edge case: the transaction is gone after commit
+	if rec := do("GET", "/txn/get?id="+begin.Id+"&key=k", ""); rec.Code != 404 {
+		t.Fatalf("Expected status 404, got %d", rec.Code)
+	}
+
+	// Like "/del", deleting a missing key fails
+	rec = do("POST", "/txn/begin", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &begin); err != nil || begin.Id == "" {
+		t.Fatalf("Unexpected begin response: %s", rec.Body)
+	}
+	if rec := do("DELETE", "/txn/del?id="+begin.Id+"&key=missing", ""); rec.Code != 404 {
+		t.Fatalf("Expected status 404, got %d", rec.Code)
+	}
+	if rec := do("DELETE", "/txn/del?id="+begin.Id+"&key=k", ""); rec.Code != 200 || rec.Body.String() != "Key deleted successfully. Value: other" {
+		t.Fatalf("Unexpected delete response %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/txn/commit?id="+begin.Id, ""); rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := db.Get("k"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected k to be deleted, got %v", err)
+	}
+}
+
+func TestTxnRegistryTimeout(t *testing.T) {
+	db := newTestDB(t)
+	txns := newTxnRegistry()
+	id, err := txns.begin(db, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error beginning transaction: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if ht := txns.get(id); ht != nil {
+		t.Fatal("Expected the transaction to expire")
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if len(db.snapshots) != 0 {
+		t.Fatal("Expected the expired transaction's snapshot to be released")
+	}
+}
+
+func TestHandleConditionalWrites(t *testing.T) {
+	db := newTestDB(t)
+	handler := handleFunction(db, nil)
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := do("POST", "/set", `{"key": "k", "value": "1"}`, "If-None-Match", "*"); rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/set", `{"key": "k", "value": "2"}`, "If-None-Match", "*"); rec.Code != 412 {
+		t.Fatalf("Expected status 412, got %d", rec.Code)
+	}
+
+	etag := do("GET", "/get?key=k", "").Header().Get("ETag")
+	rec := do("POST", "/set", `{"key": "k", "value": "2"}`, "If-Match", etag)
+	if rec.Code != 200 || rec.Header().Get("ETag") == etag {
+		t.Fatalf("Unexpected status %d and ETag %s", rec.Code, rec.Header().Get("ETag"))
+	}
+	// The old ETag is stale now
+	if rec := do("GET", "/del?key=k", "", "If-Match", etag); rec.Code != 412 {
+		t.Fatalf("Expected status 412, got %d", rec.Code)
+	}
+	if val, _ := db.Get("k"); string(val) != "2" {
+		t.Fatalf("Expected value 2, got %s", val)
+	}
+}
+
+func TestHandleTTL(t *testing.T) {
+	db := newTestDB(t)
+	handler := handleFunction(db, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do("POST", "/set", `{"key": "a", "value": "1", "ttl": "60"}`); rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/set", `{"key": "b", "value": "1", "ttl": "1m30s"}`); rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/set", `{"key": "c", "value": "1"}`); rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/set", `{"key": "d", "value": "1", "ttl": "-5"}`); rec.Code != 400 {
+		t.Fatalf("Expected status 400, got %d", rec.Code)
+	}
+
+	for key, expected := range map[string]string{"a": "60", "b": "90", "c": "-1"} {
+		if rec := do("GET", "/ttl?key="+key, ""); rec.Code != 200 || rec.Body.String() != expected {
+			t.Fatalf("Expected TTL %s for %s, got %d %s", expected, key, rec.Code, rec.Body)
+		}
+	}
+	if rec := do("GET", "/ttl?key=d", ""); rec.Code != 404 {
+		t.Fatalf("Expected status 404, got %d", rec.Code)
+	}
+}
+
+func TestHandleDeleteRange(t *testing.T) {
+	db := newTestDB(t)
+	handler := handleFunction(db, nil)
+	for _, key := range []string{"tenant1/a", "tenant1/b", "tenant2/a"} {
+		if err := db.Set(key, []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/delrange?start=tenant1/&end=tenant10", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if _, err := db.Get("tenant1/b"); err == nil {
+		t.Fatal("Expected tenant1/b to be deleted")
+	}
+	if _, err := db.Get("tenant2/a"); err != nil {
+		t.Fatalf("Expected tenant2/a to be kept: %s", err)
+	}
+
+	// Edge case: an empty range is rejected
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/delrange?start=b&end=a", nil))
+	if rec.Code != 400 {
+		t.Fatalf("Expected status 400, got %d", rec.Code)
+	}
+}
+
+func TestHandleMultiGet(t *testing.T) {
+	db := newTestDB(t)
+	handler := handleFunction(db, nil)
+	for _, key := range []string{"a", "b"} {
+		if err := db.Set(key, []byte("v"+key)); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/mget", strings.NewReader(`["b", "c", "a"]`)))
+	if rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	var res multiGetResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("Invalid JSON response: %s", err)
+	}
+	if len(res.Values) != 2 || res.Values["a"] != "va" || res.Values["b"] != "vb" || fmt.Sprint(res.Missing) != "[c]" {
+		t.Fatalf("Unexpected response %+v", res)
+	}
+
+	// Edge case: the body must be a list of keys
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/mget", strings.NewReader(`{"key": "a"}`)))
+	if rec.Code != 400 {
+		t.Fatalf("Expected status 400, got %d", rec.Code)
+	}
+}
+
+func TestHandleColumnFamilies(t *testing.T) {
+	db := newTestDB(t)
+	handler := handleFunction(db, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	if rec := do("GET", "/get?key=k&cf=sessions", ""); rec.Code != 404 {
+		t.Fatalf("Expected status 404 for an unknown column family, got %d", rec.Code)
+	}
+	if rec := do("POST", "/cf?name=sessions", ""); rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("POST", "/cf?name=sessions", ""); rec.Code != 409 {
+		t.Fatalf("Expected status 409, got %d", rec.Code)
+	}
+	if rec := do("GET", "/cf", ""); strings.TrimSpace(rec.Body.String()) != `["default","sessions"]` {
+		t.Fatalf("Unexpected column families %s", rec.Body)
+	}
+
+	if rec := do("POST", "/set?cf=sessions", `{"key": "k", "value": "token"}`); rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := do("GET", "/get?key=k&cf=sessions", ""); rec.Code != 200 || rec.Body.String() != "token" {
+		t.Fatalf("Expected token, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := do("GET", "/get?key=k", ""); rec.Code != 404 {
+		t.Fatalf("Expected status 404 in the default column family, got %d", rec.Code)
+	}
+
+	// A batch writes to several column families atomically
+	rec := do("POST", "/batch", `[{"op": "set", "key": "a", "value": "1"}, {"op": "set", "key": "a", "value": "2", "cf": "sessions"}]`)
+	if rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	if val, _ := db.Get("a"); string(val) != "1" {
+		t.Fatalf("Expected 1, got %s", val)
+	}
+	if val, _ := db.ColumnFamily("sessions").Get("a"); string(val) != "2" {
+		t.Fatalf("Expected 2, got %s", val)
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	db := newTestDB(t)
+	handler := handleFunction(db, nil)
+
+	for _, tc := range []struct {
+		method, target, body string
+		status               int
+		code                 string
+	}{
+		{"GET", "/get?key=missing", "", 404, "not_found"},
+		{"GET", "/del?key=missing", "", 404, "not_found"},
+		{"GET", "/get", "", 400, "invalid_argument"},
+		{"GET", "/get?key=k&cf=unknown", "", 404, "column_family_not_found"},
+		{"GET", "/delrange?start=b&end=a", "", 400, "invalid_argument"},
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+		var res errorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatalf("%s: invalid JSON error: %s", tc.target, err)
+		}
+		if rec.Code != tc.status || res.Error.Code != tc.code || res.Error.Message == "" {
+			t.Fatalf("%s: expected %d %s, got %d %+v", tc.target, tc.status, tc.code, rec.Code, res)
+		}
+	}
+}
+
+func TestHandleTimeout(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 25; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+
+	// An expired deadline stops the lookup of the SST files
+	handler := withTimeout(handleFunction(db, nil), time.Nanosecond)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/get?key=key00", nil))
+	var res errorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || rec.Code != 504 || res.Error.Code != "timeout" {
+		t.Fatalf("Expected status 504 timeout, got %d %+v (%v)", rec.Code, res, err)
+	}
+
+	// A client that went away cancels the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	handleFunction(db, nil)(rec, httptest.NewRequest("GET", "/scan", nil).WithContext(ctx))
+	if rec.Code != statusClientClosedRequest {
+		t.Fatalf("Expected status %d, got %d", statusClientClosedRequest, rec.Code)
+	}
+
+	// Edge case: no timeout
+	rec = httptest.NewRecorder()
+	withTimeout(handleFunction(db, nil), 0)(rec, httptest.NewRequest("GET", "/get?key=key00", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// handleReplication is an HTTP handler function for the "/replication/" endpoints:
+//   - GET "/replication/stream" streams the writes after the sequence number given by the after parameter to a
+//     follower, as WAL records framed by writeReplicationFrame, answering 410 Gone if they are no longer retained.
+//   - GET "/replication/checkpoint" sends the SST files of all the column families as a tar archive, along with
+//     the sequence number of the last write they hold in the X-GoDB-Seq header.
+//   - GET "/replication/status" writes the ReplicationStatus of the database as a JSON object.
+//   - POST "/replication/promote" promotes a follower, which then accepts writes.
+func handleReplication(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	switch req.URL.Path {
+	case replicationStreamPath:
+		handleReplicationStream(resp, req, db)
+
+	case replicationCheckpointPath:
+		seq, files, err := db.checkpoint()
+		if err != nil {
+			writeError(resp, fmt.Errorf("Error taking checkpoint: %w", err))
+			return
+		}
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		resp.Header().Set("Content-Type", "application/x-tar")
+		resp.Header().Set("X-GoDB-Seq", strconv.FormatUint(seq, 10))
+		archive := tar.NewWriter(resp)
+		for _, name := range names {
+			header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), ModTime: time.Now()}
+			if err := archive.WriteHeader(header); err != nil {
+				return
+			}
+			if _, err := archive.Write(files[name]); err != nil {
+				return
+			}
+		}
+		archive.Close()
+
+	case "/replication/status":
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(db.ReplicationStatus())
+
+	case "/replication/promote":
+		if req.Method != http.MethodPost {
+			httpError(resp, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := db.Promote(); err != nil {
+			writeError(resp, fmt.Errorf("Error promoting: %w", err))
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(db.ReplicationStatus())
+
+	default:
+		httpError(resp, "Not Found", http.StatusNotFound)
+	}
+}
+
+// handleReplicationStream streams the writes after the after parameter to a follower, with a heartbeat when idle,
+// until the follower goes away or falls too far behind.
+func handleReplicationStream(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		httpError(resp, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	after, err := strconv.ParseUint(req.URL.Query().Get("after"), 10, 64)
+	if err != nil {
+		httpError(resp, "Invalid after parameter", http.StatusBadRequest)
+		return
+	}
+	t, err := db.tailLog(after)
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error streaming writes: %w", err))
+		return
+	}
+	defer t.close()
+
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.WriteHeader(http.StatusOK)
+	if writeReplicationFrame(resp, db.sequence(), nil) != nil {
+		return
+	}
+	flusher.Flush()
+
+	ctx := req.Context()
+	batches := make(chan walBatch, watchBufferSize)
+	go func() {
+		defer close(batches)
+		for {
+			wb, err := t.next(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case batches <- wb:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case wb, ok := <-batches:
+			if !ok {
+				return // The follower fell behind, or the database was closed: the follower reconnects
+			}
+			if writeReplicationFrame(resp, db.sequence(), batchToRecord(wb.first, wb.b)) != nil {
+				return
+			}
+			if len(batches) == 0 {
+				flusher.Flush()
+			}
+		case <-heartbeat.C:
+			if writeReplicationFrame(resp, db.sequence(), nil) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTxnTimeout = 30 * time.Second
+	maxTxnTimeout     = 5 * time.Minute
+)
+
+// httpTxn is a transaction opened over HTTP. Its mutex serializes the requests using it.
+type httpTxn struct {
+	mu    sync.Mutex
+	txn   *Txn
+	timer *time.Timer
+}
+
+// txnRegistry keeps the transactions opened over HTTP, identified by a random id.
+// A transaction that is neither committed nor rolled back before its timeout is rolled back automatically.
+type txnRegistry struct {
+	mu   sync.Mutex
+	txns map[string]*httpTxn
+}
+
+// newTxnRegistry creates an empty txnRegistry.
+func newTxnRegistry() *txnRegistry {
+	return &txnRegistry{txns: make(map[string]*httpTxn)}
+}
+
+// begin starts a transaction that is rolled back after timeout unless it ends before.
+// Returns the id of the transaction and any encountered error.
+func (reg *txnRegistry) begin(db *fileDB, timeout time.Duration) (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+
+	ht := &httpTxn{txn: db.Begin()}
+	reg.mu.Lock()
+	reg.txns[id] = ht
+	ht.timer = time.AfterFunc(timeout, func() { reg.expire(id) })
+	reg.mu.Unlock()
+	return id, nil
+}
+
+// get returns the transaction with the given id, locked, or nil if it does not exist.
+// The caller must unlock it once done.
+func (reg *txnRegistry) get(id string) *httpTxn {
+	reg.mu.Lock()
+	ht := reg.txns[id]
+	reg.mu.Unlock()
+	if ht == nil {
+		return nil
+	}
+	ht.mu.Lock()
+	if ht.txn.done {
+		// Ended concurrently, e.g. by its timeout
+		ht.mu.Unlock()
+		return nil
+	}
+	return ht
+}
+
+// remove removes the transaction with the given id from the registry and stops its timeout.
+// Returns the removed transaction, or nil if it does not exist.
+func (reg *txnRegistry) remove(id string) *httpTxn {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	ht := reg.txns[id]
+	if ht != nil {
+		ht.timer.Stop()
+		delete(reg.txns, id)
+	}
+	return ht
+}
+
+// expire rolls back the transaction with the given id once its timeout elapsed.
+func (reg *txnRegistry) expire(id string) {
+	if ht := reg.remove(id); ht != nil {
+		ht.mu.Lock()
+		ht.txn.Rollback()
+		ht.mu.Unlock()
+	}
+}
+
+// handleTxn is an HTTP handler function for the "/txn/" endpoints, which run a transaction over several requests:
+//   - "/txn/begin" starts a transaction and returns its id, with an optional timeout parameter in seconds.
+//   - "/txn/get", "/txn/set" and "/txn/del" work like "/get", "/set" and "/del" within the transaction given by id.
+//   - "/txn/commit" commits the transaction, answering 409 Conflict if a key it used was modified meanwhile.
+//   - "/txn/rollback" discards the transaction.
+func handleTxn(resp http.ResponseWriter, req *http.Request, db *fileDB, txns *txnRegistry) {
+	if req.URL.Path == "/txn/begin" {
+		timeout := defaultTxnTimeout
+		if t := req.URL.Query().Get("timeout"); t != "" {
+			seconds, err := strconv.Atoi(t)
+			if err != nil || seconds <= 0 {
+				httpError(resp, "Invalid timeout parameter", http.StatusBadRequest)
+				return
+			}
+			timeout = min(time.Duration(seconds)*time.Second, maxTxnTimeout)
+		}
+		id, err := txns.begin(db, timeout)
+		if err != nil {
+			writeError(resp, fmt.Errorf("Error beginning transaction: %w", err))
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(map[string]interface{}{"id": id, "timeout": int(timeout.Seconds())})
+		return
+	}
+
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		httpError(resp, "Id parameter is missing", http.StatusBadRequest)
+		return
+	}
+	ht := txns.get(id)
+	if ht == nil {
+		httpError(resp, "Transaction not found", http.StatusNotFound)
+		return
+	}
+	defer ht.mu.Unlock()
+
+	switch req.URL.Path {
+	case "/txn/get":
+		key := req.URL.Query().Get("key")
+		if key == "" {
+			httpError(resp, "Key parameter is missing", http.StatusBadRequest)
+			return
+		}
+		value, err := ht.txn.GetContext(req.Context(), key)
+		if err != nil {
+			writeError(resp, err)
+			return
+		}
+		resp.Write(value)
+
+	case "/txn/set":
+		var data map[string]string
+		if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+			httpError(resp, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		key, ok := data["key"]
+		if !ok || key == "" {
+			httpError(resp, "Key parameter is missing", http.StatusBadRequest)
+			return
+		}
+		value, ok := data["value"]
+		if !ok || value == "" {
+			httpError(resp, "Value parameter is missing", http.StatusBadRequest)
+			return
+		}
+		ht.txn.Set(key, []byte(value))
+		resp.Write([]byte("Key set successfully"))
+
+	case "/txn/del":
+		key := req.URL.Query().Get("key")
+		if key == "" {
+			httpError(resp, "Key parameter is missing", http.StatusBadRequest)
+			return
+		}
+		// Like "/del", deleting a missing key fails. The key is read by the transaction, so that a concurrent
+		// creation makes the commit fail
+		value, err := ht.txn.GetContext(req.Context(), key)
+		if err != nil {
+			writeError(resp, err)
+			return
+		}
+		ht.txn.Del(key)
+		resp.Write([]byte(fmt.Sprintf("Key deleted successfully. Value: %s", value)))
+
+	case "/txn/commit":
+		err := ht.txn.CommitContext(req.Context())
+		txns.remove(id)
+		if err != nil {
+			writeError(resp, fmt.Errorf("Error committing transaction: %w", err))
+			return
+		}
+		resp.Write([]byte("Transaction committed successfully"))
+
+	case "/txn/rollback":
+		ht.txn.Rollback()
+		txns.remove(id)
+		resp.Write([]byte("Transaction rolled back"))
+
+	default:
+		httpError(resp, "Not Found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const keysV2Prefix = "/v2/keys/"
+
+// keyV2 is the JSON representation of a key and its value in the v2 API. Values are base64-encoded, so that
+// they may hold arbitrary bytes.
+type keyV2 struct {
+	Key     string `json:"key,omitempty"`
+	Value   []byte `json:"value"`
+	Version uint64 `json:"version,omitempty"`
+	TTL     string `json:"ttl,omitempty"` // Only read by PUT, in seconds or as a Go duration
+}
+
+// handleKeyV2 is an HTTP handler function for the "/v2/keys/{key}" endpoint, where key is URL-escaped.
+// GET and HEAD read the key, PUT writes it and DELETE deletes it. Values are raw application/octet-stream bodies,
+// or JSON objects with a base64-encoded value when the request accepts or sends application/json.
+// Writes honor the If-Match and If-None-Match headers like "/set", and every response carries the version
+// of the key as the ETag header.
+func handleKeyV2(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	key, ok := parseKeyV2(resp, req)
+	if !ok {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		getKeyV2(resp, req, db, key)
+	case http.MethodPut:
+		putKeyV2(resp, req, db, key)
+	case http.MethodDelete:
+		deleteKeyV2(resp, req, db, key)
+	default:
+		resp.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		httpError(resp, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseKeyV2 returns the key of a "/v2/keys/{key}" request and true, or writes an error response and returns false.
+func parseKeyV2(resp http.ResponseWriter, req *http.Request) (string, bool) {
+	key, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), keysV2Prefix))
+	if err != nil || key == "" {
+		httpError(resp, "Invalid or missing key", http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+// getKeyV2 writes the value of key, or only its headers for a HEAD request.
+// Returns 304 Not Modified when the If-None-Match header holds the current version.
+func getKeyV2(resp http.ResponseWriter, req *http.Request, db *fileDB, key string) {
+	val, version, err := db.GetVersionContext(req.Context(), key)
+	if err != nil {
+		writeError(resp, err)
+		return
+	}
+
+	resp.Header().Set("ETag", formatETag(version))
+	if etag := req.Header.Get("If-None-Match"); etag != "" {
+		if current, ok := parseETag(etag); ok && current == version {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	body := val
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		resp.Header().Set("Content-Type", "application/json")
+		body, _ = json.Marshal(keyV2{Key: key, Value: val, Version: version})
+	} else {
+		resp.Header().Set("Content-Type", "application/octet-stream")
+	}
+	resp.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if req.Method == http.MethodHead {
+		return
+	}
+	resp.Write(body)
+}
+
+// putKeyV2 stores the value of key from the request body, with an optional TTL given by the ttl query parameter
+// or the ttl field in JSON mode. Empty values are allowed.
+// Returns 201 Created if the key did not exist and 204 No Content otherwise.
+func putKeyV2(resp http.ResponseWriter, req *http.Request, db *fileDB, key string) {
+	v, ok := decodePutV2(resp, req)
+	if !ok {
+		return
+	}
+
+	cond, err := parseWriteCondition(req)
+	if err != nil {
+		httpError(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	existed := false
+	version, err := db.writeIf(req.Context(), key, v, func(current []byte, version uint64, exists bool) bool {
+		existed = exists
+		return cond(current, version, exists)
+	})
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error setting key: %w", err))
+		return
+	}
+	writePutV2(resp, key, version, existed)
+}
+
+// decodePutV2 decodes the value of a PUT request to the v2 API, with its optional TTL.
+// Returns the value to write and true, or writes an error response and returns false.
+func decodePutV2(resp http.ResponseWriter, req *http.Request) (value, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(resp, req.Body, maxValueSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(resp, fmt.Errorf("%w: the maximum value size is %d bytes", ErrTooLarge, maxValueSize))
+		return value{}, false
+	}
+	if err != nil {
+		httpError(resp, "Error reading request body", http.StatusBadRequest)
+		return value{}, false
+	}
+
+	v := value{set, body, 0}
+	ttl := req.URL.Query().Get("ttl")
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		var data keyV2
+		if err := json.Unmarshal(body, &data); err != nil {
+			httpError(resp, "Invalid JSON format", http.StatusBadRequest)
+			return value{}, false
+		}
+		if data.Value == nil {
+			data.Value = []byte{}
+		}
+		v.val = data.Value
+		if data.TTL != "" {
+			ttl = data.TTL
+		}
+	}
+	if ttl != "" {
+		d, err := parseTTL(ttl)
+		if err != nil {
+			httpError(resp, "Invalid ttl parameter", http.StatusBadRequest)
+			return value{}, false
+		}
+		v.expiry = time.Now().Add(d).UnixNano()
+	}
+	return v, true
+}
+
+// writePutV2 writes the response of a PUT request to the v2 API which wrote version of key: 201 Created if the
+// key did not exist and 204 No Content otherwise.
+func writePutV2(resp http.ResponseWriter, key string, version uint64, existed bool) {
+	resp.Header().Set("ETag", formatETag(version))
+	if existed {
+		resp.WriteHeader(http.StatusNoContent)
+		return
+	}
+	resp.Header().Set("Location", keysV2Prefix+url.PathEscape(key))
+	resp.WriteHeader(http.StatusCreated)
+}
+
+// deleteKeyV2 deletes key, only if its version matches the If-Match header when there is one.
+// Returns 204 No Content, 404 Not Found if the key does not exist, or 412 Precondition Failed.
+func deleteKeyV2(resp http.ResponseWriter, req *http.Request, db *fileDB, key string) {
+	cond, err := parseWriteCondition(req)
+	if err != nil {
+		httpError(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	existed := false
+	_, err = db.writeIf(req.Context(), key, value{del, nil, 0}, func(current []byte, version uint64, exists bool) bool {
+		existed = exists
+		return exists && cond(current, version, exists)
+	})
+	if errors.Is(err, ErrConditionFailed) && !existed {
+		err = fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error deleting key: %w", err))
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleKeyV2(t *testing.T) {
+	db := newTestDB(t)
+	handler := handleFunction(db, nil)
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	// Raw bytes under a URL-escaped key
+	binary := "\x00\xff\n bytes"
+	rec := do("PUT", "/v2/keys/users%2F1%3Fx", binary, "Content-Type", "application/octet-stream")
+	if rec.Code != 201 || rec.Header().Get("ETag") == "" {
+		t.Fatalf("Expected status 201 with an ETag, got %d: %s", rec.Code, rec.Body)
+	}
+	if val, err := db.Get("users/1?x"); err != nil || string(val) != binary {
+		t.Fatalf("Expected the raw value, got %q (%v)", val, err)
+	}
+	rec = do("GET", "/v2/keys/users%2F1%3Fx", "")
+	if rec.Code != 200 || rec.Body.String() != binary || rec.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("Unexpected response %d %q", rec.Code, rec.Body)
+	}
+	etag := rec.Header().Get("ETag")
+	if rec := do("GET", "/v2/keys/users%2F1%3Fx", "", "If-None-Match", etag); rec.Code != 304 {
+		t.Fatalf("Expected status 304, got %d", rec.Code)
+	}
+	if rec := do("HEAD", "/v2/keys/users%2F1%3Fx", ""); rec.Code != 200 || rec.Body.Len() != 0 || rec.Header().Get("Content-Length") != "9" {
+		t.Fatalf("Unexpected HEAD response %d %q %s", rec.Code, rec.Body, rec.Header().Get("Content-Length"))
+	}
+
+	// Empty values are allowed, and replacing a key returns 204
+	if rec := do("PUT", "/v2/keys/users%2F1%3Fx", ""); rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d", rec.Code)
+	}
+	if rec := do("PUT", "/v2/keys/users%2F1%3Fx", "x", "If-Match", etag); rec.Code != 412 {
+		t.Fatalf("Expected status 412 for a stale ETag, got %d", rec.Code)
+	}
+
+	// JSON mode uses base64 values
+	rec = do("PUT", "/v2/keys/doc", `{"value": "AAEC", "ttl": "60"}`, "Content-Type", "application/json")
+	if rec.Code != 201 {
+		t.Fatalf("Unexpected status %d: %s", rec.Code, rec.Body)
+	}
+	rec = do("GET", "/v2/keys/doc", "", "Accept", "application/json")
+	var res keyV2
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Key != "doc" || !bytes.Equal(res.Value, []byte{0, 1, 2}) || res.Version == 0 {
+		t.Fatalf("Unexpected JSON response %+v (%v)", res, err)
+	}
+	if ttl, expires, err := db.TTL("doc"); err != nil || !expires || ttl <= 0 {
+		t.Fatalf("Expected a TTL, got %s, %v (%v)", ttl, expires, err)
+	}
+
+	// Deletion and error statuses
+	if rec := do("DELETE", "/v2/keys/doc", ""); rec.Code != 204 {
+		t.Fatalf("Expected status 204, got %d", rec.Code)
+	}
+	if rec := do("DELETE", "/v2/keys/doc", ""); rec.Code != 404 {
+		t.Fatalf("Expected status 404, got %d", rec.Code)
+	}
+	if rec := do("GET", "/v2/keys/doc", ""); rec.Code != 404 {
+		t.Fatalf("Expected status 404, got %d", rec.Code)
+	}
+	if rec := do("POST", "/v2/keys/doc", ""); rec.Code != 405 || rec.Header().Get("Allow") == "" {
+		t.Fatalf("Expected status 405 with an Allow header, got %d", rec.Code)
+	}
+	if rec := do("GET", "/v2/keys/", ""); rec.Code != 400 {
+		t.Fatalf("Expected status 400 for a missing key, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// watchKeepAlive is the interval of the comments written to idle "/watch" streams, so that proxies keep them open.
+const watchKeepAlive = 15 * time.Second
+
+// watchEvent is the JSON data of a "/watch" event.
+type watchEvent struct {
+	Seq    uint64  `json:"seq"`
+	Op     string  `json:"op"`
+	Key    string  `json:"key"`
+	Value  *string `json:"value,omitempty"`  // Value set or merge operand
+	End    string  `json:"end,omitempty"`    // End of the range deleted
+	Expiry *int64  `json:"expiry,omitempty"` // Expiry time, in Unix milliseconds
+}
+
+// handleWatch is an HTTP handler function for the "/watch" endpoint, streaming the changes to the keys starting
+// with the prefix parameter as Server-Sent Events. Each event has the sequence number of the change as its id,
+// the operation as its type and a JSON watchEvent as its data.
+// The after parameter, or the Last-Event-ID header sent by reconnecting clients, resumes the stream after
+// a sequence number, replaying the changes retained in the Write-Ahead Logs; 410 Gone is returned if they are
+// no longer retained. The stream ends with an error event if the client falls too far behind.
+func handleWatch(resp http.ResponseWriter, req *http.Request, db *fileDB) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		httpError(resp, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var after uint64
+	for _, s := range []string{req.Header.Get("Last-Event-ID"), req.URL.Query().Get("after")} {
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			httpError(resp, "Invalid after parameter", http.StatusBadRequest)
+			return
+		}
+		after = max(after, n)
+	}
+
+	w, err := db.Watch(req.URL.Query().Get("prefix"), after)
+	if err != nil {
+		writeError(resp, fmt.Errorf("Error watching keys: %w", err))
+		return
+	}
+	defer w.Close()
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := req.Context()
+	changes := make(chan Change, watchBufferSize)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			c, err := w.Next(ctx)
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case changes <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case c := <-changes:
+			writeWatchEvent(resp, c)
+			// Flush once the changes available right away are written
+			if len(changes) == 0 {
+				flusher.Flush()
+			}
+		case err := <-failed:
+			for len(changes) > 0 {
+				writeWatchEvent(resp, <-changes)
+			}
+			if ctx.Err() == nil {
+				_, code := errorStatus(err)
+				data, _ := json.Marshal(errorResponse{errorBody{code, err.Error()}})
+				fmt.Fprintf(resp, "event: error\ndata: %s\n\n", data)
+				flusher.Flush()
+			}
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(resp, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newWatchEvent returns the JSON representation of a change.
+func newWatchEvent(c Change) watchEvent {
+	event := watchEvent{Seq: c.Seq, Op: c.Op, Key: c.Key}
+	switch c.Op {
+	case ChangeSet, ChangeMerge:
+		val := string(c.Value)
+		event.Value = &val
+	case ChangeDeleteRange:
+		event.End = string(c.Value)
+	}
+	if !c.Expiry.IsZero() {
+		expiry := c.Expiry.UnixMilli()
+		event.Expiry = &expiry
+	}
+	return event
+}
+
+// writeWatchEvent writes a change as a Server-Sent Event.
+func writeWatchEvent(resp http.ResponseWriter, c Change) {
+	data, _ := json.Marshal(newWatchEvent(c))
+	fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Op, data)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvents reads n Server-Sent Events from r, skipping the comments.
+// Returns the lines of each event, without the empty line ending it.
+func readEvents(t *testing.T, r *bufio.Reader, n int) [][]string {
+	t.Helper()
+	events := make([][]string, 0, n)
+	var event []string
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading event %d: %s", len(events), err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, ":"):
+		case line == "":
+			events = append(events, event)
+			event = nil
+		default:
+			event = append(event, line)
+		}
+	}
+	return events
+}
+
+// watch opens a "/watch" stream of srv with the given query and Last-Event-ID header.
+func watch(t *testing.T, srv *httptest.Server, query, lastEventID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/watch?"+query, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error opening the stream: %s", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestHandleWatch(t *testing.T) {
+	db := newTestDB(t)
+	srv := httptest.NewServer(withTimeout(handleFunction(db, nil), 50*time.Millisecond))
+	t.Cleanup(srv.Close) // Runs after the streams are closed by the cleanups registered later
+
+	resp, r := watch(t, srv, "prefix=user:", "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	db.Set("other", []byte("x"))
+	db.Set("user:1", []byte("bob"))
+	db.Del("user:1")
+	events := readEvents(t, r, 2)
+	want := [][]string{
+		{"id: 2", "event: set", `data: {"seq":2,"op":"set","key":"user:1","value":"bob"}`},
+		{"id: 3", "event: del", `data: {"seq":3,"op":"del","key":"user:1"}`},
+	}
+	for i := range want {
+		if strings.Join(events[i], "\n") != strings.Join(want[i], "\n") {
+			t.Fatalf("Expected event %q, got %q", want[i], events[i])
+		}
+	}
+
+	// The stream outlives the request timeout
+	time.Sleep(100 * time.Millisecond)
+	db.Set("user:2", []byte("alice"))
+	if events := readEvents(t, r, 1); events[0][0] != "id: 4" {
+		t.Fatalf("Unexpected event %q", events[0])
+	}
+
+	// A reconnecting client resumes after its last event
+	_, r = watch(t, srv, "prefix=user:", "2")
+	if events := readEvents(t, r, 2); events[0][0] != "id: 3" || events[1][0] != "id: 4" {
+		t.Fatalf("Unexpected events %q", events)
+	}
+
+	// Edge cases: invalid and trimmed sequence numbers
+	if resp, _ := watch(t, srv, "after=abc", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", resp.StatusCode)
+	}
+	for i := 0; i < memLimit; i++ {
+		db.Set("key", []byte("v"))
+	}
+	archives, _ := db.archivedWALs()
+	for _, archive := range archives {
+		os.Remove(archive)
+	}
+	if resp, _ := watch(t, srv, "after=1", ""); resp.StatusCode != http.StatusGone {
+		t.Fatalf("Expected 410, got %d", resp.StatusCode)
+	}
+}
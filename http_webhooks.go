@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// handleWebhooks is an HTTP handler function for the "/webhooks" endpoints, administering the webhooks:
+//   - GET "/webhooks" lists the webhooks along with their delivery cursor, their number of dead letters and the
+//     error that stopped their delivery if they failed.
+//   - POST "/webhooks" registers a webhook from a JSON object with the url, prefix and cf fields, and answers
+//     201 Created with the webhook and its id.
+//   - DELETE "/webhooks" removes the webhook given by the id parameter, along with its dead letters.
+//   - GET "/webhooks/dead" lists the dead letters of the webhook given by the id parameter, or of all of them.
+//   - DELETE "/webhooks/dead" discards the dead letters of the webhook given by the id parameter.
+func handleWebhooks(resp http.ResponseWriter, req *http.Request, hooks *webhookManager) {
+	id := req.URL.Query().Get("id")
+	switch {
+	case req.URL.Path == "/webhooks" && req.Method == http.MethodGet:
+		statuses, err := hooks.status()
+		if err != nil {
+			writeError(resp, fmt.Errorf("Error listing webhooks: %w", err))
+			return
+		}
+		if statuses == nil {
+			statuses = []webhookStatus{}
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(statuses)
+
+	case req.URL.Path == "/webhooks" && req.Method == http.MethodPost:
+		var hook webhook
+		if err := json.NewDecoder(req.Body).Decode(&hook); err != nil {
+			httpError(resp, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		hook, err := hooks.register(webhook{URL: hook.URL, Prefix: hook.Prefix, CF: hook.CF})
+		if err != nil {
+			writeError(resp, fmt.Errorf("Error registering webhook: %w", err))
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(http.StatusCreated)
+		json.NewEncoder(resp).Encode(hook)
+
+	case req.URL.Path == "/webhooks" && req.Method == http.MethodDelete:
+		if id == "" {
+			httpError(resp, "Id parameter is missing", http.StatusBadRequest)
+			return
+		}
+		if err := hooks.remove(id); err != nil {
+			writeError(resp, fmt.Errorf("Error removing webhook: %w", err))
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+
+	case req.URL.Path == "/webhooks/dead" && req.Method == http.MethodGet:
+		letters, err := hooks.deadLetters(id)
+		if err != nil {
+			writeError(resp, fmt.Errorf("Error listing dead letters: %w", err))
+			return
+		}
+		if letters == nil {
+			letters = []deadLetter{}
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(letters)
+
+	case req.URL.Path == "/webhooks/dead" && req.Method == http.MethodDelete:
+		if id == "" {
+			httpError(resp, "Id parameter is missing", http.StatusBadRequest)
+			return
+		}
+		if err := hooks.purge(id); err != nil {
+			writeError(resp, fmt.Errorf("Error discarding dead letters: %w", err))
+			return
+		}
+		resp.WriteHeader(http.StatusNoContent)
+
+	case req.URL.Path == "/webhooks" || req.URL.Path == "/webhooks/dead":
+		httpError(resp, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		httpError(resp, "Not Found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// IterOptions restricts the range of keys visited by an Iterator.
+// An empty bound means the iteration is unbounded on that side.
+type IterOptions struct {
+	LowerBound string // Inclusive lower bound
+	UpperBound string // Exclusive upper bound
+	Prefix     string // Only keys starting with Prefix are visited
+}
+
+// iterWindow is the number of entries of an SST file an Iterator decodes ahead of its position, or behind it
+// when moving backwards.
+const iterWindow = 256
+
+// Iterator walks the live keys of the database in sorted order.
+// It merges the Memtable and all SST files, so that for every key only the newest version visible at the
+// Iterator's sequence number is returned and deleted or expired keys are skipped. The view is fixed when the Iterator is created.
+type Iterator struct {
+	ctx     context.Context // Once done, the Iterator becomes invalid and Err returns its error
+	sources []*iterSource   // From the newest source (the Memtable) to the oldest SST file
+	seq     uint64          // Versions written after this sequence number are ignored
+	now     int64           // Values expired at this time, in Unix nanoseconds, are skipped
+	err     error           // First error encountered while reading an SST file or combining merge operands, or the error of ctx
+
+	mergeOperator MergeOperator
+	lower         string
+	upper         string
+	key           string
+	val           []byte
+	valid         bool
+}
+
+// iterSource is the Memtable or an SST file merged by an Iterator.
+// The entries of an SST file are decoded lazily, in a window of iterWindow entries, so that only the files overlapping
+// the position of the Iterator are read and only a few of their entries are held in memory. Moving forward out of the
+// window goes on decoding from where the window ended. Other moves decode from the block of the file holding the new
+// position, found with its sparse index; files compressed in one piece are decoded from their beginning instead, and
+// entirely once to check their checksum. The range tombstones, stored after the other entries, are read first.
+type iterSource struct {
+	file      *os.File  // Opened when the Iterator is created, so that a compaction removing it does not affect the Iterator. Nil for the Memtable
+	index     *sstIndex // Sparse index of the blocks of the file, nil if it is compressed in one piece
+	header    sstStream // Header of the file, positioned before its first entry
+	sKey      string    // Key range of the file, range tombstones included
+	lKey      string
+	scanned   bool      // Whether the range tombstones of the file were read
+	rangeDels []kvEntry // Range tombstones of the source
+
+	entries []kvEntry // All the versions of the keys within [lo, hi) of the source, sorted by internal key
+	lo      string
+	hi      string // An empty hi means the window reaches the end of the source
+	loaded  bool
+
+	stream    *sstStream // After a window loaded forward, positioned after following, the first entry after the window
+	following kvEntry
+	decoded   int // Number of entries decoded from the file
+}
+
+// NewIterator creates an Iterator over the Memtable and the SST files.
+// The Memtable entries within the bounds are copied and the SST files are opened while holding the read lock,
+// so that concurrent writes, flushes and compactions do not affect the Iterator once it is created.
+// Returns the Iterator, positioned nowhere, and any encountered error.
+func (mem *fileDB) NewIterator(opts *IterOptions) (*Iterator, error) {
+	return mem.NewIteratorContext(context.Background(), opts)
+}
+
+// NewIteratorContext is like NewIterator, but stops opening the SST files with the error of ctx once it is done.
+// Afterwards, the Iterator stops moving once ctx is done, and Err returns the error of ctx.
+func (mem *fileDB) NewIteratorContext(ctx context.Context, opts *IterOptions) (*Iterator, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	return mem.newIterator(ctx, mem.seq, opts)
+}
+
+// newIterator creates an Iterator merging the Memtable with the SST files as of sequence number seq.
+// The caller must hold mem.mu.
+// Returns the Iterator and any encountered error while opening the SST files.
+func (mem *fileDB) newIterator(ctx context.Context, seq uint64, opts *IterOptions) (*Iterator, error) {
+	if mem.closed {
+		return nil, ErrClosed
+	}
+	files, err := mem.sstFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	it := &Iterator{ctx: ctx, seq: seq, now: time.Now().UnixNano(), mergeOperator: mem.mergeOperator}
+	if opts != nil {
+		it.lower, it.upper = opts.LowerBound, opts.UpperBound
+		if opts.Prefix != "" {
+			if it.lower < opts.Prefix {
+				it.lower = opts.Prefix
+			}
+			if end := prefixEnd(opts.Prefix); end != "" && (it.upper == "" || end < it.upper) {
+				it.upper = end
+			}
+		}
+	}
+
+	// The Memtable is the newest source, then the SST files from the newest to the oldest one
+	memtable := &iterSource{entries: mem.memEntries(it.lower, it.upper), scanned: true, loaded: true}
+	memtable.rangeDels = append(memtable.rangeDels, mem.rangeDels...)
+	it.sources = append(it.sources, memtable)
+	for i := len(files) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			it.Close()
+			return nil, err
+		}
+		source, err := openIterSource(files[i])
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.sources = append(it.sources, source)
+	}
+	return it, nil
+}
+
+// memEntries copies the versions of the keys of the Memtable within [lower, upper) into a slice sorted by internal key.
+// An empty upper means no upper bound. The caller must hold mem.mu.
+func (mem *fileDB) memEntries(lower, upper string) []kvEntry {
+	var entries []kvEntry
+	iterator := mem.values.Iterator()
+	for iterator.Next() {
+		ik := iterator.Key().(internalKey)
+		if upper != "" && ik.key >= upper {
+			break
+		}
+		if ik.key >= lower {
+			entries = append(entries, kvEntry{ik, iterator.Value().(value)})
+		}
+	}
+	return entries
+}
+
+// openIterSource opens an SST file and decodes its key range, leaving its entries to be decoded when needed.
+// Returns the source and any encountered error.
+func openIterSource(name string) (*iterSource, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &iterSource{file: file}
+	if s.index, err = readSSTIndex(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	stream, err := s.open(nil)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.header, s.sKey, s.lKey = *stream, stream.sKey, stream.lKey
+	return s, nil
+}
+
+// open opens a stream on the SST file, positioned on the first entry of block, or on the first entry of the file
+// if block is nil or the file has no index.
+// Returns the stream and any encountered error.
+func (s *iterSource) open(block *sstBlock) (*sstStream, error) {
+	if s.index == nil {
+		return openSSTStream(io.NewSectionReader(s.file, 0, math.MaxInt64), s.file.Name())
+	}
+	if block == nil {
+		return openSSTStream(io.NewSectionReader(s.file, int64(sstBlockHeaderSize), s.index.end-int64(sstBlockHeaderSize)), s.file.Name())
+	}
+	return openSSTEntries(io.NewSectionReader(s.file, block.offset, s.index.end-block.offset), &s.header, block.ordinal)
+}
+
+// decode decodes the next entry of a stream opened on the file, counting it.
+// Returns the entry and any encountered error.
+func (s *iterSource) decode(stream *sstStream) (kvEntry, error) {
+	s.decoded++
+	return stream.next()
+}
+
+// covers reports whether the window of the source holds all the versions of key.
+func (s *iterSource) covers(key string) bool {
+	return s.loaded && key >= s.lo && (s.hi == "" || key < s.hi)
+}
+
+// seek returns the smallest key of the source greater than or equal to from, decoding the window starting at from
+// if the current one does not tell.
+// Returns the key, whether there is one and any encountered error while reading the file.
+func (s *iterSource) seek(from string) (string, bool, error) {
+	if s.file != nil && from > s.lKey {
+		return "", false, nil
+	}
+	if !s.covers(from) {
+		if err := s.load(from, false); err != nil {
+			return "", false, err
+		}
+	}
+	for {
+		i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].key >= from })
+		if i < len(s.entries) {
+			return s.entries[i].key, true, nil
+		}
+		if s.hi == "" {
+			return "", false, nil
+		}
+		// The following keys are after the window
+		if err := s.load(s.hi, false); err != nil {
+			return "", false, err
+		}
+	}
+}
+
+// seekBefore returns the largest key of the source less than before, or the largest key if before is empty, decoding
+// the window ending at before if the current one does not tell.
+// Returns the key, whether there is one and any encountered error while reading the file.
+func (s *iterSource) seekBefore(before string) (string, bool, error) {
+	if s.file != nil {
+		if before != "" && before <= s.sKey {
+			return "", false, nil
+		}
+		if before == "" || before > s.lKey {
+			// The smallest key greater than every key of the file
+			before = s.lKey + "\x00"
+		}
+	}
+	if !s.loaded || (before == "" && s.hi != "") || (before != "" && s.hi != "" && before > s.hi) {
+		if err := s.load(before, true); err != nil {
+			return "", false, err
+		}
+	}
+	for {
+		i := len(s.entries)
+		if before != "" {
+			i = sort.Search(len(s.entries), func(i int) bool { return s.entries[i].key >= before })
+		}
+		if i > 0 {
+			return s.entries[i-1].key, true, nil
+		}
+		if s.lo == "" {
+			return "", false, nil
+		}
+		// The preceding keys are before the window
+		if before > s.lo {
+			before = s.lo
+		}
+		if err := s.load(before, true); err != nil {
+			return "", false, err
+		}
+	}
+}
+
+// versions returns the entries of the source holding all the versions of key, along with its range tombstones,
+// decoding the window starting at key if the current one does not hold them.
+// Returns the entries, the range tombstones and any encountered error while reading the file.
+func (s *iterSource) versions(key string) ([]kvEntry, []kvEntry, error) {
+	if s.file != nil && (key < s.sKey || key > s.lKey) {
+		return nil, nil, nil
+	}
+	if !s.covers(key) {
+		if err := s.load(key, false); err != nil {
+			return nil, nil, err
+		}
+	}
+	return s.entries, s.rangeDels, nil
+}
+
+// load decodes the window of the SST file starting at target, or ending before target if backward is true. The window
+// holds iterWindow entries, plus the other versions of its last key, or of its first key when moving backwards.
+// The range tombstones of the file are read beforehand.
+// Returns any encountered error while reading the file.
+func (s *iterSource) load(target string, backward bool) error {
+	if !s.scanned {
+		if err := s.scan(); err != nil {
+			return err
+		}
+	}
+	if backward {
+		return s.loadBackward(target)
+	}
+	return s.loadForward(target)
+}
+
+// scan reads the range tombstones of the SST file, which are stored after the other entries: from their block for a
+// file with an index, otherwise by decoding the whole file, whose checksum is then verified.
+// Returns any encountered error while reading the file.
+func (s *iterSource) scan() error {
+	if s.index != nil && s.index.rangeDels == nil {
+		s.scanned = true
+		return nil
+	}
+	var block *sstBlock
+	if s.index != nil {
+		block = s.index.rangeDels
+	}
+	stream, err := s.open(block)
+	if err != nil {
+		return err
+	}
+	var rangeDels []kvEntry
+	for stream.count > 0 {
+		entry, err := s.decode(stream)
+		if err != nil {
+			return err
+		}
+		if entry.flag == rangeDel {
+			rangeDels = append(rangeDels, entry)
+		}
+	}
+	if s.index == nil {
+		if err := stream.verify(); err != nil {
+			return err
+		}
+	}
+	s.rangeDels, s.scanned = rangeDels, true
+	return nil
+}
+
+// loadForward decodes the window starting at target. When target is where the previous window loaded forward ended,
+// the decoding goes on from there; otherwise it starts from the last block of the file whose first key is not after
+// target, or from the beginning of a file without index.
+// Returns any encountered error while reading the file.
+func (s *iterSource) loadForward(target string) error {
+	if s.stream == nil || target != s.hi {
+		var block *sstBlock
+		if s.index != nil {
+			if i := sort.Search(len(s.index.blocks), func(i int) bool { return s.index.blocks[i].key > target }); i > 0 {
+				block = &s.index.blocks[i-1]
+			}
+		}
+		stream, err := s.open(block)
+		if err != nil {
+			return err
+		}
+		s.stream = stream
+		if s.following, err = s.nextEntry(); err != nil {
+			return err
+		}
+	}
+
+	var entries []kvEntry
+	for s.stream != nil {
+		entry := s.following
+		if len(entries) >= iterWindow && entries[len(entries)-1].key != entry.key {
+			s.entries, s.lo, s.hi, s.loaded = entries, target, entry.key, true
+			return nil
+		}
+		if entry.key >= target {
+			entries = append(entries, entry)
+		}
+		var err error
+		if s.following, err = s.nextEntry(); err != nil {
+			return err
+		}
+	}
+	s.entries, s.lo, s.hi, s.loaded = entries, target, "", true
+	return nil
+}
+
+// nextEntry decodes the next entry of the stream of the source into following, and closes the stream once the
+// entries other than range tombstones are exhausted.
+// Returns the entry and any encountered error.
+func (s *iterSource) nextEntry() (kvEntry, error) {
+	if s.stream.count > 0 {
+		entry, err := s.decode(s.stream)
+		if err != nil {
+			s.stream = nil
+			return entry, err
+		}
+		if entry.flag != rangeDel {
+			return entry, nil
+		}
+	}
+	s.stream = nil
+	return kvEntry{}, nil
+}
+
+// loadBackward decodes the window ending before target, from a few blocks before the last block of the file whose
+// first key is before target, or from the beginning of a file without index.
+// Returns any encountered error while reading the file.
+func (s *iterSource) loadBackward(target string) error {
+	s.stream = nil
+	var block *sstBlock
+	lo := ""
+	if s.index != nil {
+		i := sort.Search(len(s.index.blocks), func(i int) bool { return target != "" && s.index.blocks[i].key >= target })
+		if i -= 1 + iterWindow/sstBlockEntries; i > 0 {
+			block, lo = &s.index.blocks[i], s.index.blocks[i].key
+		}
+	}
+	stream, err := s.open(block)
+	if err != nil {
+		return err
+	}
+
+	var entries []kvEntry
+	for stream.count > 0 {
+		entry, err := s.decode(stream)
+		if err != nil {
+			return err
+		}
+		if entry.flag == rangeDel || (target != "" && entry.key >= target) {
+			break
+		}
+		if len(entries) >= 2*iterWindow && entries[len(entries)-1].key != entry.key {
+			// Drop the oldest entries, keeping the versions of a key together
+			cut := len(entries) - iterWindow
+			for cut < len(entries) && entries[cut].key == entries[cut-1].key {
+				cut++
+			}
+			lo = entry.key
+			if cut < len(entries) {
+				lo = entries[cut].key
+			}
+			entries = append([]kvEntry(nil), entries[cut:]...)
+		}
+		entries = append(entries, entry)
+	}
+	s.entries, s.lo, s.hi, s.loaded = entries, lo, target, true
+	return nil
+}
+
+// prefixEnd returns the smallest key greater than every key starting with prefix,
+// or an empty string if there is none (the prefix only contains 0xff bytes).
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Valid reports whether the Iterator is positioned on a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key at the current position. Only meaningful when Valid() is true.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value at the current position. Only meaningful when Valid() is true.
+// The returned slice must not be modified.
+func (it *Iterator) Value() []byte {
+	return it.val
+}
+
+// First positions the Iterator on the smallest key and reports whether it is valid.
+func (it *Iterator) First() bool {
+	return it.forward(it.lower, true)
+}
+
+// Last positions the Iterator on the largest key and reports whether it is valid.
+func (it *Iterator) Last() bool {
+	if it.upper == "" {
+		return it.backward("", false, true)
+	}
+	return it.backward(it.upper, false, false)
+}
+
+// Seek positions the Iterator on the first key greater than or equal to key and reports whether it is valid.
+func (it *Iterator) Seek(key string) bool {
+	if key < it.lower {
+		key = it.lower
+	}
+	return it.forward(key, true)
+}
+
+// SeekForPrev positions the Iterator on the last key less than or equal to key and reports whether it is valid.
+func (it *Iterator) SeekForPrev(key string) bool {
+	if it.upper != "" && key >= it.upper {
+		return it.backward(it.upper, false, false)
+	}
+	return it.backward(key, true, false)
+}
+
+// Next moves the Iterator to the following key and reports whether it is still valid.
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	return it.forward(it.key, false)
+}
+
+// Prev moves the Iterator to the preceding key and reports whether it is still valid.
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	return it.backward(it.key, false, false)
+}
+
+// Close releases the data and the files held by the Iterator.
+func (it *Iterator) Close() {
+	for _, source := range it.sources {
+		if source.file != nil {
+			source.file.Close()
+		}
+	}
+	it.sources = nil
+	it.valid = false
+	it.val = nil
+}
+
+// forward positions the Iterator on the first live key after target (or at target if inclusive).
+// Deleted keys are skipped. Reports whether a key was found within the bounds.
+func (it *Iterator) forward(target string, inclusive bool) bool {
+	for {
+		if it.cancelled() {
+			return false
+		}
+		if !inclusive {
+			// The smallest key greater than target
+			target += "\x00"
+		}
+		// The candidate is the smallest key among all sources
+		found := false
+		candidate := ""
+		for _, source := range it.sources {
+			key, ok, err := source.seek(target)
+			if err != nil {
+				return it.fail(err)
+			}
+			if ok && (!found || key < candidate) {
+				candidate, found = key, true
+			}
+		}
+		if !found || (it.upper != "" && candidate >= it.upper) {
+			it.valid = false
+			return false
+		}
+		live, err := it.resolve(candidate)
+		if err != nil {
+			return it.fail(err)
+		}
+		if live {
+			return true
+		}
+		// The candidate was deleted, continue after it
+		target, inclusive = candidate, false
+	}
+}
+
+// backward positions the Iterator on the last live key before target (or at target if inclusive).
+// If unbounded is true, target is ignored and the search starts from the largest key.
+// Deleted keys are skipped. Reports whether a key was found within the bounds.
+func (it *Iterator) backward(target string, inclusive bool, unbounded bool) bool {
+	for {
+		if it.cancelled() {
+			return false
+		}
+		before := ""
+		if !unbounded {
+			before = target
+			if inclusive {
+				// The smallest key greater than target
+				before += "\x00"
+			}
+		}
+		// The candidate is the largest key among all sources
+		found := false
+		candidate := ""
+		for _, source := range it.sources {
+			key, ok, err := source.seekBefore(before)
+			if err != nil {
+				return it.fail(err)
+			}
+			if ok && (!found || key > candidate) {
+				candidate, found = key, true
+			}
+		}
+		if !found || candidate < it.lower {
+			it.valid = false
+			return false
+		}
+		live, err := it.resolve(candidate)
+		if err != nil {
+			return it.fail(err)
+		}
+		if live {
+			return true
+		}
+		// The candidate was deleted, continue before it
+		target, inclusive, unbounded = candidate, false, false
+	}
+}
+
+// cancelled reports whether the context of the Iterator is done, in which case the Iterator becomes invalid
+// and its error is recorded. It is checked for every candidate key, so that long runs of deleted keys are interrupted too.
+func (it *Iterator) cancelled() bool {
+	if err := it.ctx.Err(); err != nil {
+		it.fail(err)
+		return true
+	}
+	return false
+}
+
+// fail records err as the error of the Iterator, unless it already has one, and makes the Iterator invalid.
+// Returns false.
+func (it *Iterator) fail(err error) bool {
+	if it.err == nil {
+		it.err = err
+	}
+	it.valid = false
+	return false
+}
+
+// resolve looks up the newest version of key visible at the Iterator's sequence number, across all sources.
+// Merge operands are combined with the older versions of the key, and range tombstones delete the older versions.
+// Positions the Iterator on key and returns true if that version is not a deletion, and any encountered error while
+// reading an SST file.
+func (it *Iterator) resolve(key string) (bool, error) {
+	var newest, tombstone kvEntry
+	found, deleted := false, false
+	windows := make([][]kvEntry, 0, len(it.sources))
+	for _, source := range it.sources {
+		entries, rangeDels, err := source.versions(key)
+		if err != nil {
+			return false, err
+		}
+		windows = append(windows, entries)
+		// On a tie (versions written before sequence numbers), the newest source wins
+		if entry, ok := findVersion(entries, key, it.seq); ok && (!found || entry.seq > newest.seq) {
+			newest, found = entry, true
+		}
+		if r, ok := coveringRangeDel(rangeDels, key, it.seq); ok && (!deleted || r.seq > tombstone.seq) {
+			tombstone, deleted = r, true
+		}
+	}
+	if deleted && (!found || tombstone.seq > newest.seq) {
+		newest, found = tombstone, true
+	}
+	if found && newest.flag == merge {
+		var versions []kvEntry
+		for _, entries := range windows {
+			versions = append(versions, findVersions(entries, key, it.seq)...)
+		}
+		if deleted {
+			versions = append(versions, tombstone)
+		}
+		var err error
+		if newest, found, err = mergeVersions(it.mergeOperator, versions, it.now); err != nil {
+			if it.err == nil {
+				it.err = err
+			}
+			return false, nil
+		}
+	}
+	if !found || newest.flag == del || newest.expired(it.now) {
+		return false, nil
+	}
+	it.key, it.val, it.valid = key, newest.val, true
+	return true, nil
+}
+
+// Err returns the first error encountered while reading an SST file, which stops the iteration, or while combining
+// merge operands, or the error of the context of the Iterator if it stopped the iteration. Keys whose operands could
+// not be combined are skipped.
+func (it *Iterator) Err() error {
+	return it.err
+}
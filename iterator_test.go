@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// newTestDB creates a fileDB whose WAL and SST files live in a temporary directory.
+func newTestDB(t testing.TB) *fileDB {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	db, err := newDB()
+	if err != nil {
+		t.Fatal("Error creating a new DB:", err)
+	}
+	t.Cleanup(func() { db.wal.Close() })
+	return db
+}
+
+func TestIterator(t *testing.T) {
+	db := newTestDB(t)
+
+	// Spread the keys over several SST files and the Memtable
+	for i := 0; i < 25; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	// Shadow a flushed version and delete flushed keys
+	if err := db.Set("key03", []byte("new")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	for _, key := range []string{"key00", "key05", "key24"} {
+		if _, err := db.Del(key); err != nil {
+			t.Fatalf("Error deleting key: %s", err)
+		}
+	}
+
+	it, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("Error creating iterator: %s", err)
+	}
+	defer it.Close()
+
+	var keys []string
+	for ok := it.First(); ok; ok = it.Next() {
+		keys = append(keys, it.Key())
+		if it.Key() == "key03" && string(it.Value()) != "new" {
+			t.Fatalf("Expected shadowing value new, got %s", it.Value())
+		}
+	}
+	if len(keys) != 22 || keys[0] != "key01" || keys[len(keys)-1] != "key23" {
+		t.Fatalf("Unexpected forward keys: %v", keys)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] || keys[i] == "key05" {
+			t.Fatalf("Unexpected forward keys: %v", keys)
+		}
+	}
+
+	// Reverse iteration visits the same keys
+	n := 0
+	for ok := it.Last(); ok; ok = it.Prev() {
+		n++
+		if it.Key() != keys[len(keys)-n] {
+			t.Fatalf("Expected key %s, got %s", keys[len(keys)-n], it.Key())
+		}
+	}
+	if n != len(keys) {
+		t.Fatalf("Expected %d keys in reverse, got %d", len(keys), n)
+	}
+
+	// Seek lands on the next live key
+	if !it.Seek("key05") || it.Key() != "key06" {
+		t.Fatalf("Expected Seek to land on key06, got %s", it.Key())
+	}
+	if !it.SeekForPrev("key05") || it.Key() != "key04" {
+		t.Fatalf("Expected SeekForPrev to land on key04, got %s", it.Key())
+	}
+
+	// Edge case: Seek past the last key
+	if it.Seek("zzz") {
+		t.Fatal("Expected Seek past the last key to be invalid")
+	}
+}
+
+func TestIteratorBounds(t *testing.T) {
+	db := newTestDB(t)
+
+	for _, key := range []string{"a", "b/1", "b/2", "b/3", "c"} {
+		if err := db.Set(key, []byte(key)); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+
+	collect := func(opts *IterOptions) (keys []string) {
+		it, err := db.NewIterator(opts)
+		if err != nil {
+			t.Fatalf("Error creating iterator: %s", err)
+		}
+		defer it.Close()
+		for ok := it.First(); ok; ok = it.Next() {
+			keys = append(keys, it.Key())
+		}
+		return keys
+	}
+
+	if keys := collect(&IterOptions{Prefix: "b/"}); fmt.Sprint(keys) != "[b/1 b/2 b/3]" {
+		t.Fatalf("Unexpected prefix keys: %v", keys)
+	}
+	if keys := collect(&IterOptions{LowerBound: "b/2", UpperBound: "c"}); fmt.Sprint(keys) != "[b/2 b/3]" {
+		t.Fatalf("Unexpected bounded keys: %v", keys)
+	}
+
+	// Edge case: Last honors the exclusive upper bound
+	it, err := db.NewIterator(&IterOptions{UpperBound: "b/3"})
+	if err != nil {
+		t.Fatalf("Error creating iterator: %s", err)
+	}
+	defer it.Close()
+	if !it.Last() || it.Key() != "b/2" {
+		t.Fatalf("Expected Last to land on b/2, got %s", it.Key())
+	}
+}
+
+func TestIteratorWindows(t *testing.T) {
+	db, err := openDB(t.TempDir(), Options{MemLimit: 700, CompactingSize: 3})
+	if err != nil {
+		t.Fatalf("Error opening DB: %s", err)
+	}
+	defer db.Close()
+
+	// Several times more keys than an SST file window, shadowed and deleted across files
+	expected := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		if err := db.Set(key, []byte(key)); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+		expected[key] = key
+	}
+	for i := 0; i < 2000; i += 7 {
+		key := fmt.Sprintf("k%04d", i)
+		if err := db.Set(key, []byte("new")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+		expected[key] = "new"
+	}
+	for i := 0; i < 2000; i += 11 {
+		key := fmt.Sprintf("k%04d", i)
+		if _, err := db.Del(key); err != nil {
+			t.Fatalf("Error deleting key: %s", err)
+		}
+		delete(expected, key)
+	}
+	if err := db.DeleteRange("k0500", "k0900"); err != nil {
+		t.Fatalf("Error deleting range: %s", err)
+	}
+	for i := 500; i < 900; i++ {
+		delete(expected, fmt.Sprintf("k%04d", i))
+	}
+	var keys []string
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	it, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("Error creating iterator: %s", err)
+	}
+	defer it.Close()
+
+	n := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		if n >= len(keys) || it.Key() != keys[n] || string(it.Value()) != expected[keys[n]] {
+			t.Fatalf("Unexpected key %s=%s at position %d", it.Key(), it.Value(), n)
+		}
+		n++
+	}
+	if n != len(keys) {
+		t.Fatalf("Expected %d keys, got %d", len(keys), n)
+	}
+	for ok := it.Last(); ok; ok = it.Prev() {
+		n--
+		if it.Key() != keys[n] || string(it.Value()) != expected[keys[n]] {
+			t.Fatalf("Unexpected key %s=%s at position %d in reverse", it.Key(), it.Value(), n)
+		}
+	}
+	if n != 0 || it.Err() != nil {
+		t.Fatalf("Expected every key in reverse, %d left, error %v", n, it.Err())
+	}
+
+	// Seeks jump back and forth between windows
+	for _, target := range []string{"k1990", "k0010", "k0500", "k1500", "k0899", "k0001"} {
+		i := sort.SearchStrings(keys, target)
+		if !it.Seek(target) || it.Key() != keys[i] {
+			t.Fatalf("Expected Seek(%s) to land on %s, got %s", target, keys[i], it.Key())
+		}
+		if keys[i] != target {
+			i--
+		}
+		if !it.SeekForPrev(target) || it.Key() != keys[i] {
+			t.Fatalf("Expected SeekForPrev(%s) to land on %s, got %s", target, keys[i], it.Key())
+		}
+	}
+}
+
+func TestIteratorBlocks(t *testing.T) {
+	const count = 5000
+	dir := t.TempDir()
+	db, err := openDB(dir, Options{MemLimit: 2 * count})
+	if err != nil {
+		t.Fatalf("Error opening DB: %s", err)
+	}
+	for i := 0; i < count; i++ {
+		if err := db.Set(fmt.Sprintf("k%05d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Error closing DB: %s", err)
+	}
+
+	// iterate counts the keys and the entries decoded from the SST file by a scan from the lower bound, stopping
+	// after limit keys
+	iterate := func(lower string, limit int) (int, int) {
+		t.Helper()
+		db, err := openDB(dir, Options{MemLimit: 2 * count})
+		if err != nil {
+			t.Fatalf("Error opening DB: %s", err)
+		}
+		defer db.Close()
+		it, err := db.NewIterator(&IterOptions{LowerBound: lower})
+		if err != nil {
+			t.Fatalf("Error creating iterator: %s", err)
+		}
+		defer it.Close()
+		keys := 0
+		for ok := it.First(); ok && keys < limit; ok = it.Next() {
+			if want := fmt.Sprintf("k%05d", keys); lower == "" && it.Key() != want {
+				t.Fatalf("Expected %s, got %s", want, it.Key())
+			}
+			keys++
+		}
+		if it.Err() != nil {
+			t.Fatalf("Error iterating: %s", it.Err())
+		}
+		decoded := 0
+		for _, source := range it.sources {
+			decoded += source.decoded
+		}
+		return keys, decoded
+	}
+
+	// A scan spanning many windows decodes each entry once
+	if keys, decoded := iterate("", count); keys != count || decoded != count {
+		t.Fatalf("Expected %d keys and entries decoded, got %d keys and %d entries", count, keys, decoded)
+	}
+	// A page starting in the middle of the file starts decoding from the block holding its first key
+	if keys, decoded := iterate("k03000", 100); keys != 100 || decoded > sstBlockEntries+iterWindow+1 {
+		t.Fatalf("Expected 100 keys from at most %d entries decoded, got %d keys and %d entries", sstBlockEntries+iterWindow+1, keys, decoded)
+	}
+
+	// Files compressed in one piece, without index, are still read
+	files, err := filepath.Glob(filepath.Join(dir, "db_*.sst"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one SST file, got %v (%v)", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := decompress(sstContent(data))
+	if err != nil {
+		t.Fatalf("Error decompressing the SST file: %s", err)
+	}
+	if data, err = compress(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(files[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := iterate("", count); keys != count {
+		t.Fatalf("Expected %d keys from the file compressed in one piece, got %d", count, keys)
+	}
+	if keys, _ := iterate("k03000", count); keys != count-3000 {
+		t.Fatalf("Expected %d keys from k03000, got %d", count-3000, keys)
+	}
+}
@@ -1,37 +1,142 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 const (
-	set            = byte(0)
-	del            = byte(1)
-	walFileName    = "db.wal"
-	sstFileName    = "db_%s.sst"
-	magicNumber    = 1234
-	version        = uint16(1)
-	memLimit       = 10
-	compactingSize = 5
+	set                 = byte(0)
+	del                 = byte(1)
+	batch               = byte(2) // WAL record holding a whole WriteBatch
+	merge               = byte(3) // Merge operand, combined with the older versions of its key by the MergeOperator
+	setWithExpiry       = byte(4) // On-disk flag of a set carrying an expiry time
+	rangeDel            = byte(5) // Range tombstone deleting the keys from its key up to its value, excluded
+	cfBatch             = byte(6) // WAL record holding a WriteBatch whose entries are prefixed by their column family
+	walFileName         = "db.wal"
+	walArchiveDir       = "wal_archive" // Directory of the Write-Ahead Logs already flushed, kept for the watchers
+	archivedWALFileName = "db_%020d.wal"
+	walArchiveRetention = 64 // Number of archived Write-Ahead Logs kept
+	sstFileName         = "db_%s.sst"
+	magicNumber         = 1234
+	version             = uint16(2)
+	legacyVersion       = uint16(1) // SST files without sequence numbers
+	sstBlockMagic       = "GSST"    // Start of the SST files compressed block by block, with a sparse index
+	sstBlockEntries     = 128       // Number of entries of an SST file compressed together, more for the versions of a key
+	memLimit            = 10
+	compactingSize      = 5
+	maxKeySize          = 64 << 10 // Largest key, in bytes
+	maxValueSize        = 16 << 20 // Largest value, in bytes
 )
 
 // main is the entry point of the application.
-// Initializes a new fileDB, recovers the Memtable from the Write-Ahead Log, and starts an HTTP server.
+// Initializes a new fileDB, recovers the Memtable from the Write-Ahead Log, and starts an HTTP server,
+// along with Redis, memcached and binary protocol servers if the -resp, -memcached and -binary flags are set.
+// The -timeout flag bounds the duration of each request. With the -follow flag, the database is a read-only
+// follower replicating the primary server at the given URL. With the -raft-id flag, the server is a node of a Raft
+// cluster whose members are given by -raft-peers, writing through the Raft log.
+// The server stops on SIGINT or SIGTERM, closing the database.
 func main() {
+	timeout := flag.Duration("timeout", defaultRequestTimeout, "Maximum duration of a request, 0 for no limit")
+	respAddr := flag.String("resp", "", "Address of the Redis protocol server, such as :6379, empty to disable it")
+	binaryAddr := flag.String("binary", "", "Address of the binary protocol server, such as :7070, empty to disable it")
+	memcachedAddr := flag.String("memcached", "", "Address of the memcached protocol server, such as :11211, empty to disable it")
+	primary := flag.String("follow", "", "URL of the primary server to replicate, such as http://primary:8080, empty for a primary")
+	raftID := flag.String("raft-id", "", "Base URL of this server as a node of a Raft cluster, such as http://node1:8080, empty outside a cluster")
+	raftPeers := flag.String("raft-peers", "", "Comma-separated base URLs of the nodes bootstrapping the Raft cluster, this one included, empty to join an existing cluster")
+	flag.Parse()
+	if *primary != "" && *raftID != "" {
+		fmt.Println("The -follow and -raft-id flags are exclusive")
+		return
+	}
+
 	db, err := newDB()
 	if err != nil {
 		fmt.Println("Error in the WAL:", err)
 		return
 	}
-	defer db.wal.Close()
-	defer db.flush()
+	defer db.Close()
 
 	if _, err := os.Stat(walFileName); err == nil {
 		db.recoverWAL()
 	}
+	if *primary != "" {
+		if err := db.Follow(*primary); err != nil {
+			fmt.Println("Error following the primary:", err)
+			return
+		}
+	}
+
+	if *respAddr != "" {
+		ln, err := net.Listen("tcp", *respAddr)
+		if err != nil {
+			fmt.Println("Error starting the Redis protocol server:", err)
+			return
+		}
+		go newRESPServer(db, *timeout).serve(ln)
+	}
+	if *memcachedAddr != "" {
+		srv, err := newMemcachedServer(db, *timeout)
+		if err != nil {
+			fmt.Println("Error starting the memcached server:", err)
+			return
+		}
+		ln, err := net.Listen("tcp", *memcachedAddr)
+		if err != nil {
+			fmt.Println("Error starting the memcached server:", err)
+			return
+		}
+		go srv.serve(ln)
+	}
+	if *binaryAddr != "" {
+		ln, err := net.Listen("tcp", *binaryAddr)
+		if err != nil {
+			fmt.Println("Error starting the binary protocol server:", err)
+			return
+		}
+		go newBinaryServer(db, *timeout).serve(ln)
+	}
+
+	// The cursors of the webhooks cannot be written outside the Raft log: a cluster node does not deliver them
+	var hooks *webhookManager
+	if *raftID == "" {
+		hooks = newWebhookManager(db, defaultWebhookOptions)
+		defer hooks.stop()
+	}
+	handler := handleFunction(db, hooks)
+	if *raftID != "" {
+		var peers []string
+		if *raftPeers != "" {
+			peers = strings.Split(*raftPeers, ",")
+		}
+		node, err := newRaftNode(*raftID, db, newHTTPRaftTransport(), peers, defaultRaftOptions)
+		if err != nil {
+			fmt.Println("Error starting the Raft node:", err)
+			return
+		}
+		defer node.Stop()
+		handler = handleCluster(node, handler)
+	}
 
-	http.HandleFunc("/", handleFunction(db))
-	http.ListenAndServe(":8080", nil)
+	// On SIGINT or SIGTERM, the server stops accepting requests, then the deferred calls stop the deliveries
+	// of the webhooks, the Raft node and the database
+	srv := &http.Server{Addr: ":8080", Handler: withTimeout(handler, *timeout)}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Println("Error starting the HTTP server:", err)
+	}
 }
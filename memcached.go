@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	memcachedFlagsFamily  = "memcached_flags" // Column family of the client flags of the memcached items
+	maxMemcachedKeySize   = 250               // Largest key accepted by memcached clients, in bytes
+	maxMemcachedLineSize  = 2048              // Largest command line, in bytes
+	memcachedRelativeTime = 30 * 24 * 60 * 60 // Largest exptime counted from now, in seconds; larger ones are Unix times
+)
+
+// errMemcachedClient is returned when a client sends a malformed command.
+var errMemcachedClient = errors.New("bad command line format")
+
+// memcachedServer serves the memcached text protocol over TCP, so that memcached clients can use the database.
+// Items are the keys of the database. Their client flags are stored in the memcachedFlagsFamily column family,
+// written in the same batch as the value, just before it: flags whose version does not immediately precede the one
+// of the value belong to an older value, as for a key written through another protocol, and read as 0.
+// The CAS unique of an item is its version, the sequence number of its last write.
+type memcachedServer struct {
+	db      *fileDB
+	flags   *fileDB
+	timeout time.Duration // Maximum duration of a command, 0 for no limit
+}
+
+// memcachedItem is the value of a key along with its memcached attributes.
+type memcachedItem struct {
+	val    []byte
+	flags  uint32
+	expiry int64  // Expiry time in Unix nanoseconds, 0 if the item never expires
+	cas    uint64 // Version of the item
+}
+
+// newMemcachedServer creates a memcachedServer for db, whose commands give up after timeout.
+// Returns the server and any encountered error while opening the column family of the flags.
+func newMemcachedServer(db *fileDB, timeout time.Duration) (*memcachedServer, error) {
+	flags, err := db.OpenColumnFamily(memcachedFlagsFamily, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &memcachedServer{db, flags, timeout}, nil
+}
+
+// serve accepts connections on ln and serves each of them in its own goroutine.
+// Returns when ln is closed, with the error of Accept.
+func (srv *memcachedServer) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.handleConn(conn)
+	}
+}
+
+// handleConn reads the commands of a connection and writes their replies until the client disconnects or sends quit.
+// Replies are flushed once no more pipelined command is buffered.
+func (srv *memcachedServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readMemcachedLine(r)
+		if errors.Is(err, errMemcachedClient) {
+			w.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if fields[0] == "quit" {
+			w.Flush()
+			return
+		} else if err := srv.execute(r, w, fields); err != nil {
+			return // The connection is broken
+		}
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readMemcachedLine reads a command line terminated by CRLF or LF.
+// Returns the line without its terminator and any encountered error.
+func readMemcachedLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxMemcachedLineSize {
+			return "", fmt.Errorf("%w: line too long", errMemcachedClient)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// execute runs a command and writes its reply, within the command timeout of the server.
+// Returns an error if the data block of a storage command cannot be read, which breaks the connection.
+func (srv *memcachedServer) execute(r *bufio.Reader, w *bufio.Writer, fields []string) error {
+	ctx := context.Background()
+	if srv.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.timeout)
+		defer cancel()
+	}
+
+	switch cmd, args := fields[0], fields[1:]; cmd {
+	case "get", "gets":
+		srv.get(ctx, w, args, cmd == "gets")
+	case "set", "add", "replace", "cas":
+		return srv.store(ctx, r, w, cmd, args)
+	case "delete":
+		srv.delete(ctx, w, args)
+	case "incr", "decr":
+		srv.incr(ctx, w, args, cmd == "decr")
+	case "version":
+		w.WriteString("VERSION goDB\r\n")
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+	return nil
+}
+
+// get writes the items of the given keys that exist: get <key>*, or gets <key>* with their CAS unique.
+func (srv *memcachedServer) get(ctx context.Context, w *bufio.Writer, keys []string, withCAS bool) {
+	if len(keys) == 0 || !validMemcachedKeys(keys) {
+		w.WriteString("CLIENT_ERROR " + errMemcachedClient.Error() + "\r\n")
+		return
+	}
+	srv.db.mu.RLock()
+	defer srv.db.mu.RUnlock()
+
+	for _, key := range keys {
+		item, found, err := srv.lookup(ctx, key)
+		if err != nil {
+			w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+			return
+		}
+		if !found {
+			continue
+		}
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.val), item.cas)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.flags, len(item.val))
+		}
+		w.Write(item.val)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// store runs a storage command, whose data block follows the command line:
+// set|add|replace <key> <flags> <exptime> <bytes> [noreply], or cas <key> <flags> <exptime> <bytes> <cas unique> [noreply].
+// Returns an error if the data block cannot be read.
+func (srv *memcachedServer) store(ctx context.Context, r *bufio.Reader, w *bufio.Writer, cmd string, args []string) error {
+	n := 4
+	if cmd == "cas" {
+		n = 5
+	}
+	noreply := len(args) == n+1 && args[n] == "noreply"
+	if len(args) != n && !noreply {
+		w.WriteString("ERROR\r\n")
+		return nil
+	}
+	flags, errFlags := strconv.ParseUint(args[1], 10, 32)
+	exptime, errExptime := strconv.ParseInt(args[2], 10, 64)
+	size, errSize := strconv.Atoi(args[3])
+	var unique uint64
+	var errUnique error
+	if cmd == "cas" {
+		unique, errUnique = strconv.ParseUint(args[4], 10, 64)
+	}
+	if !validMemcachedKeys(args[:1]) || errFlags != nil || errExptime != nil || errSize != nil || size < 0 || errUnique != nil {
+		w.WriteString("CLIENT_ERROR " + errMemcachedClient.Error() + "\r\n")
+		return nil
+	}
+	if size > maxValueSize {
+		// The data block is skipped so that the next command can be read
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return err
+		}
+		w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		// The data block is longer than announced: its end is skipped up to the end of the line
+		if data[size+1] != '\n' {
+			if _, err := readMemcachedLine(r); err != nil && !errors.Is(err, errMemcachedClient) {
+				return err
+			}
+		}
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return nil
+	}
+
+	key := args[0]
+	next := memcachedItem{data[:size], uint32(flags), memcachedExpiry(exptime, time.Now()), 0}
+	err := srv.update(ctx, key, func(item memcachedItem, exists bool) (*memcachedItem, error) {
+		switch {
+		case cmd == "add" && exists:
+			return nil, ErrConditionFailed
+		case (cmd == "replace" || cmd == "cas") && !exists:
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+		case cmd == "cas" && item.cas != unique:
+			return nil, ErrConditionFailed
+		}
+		return &next, nil
+	})
+
+	reply := "STORED"
+	switch {
+	case cmd == "cas" && errors.Is(err, ErrNotFound):
+		reply = "NOT_FOUND"
+	case cmd == "cas" && errors.Is(err, ErrConditionFailed):
+		reply = "EXISTS"
+	case errors.Is(err, ErrNotFound) || errors.Is(err, ErrConditionFailed):
+		reply = "NOT_STORED"
+	case err != nil:
+		reply = "SERVER_ERROR " + err.Error()
+	}
+	if !noreply {
+		w.WriteString(reply + "\r\n")
+	}
+	return nil
+}
+
+// delete deletes an item: delete <key> [noreply].
+func (srv *memcachedServer) delete(ctx context.Context, w *bufio.Writer, args []string) {
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if (len(args) != 1 && !noreply) || !validMemcachedKeys(args[:1]) {
+		w.WriteString("CLIENT_ERROR " + errMemcachedClient.Error() + "\r\n")
+		return
+	}
+	err := srv.update(ctx, args[0], func(_ memcachedItem, exists bool) (*memcachedItem, error) {
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, args[0])
+		}
+		return nil, nil
+	})
+
+	reply := "DELETED"
+	if errors.Is(err, ErrNotFound) {
+		reply = "NOT_FOUND"
+	} else if err != nil {
+		reply = "SERVER_ERROR " + err.Error()
+	}
+	if !noreply {
+		w.WriteString(reply + "\r\n")
+	}
+}
+
+// incr adds to or subtracts from the decimal value of an item: incr|decr <key> <value> [noreply].
+// Like memcached, values are unsigned 64-bit integers: incr wraps around and decr stops at 0.
+// The item keeps its flags and expiry time.
+func (srv *memcachedServer) incr(ctx context.Context, w *bufio.Writer, args []string, decr bool) {
+	noreply := len(args) == 3 && args[2] == "noreply"
+	if (len(args) != 2 && !noreply) || !validMemcachedKeys(args[:1]) {
+		w.WriteString("CLIENT_ERROR " + errMemcachedClient.Error() + "\r\n")
+		return
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+		return
+	}
+
+	var counter uint64
+	err = srv.update(ctx, args[0], func(item memcachedItem, exists bool) (*memcachedItem, error) {
+		if !exists {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, args[0])
+		}
+		current, err := strconv.ParseUint(string(item.val), 10, 64)
+		if err != nil {
+			return nil, ErrNotACounter
+		}
+		switch {
+		case !decr:
+			counter = current + delta
+		case delta > current:
+			counter = 0
+		default:
+			counter = current - delta
+		}
+		item.val = []byte(strconv.FormatUint(counter, 10))
+		return &item, nil
+	})
+
+	reply := strconv.FormatUint(counter, 10)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		reply = "NOT_FOUND"
+	case errors.Is(err, ErrNotACounter):
+		reply = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	case err != nil:
+		reply = "SERVER_ERROR " + err.Error()
+	}
+	if !noreply {
+		w.WriteString(reply + "\r\n")
+	}
+}
+
+// lookup reads the item of a key with its flags. The caller must hold srv.db.mu.
+// Returns the item, whether it exists and any encountered error.
+func (srv *memcachedServer) lookup(ctx context.Context, key string) (memcachedItem, bool, error) {
+	entry, found, err := srv.db.resolveAt(ctx, key, srv.db.seq)
+	if err != nil || !found {
+		return memcachedItem{}, false, err
+	}
+	item := memcachedItem{entry.val, 0, entry.expiry, entry.seq}
+	flags, found, err := srv.flags.resolveAt(ctx, key, srv.db.seq)
+	if err != nil {
+		return memcachedItem{}, false, err
+	}
+	if found && flags.seq == entry.seq-1 {
+		if f, err := strconv.ParseUint(string(flags.val), 10, 32); err == nil {
+			item.flags = uint32(f)
+		}
+	}
+	return item, true, nil
+}
+
+// update atomically reads the item of a key and replaces it by the result of fn, or deletes it if fn returns nil.
+// The flags and the value of the item are written in the same batch, so that they share its fate after a crash.
+// Returns the error of fn, or any encountered error.
+func (srv *memcachedServer) update(ctx context.Context, key string, fn func(item memcachedItem, exists bool) (*memcachedItem, error)) error {
+	srv.db.mu.Lock()
+	defer srv.db.mu.Unlock()
+
+	item, exists, err := srv.lookup(ctx, key)
+	if err != nil {
+		return err
+	}
+	next, err := fn(item, exists)
+	if err != nil {
+		return err
+	}
+
+	b := WriteBatch{}
+	if next == nil {
+		b.DelCF(srv.flags, key)
+		b.Del(key)
+	} else {
+		// The flags come first, so that their version immediately precedes the one of the value
+		flags := []byte(strconv.FormatUint(uint64(next.flags), 10))
+		b.ops = append(b.ops, batchOp{srv.flags.name, key, value{set, flags, next.expiry}})
+		b.ops = append(b.ops, batchOp{"", key, value{set, next.val, next.expiry}})
+	}
+	return srv.db.write(ctx, &b)
+}
+
+// memcachedExpiry converts an exptime to an expiry time in Unix nanoseconds.
+// An exptime of 0 never expires, a negative one has already expired, one up to 30 days is a number of seconds
+// from now, and a larger one is a Unix time.
+func memcachedExpiry(exptime int64, now time.Time) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return now.UnixNano()
+	case exptime <= memcachedRelativeTime:
+		return now.Add(time.Duration(exptime) * time.Second).UnixNano()
+	case exptime > math.MaxInt64/int64(time.Second):
+		return math.MaxInt64
+	}
+	return time.Unix(exptime, 0).UnixNano()
+}
+
+// validMemcachedKeys reports whether keys can be used by memcached clients: at most 250 bytes without control characters.
+func validMemcachedKeys(keys []string) bool {
+	for _, key := range keys {
+		if len(key) > maxMemcachedKeySize {
+			return false
+		}
+		for i := 0; i < len(key); i++ {
+			if key[i] <= ' ' || key[i] == 0x7f {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// newMemcachedConn starts a memcached server for db on a random port and connects to it.
+func newMemcachedConn(t *testing.T, db *fileDB) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	srv, err := newMemcachedServer(db, time.Second)
+	if err != nil {
+		t.Fatalf("Error creating the memcached server: %s", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go srv.serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// memcachedDo sends a raw request and checks that the reply is exactly want.
+func memcachedDo(t *testing.T, conn net.Conn, r *bufio.Reader, request, want string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Error sending %q: %s", request, err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("Error reading %q: %s (got %q)", want, err, got)
+	}
+	if string(got) != want {
+		t.Fatalf("Expected %q for %q, got %q", want, request, got)
+	}
+}
+
+func TestMemcachedCommands(t *testing.T) {
+	db := newTestDB(t)
+	conn, r := newMemcachedConn(t, db)
+	do := func(request, want string) {
+		t.Helper()
+		memcachedDo(t, conn, r, request, want)
+	}
+
+	do("set user 42 0 3\r\nbob\r\n", "STORED\r\n")
+	do("get user\r\n", "VALUE user 42 3\r\nbob\r\nEND\r\n")
+	do("get missing user missing\r\n", "VALUE user 42 3\r\nbob\r\nEND\r\n")
+
+	// The values are shared with the other protocols
+	if val, err := db.Get("user"); err != nil || string(val) != "bob" {
+		t.Fatalf("Expected bob, got %s (%v)", val, err)
+	}
+	if err := db.Set("other", []byte("x")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	do("get other\r\n", "VALUE other 0 1\r\nx\r\nEND\r\n")
+
+	// A key written by another protocol loses its flags
+	if err := db.Set("user", []byte("alice")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	do("get user\r\n", "VALUE user 0 5\r\nalice\r\nEND\r\n")
+
+	do("add user 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	do("add new 7 0 1\r\nx\r\n", "STORED\r\n")
+	do("replace missing 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	do("replace new 8 0 1\r\ny\r\n", "STORED\r\n")
+	do("get new\r\n", "VALUE new 8 1\r\ny\r\nEND\r\n")
+
+	// Binary-safe data blocks
+	do("set bin 0 0 4\r\na\r\nb\r\n", "STORED\r\n")
+	do("get bin\r\n", "VALUE bin 0 4\r\na\r\nb\r\nEND\r\n")
+
+	do("delete new\r\n", "DELETED\r\n")
+	do("delete new\r\n", "NOT_FOUND\r\n")
+	do("delete bin noreply\r\nget bin\r\n", "END\r\n")
+
+	// Counters
+	do("set n 5 0 2\r\n10\r\n", "STORED\r\n")
+	do("incr n 5\r\n", "15\r\n")
+	do("decr n 20\r\n", "0\r\n")
+	do("get n\r\n", "VALUE n 5 1\r\n0\r\nEND\r\n")
+	do("incr missing 1\r\n", "NOT_FOUND\r\n")
+	do("incr user 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	do("set max 0 0 20\r\n18446744073709551615\r\nincr max 1\r\n", "STORED\r\n0\r\n")
+
+	// Expiry
+	do("set short 0 -1 1\r\nx\r\nget short\r\n", "STORED\r\nEND\r\n")
+	do("set long 0 100 1\r\nx\r\n", "STORED\r\n")
+	if ttl, expires, err := db.TTL("long"); err != nil || !expires || ttl > 100*time.Second || ttl < 99*time.Second {
+		t.Fatalf("Expected about 100s, got %s, %v (%v)", ttl, expires, err)
+	}
+
+	// Errors
+	do("flush_all\r\n", "ERROR\r\n")
+	do("set k 0 0\r\n", "ERROR\r\n")
+	do("set k abc 0 1\r\nx\r\n", "CLIENT_ERROR bad command line format\r\nERROR\r\n")
+	do("set k 0 0 1\r\nxyz\r\n", "CLIENT_ERROR bad data chunk\r\n")
+	do("version\r\n", "VERSION goDB\r\n")
+}
+
+func TestMemcachedCAS(t *testing.T) {
+	db := newTestDB(t)
+	conn, r := newMemcachedConn(t, db)
+
+	memcachedDo(t, conn, r, "set k 1 0 2\r\nv1\r\n", "STORED\r\n")
+	conn.Write([]byte("gets k\r\n"))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`^VALUE k 1 2 (\d+)\r\n$`).FindStringSubmatch(line)
+	if m == nil {
+		t.Fatalf("Unexpected gets reply %q", line)
+	}
+	memcachedDo(t, conn, r, "", "v1\r\nEND\r\n")
+
+	// The CAS unique is the version of the key
+	if _, version, err := db.GetVersion("k"); err != nil || fmt.Sprint(version) != m[1] {
+		t.Fatalf("Expected the CAS unique %s to be the version %d (%v)", m[1], version, err)
+	}
+
+	unique := m[1]
+	memcachedDo(t, conn, r, "cas k 2 0 2 "+unique+"\r\nv2\r\n", "STORED\r\n")
+	memcachedDo(t, conn, r, "cas k 3 0 2 "+unique+"\r\nv3\r\n", "EXISTS\r\n")
+	memcachedDo(t, conn, r, "cas missing 0 0 1 1\r\nx\r\n", "NOT_FOUND\r\n")
+	memcachedDo(t, conn, r, "get k\r\n", "VALUE k 2 2\r\nv2\r\nEND\r\n")
+
+	// Edge case: the flags survive a flush of the Memtables
+	for i := 0; i < memLimit; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	memcachedDo(t, conn, r, "get k\r\n", "VALUE k 2 2\r\nv2\r\nEND\r\n")
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// MergeOperator combines the merge operands of a key with its existing value.
+// Operands are recorded by Merge without reading the key, and combined lazily by Get, iterators and compaction.
+type MergeOperator interface {
+	// Name identifies the operator.
+	Name() string
+
+	// FullMerge combines the existing value of key, nil if it does not exist, with operands sorted
+	// from the oldest to the newest one.
+	// Returns the combined value and any encountered error.
+	FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// Merge records a merge operand for a key in the Memtable and the Write-Ahead Log, without reading the key.
+// The operand is combined with the value of the key by the MergeOperator of the database when the key is read.
+// Returns any encountered error during the process.
+func (mem *fileDB) Merge(key string, operand []byte) error {
+	return mem.MergeContext(context.Background(), key, operand)
+}
+
+// MergeContext is like Merge, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) MergeContext(ctx context.Context, key string, operand []byte) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	b := WriteBatch{}
+	b.Merge(key, operand)
+	return mem.write(ctx, &b)
+}
+
+// resolveAt looks up the value of a key as of sequence number seq, combining its merge operands if needed.
+// Expired values read as not found. The caller must hold mem.mu.
+// Returns the version with the resolved value, whether the key exists and any encountered error,
+// which is the one of ctx if it is done before all the SST files are read.
+func (mem *fileDB) resolveAt(ctx context.Context, key string, seq uint64) (kvEntry, bool, error) {
+	now := time.Now().UnixNano()
+	entry, found, err := mem.findAt(ctx, key, seq)
+	if err != nil || !found || entry.flag == del || entry.expired(now) {
+		return kvEntry{}, false, err
+	}
+	if entry.flag != merge {
+		return entry, true, nil
+	}
+
+	// Gather all the versions of the key, from the Memtable and the SST files
+	var versions []kvEntry
+	iterator := mem.values.Iterator()
+	if iterator.NextTo(func(k, _ interface{}) bool { return compareInternalKeys(k.(internalKey), internalKey{key, seq}) >= 0 }) {
+		for ok := true; ok && iterator.Key().(internalKey).key == key; ok = iterator.Next() {
+			versions = append(versions, kvEntry{iterator.Key().(internalKey), iterator.Value().(value)})
+		}
+	}
+	if tombstone, ok := coveringRangeDel(mem.rangeDels, key, seq); ok {
+		versions = append(versions, tombstone)
+	}
+	matchingFiles, err := mem.sstFiles()
+	if err != nil {
+		return kvEntry{}, false, err
+	}
+	for i := len(matchingFiles) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return kvEntry{}, false, err
+		}
+		table, err := readSST(matchingFiles[i])
+		if err != nil {
+			return kvEntry{}, false, err
+		}
+		if key >= table.sKey && key <= table.lKey {
+			versions = append(versions, findVersions(table.entries, key, seq)...)
+			if tombstone, ok := coveringRangeDel(table.rangeDels, key, seq); ok {
+				versions = append(versions, tombstone)
+			}
+		}
+	}
+	return mergeVersions(mem.mergeOperator, versions, now)
+}
+
+// mergeVersions combines the newest version of a key with the older ones when it is a merge operand.
+// versions may come from several sources, the newest source first; they are sorted by sequence number here.
+// A value expired at now, in Unix nanoseconds, counts as missing; the combined value keeps the expiry time of its base.
+// Returns the newest version with the combined value, whether the key exists and any encountered error.
+func mergeVersions(op MergeOperator, versions []kvEntry, now int64) (kvEntry, bool, error) {
+	if len(versions) == 0 {
+		return kvEntry{}, false, nil
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].seq > versions[j].seq })
+	newest := versions[0]
+	if newest.flag != merge {
+		return newest, newest.flag != del && !newest.expired(now), nil
+	}
+	if op == nil {
+		return kvEntry{}, false, fmt.Errorf("%w: no merge operator configured", ErrInvalidArgument)
+	}
+
+	// Collect the operands down to the newest set or del
+	var existing []byte
+	var expiry int64
+	var operands [][]byte
+	for _, v := range versions {
+		if v.flag == merge {
+			operands = append(operands, v.val)
+			continue
+		}
+		if v.flag == set && !v.expired(now) {
+			existing, expiry = v.val, v.expiry
+		}
+		break
+	}
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+
+	merged, err := op.FullMerge(newest.key, existing, operands)
+	if err != nil {
+		return kvEntry{}, false, err
+	}
+	return kvEntry{newest.internalKey, value{set, merged, expiry}}, true, nil
+}
+
+// Int64AddOperator adds signed 64-bit integers stored as decimal strings. A missing key counts as 0.
+type Int64AddOperator struct{}
+
+// Name identifies the operator.
+func (Int64AddOperator) Name() string {
+	return "int64add"
+}
+
+// FullMerge adds the operands to the existing value.
+// Returns the sum as a decimal string, or an error on an invalid number or an overflow.
+func (Int64AddOperator) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if existing != nil {
+		n, err := strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid integer value for key %s: %w", key, err)
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(string(operand), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid integer operand for key %s: %w", key, err)
+		}
+		var ok bool
+		if sum, ok = addInt64(sum, n); !ok {
+			return nil, fmt.Errorf("Integer overflow for key %s", key)
+		}
+	}
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+// addInt64 adds two signed 64-bit integers.
+// Returns the sum and false if it overflows.
+func addInt64(a, b int64) (int64, bool) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, false
+	}
+	return a + b, true
+}
+
+// StringAppendOperator appends the operands to the existing value, separated by Separator.
+type StringAppendOperator struct {
+	Separator string
+}
+
+// Name identifies the operator.
+func (StringAppendOperator) Name() string {
+	return "stringappend"
+}
+
+// FullMerge appends the operands to the existing value.
+// Returns the concatenated value.
+func (op StringAppendOperator) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	res := append([]byte{}, existing...)
+	for i, operand := range operands {
+		if existing != nil || i > 0 {
+			res = append(res, op.Separator...)
+		}
+		res = append(res, operand...)
+	}
+	return res, nil
+}
+
+// JSONMergePatchOperator applies the operands as JSON merge patches (RFC 7396) to the existing JSON document.
+type JSONMergePatchOperator struct{}
+
+// Name identifies the operator.
+func (JSONMergePatchOperator) Name() string {
+	return "jsonmergepatch"
+}
+
+// FullMerge applies the patches in order to the existing document, a missing key being an empty document.
+// Returns the patched document and any encountered error on invalid JSON.
+func (JSONMergePatchOperator) FullMerge(key string, existing []byte, operands [][]byte) ([]byte, error) {
+	var doc interface{}
+	if existing != nil {
+		if err := json.Unmarshal(existing, &doc); err != nil {
+			return nil, fmt.Errorf("Invalid JSON value for key %s: %w", key, err)
+		}
+	}
+	for _, operand := range operands {
+		var patch interface{}
+		if err := json.Unmarshal(operand, &patch); err != nil {
+			return nil, fmt.Errorf("Invalid JSON patch for key %s: %w", key, err)
+		}
+		doc = mergePatch(doc, patch)
+	}
+	return json.Marshal(doc)
+}
+
+// mergePatch applies a JSON merge patch to a decoded JSON document.
+// Returns the patched document.
+func mergePatch(doc, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch // A patch that is not an object replaces the whole document
+	}
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = make(map[string]interface{})
+	}
+	for name, field := range fields {
+		if field == nil {
+			delete(target, name)
+		} else {
+			target[name] = mergePatch(target[name], field)
+		}
+	}
+	return target
+}
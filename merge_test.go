@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	db := newTestDB(t)
+	db.mergeOperator = Int64AddOperator{}
+
+	// Operands spread over the Memtable and several SST files, compacted along the way
+	if err := db.Set("counter", []byte("100")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	for i := 0; i < memLimit*compactingSize; i++ {
+		if err := db.Merge("counter", []byte("2")); err != nil {
+			t.Fatalf("Error merging key: %s", err)
+		}
+		if i == memLimit {
+			if val, err := db.Get("counter"); err != nil || string(val) != fmt.Sprint(100+2*(i+1)) {
+				t.Fatalf("Unexpected merged value %s (%v)", val, err)
+			}
+		}
+	}
+	if err := db.Merge("counter", []byte("-1")); err != nil {
+		t.Fatalf("Error merging key: %s", err)
+	}
+	want := fmt.Sprint(100 + 2*memLimit*compactingSize - 1)
+	if val, err := db.Get("counter"); err != nil || string(val) != want {
+		t.Fatalf("Expected merged value %s, got %s (%v)", want, val, err)
+	}
+
+	// Iterators see merged values, including on keys without a base value
+	if err := db.Merge("fresh", []byte("5")); err != nil {
+		t.Fatalf("Error merging key: %s", err)
+	}
+	it, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("Error creating iterator: %s", err)
+	}
+	defer it.Close()
+	if !it.First() || it.Key() != "counter" || string(it.Value()) != want {
+		t.Fatalf("Unexpected first entry %s=%s", it.Key(), it.Value())
+	}
+	if !it.Next() || it.Key() != "fresh" || string(it.Value()) != "5" {
+		t.Fatalf("Unexpected second entry %s=%s", it.Key(), it.Value())
+	}
+
+	// Edge case: a deletion resets the operands
+	if _, err := db.Del("counter"); err != nil {
+		t.Fatalf("Error deleting key: %s", err)
+	}
+	db.Merge("counter", []byte("1"))
+	if val, err := db.Get("counter"); err != nil || string(val) != "1" {
+		t.Fatalf("Expected merged value 1, got %s (%v)", val, err)
+	}
+
+	// Edge case: operands cannot be combined without a merge operator
+	db.mergeOperator = nil
+	if _, err := db.Get("counter"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestMergeOperators(t *testing.T) {
+	tests := []struct {
+		op       MergeOperator
+		existing []byte
+		operands []string
+		want     string
+	}{
+		{Int64AddOperator{}, nil, []string{"1", "2", "-4"}, "-1"},
+		{Int64AddOperator{}, []byte("10"), []string{"5"}, "15"},
+		{StringAppendOperator{","}, nil, []string{"a", "b"}, "a,b"},
+		{StringAppendOperator{","}, []byte("x"), []string{"y"}, "x,y"},
+		{JSONMergePatchOperator{}, []byte(`{"a":1,"b":{"c":2}}`), []string{`{"b":{"c":null,"d":3}}`, `{"e":true}`}, `{"a":1,"b":{"d":3},"e":true}`},
+	}
+	for _, test := range tests {
+		var operands [][]byte
+		for _, operand := range test.operands {
+			operands = append(operands, []byte(operand))
+		}
+		got, err := test.op.FullMerge("key", test.existing, operands)
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s: expected %s, got %s (%v)", test.op.Name(), test.want, got, err)
+		}
+	}
+
+	// Edge case: integer overflow
+	if _, err := (Int64AddOperator{}).FullMerge("key", []byte("9223372036854775807"), [][]byte{[]byte("1")}); err == nil {
+		t.Error("Expected an overflow error")
+	}
+}
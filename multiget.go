@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// MultiGet retrieves the values of several keys at once, as of a single point in time.
+// The keys are sorted and looked up in the Memtable first; the remaining ones are then resolved
+// with a single read of each SST file, instead of one walk over all the SST files per key.
+// Returns the values of the keys that exist, by key, and any encountered error. Missing keys are absent from the result.
+func (mem *fileDB) MultiGet(keys []string) (map[string][]byte, error) {
+	return mem.MultiGetContext(context.Background(), keys)
+}
+
+// MultiGetContext is like MultiGet, but stops reading the SST files with the error of ctx once it is done.
+func (mem *fileDB) MultiGetContext(ctx context.Context, keys []string) (map[string][]byte, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	if mem.closed {
+		return nil, ErrClosed
+	}
+
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	// Look up the Memtable, which holds the newest writes
+	newest := make(map[string]kvEntry, len(sorted))
+	var pending []string
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] {
+			continue // Duplicate key
+		}
+		if entry, found := mem.findInMemtable(key, mem.seq); found {
+			newest[key] = entry
+		} else {
+			pending = append(pending, key)
+		}
+	}
+
+	// Read each SST file once for all the remaining keys
+	if len(pending) > 0 {
+		matchingFiles, err := mem.sstFiles()
+		if err != nil {
+			return nil, err
+		}
+		for i := len(matchingFiles) - 1; i >= 0; i-- {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			table, err := readSST(matchingFiles[i])
+			if err != nil {
+				return nil, err
+			}
+			// Only the sorted keys within the range of the file are searched
+			j := sort.SearchStrings(pending, table.sKey)
+			for ; j < len(pending) && pending[j] <= table.lKey; j++ {
+				key := pending[j]
+				current, found := newest[key]
+				if entry, ok := table.findAt(key, mem.seq); ok && (!found || entry.seq > current.seq) {
+					newest[key] = entry
+				}
+			}
+		}
+	}
+
+	now := time.Now().UnixNano()
+	values := make(map[string][]byte, len(newest))
+	for key, entry := range newest {
+		if entry.flag == merge {
+			// Merge operands need the older versions of the key, only gathered for such keys
+			resolved, found, err := mem.resolveAt(ctx, key, mem.seq)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				values[key] = resolved.val
+			}
+			continue
+		}
+		if entry.flag != del && !entry.expired(now) {
+			values[key] = entry.val
+		}
+	}
+	return values, nil
+}
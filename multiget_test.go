@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMultiGet(t *testing.T) {
+	db := newTestDB(t)
+	db.mergeOperator = StringAppendOperator{","}
+
+	// Spread the keys over SST files and the Memtable
+	for i := 0; i < 25; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	if _, err := db.Del("key03"); err != nil {
+		t.Fatalf("Error deleting key: %s", err)
+	}
+	if err := db.DeleteRange("key10", "key12"); err != nil {
+		t.Fatalf("Error deleting range: %s", err)
+	}
+	if err := db.Set("key01", []byte("new")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if err := db.Merge("key02", []byte("x")); err != nil {
+		t.Fatalf("Error merging key: %s", err)
+	}
+
+	keys := []string{"key24", "key01", "key03", "missing", "key02", "key11", "key01", "key20"}
+	values, err := db.MultiGet(keys)
+	if err != nil {
+		t.Fatalf("Error getting keys: %s", err)
+	}
+	expected := map[string]string{"key24": "24", "key01": "new", "key02": "2,x", "key20": "20"}
+	if len(values) != len(expected) {
+		t.Fatalf("Expected %d values, got %d: %q", len(expected), len(values), values)
+	}
+	for key, val := range expected {
+		if string(values[key]) != val {
+			t.Fatalf("Expected %s for %s, got %s", val, key, values[key])
+		}
+	}
+
+	// Edge case: no keys
+	if values, err := db.MultiGet(nil); err != nil || len(values) != 0 {
+		t.Fatalf("Expected no values, got %q (%v)", values, err)
+	}
+}
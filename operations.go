@@ -1,152 +1,148 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"errors"
+	"context"
 	"fmt"
-	"os"
-	"path/filepath"
 )
 
 // Set stores a key-value pair in the Memtable and appends the operation to the Write-Ahead Log.
-// If the Memtable size exceeds memLimit, it triggers a flush to disk.
+// If the Memtable size exceeds its limit, it triggers a flush to disk.
 // Returns any encountered error during the process.
 func (mem *fileDB) Set(key string, val []byte) error {
-	v := value{
-		set,
-		val,
-	}
-	if err := mem.appendToWAL(key, v); err != nil {
-		return err
-	}
-	mem.values.Put(key, v)
+	return mem.SetContext(context.Background(), key, val)
+}
 
-	if mem.values.Size() == memLimit {
-		if err := mem.flush(); err != nil {
-			return errors.New("Error while flushing Memtable to disk.")
-		}
-	}
+// SetContext is like Set, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) SetContext(ctx context.Context, key string, val []byte) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
 
-	return nil
+	b := WriteBatch{}
+	b.Set(key, val)
+	return mem.write(ctx, &b)
 }
 
 // Get retrieves the value for a given key.
 // It first checks in the Memtable. If not found, it looks in SST files from the newest to the oldest one.
 // Returns the value associated with the key and any encountered error.
 func (mem *fileDB) Get(key string) ([]byte, error) {
-	if v, ok := mem.values.Get(key); ok { // Check the existence in the Memtable
-		if v.(value).flag == del { // Check if it was deleted
-			return nil, errors.New("Key not found")
-		}
-		return v.(value).val, nil
+	return mem.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but stops looking up the SST files with the error of ctx once it is done.
+func (mem *fileDB) GetContext(ctx context.Context, key string) ([]byte, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	return mem.get(ctx, key)
+}
+
+// get is the lock-free implementation of Get. The caller must hold mem.mu.
+func (mem *fileDB) get(ctx context.Context, key string) ([]byte, error) {
+	return mem.getAt(ctx, key, mem.seq)
+}
+
+// getAt retrieves the value of a key as of sequence number seq, ignoring the versions written afterwards.
+// Merge operands are combined with the older versions of the key.
+// The caller must hold mem.mu.
+// Returns the value associated with the key and any encountered error.
+func (mem *fileDB) getAt(ctx context.Context, key string, seq uint64) ([]byte, error) {
+	entry, found, err := mem.resolveAt(ctx, key, seq)
+	if err != nil {
+		return nil, err
+	}
+	if !found { // Check if it was deleted
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return entry.val, nil
+}
+
+// findAt looks up the newest version of a key visible at sequence number seq, including deletions.
+// A range tombstone covering the key is returned as a deletion of the key.
+// The caller must hold mem.mu.
+// Returns the version, whether one was found and any encountered error.
+func (mem *fileDB) findAt(ctx context.Context, key string, seq uint64) (kvEntry, bool, error) {
+	if mem.closed {
+		return kvEntry{}, false, ErrClosed
+	}
+	// The Memtable only holds writes newer than those of the SST files
+	if entry, found := mem.findInMemtable(key, seq); found {
+		return entry, true, nil
 	}
 	// Not found. Check in SST files
-	pattern := "db_*.sst"
-	matchingFiles, err := filepath.Glob(pattern) // Glob() returns a sorted []string.
+	matchingFiles, err := mem.sstFiles()
 	if err != nil {
-		return nil, err
+		return kvEntry{}, false, err
 	}
+	return findInSST(ctx, key, seq, matchingFiles)
+}
 
-	// Iterate through the SST files from the newest to the oldest one
-	for i := len(matchingFiles) - 1; i >= 0; i-- {
-		file := matchingFiles[i]
+// findInMemtable looks up the newest version of a key visible at sequence number seq in the Memtable,
+// range tombstones included. The caller must hold mem.mu.
+// Returns the version and whether one was found.
+func (mem *fileDB) findInMemtable(key string, seq uint64) (kvEntry, bool) {
+	// The Memtable is sorted from the newest to the oldest version of each key,
+	// so the ceiling of (key, seq) is the newest version visible at seq, if any.
+	var entry kvEntry
+	found := false
+	if ik, v := mem.values.Ceiling(internalKey{key, seq}); ik != nil && ik.(internalKey).key == key {
+		entry, found = kvEntry{ik.(internalKey), v.(value)}, true
+	}
+	if tombstone, ok := coveringRangeDel(mem.rangeDels, key, seq); ok && (!found || tombstone.seq > entry.seq) {
+		entry, found = tombstone, true
+	}
+	return entry, found
+}
 
-		// Read the entire content of the current file into a byte slice.
-		fileContent, err := os.ReadFile(file)
+// findInSST looks for the newest version of a key visible at sequence number seq in the given SST files,
+// range tombstones included.
+// Versions are ordered by their sequence numbers, so the result does not depend on the names of the files.
+// The search stops with the error of ctx if it is done before all the files are read.
+// Returns the version, whether one was found and any encountered error.
+func findInSST(ctx context.Context, key string, seq uint64, matchingFiles []string) (kvEntry, bool, error) {
+	var newest kvEntry
+	found := false
 
+	// Iterate through the SST files from the newest to the oldest one
+	for i := len(matchingFiles) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return kvEntry{}, false, err
+		}
 		// Unlike using os.Open(file), which requires disk access each time to read parts of the file,
 		// os.ReadFile(file) efficiently reads the entire file into memory in a single operation.
-
+		table, err := readSST(matchingFiles[i])
 		if err != nil {
-			return nil, err
-		}
-
-		fileContent, _ = decompress(fileContent)
-
-		position := 0
-		// Check the magic number
-		retrievedMag := binary.LittleEndian.Uint32(fileContent[position : position+4])
-		position += 4
-		if retrievedMag != magicNumber {
-			fmt.Println("This file should not be considered")
-			continue // Move to the next file
+			return kvEntry{}, false, err
 		}
 
-		// Check the checksum
-		checksum := calculateChecksum(fileContent[0 : len(fileContent)-4])
-		retrievedChecksum := fileContent[len(fileContent)-4:]
-
-		if !bytes.Equal(checksum, retrievedChecksum) {
-			fmt.Println("This was was corrupted")
-			continue
-		}
-
-		entryCount := binary.LittleEndian.Uint32(fileContent[position : position+4])
-		position += 4
-
-		sKeyLength := binary.LittleEndian.Uint32(fileContent[position : position+4])
-		position += 4
-		sKey := fileContent[position : position+int(sKeyLength)]
-		position += int(sKeyLength)
-
-		lKeyLength := binary.LittleEndian.Uint32(fileContent[position : position+4])
-		position += 4
-		lKey := fileContent[position : position+int(lKeyLength)]
-		position += int(lKeyLength)
-
-		// Check if the key falls within the range of the current file.
-		if key < string(sKey) || key > string(lKey) {
-			// If the key is outside the range of the current file, skip to the next file.
-			continue
-			// The lexicographical sorting of SST files ensures that we can efficiently
-			// determine whether the key is within the file's range, leveraging the file order.
-		}
-
-		// Check the version
-		retrievedVersion := binary.LittleEndian.Uint16(fileContent[position : position+2])
-		position += 2
-		if retrievedVersion != version {
-			fmt.Println("This file is of an old version")
-			continue // Old version
-		}
-
-		for i := 0; i < int(entryCount); i++ {
-			// Each SST file corresponds to a single TreeMap.
-			// Consequently, if the key exists, there is precisely one entry in the SST file associated with that key.
-			// Therefore, upon finding the key, we can promptly return its corresponding value.
-			flag, keyBytes, valueBytes := entryToKv(fileContent, &position)
-			if string(keyBytes) == key {
-				if flag == set {
-					return valueBytes, nil
-				}
-				return nil, errors.New("Key not found")
-			}
+		// Keep the version with the largest sequence number. On a tie (files written before sequence numbers),
+		// the newest file wins.
+		if entry, ok := table.findAt(key, seq); ok && (!found || entry.seq > newest.seq) {
+			newest, found = entry, true
 		}
 	}
-	return nil, errors.New("Key not found")
+	return newest, found, nil
 }
 
 // Del writes a delete entry to Memtable and appends it to the Write-Ahead Log.
 // If the Memtable size exceeds a limit, it triggers a flush to disk.
 // Returns the deleted value and any encountered error during the process.
 func (mem *fileDB) Del(key string) ([]byte, error) {
-	if val, err := mem.Get(key); err != nil { // Check the existence of the key
+	return mem.DelContext(context.Background(), key)
+}
+
+// DelContext is like Del, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) DelContext(ctx context.Context, key string) ([]byte, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	if val, err := mem.get(ctx, key); err != nil { // Check the existence of the key
 		return nil, err
 	} else {
-		v := value{
-			del,
-			val,
-		}
-		if err := mem.appendToWAL(key, v); err != nil {
+		b := WriteBatch{}
+		b.Del(key)
+		if err := mem.write(ctx, &b); err != nil {
 			return nil, err
 		}
-		mem.values.Put(key, v)
-		if mem.values.Size() == memLimit {
-			if err := mem.flush(); err != nil {
-				return nil, errors.New("Error while flushing Memtable to disk.")
-			}
-		}
 		return val, nil
 	}
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
 )
 
@@ -47,3 +50,48 @@ func TestSetGetDel(t *testing.T) {
 		t.Fatal("Expected error deleting nonexistent key")
 	}
 }
+
+func TestContextCancellation(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 25; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Keys in SST files are not looked up once the context is done
+	if _, err := db.GetContext(ctx, "key00"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := db.MultiGetContext(ctx, []string{"key00", "key01"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := db.NewIteratorContext(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// Writes are not started once the context is done
+	if err := db.SetContext(ctx, "new", []byte("v")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := db.Get("new"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected the key not to be written, got %v", err)
+	}
+
+	// An Iterator stops moving once its context is done
+	ctx, cancel = context.WithCancel(context.Background())
+	it, err := db.NewIteratorContext(ctx, nil)
+	if err != nil {
+		t.Fatalf("Error creating iterator: %s", err)
+	}
+	defer it.Close()
+	if !it.First() {
+		t.Fatal("Expected a first key")
+	}
+	cancel()
+	if it.Next() || it.Valid() || !errors.Is(it.Err(), context.Canceled) {
+		t.Fatalf("Expected the iterator to stop, got %v", it.Err())
+	}
+}
@@ -0,0 +1,1380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// raftColumnFamily is the column family in which each replicated batch records the index of its entry under
+// raftAppliedKey, atomically with its operations, so that a restarted node applies every entry exactly once.
+const (
+	raftColumnFamily = "raft"
+	raftAppliedKey   = "applied"
+)
+
+// Types of the entries of a Raft log.
+const (
+	entryNoop    = "noop"    // Appended by a new leader, so that the entries of the previous terms get committed
+	entryCommand = "command" // A batch, serialized as a WAL record by batchToRecord
+	entryConfig  = "config"  // A new list of members, effective as soon as it is appended
+)
+
+// States of a raftNode, as reported by RaftStatus.
+const (
+	StateFollower  = "follower"
+	StateCandidate = "candidate"
+	StateLeader    = "leader"
+)
+
+// Types of the messages exchanged by the nodes of a cluster.
+const (
+	msgPreVote   = "prevote"   // Asks whether a vote would be granted, without disrupting the cluster
+	msgVote      = "vote"      // Asks for a vote
+	msgAppend    = "append"    // Replicates entries, or is a heartbeat without entries
+	msgHeartbeat = "heartbeat" // Confirms the leadership for a read, without touching the log
+	msgSnapshot  = "snapshot"  // Replaces the database of a follower left behind the compacted log
+	msgReadIndex = "readindex" // Asks the leader for the commit index to wait for before a read
+)
+
+// ErrNotLeader is returned when a write, a read or a membership change reaches a node of a cluster that is not
+// its leader. The error names the leader when it is known.
+var ErrNotLeader = errors.New("Not the leader")
+
+// raftOptions configures the timing of a raftNode.
+type raftOptions struct {
+	electionTimeout   time.Duration // Time without hearing from a leader before an election, randomized up to twice
+	heartbeat         time.Duration // Interval of the heartbeats of the leader
+	snapshotThreshold int           // Applied entries kept in the log before it is compacted
+	maxAppendEntries  int           // Entries sent per message to a follower
+	proposalTimeout   time.Duration // Maximum duration of a write, a read or a membership change
+}
+
+// defaultRaftOptions suit nodes on a local network.
+var defaultRaftOptions = raftOptions{time.Second, 100 * time.Millisecond, 10000, 256, 10 * time.Second}
+
+// raftEntry is an entry of the Raft log.
+type raftEntry struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Type    string   `json:"type"`
+	Data    []byte   `json:"data,omitempty"`    // WAL record of a command
+	Members []string `json:"members,omitempty"` // Members of a configuration
+}
+
+// raftMessage is a request or a response exchanged by the nodes of a cluster. Each message type uses some
+// of the fields.
+type raftMessage struct {
+	Type string `json:"type"`
+	From string `json:"from"`
+	Term uint64 `json:"term"` // Term of the sender
+
+	// Elections
+	LastLogIndex uint64 `json:"lastLogIndex,omitempty"`
+	LastLogTerm  uint64 `json:"lastLogTerm,omitempty"`
+	Granted      bool   `json:"granted,omitempty"`
+
+	// Replication
+	PrevLogIndex uint64      `json:"prevLogIndex,omitempty"`
+	PrevLogTerm  uint64      `json:"prevLogTerm,omitempty"`
+	Entries      []raftEntry `json:"entries,omitempty"`
+	Commit       uint64      `json:"commit,omitempty"`
+	Success      bool        `json:"success,omitempty"`
+	Index        uint64      `json:"index,omitempty"` // Last index matched, or next index to try after a mismatch
+
+	// Snapshots
+	SnapshotIndex uint64            `json:"snapshotIndex,omitempty"`
+	SnapshotTerm  uint64            `json:"snapshotTerm,omitempty"`
+	Members       []string          `json:"members,omitempty"`
+	Seq           uint64            `json:"seq,omitempty"`   // Sequence number of the database checkpoint
+	Files         map[string][]byte `json:"files,omitempty"` // Files of the database checkpoint
+}
+
+// raftTransport sends the messages of a node to the other nodes of its cluster.
+type raftTransport interface {
+	// call sends msg to the node to and returns its response, or any encountered error.
+	call(ctx context.Context, to string, msg *raftMessage) (*raftMessage, error)
+}
+
+// RaftStatus describes a node of a cluster, as reported by Status and the "/cluster/status" endpoint.
+type RaftStatus struct {
+	ID            string   `json:"id"`
+	State         string   `json:"state"` // StateFollower, StateCandidate or StateLeader
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader,omitempty"`
+	Members       []string `json:"members"`
+	LastIndex     uint64   `json:"lastIndex"`   // Index of the last entry of the log
+	CommitIndex   uint64   `json:"commitIndex"` // Index of the last entry known to be committed
+	LastApplied   uint64   `json:"lastApplied"` // Index of the last entry applied to the database
+	SnapshotIndex uint64   `json:"snapshotIndex"`
+}
+
+// proposal is an entry appended by the leader on behalf of a caller waiting for it to be applied.
+type proposal struct {
+	term uint64
+	done chan proposalResult
+}
+
+// proposalResult is the outcome of a proposal: for the write of a single key, its previous value, whether it
+// existed and its new version on the node.
+type proposalResult struct {
+	prev    []byte
+	existed bool
+	version uint64
+	err     error
+}
+
+// raftNode replicates a database as a node of a Raft cluster: writes are appended to a log replicated by the
+// leader to the other members, and applied to the database of every node in the order of the log once a
+// majority of the members stored them. The database rejects the other writes.
+type raftNode struct {
+	id        string
+	db        *fileDB
+	transport raftTransport
+	opts      raftOptions
+	ctx       context.Context // Done once the node is stopped
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup // Running goroutines
+	applyCh   chan struct{}  // Signals newly committed entries
+	sendCh    chan struct{}  // Signals new entries for the leader to replicate
+
+	applyMu sync.Mutex // Held while applying entries or installing and taking snapshots, after mu if both are held
+
+	mu               sync.Mutex
+	raftState                    // Persisted state
+	state            string      // StateFollower, StateCandidate or StateLeader
+	leader           string      // Known leader of the current term
+	log              []raftEntry // Entries after the snapshot
+	logFile          *os.File
+	members          []string // Members of the latest configuration of the log
+	configIndex      uint64   // Index of the latest configuration of the log, 0 if it is the snapshot one
+	commitIndex      uint64
+	lastApplied      uint64
+	electionDeadline time.Time
+	lastContact      time.Time            // Last message from the leader of the current term
+	campaigning      bool                 // An election is in progress
+	nextIndex        map[string]uint64    // Leader: next entry to send to each member
+	matchIndex       map[string]uint64    // Leader: last entry known to be stored by each member
+	peerContact      map[string]time.Time // Leader: last response of each member
+	sending          map[string]bool      // Leader: members with a message in flight
+	lastBroadcast    time.Time
+	waiters          map[uint64]*proposal // Proposals by index
+	applied          chan struct{}        // Closed and replaced when entries are applied
+}
+
+// newRaftNode starts the node id of a cluster replicating db, sending its messages through transport.
+// The state and log of the node are kept in the directory of db. A new node with an empty log bootstraps
+// the cluster whose members are peers, its own id included; a node joining an existing cluster is started
+// without peers and added by the leader with AddMember.
+// Returns the node and any encountered error.
+func newRaftNode(id string, db *fileDB, transport raftTransport, peers []string, opts raftOptions) (*raftNode, error) {
+	if id == "" {
+		return nil, fmt.Errorf("%w: empty node id", ErrInvalidArgument)
+	}
+	raftCF, err := db.OpenColumnFamily(raftColumnFamily, Options{})
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadRaftState(db.path(raftStateFileName))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := loadRaftLog(db.path(raftLogFileName))
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := openRaftLog(db.path(raftLogFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	n := &raftNode{
+		id:        id,
+		db:        db,
+		transport: transport,
+		opts:      opts,
+		applyCh:   make(chan struct{}, 1),
+		sendCh:    make(chan struct{}, 1),
+		raftState: state,
+		state:     StateFollower,
+		logFile:   logFile,
+		waiters:   make(map[uint64]*proposal),
+		applied:   make(chan struct{}),
+	}
+	for _, e := range entries {
+		if e.Index > state.SnapshotIndex {
+			n.log = append(n.log, e)
+		}
+	}
+	if len(n.log) == 0 && n.SnapshotIndex == 0 {
+		n.SnapshotMembers = append([]string(nil), peers...)
+	}
+	n.updateMembers()
+
+	// The entries up to the last one recorded in the database were applied before the restart
+	if val, err := raftCF.Get(raftAppliedKey); err == nil {
+		if n.lastApplied, err = strconv.ParseUint(string(val), 10, 64); err != nil {
+			logFile.Close()
+			return nil, fmt.Errorf("%w: applied index %q", ErrCorruption, val)
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		logFile.Close()
+		return nil, err
+	}
+	n.lastApplied = max(n.lastApplied, n.SnapshotIndex)
+	n.commitIndex = n.lastApplied
+
+	db.mu.Lock()
+	if db.closed || db.follower != nil || db.raft != nil {
+		db.mu.Unlock()
+		logFile.Close()
+		return nil, fmt.Errorf("%w: the database is closed, a follower or already in a cluster", ErrInvalidArgument)
+	}
+	db.raft = n
+	db.mu.Unlock()
+
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.resetElectionDeadline()
+	n.wg.Add(2)
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// Stop stops the node, whose database then accepts writes again. The database is not closed.
+func (n *raftNode) Stop() {
+	n.cancel()
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.logFile.Close()
+	for index, p := range n.waiters {
+		p.done <- proposalResult{err: ErrClosed}
+		delete(n.waiters, index)
+	}
+	n.db.mu.Lock()
+	if n.db.raft == n {
+		n.db.raft = nil
+	}
+	n.db.mu.Unlock()
+}
+
+// Status returns the state of the node.
+func (n *raftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return RaftStatus{
+		ID:            n.id,
+		State:         n.state,
+		Term:          n.Term,
+		Leader:        n.leader,
+		Members:       append([]string{}, n.members...),
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.SnapshotIndex,
+	}
+}
+
+// notLeader returns ErrNotLeader wrapped with the known leader. The caller must hold n.mu.
+func (n *raftNode) notLeader() error {
+	if n.leader == "" || n.leader == n.id {
+		return fmt.Errorf("%w: no known leader", ErrNotLeader)
+	}
+	return fmt.Errorf("%w: the leader is %s", ErrNotLeader, n.leader)
+}
+
+// Leader returns the id of the known leader of the cluster, or an empty string.
+func (n *raftNode) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// Set stores a key-value pair through the Raft log.
+// Returns ErrNotLeader if the node is not the leader, or any encountered error.
+func (n *raftNode) Set(key string, val []byte) error {
+	return n.SetContext(context.Background(), key, val)
+}
+
+// SetContext is like Set, but gives up with the error of ctx once it is done. The write may still be applied.
+func (n *raftNode) SetContext(ctx context.Context, key string, val []byte) error {
+	b := WriteBatch{}
+	b.Set(key, val)
+	return n.WriteContext(ctx, &b)
+}
+
+// Del deletes a key through the Raft log.
+// Returns the deleted value, ErrNotFound if the key did not exist, ErrNotLeader if the node is not the leader,
+// or any encountered error.
+func (n *raftNode) Del(key string) ([]byte, error) {
+	return n.DelContext(context.Background(), key)
+}
+
+// DelContext is like Del, but gives up with the error of ctx once it is done. The deletion may still be applied.
+func (n *raftNode) DelContext(ctx context.Context, key string) ([]byte, error) {
+	b := WriteBatch{}
+	b.Del(key)
+	r := n.proposeBatch(ctx, &b)
+	return r.prev, r.err
+}
+
+// Write applies all the operations of a batch atomically through the Raft log, like fileDB.Write.
+// Returns ErrNotLeader if the node is not the leader, or any encountered error.
+func (n *raftNode) Write(b *WriteBatch) error {
+	return n.WriteContext(context.Background(), b)
+}
+
+// WriteContext is like Write, but gives up with the error of ctx once it is done. The batch may still be applied.
+func (n *raftNode) WriteContext(ctx context.Context, b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	return n.proposeBatch(ctx, b).err
+}
+
+// Get retrieves the value of a key, reading all the writes acknowledged before the call.
+// Returns the value, ErrNotFound if the key does not exist, ErrNotLeader if no leader can be reached,
+// or any encountered error.
+func (n *raftNode) Get(key string) ([]byte, error) {
+	return n.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but gives up with the error of ctx once it is done.
+func (n *raftNode) GetContext(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, n.opts.proposalTimeout)
+	defer cancel()
+	if err := n.ReadBarrier(ctx); err != nil {
+		return nil, err
+	}
+	return n.db.GetContext(ctx, key)
+}
+
+// ReadBarrier waits until the database of the node reflects every write committed before the call, so that
+// the reads that follow are linearizable. The commit index is obtained from the leader, which confirms it is
+// still the leader with a round of heartbeats, then the node waits to apply the log up to it.
+// Returns ErrNotLeader if no leader can be reached, or the error of ctx.
+func (n *raftNode) ReadBarrier(ctx context.Context) error {
+	n.mu.Lock()
+	state, leader, term := n.state, n.leader, n.Term
+	n.mu.Unlock()
+
+	var index uint64
+	if state == StateLeader {
+		var err error
+		if index, err = n.readIndex(ctx); err != nil {
+			return err
+		}
+	} else {
+		if leader == "" {
+			return fmt.Errorf("%w: no known leader", ErrNotLeader)
+		}
+		resp, err := n.transport.call(ctx, leader, &raftMessage{Type: msgReadIndex, From: n.id, Term: term})
+		if err != nil {
+			return fmt.Errorf("%w: the leader %s is unreachable: %s", ErrNotLeader, leader, err)
+		}
+		if !resp.Success {
+			return fmt.Errorf("%w: %s is no longer the leader", ErrNotLeader, leader)
+		}
+		index = resp.Index
+	}
+	return n.waitApplied(ctx, index)
+}
+
+// readIndex returns the commit index of the leader, once it made sure it is still the leader.
+// Returns ErrNotLeader if it is not, or the error of ctx.
+func (n *raftNode) readIndex(ctx context.Context) (uint64, error) {
+	// The commit index is up to date once an entry of the current term, the no-op of the leader, is committed
+	n.mu.Lock()
+	term := n.Term
+	for {
+		if n.state != StateLeader || n.Term != term {
+			err := n.notLeader()
+			n.mu.Unlock()
+			return 0, err
+		}
+		if t, _ := n.termAt(n.commitIndex); t == term {
+			break
+		}
+		applied := n.applied
+		n.mu.Unlock()
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+		n.mu.Lock()
+	}
+	index := n.commitIndex
+	n.mu.Unlock()
+
+	if err := n.confirmLeadership(ctx, term); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// confirmLeadership sends a heartbeat to the members, to check that a majority still follow the leader of term.
+// Returns ErrNotLeader if they do not, or the error of ctx.
+func (n *raftNode) confirmLeadership(ctx context.Context, term uint64) error {
+	n.mu.Lock()
+	members := append([]string(nil), n.members...)
+	msg := raftMessage{Type: msgHeartbeat, From: n.id, Term: term}
+	n.mu.Unlock()
+
+	votes := n.gather(ctx, members, &msg, func(resp *raftMessage) bool { return resp.Term == term })
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if votes < quorum(members) {
+		return fmt.Errorf("%w: lost the majority", ErrNotLeader)
+	}
+	return nil
+}
+
+// gather sends msg to the members, counting the node itself and the members whose response is accepted by ok,
+// until they form a majority or every member answered. The messages still in flight are then cancelled.
+// Returns the count.
+func (n *raftNode) gather(ctx context.Context, members []string, msg *raftMessage, ok func(*raftMessage) bool) int {
+	ctx, cancel := context.WithCancel(ctx)
+	var calls sync.WaitGroup
+	defer calls.Wait()
+	defer cancel()
+
+	accepted := make(chan bool, len(members))
+	votes := 0
+	for _, member := range members {
+		if member == n.id {
+			votes++
+			continue
+		}
+		calls.Add(1)
+		go func(member string) {
+			defer calls.Done()
+			resp, err := n.call(ctx, member, msg)
+			accepted <- err == nil && ok(resp)
+		}(member)
+	}
+	for pending := len(members) - votes; votes < quorum(members) && pending > 0; pending-- {
+		if <-accepted {
+			votes++
+		}
+	}
+	return votes
+}
+
+// waitApplied waits until the entries up to index are applied to the database.
+// Returns the error of ctx if it is done first, or ErrClosed if the node is stopped.
+func (n *raftNode) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		n.mu.Lock()
+		done, applied := n.lastApplied >= index, n.applied
+		n.mu.Unlock()
+		if done {
+			return nil
+		}
+		select {
+		case <-applied:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-n.ctx.Done():
+			return ErrClosed
+		}
+	}
+}
+
+// AddMember adds the node id to the cluster. The leader then replicates its log, or a snapshot, to the new node,
+// which should have been started without peers. Membership changes are made one at a time.
+// Returns ErrNotLeader if the node is not the leader, an error wrapping ErrInvalidArgument if id is already
+// a member or a change is in progress, or any encountered error.
+func (n *raftNode) AddMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, id, true)
+}
+
+// RemoveMember removes the node id from the cluster, possibly the leader itself, which steps down once the
+// change is committed. Membership changes are made one at a time.
+// Returns ErrNotLeader if the node is not the leader, an error wrapping ErrInvalidArgument if id is not
+// a member or a change is in progress, or any encountered error.
+func (n *raftNode) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, id, false)
+}
+
+// changeMembers appends a configuration adding or removing the node id, and waits for it to be applied.
+func (n *raftNode) changeMembers(ctx context.Context, id string, add bool) error {
+	if id == "" {
+		return fmt.Errorf("%w: empty node id", ErrInvalidArgument)
+	}
+	n.mu.Lock()
+	if n.state != StateLeader {
+		err := n.notLeader()
+		n.mu.Unlock()
+		return err
+	}
+	if n.configIndex > n.commitIndex {
+		n.mu.Unlock()
+		return fmt.Errorf("%w: a membership change is in progress", ErrInvalidArgument)
+	}
+	var members []string
+	found := false
+	for _, member := range n.members {
+		if member == id {
+			found = true
+		} else {
+			members = append(members, member)
+		}
+	}
+	if found == add {
+		n.mu.Unlock()
+		if add {
+			return fmt.Errorf("%w: %s is already a member", ErrInvalidArgument, id)
+		}
+		return fmt.Errorf("%w: %s is not a member", ErrInvalidArgument, id)
+	}
+	if add {
+		members = append(members, id)
+		sort.Strings(members)
+	}
+	if len(members) == 0 {
+		n.mu.Unlock()
+		return fmt.Errorf("%w: cannot remove the last member", ErrInvalidArgument)
+	}
+	return n.propose(ctx, raftEntry{Type: entryConfig, Members: members}).err
+}
+
+// proposeBatch appends a batch to the log and waits for it to be applied.
+func (n *raftNode) proposeBatch(ctx context.Context, b *WriteBatch) proposalResult {
+	for _, op := range b.ops {
+		if op.family == raftColumnFamily {
+			return proposalResult{err: fmt.Errorf("%w: the %s column family is reserved", ErrInvalidArgument, raftColumnFamily)}
+		}
+	}
+	n.db.mu.RLock()
+	bound, err := n.db.bind(b)
+	n.db.mu.RUnlock()
+	if err != nil {
+		return proposalResult{err: err}
+	}
+	n.mu.Lock()
+	if n.state != StateLeader {
+		err := n.notLeader()
+		n.mu.Unlock()
+		return proposalResult{err: err}
+	}
+	return n.propose(ctx, raftEntry{Type: entryCommand, Data: batchToRecord(0, bound)})
+}
+
+// propose appends an entry to the log of the leader and waits for it to be applied, for proposalTimeout at most.
+// The caller must hold n.mu, which is released.
+func (n *raftNode) propose(ctx context.Context, e raftEntry) proposalResult {
+	if err := n.appendEntries(e); err != nil {
+		n.mu.Unlock()
+		return proposalResult{err: err}
+	}
+	index := n.lastIndex()
+	p := &proposal{n.Term, make(chan proposalResult, 1)}
+	n.waiters[index] = p
+	n.mu.Unlock()
+	n.signal(n.sendCh)
+
+	ctx, cancel := context.WithTimeout(ctx, n.opts.proposalTimeout)
+	defer cancel()
+	select {
+	case r := <-p.done:
+		return r
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, index)
+		n.mu.Unlock()
+		return proposalResult{err: fmt.Errorf("Entry %d not applied: %w", index, ctx.Err())}
+	}
+}
+
+// appendEntries appends new entries of the current term to the log of the leader and persists them.
+// The caller must hold n.mu.
+// Returns any encountered error.
+func (n *raftNode) appendEntries(entries ...raftEntry) error {
+	for i := range entries {
+		entries[i].Index = n.lastIndex() + uint64(i) + 1
+		entries[i].Term = n.Term
+	}
+	if err := appendRaftLog(n.logFile, entries); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	n.updateMembers()
+	n.maybeCommit()
+	return nil
+}
+
+// signal wakes up the goroutine waiting on ch, unless it is already signalled.
+func (n *raftNode) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// lastIndex returns the index of the last entry of the log. The caller must hold n.mu.
+func (n *raftNode) lastIndex() uint64 {
+	return n.SnapshotIndex + uint64(len(n.log))
+}
+
+// lastTerm returns the term of the last entry of the log. The caller must hold n.mu.
+func (n *raftNode) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.SnapshotTerm
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, false if it is compacted or after the log.
+// The caller must hold n.mu.
+func (n *raftNode) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == n.SnapshotIndex:
+		return n.SnapshotTerm, true
+	case index < n.SnapshotIndex || index > n.lastIndex():
+		return 0, false
+	default:
+		return n.log[index-n.SnapshotIndex-1].Term, true
+	}
+}
+
+// entries returns a copy of the entries from index from to index to, included. The caller must hold n.mu.
+func (n *raftNode) entries(from, to uint64) []raftEntry {
+	if from > to {
+		return nil
+	}
+	return append([]raftEntry(nil), n.log[from-n.SnapshotIndex-1:to-n.SnapshotIndex]...)
+}
+
+// updateMembers sets the members from the latest configuration of the log. The caller must hold n.mu.
+func (n *raftNode) updateMembers() {
+	n.members, n.configIndex = n.membersAt(n.lastIndex())
+	if n.state == StateLeader {
+		for _, member := range n.members {
+			if _, ok := n.nextIndex[member]; !ok {
+				n.nextIndex[member] = n.lastIndex() + 1
+				n.peerContact[member] = time.Now()
+			}
+		}
+	}
+}
+
+// membersAt returns the members as of the entry at index, and the index of their configuration, 0 for the
+// snapshot one. The caller must hold n.mu.
+func (n *raftNode) membersAt(index uint64) ([]string, uint64) {
+	for i := min(index, n.lastIndex()); i > n.SnapshotIndex; i-- {
+		if e := n.log[i-n.SnapshotIndex-1]; e.Type == entryConfig {
+			return e.Members, i
+		}
+	}
+	return n.SnapshotMembers, 0
+}
+
+// isMember reports whether id is a member of the latest configuration. The caller must hold n.mu.
+func (n *raftNode) isMember(id string) bool {
+	for _, member := range n.members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// quorum returns the number of members forming a majority.
+func quorum(members []string) int {
+	return len(members)/2 + 1
+}
+
+// persist saves the term, vote and snapshot of the node. The caller must hold n.mu.
+// Returns any encountered error, in which case the node must not act on the state it could not save: a vote or
+// a term forgotten by a restart could let two leaders be elected in the same term.
+func (n *raftNode) persist() error {
+	if err := saveRaftState(n.db.path(raftStateFileName), n.raftState); err != nil {
+		return fmt.Errorf("Error saving the Raft state: %w", err)
+	}
+	return nil
+}
+
+// rewriteLog replaces the log file by the current entries. The caller must hold n.mu.
+// Returns any encountered error.
+func (n *raftNode) rewriteLog() error {
+	n.logFile.Close()
+	f, err := rewriteRaftLog(n.db.path(raftLogFileName), n.log)
+	if err != nil {
+		// Keep appending to the old file, which still holds the entries
+		if f, err2 := openRaftLog(n.db.path(raftLogFileName)); err2 == nil {
+			n.logFile = f
+		}
+		return err
+	}
+	n.logFile = f
+	return nil
+}
+
+// resetElectionDeadline schedules the next election after a random timeout. The caller must hold n.mu.
+func (n *raftNode) resetElectionDeadline() {
+	timeout := n.opts.electionTimeout + time.Duration(rand.Int63n(int64(n.opts.electionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// becomeFollower makes the node a follower of term, forgetting its vote if the term is new.
+// If the new term cannot be saved, the node stays in its term, as a follower. The caller must hold n.mu.
+// Returns any encountered error while saving the new term.
+func (n *raftNode) becomeFollower(term uint64) error {
+	var err error
+	if term > n.Term {
+		prev := n.raftState
+		prevLeader := n.leader
+		n.Term, n.VotedFor, n.leader = term, "", ""
+		if err = n.persist(); err != nil {
+			n.raftState, n.leader = prev, prevLeader
+		}
+	}
+	if n.state != StateFollower {
+		n.state = StateFollower
+		n.resetElectionDeadline()
+	}
+	return err
+}
+
+// becomeLeader makes the candidate the leader of its term, and appends a no-op entry so that the entries of
+// the previous terms get committed. The caller must hold n.mu.
+func (n *raftNode) becomeLeader() {
+	n.state, n.leader = StateLeader, n.id
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.peerContact = make(map[string]time.Time)
+	n.sending = make(map[string]bool)
+	n.updateMembers()
+	fmt.Printf("Node %s is the leader of term %d\n", n.id, n.Term)
+	if err := n.appendEntries(raftEntry{Type: entryNoop}); err != nil {
+		fmt.Println("Error appending to the Raft log:", err)
+	}
+	n.signal(n.sendCh)
+}
+
+// run drives the elections and the heartbeats until the node is stopped.
+func (n *raftNode) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.opts.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+			n.tick()
+		case <-n.sendCh:
+			n.broadcast()
+		}
+	}
+}
+
+// tick starts an election once the election timeout elapsed without a leader, and makes the leader send
+// heartbeats, or step down once it did not hear from a majority for an election timeout.
+func (n *raftNode) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	if n.state == StateLeader {
+		votes := 0
+		for _, member := range n.members {
+			if member == n.id || now.Sub(n.peerContact[member]) < n.opts.electionTimeout {
+				votes++
+			}
+		}
+		if votes < quorum(n.members) {
+			fmt.Printf("Node %s lost the majority, stepping down\n", n.id)
+			n.becomeFollower(n.Term)
+			n.leader = ""
+			return
+		}
+		if now.Sub(n.lastBroadcast) >= n.opts.heartbeat {
+			n.signal(n.sendCh)
+		}
+		return
+	}
+	if now.After(n.electionDeadline) && !n.campaigning && n.isMember(n.id) {
+		n.campaigning = true
+		n.resetElectionDeadline()
+		n.wg.Add(1)
+		go n.campaign()
+	}
+}
+
+// campaign runs an election: a pre-vote checks that the node can win, so that a partitioned node does not
+// disrupt the cluster with higher terms when it comes back, then the node votes for itself in a new term and
+// asks the others for their votes.
+func (n *raftNode) campaign() {
+	defer n.wg.Done()
+	defer func() {
+		n.mu.Lock()
+		n.campaigning = false
+		n.mu.Unlock()
+	}()
+
+	n.mu.Lock()
+	term := n.Term + 1
+	n.mu.Unlock()
+	if !n.poll(msgPreVote, term) {
+		return
+	}
+
+	n.mu.Lock()
+	if n.Term+1 != term || n.state == StateLeader {
+		n.mu.Unlock()
+		return
+	}
+	// The vote for itself must be saved before the node asks for the others'
+	prev := n.raftState
+	n.Term, n.VotedFor = term, n.id
+	if err := n.persist(); err != nil {
+		n.raftState = prev
+		n.mu.Unlock()
+		fmt.Println("Error starting an election:", err)
+		return
+	}
+	n.state, n.leader = StateCandidate, ""
+	n.mu.Unlock()
+	if !n.poll(msgVote, term) {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Term == term && n.state == StateCandidate {
+		n.becomeLeader()
+	}
+}
+
+// poll asks the members for their votes for term, with a message of type msgPreVote or msgVote.
+// Returns whether a majority granted them.
+func (n *raftNode) poll(msgType string, term uint64) bool {
+	n.mu.Lock()
+	members := append([]string(nil), n.members...)
+	msg := raftMessage{Type: msgType, From: n.id, Term: term, LastLogIndex: n.lastIndex(), LastLogTerm: n.lastTerm()}
+	n.mu.Unlock()
+
+	votes := n.gather(n.ctx, members, &msg, func(resp *raftMessage) bool {
+		if resp.Term > term && msgType == msgVote {
+			n.mu.Lock()
+			if err := n.becomeFollower(resp.Term); err != nil {
+				fmt.Println(err)
+			}
+			n.mu.Unlock()
+		}
+		return resp.Granted
+	})
+	return votes >= quorum(members)
+}
+
+// call sends a message to a member, giving up after an election timeout, or longer for a snapshot.
+func (n *raftNode) call(ctx context.Context, to string, msg *raftMessage) (*raftMessage, error) {
+	timeout := n.opts.electionTimeout
+	if msg.Type == msgSnapshot {
+		timeout = n.opts.proposalTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return n.transport.call(ctx, to, msg)
+}
+
+// broadcast makes the leader send the new entries, or a heartbeat, to every member without a message in flight.
+func (n *raftNode) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != StateLeader {
+		return
+	}
+	n.lastBroadcast = time.Now()
+	for _, member := range n.members {
+		if member != n.id && !n.sending[member] {
+			n.sending[member] = true
+			n.wg.Add(1)
+			go n.replicate(member, n.Term)
+		}
+	}
+}
+
+// replicate sends the entries missing on a member, or a snapshot if they are compacted, until it is up to date
+// or the node is no longer the leader of term.
+func (n *raftNode) replicate(member string, term uint64) {
+	defer n.wg.Done()
+	defer func() {
+		n.mu.Lock()
+		delete(n.sending, member)
+		n.mu.Unlock()
+	}()
+
+	for n.ctx.Err() == nil {
+		n.mu.Lock()
+		if n.state != StateLeader || n.Term != term {
+			n.mu.Unlock()
+			return
+		}
+		next := n.nextIndex[member]
+		if next <= n.SnapshotIndex {
+			n.mu.Unlock()
+			if !n.sendSnapshot(member, term) {
+				return
+			}
+			continue
+		}
+		prevTerm, _ := n.termAt(next - 1)
+		last := min(n.lastIndex(), next+uint64(n.opts.maxAppendEntries)-1)
+		msg := raftMessage{
+			Type:         msgAppend,
+			From:         n.id,
+			Term:         term,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  prevTerm,
+			Entries:      n.entries(next, last),
+			Commit:       n.commitIndex,
+		}
+		n.mu.Unlock()
+
+		resp, err := n.call(n.ctx, member, &msg)
+		if err != nil {
+			return
+		}
+
+		n.mu.Lock()
+		n.peerContact[member] = time.Now()
+		if resp.Term > term {
+			if err := n.becomeFollower(resp.Term); err != nil {
+				fmt.Println(err)
+			}
+			n.mu.Unlock()
+			return
+		}
+		if n.state != StateLeader || n.Term != term {
+			n.mu.Unlock()
+			return
+		}
+		if resp.Success {
+			n.matchIndex[member] = max(n.matchIndex[member], resp.Index)
+			n.nextIndex[member] = n.matchIndex[member] + 1
+			n.maybeCommit()
+		} else {
+			n.nextIndex[member] = max(1, min(resp.Index, next-1))
+		}
+		upToDate := n.nextIndex[member] > n.lastIndex()
+		n.mu.Unlock()
+		if upToDate {
+			return
+		}
+	}
+}
+
+// sendSnapshot sends a checkpoint of the database to a member whose missing entries are compacted.
+// Returns whether it was installed.
+func (n *raftNode) sendSnapshot(member string, term uint64) bool {
+	n.applyMu.Lock()
+	n.mu.Lock()
+	index := n.lastApplied
+	snapshotTerm, _ := n.termAt(index)
+	members, _ := n.membersAt(index)
+	n.mu.Unlock()
+	seq, files, err := n.db.checkpoint()
+	n.applyMu.Unlock()
+	if err != nil {
+		fmt.Printf("Error taking a snapshot for %s: %s\n", member, err)
+		return false
+	}
+
+	msg := raftMessage{
+		Type:          msgSnapshot,
+		From:          n.id,
+		Term:          term,
+		SnapshotIndex: index,
+		SnapshotTerm:  snapshotTerm,
+		Members:       members,
+		Seq:           seq,
+		Files:         files,
+	}
+	resp, err := n.call(n.ctx, member, &msg)
+	if err != nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.peerContact[member] = time.Now()
+	if resp.Term > term {
+		if err := n.becomeFollower(resp.Term); err != nil {
+			fmt.Println(err)
+		}
+		return false
+	}
+	if !resp.Success || n.state != StateLeader || n.Term != term {
+		return false
+	}
+	n.matchIndex[member] = max(n.matchIndex[member], index)
+	n.nextIndex[member] = n.matchIndex[member] + 1
+	return true
+}
+
+// maybeCommit advances the commit index of the leader to the last entry of its term stored by a majority.
+// The caller must hold n.mu.
+func (n *raftNode) maybeCommit() {
+	if n.state != StateLeader {
+		return
+	}
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.Term {
+			return // The entries of the previous terms are only committed along with one of the current term
+		}
+		votes := 0
+		for _, member := range n.members {
+			if member == n.id || n.matchIndex[member] >= index {
+				votes++
+			}
+		}
+		if votes >= quorum(n.members) {
+			n.commitIndex = index
+			n.signal(n.applyCh)
+			return
+		}
+	}
+}
+
+// handle processes a message from another node.
+// Returns the response, or an error if the node is stopped or cannot save its state.
+func (n *raftNode) handle(ctx context.Context, msg *raftMessage) (*raftMessage, error) {
+	if n.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	switch msg.Type {
+	case msgPreVote, msgVote:
+		return n.handleVote(msg)
+	case msgAppend:
+		return n.handleAppend(msg)
+	case msgHeartbeat:
+		return n.handleHeartbeat(msg)
+	case msgSnapshot:
+		return n.handleSnapshot(msg)
+	case msgReadIndex:
+		resp := &raftMessage{Type: msgReadIndex, From: n.id}
+		index, err := n.readIndex(ctx)
+		resp.Success, resp.Index = err == nil, index
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown message type %q", ErrInvalidArgument, msg.Type)
+	}
+}
+
+// handleVote grants a vote, or tells whether it would for a pre-vote, to a candidate whose log is at least
+// as up to date, unless the node heard from a leader during the last election timeout.
+// Returns the response, or an error refusing the vote if the new term or the vote cannot be saved.
+func (n *raftNode) handleVote(msg *raftMessage) (*raftMessage, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &raftMessage{Type: msg.Type, From: n.id, Term: n.Term}
+	if msg.Term < n.Term {
+		return resp, nil
+	}
+	if n.state == StateLeader || (n.leader != "" && time.Since(n.lastContact) < n.opts.electionTimeout) {
+		return resp, nil // The leader is alive: a node that cannot hear it should not replace it
+	}
+	upToDate := msg.LastLogTerm > n.lastTerm() || (msg.LastLogTerm == n.lastTerm() && msg.LastLogIndex >= n.lastIndex())
+	if msg.Type == msgPreVote {
+		resp.Granted = upToDate && msg.Term > n.Term
+		return resp, nil
+	}
+
+	if msg.Term > n.Term {
+		if err := n.becomeFollower(msg.Term); err != nil {
+			return nil, err
+		}
+		resp.Term = n.Term
+	}
+	if upToDate && (n.VotedFor == "" || n.VotedFor == msg.From) {
+		prev := n.VotedFor
+		n.VotedFor = msg.From
+		if err := n.persist(); err != nil {
+			n.VotedFor = prev
+			return nil, err
+		}
+		n.resetElectionDeadline()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+// hearLeader records a message from the leader of term, which is at least the term of the node.
+// The caller must hold n.mu.
+// Returns any encountered error while saving the term, in which case the message must be rejected.
+func (n *raftNode) hearLeader(leader string, term uint64) error {
+	if err := n.becomeFollower(term); err != nil {
+		return err
+	}
+	n.leader, n.lastContact = leader, time.Now()
+	n.resetElectionDeadline()
+	return nil
+}
+
+// handleAppend appends the entries sent by the leader, once the log matches the leader's at the previous entry,
+// replacing the conflicting entries, and advances the commit index.
+// Returns the response, or any encountered error while saving the term of the leader.
+func (n *raftNode) handleAppend(msg *raftMessage) (*raftMessage, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &raftMessage{Type: msgAppend, From: n.id, Term: n.Term}
+	if msg.Term < n.Term {
+		return resp, nil
+	}
+	if err := n.hearLeader(msg.From, msg.Term); err != nil {
+		return nil, err
+	}
+	resp.Term = n.Term
+
+	// The log must match the leader's at the previous entry: otherwise hint the leader at where to resume,
+	// skipping the entries of the conflicting term
+	if msg.PrevLogIndex > n.lastIndex() {
+		resp.Index = n.lastIndex() + 1
+		return resp, nil
+	}
+	if term, ok := n.termAt(msg.PrevLogIndex); ok && term != msg.PrevLogTerm {
+		index := msg.PrevLogIndex
+		for index > n.SnapshotIndex+1 {
+			if t, _ := n.termAt(index - 1); t != term {
+				break
+			}
+			index--
+		}
+		resp.Index = index
+		return resp, nil
+	}
+
+	for i, e := range msg.Entries {
+		if e.Index <= n.SnapshotIndex {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if term, _ := n.termAt(e.Index); term == e.Term {
+				continue
+			}
+			// A conflicting entry, never committed: drop it and the following ones
+			n.log = n.log[:e.Index-n.SnapshotIndex-1]
+			if err := n.rewriteLog(); err != nil {
+				fmt.Println("Error truncating the Raft log:", err)
+				return resp, nil
+			}
+		}
+		if err := appendRaftLog(n.logFile, msg.Entries[i:]); err != nil {
+			fmt.Println("Error appending to the Raft log:", err)
+			return resp, nil
+		}
+		n.log = append(n.log, msg.Entries[i:]...)
+		break
+	}
+	n.updateMembers()
+
+	last := msg.PrevLogIndex + uint64(len(msg.Entries))
+	if commit := min(msg.Commit, last); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.signal(n.applyCh)
+	}
+	resp.Success, resp.Index = true, last
+	return resp, nil
+}
+
+// handleHeartbeat acknowledges the leadership of the sender, for a read, if its term is current.
+// Returns the response, or any encountered error while saving the term of the leader.
+func (n *raftNode) handleHeartbeat(msg *raftMessage) (*raftMessage, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if msg.Term >= n.Term {
+		if err := n.hearLeader(msg.From, msg.Term); err != nil {
+			return nil, err
+		}
+	}
+	return &raftMessage{Type: msgHeartbeat, From: n.id, Term: n.Term}, nil
+}
+
+// handleSnapshot replaces the database by a checkpoint of the leader, and the log up to the snapshot,
+// keeping the entries that follow it if the log matches.
+// Returns the response, or any encountered error.
+func (n *raftNode) handleSnapshot(msg *raftMessage) (*raftMessage, error) {
+	n.mu.Lock()
+	resp := &raftMessage{Type: msgSnapshot, From: n.id, Term: n.Term}
+	if msg.Term < n.Term {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	if err := n.hearLeader(msg.From, msg.Term); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	resp.Term = n.Term
+	n.mu.Unlock()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if msg.SnapshotIndex <= n.lastApplied {
+		resp.Success, resp.Index = true, msg.SnapshotIndex
+		return resp, nil
+	}
+	fmt.Printf("Node %s installing a snapshot of %s at index %d\n", n.id, msg.From, msg.SnapshotIndex)
+	if err := n.db.installCheckpoint(msg.Seq, msg.Files); err != nil {
+		return nil, err
+	}
+
+	if term, ok := n.termAt(msg.SnapshotIndex); ok && term == msg.SnapshotTerm && msg.SnapshotIndex > n.SnapshotIndex {
+		n.log = n.log[msg.SnapshotIndex-n.SnapshotIndex:]
+	} else {
+		n.log = nil
+	}
+	n.SnapshotIndex, n.SnapshotTerm, n.SnapshotMembers = msg.SnapshotIndex, msg.SnapshotTerm, msg.Members
+	if err := n.persist(); err != nil {
+		return nil, err
+	}
+	if err := n.rewriteLog(); err != nil {
+		return nil, err
+	}
+	n.updateMembers()
+	n.commitIndex = max(n.commitIndex, msg.SnapshotIndex)
+	n.lastApplied = msg.SnapshotIndex
+	close(n.applied)
+	n.applied = make(chan struct{})
+	resp.Success, resp.Index = true, msg.SnapshotIndex
+	return resp, nil
+}
+
+// applyLoop applies the committed entries to the database until the node is stopped.
+func (n *raftNode) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.applyCh:
+			n.applyCommitted()
+		}
+	}
+}
+
+// applyCommitted applies the entries committed since the last applied one, answers their proposals, then
+// compacts the log once it holds more than snapshotThreshold applied entries.
+func (n *raftNode) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	for {
+		n.mu.Lock()
+		if n.lastApplied >= n.commitIndex {
+			n.mu.Unlock()
+			break
+		}
+		entries := n.entries(n.lastApplied+1, n.commitIndex)
+		n.mu.Unlock()
+
+		for _, e := range entries {
+			r := n.apply(e)
+			if r.err != nil && !errors.Is(r.err, ErrNotFound) {
+				fmt.Printf("Error applying entry %d: %s\n", e.Index, r.err)
+				return // The entry is applied again with the next ones
+			}
+			n.mu.Lock()
+			n.lastApplied = e.Index
+			if p, ok := n.waiters[e.Index]; ok {
+				delete(n.waiters, e.Index)
+				if p.term != e.Term {
+					r = proposalResult{err: fmt.Errorf("%w: the entry was replaced by a new leader", ErrNotLeader)}
+				}
+				p.done <- r
+			}
+			if e.Type == entryConfig && n.state == StateLeader && !n.isMember(n.id) {
+				fmt.Printf("Node %s was removed from the cluster, stepping down\n", n.id)
+				n.becomeFollower(n.Term)
+				n.leader = ""
+			}
+			close(n.applied)
+			n.applied = make(chan struct{})
+			n.mu.Unlock()
+		}
+	}
+	n.compact()
+}
+
+// apply applies a committed entry to the database. The caller must hold n.applyMu.
+// Returns, for the write of a single key, its previous value and its new version, ErrNotFound for the deletion
+// of a key that did not exist, and any encountered error.
+func (n *raftNode) apply(e raftEntry) proposalResult {
+	if e.Type != entryCommand {
+		return proposalResult{}
+	}
+	position := 0
+	_, b, err := recordToBatch(e.Data, &position)
+	if err != nil {
+		return proposalResult{err: err}
+	}
+
+	var r proposalResult
+	if len(b.ops) == 1 && (b.ops[0].flag == set || b.ops[0].flag == del) {
+		op, family := b.ops[0], n.db
+		if op.family != "" {
+			family = n.db.ColumnFamily(op.family)
+		}
+		if family != nil {
+			prev, err := family.Get(op.key)
+			r.prev, r.existed = prev, err == nil
+			if op.flag == del {
+				r.err = err
+			}
+		}
+	}
+	b.ops = append(b.ops, batchOp{raftColumnFamily, raftAppliedKey, value{set, []byte(strconv.FormatUint(e.Index, 10)), 0}})
+	if r.version, err = n.db.applyCommitted(b); err != nil {
+		return proposalResult{err: err}
+	}
+	return r
+}
+
+// compact discards the applied entries from the log once they are more than snapshotThreshold: the database
+// then serves as the snapshot, sent to the members missing them. The caller must hold n.applyMu.
+func (n *raftNode) compact() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.lastApplied-n.SnapshotIndex <= uint64(n.opts.snapshotThreshold) {
+		return
+	}
+	index := n.lastApplied
+	prev, prevLog := n.raftState, n.log
+	n.SnapshotTerm, _ = n.termAt(index)
+	n.SnapshotMembers, _ = n.membersAt(index)
+	n.log = append([]raftEntry(nil), n.log[index-n.SnapshotIndex:]...)
+	n.SnapshotIndex = index
+	if err := n.persist(); err != nil {
+		// The log file still holds the compacted entries: keep them, and retry at the next compaction
+		n.raftState, n.log = prev, prevLog
+		fmt.Println("Error compacting the Raft log:", err)
+		return
+	}
+	if err := n.rewriteLog(); err != nil {
+		fmt.Println("Error compacting the Raft log:", err)
+	}
+	n.updateMembers()
+}
+
+// applyCommitted logs and applies a batch committed by the Raft log of the cluster of the database, which
+// rejects the other writes.
+// Returns the sequence number of the first operation of the batch, and any encountered error.
+func (mem *fileDB) applyCommitted(b *WriteBatch) (uint64, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return 0, ErrClosed
+	}
+	first := mem.seq + 1
+	return first, mem.commit(first, b)
+}
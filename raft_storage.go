@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	raftStateFileName = "raft_state.json" // Term, vote and snapshot of a raftNode
+	raftLogFileName   = "raft.log"        // Entries of a raftNode after its snapshot
+
+	raftRecordHeaderSize = 8 // Length (4 bytes) and checksum (4 bytes) of a raft.log record
+)
+
+// raftState is the state of a raftNode persisted in raftStateFileName, besides its log.
+type raftState struct {
+	Term            uint64   `json:"term"`
+	VotedFor        string   `json:"votedFor,omitempty"` // Node voted for in Term
+	SnapshotIndex   uint64   `json:"snapshotIndex"`      // Index of the last entry compacted out of the log
+	SnapshotTerm    uint64   `json:"snapshotTerm"`       // Term of the entry at SnapshotIndex
+	SnapshotMembers []string `json:"snapshotMembers"`    // Members of the cluster as of SnapshotIndex
+}
+
+// loadRaftState reads the persisted state of a raftNode from path.
+// Returns the zero state if the file does not exist, and any encountered error.
+func loadRaftState(path string) (raftState, error) {
+	var state raftState
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("%w: %s: %s", ErrCorruption, path, err)
+	}
+	return state, nil
+}
+
+// saveRaftState writes the state of a raftNode to path, through a temporary file renamed over it so that
+// a crash leaves either the old or the new state.
+// Returns any encountered error.
+func saveRaftState(path string, state raftState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// raftEntriesToRecords serializes log entries as raft.log records: the length of the JSON entry, its checksum
+// and the JSON entry.
+// Returns the records and any encountered error.
+func raftEntriesToRecords(entries []raftEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	header := make([]byte, raftRecordHeaderSize)
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(data)))
+		copy(header[4:8], calculateChecksum(data))
+		buf.Write(header)
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// loadRaftLog reads the entries of raft.log at path. A record that was only partially written is dropped
+// along with the rest of the file, which is truncated so that new records are not appended after it.
+// Returns the entries, none if the file does not exist, and any encountered error.
+func loadRaftLog(path string) ([]raftEntry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []raftEntry
+	position := 0
+	for position < len(data) {
+		valid := false
+		var e raftEntry
+		if len(data)-position >= raftRecordHeaderSize {
+			length := int(binary.LittleEndian.Uint32(data[position : position+4]))
+			start := position + raftRecordHeaderSize
+			if start+length <= len(data) && bytes.Equal(calculateChecksum(data[start:start+length]), data[position+4:start]) {
+				valid = json.Unmarshal(data[start:start+length], &e) == nil
+			}
+			if valid {
+				position = start + length
+			}
+		}
+		if !valid {
+			fmt.Println("Ignoring the end of the Raft log: truncated record")
+			if err := os.Truncate(path, int64(position)); err != nil {
+				return nil, err
+			}
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// openRaftLog opens raft.log at path in append-only mode, creating it if it does not exist.
+// Returns the opened file and any encountered error.
+func openRaftLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// appendRaftLog appends entries to the open raft.log f and syncs it, so that they are durable before the node
+// acknowledges them.
+// Returns any encountered error.
+func appendRaftLog(f *os.File, entries []raftEntry) error {
+	records, err := raftEntriesToRecords(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(records); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// rewriteRaftLog replaces raft.log at path by one holding only entries, after a truncation or a compaction,
+// through a temporary file renamed over it.
+// Returns the reopened file and any encountered error.
+func rewriteRaftLog(path string, entries []raftEntry) (*os.File, error) {
+	records, err := raftEntriesToRecords(entries)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, records, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	return openRaftLog(path)
+}
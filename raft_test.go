@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRaftOptions elect a leader and replicate quickly, so that the tests run fast.
+var testRaftOptions = raftOptions{50 * time.Millisecond, 10 * time.Millisecond, 1000, 64, 2 * time.Second}
+
+// errUnreachable is returned by a raftNetwork for a node that is stopped or on the other side of a partition.
+var errUnreachable = errors.New("Node unreachable")
+
+// raftNetwork connects the nodes of a test cluster in memory, and simulates partitions.
+type raftNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*raftNode
+	group map[string]int // Partition of each node, nodes of different partitions cannot reach each other
+}
+
+// memTransport sends the messages of a node through a raftNetwork.
+type memTransport struct {
+	net  *raftNetwork
+	from string
+}
+
+// call delivers msg to the node to, unless a partition separates them, before or after it is handled.
+func (t *memTransport) call(ctx context.Context, to string, msg *raftMessage) (*raftMessage, error) {
+	if !t.net.reachable(t.from, to) {
+		return nil, errUnreachable
+	}
+	t.net.mu.Lock()
+	node := t.net.nodes[to]
+	t.net.mu.Unlock()
+	resp, err := node.handle(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	if !t.net.reachable(to, t.from) {
+		return nil, errUnreachable
+	}
+	return resp, nil
+}
+
+// reachable reports whether the node from can send a message to the running node to.
+func (net *raftNetwork) reachable(from, to string) bool {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	return net.nodes[to] != nil && net.group[from] == net.group[to]
+}
+
+// partition isolates the given nodes from the others, which stay connected to each other.
+func (net *raftNetwork) partition(ids ...string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	for _, id := range ids {
+		net.group[id] = 1
+	}
+}
+
+// heal removes the partitions.
+func (net *raftNetwork) heal() {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.group = make(map[string]int)
+}
+
+// testCluster is a cluster of nodes running in the test process, each with a database in its own directory.
+type testCluster struct {
+	t     *testing.T
+	net   *raftNetwork
+	peers []string
+	dirs  map[string]string
+	nodes map[string]*raftNode
+}
+
+// newTestCluster starts a cluster of size nodes, "n1" to "n<size>", stopped at the end of the test.
+func newTestCluster(t *testing.T, size int, opts raftOptions) *testCluster {
+	c := &testCluster{
+		t:     t,
+		net:   &raftNetwork{nodes: make(map[string]*raftNode), group: make(map[string]int)},
+		dirs:  make(map[string]string),
+		nodes: make(map[string]*raftNode),
+	}
+	for i := 1; i <= size; i++ {
+		c.peers = append(c.peers, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range c.peers {
+		c.start(id, c.peers, opts)
+	}
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start starts the node id with the given peers, reopening its database if it ran before.
+func (c *testCluster) start(id string, peers []string, opts raftOptions) *raftNode {
+	c.t.Helper()
+	if c.dirs[id] == "" {
+		c.dirs[id] = c.t.TempDir()
+	}
+	db, err := openDB(c.dirs[id], Options{})
+	if err != nil {
+		c.t.Fatalf("Error opening the database of %s: %s", id, err)
+	}
+	node, err := newRaftNode(id, db, &memTransport{c.net, id}, peers, opts)
+	if err != nil {
+		c.t.Fatalf("Error starting %s: %s", id, err)
+	}
+	c.net.mu.Lock()
+	c.net.nodes[id] = node
+	c.net.mu.Unlock()
+	c.nodes[id] = node
+	return node
+}
+
+// stop stops the node id and closes its database.
+func (c *testCluster) stop(id string) {
+	node := c.nodes[id]
+	c.net.mu.Lock()
+	delete(c.net.nodes, id)
+	c.net.mu.Unlock()
+	delete(c.nodes, id)
+	node.Stop()
+	node.db.Close()
+}
+
+// leader waits until one of the given nodes, all the running ones if none are given, leads a majority.
+func (c *testCluster) leader(ids ...string) *raftNode {
+	c.t.Helper()
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+	var nodes []*raftNode
+	for _, id := range ids {
+		nodes = append(nodes, c.nodes[id])
+	}
+	return waitLeader(c.t, nodes)
+}
+
+// waitLeader waits until one of nodes leads a majority.
+func waitLeader(t *testing.T, nodes []*raftNode) *raftNode {
+	t.Helper()
+	var leader *raftNode
+	waitFor(t, "a leader", func() bool {
+		for _, node := range nodes {
+			if status := node.Status(); status.State == StateLeader && node.confirmLeadership(context.Background(), status.Term) == nil {
+				leader = node
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// waitApplied waits until the given nodes applied every entry committed by the leader.
+func (c *testCluster) waitApplied(leader *raftNode, ids ...string) {
+	c.t.Helper()
+	commit := leader.Status().CommitIndex
+	for _, id := range ids {
+		node := c.nodes[id]
+		waitFor(c.t, id+" to apply the log", func() bool { return node.Status().LastApplied >= commit })
+	}
+}
+
+// expectValue checks the value of key in the database of each given node, read locally.
+func (c *testCluster) expectValue(key, want string, ids ...string) {
+	c.t.Helper()
+	for _, id := range ids {
+		if val, err := c.nodes[id].db.Get(key); err != nil || string(val) != want {
+			c.t.Fatalf("Expected %s=%s on %s, got %q (%v)", key, want, id, val, err)
+		}
+	}
+}
+
+func TestRaftElectionAndReplication(t *testing.T) {
+	c := newTestCluster(t, 3, testRaftOptions)
+	leader := c.leader()
+
+	// Writes go through the leader and are applied on every node
+	if err := leader.Set("a", []byte("1")); err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	b := NewWriteBatch()
+	b.Set("b", []byte("2"))
+	b.Set("c", []byte("3"))
+	if err := leader.Write(b); err != nil {
+		t.Fatalf("Error writing a batch: %s", err)
+	}
+	if val, err := leader.Del("c"); err != nil || string(val) != "3" {
+		t.Fatalf("Expected the deleted value 3, got %q (%v)", val, err)
+	}
+	if _, err := leader.Del("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	c.waitApplied(leader, c.peers...)
+	c.expectValue("a", "1", c.peers...)
+	c.expectValue("b", "2", c.peers...)
+
+	// Followers forward the reads to the leader, and reject the writes
+	var follower *raftNode
+	for _, node := range c.nodes {
+		if node != leader {
+			follower = node
+		}
+	}
+	if val, err := follower.Get("b"); err != nil || string(val) != "2" {
+		t.Fatalf("Expected b=2 read from a follower, got %q (%v)", val, err)
+	}
+	if err := follower.Set("x", []byte("y")); !errors.Is(err, ErrNotLeader) || !strings.Contains(err.Error(), leader.id) {
+		t.Fatalf("Expected ErrNotLeader naming %s, got %v", leader.id, err)
+	}
+	if err := follower.db.Set("x", []byte("y")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected the database to reject direct writes, got %v", err)
+	}
+	b = NewWriteBatch()
+	b.SetCF(leader.db.ColumnFamily(raftColumnFamily), raftAppliedKey, []byte("0"))
+	if err := leader.Write(b); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Expected the raft column family to be reserved, got %v", err)
+	}
+
+	// A new leader is elected when the leader is partitioned away, and the old one steps down
+	c.net.partition(leader.id)
+	var others []string
+	for _, id := range c.peers {
+		if id != leader.id {
+			others = append(others, id)
+		}
+	}
+	newLeader := c.leader(others...)
+	if err := newLeader.Set("a", []byte("2")); err != nil {
+		t.Fatalf("Error writing to the new leader: %s", err)
+	}
+	waitFor(t, "the old leader to step down", func() bool { return leader.Status().State != StateLeader })
+	if err := leader.Set("lost", []byte("1")); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("Expected ErrNotLeader from the partitioned node, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := leader.GetContext(ctx, "a"); err == nil {
+		t.Fatal("Expected the partitioned node to refuse a stale read")
+	}
+
+	// Once healed, the old leader catches up without disrupting the new one
+	c.net.heal()
+	term := newLeader.Status().Term
+	c.waitApplied(newLeader, c.peers...)
+	c.expectValue("a", "2", c.peers...)
+	if val, err := leader.Get("a"); err != nil || string(val) != "2" {
+		t.Fatalf("Expected a=2 read from the old leader, got %q (%v)", val, err)
+	}
+	if status := newLeader.Status(); status.State != StateLeader || status.Term != term {
+		t.Fatalf("Expected %s to stay the leader of term %d, got %+v", newLeader.id, term, status)
+	}
+}
+
+func TestRaftMinorityPartition(t *testing.T) {
+	c := newTestCluster(t, 5, testRaftOptions)
+	leader := c.leader()
+
+	// A leader cut off with a minority cannot commit, while the majority elects another leader
+	var minority, majority []string
+	minority = append(minority, leader.id)
+	for _, id := range c.peers {
+		if id == leader.id {
+			continue
+		}
+		if len(minority) < 2 {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+	c.net.partition(minority...)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := leader.SetContext(ctx, "k", []byte("minority")); err == nil {
+		t.Fatal("Expected the minority to fail committing")
+	}
+	newLeader := c.leader(majority...)
+	for i := 0; i < 20; i++ {
+		if err := newLeader.Set(fmt.Sprintf("key%02d", i), []byte("majority")); err != nil {
+			t.Fatalf("Error writing to the majority: %s", err)
+		}
+	}
+	if err := newLeader.Set("k", []byte("majority")); err != nil {
+		t.Fatalf("Error writing to the majority: %s", err)
+	}
+
+	// After healing, the uncommitted entry of the minority is replaced on every node
+	c.net.heal()
+	c.waitApplied(newLeader, c.peers...)
+	c.expectValue("k", "majority", c.peers...)
+	c.expectValue("key19", "majority", c.peers...)
+	for _, id := range c.peers {
+		if status := c.nodes[id].Status(); status.LastIndex != newLeader.Status().LastIndex {
+			t.Fatalf("Expected the logs to converge, got %+v on %s and %+v on the leader", status, id, newLeader.Status())
+		}
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	opts := testRaftOptions
+	opts.snapshotThreshold = 5
+	c := newTestCluster(t, 3, opts)
+	leader := c.leader()
+
+	// A stopped node falls behind the compacted log of the others
+	var lagging string
+	for _, id := range c.peers {
+		if id != leader.id {
+			lagging = id
+		}
+	}
+	c.stop(lagging)
+	for i := 0; i < 3*memLimit; i++ {
+		if err := leader.Set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error writing: %s", err)
+		}
+	}
+	leader.Del("key00")
+	if status := leader.Status(); status.SnapshotIndex == 0 {
+		t.Fatalf("Expected the log to be compacted, got %+v", status)
+	}
+
+	// The restarted node is sent a snapshot, then the entries after it
+	c.start(lagging, c.peers, opts)
+	leader.Set("after", []byte("snapshot"))
+	c.waitApplied(leader, lagging)
+	c.expectValue("key29", "29", lagging)
+	c.expectValue("after", "snapshot", lagging)
+	if _, err := c.nodes[lagging].db.Get("key00"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected key00 to be deleted on %s, got %v", lagging, err)
+	}
+	if status := c.nodes[lagging].Status(); status.SnapshotIndex == 0 {
+		t.Fatalf("Expected %s to install a snapshot, got %+v", lagging, status)
+	}
+
+	// Every node restarts from its own state, applying each entry once
+	for _, id := range c.peers {
+		c.stop(id)
+	}
+	for _, id := range c.peers {
+		c.start(id, c.peers, opts)
+	}
+	leader = c.leader()
+	leader.Set("restarted", []byte("1"))
+	c.waitApplied(leader, c.peers...)
+	c.expectValue("after", "snapshot", c.peers...)
+	c.expectValue("restarted", "1", c.peers...)
+}
+
+func TestRaftMembership(t *testing.T) {
+	c := newTestCluster(t, 3, testRaftOptions)
+	leader := c.leader()
+	leader.Set("a", []byte("1"))
+
+	// A node started without peers joins once added, receiving the whole log
+	c.start("n4", nil, testRaftOptions)
+	ctx := context.Background()
+	if err := leader.AddMember(ctx, "n4"); err != nil {
+		t.Fatalf("Error adding n4: %s", err)
+	}
+	c.waitApplied(leader, "n4")
+	c.expectValue("a", "1", "n4")
+	if members := c.nodes["n4"].Status().Members; len(members) != 4 {
+		t.Fatalf("Expected n4 to know the 4 members, got %v", members)
+	}
+	if err := leader.AddMember(ctx, "n4"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Expected ErrInvalidArgument adding n4 again, got %v", err)
+	}
+	if err := c.nodes["n4"].AddMember(ctx, "n5"); !errors.Is(err, ErrNotLeader) && leader.id != "n4" {
+		t.Fatalf("Expected ErrNotLeader from a follower, got %v", err)
+	}
+
+	// Removing the leader makes it step down, and the remaining members elect another one
+	if err := leader.RemoveMember(ctx, leader.id); err != nil {
+		t.Fatalf("Error removing the leader: %s", err)
+	}
+	waitFor(t, "the removed leader to step down", func() bool { return leader.Status().State != StateLeader })
+	var remaining []string
+	for _, id := range append(c.peers, "n4") {
+		if id != leader.id {
+			remaining = append(remaining, id)
+		}
+	}
+	newLeader := c.leader(remaining...)
+	if err := newLeader.Set("b", []byte("2")); err != nil {
+		t.Fatalf("Error writing after the removal: %s", err)
+	}
+	c.waitApplied(newLeader, remaining...)
+	c.expectValue("b", "2", remaining...)
+	if members := newLeader.Status().Members; len(members) != 3 {
+		t.Fatalf("Expected 3 members, got %v", members)
+	}
+	if err := newLeader.RemoveMember(ctx, "n9"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Expected ErrInvalidArgument removing a stranger, got %v", err)
+	}
+}
+
+func TestRaftPersistFailure(t *testing.T) {
+	// No election happens during the test
+	opts := testRaftOptions
+	opts.electionTimeout = time.Hour
+	c := newTestCluster(t, 3, opts)
+	node := c.nodes["n1"]
+	ctx := context.Background()
+
+	// The state cannot be saved while a directory stands in the way of its temporary file
+	tmp := node.db.path(raftStateFileName) + ".tmp"
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	vote := &raftMessage{Type: msgVote, From: "n2", Term: 5}
+	if _, err := node.handle(ctx, vote); err == nil {
+		t.Fatal("Expected the vote to be refused")
+	}
+	if _, err := node.handle(ctx, &raftMessage{Type: msgHeartbeat, From: "n2", Term: 5}); err == nil {
+		t.Fatal("Expected the heartbeat of a new term to be rejected")
+	}
+	if status := node.Status(); status.Term != 0 || status.Leader != "" {
+		t.Fatalf("Expected the node to stay in term 0, got %+v", status)
+	}
+
+	// Once the state can be saved, the vote is granted and survives a restart
+	os.Remove(tmp)
+	resp, err := node.handle(ctx, vote)
+	if err != nil || !resp.Granted || resp.Term != 5 {
+		t.Fatalf("Expected the vote to be granted, got %+v (%v)", resp, err)
+	}
+	if state, err := loadRaftState(node.db.path(raftStateFileName)); err != nil || state.Term != 5 || state.VotedFor != "n2" {
+		t.Fatalf("Expected the vote to be saved, got %+v (%v)", state, err)
+	}
+}
+
+func TestHandleCluster(t *testing.T) {
+	// Nodes are identified by the base URL of their servers, which start before the nodes
+	var nodes []*raftNode
+	var servers []*httptest.Server
+	var mu sync.Mutex
+	for i := 0; i < 3; i++ {
+		i := i
+		srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			ready := len(nodes) == 3
+			mu.Unlock()
+			if !ready {
+				httpError(resp, "Not started", http.StatusServiceUnavailable)
+				return
+			}
+			handleCluster(nodes[i], handleFunction(nodes[i].db, nil))(resp, req)
+		}))
+		t.Cleanup(srv.Close)
+		servers = append(servers, srv)
+	}
+	var peers []string
+	for _, srv := range servers {
+		peers = append(peers, srv.URL)
+	}
+	mu.Lock()
+	for _, peer := range peers {
+		db, err := openDB(t.TempDir(), Options{})
+		if err != nil {
+			t.Fatalf("Error opening the database: %s", err)
+		}
+		if _, err := db.CreateColumnFamily("users", Options{}); err != nil {
+			t.Fatalf("Error creating column family: %s", err)
+		}
+		node, err := newRaftNode(peer, db, newHTTPRaftTransport(), peers, testRaftOptions)
+		if err != nil {
+			t.Fatalf("Error starting %s: %s", peer, err)
+		}
+		t.Cleanup(func() { node.Stop(); db.Close() })
+		nodes = append(nodes, node)
+	}
+	mu.Unlock()
+
+	leader := waitLeader(t, nodes)
+	var follower string
+	for _, peer := range peers {
+		if peer != leader.id {
+			follower = peer
+		}
+	}
+
+	resp, _ := http.Post(leader.id+"/set", "application/json", strings.NewReader(`{"key":"a","value":"1"}`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+	resp, _ = http.Post(leader.id+"/batch", "application/json", strings.NewReader(`[{"op":"set","key":"b","value":"2"},{"op":"del","key":"a"}]`))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	// Followers serve linearizable reads, and redirect writes to the leader
+	resp, _ = http.Get(follower + "/get?key=b")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "2" {
+		t.Fatalf("Expected b=2 from the follower, got %d %q", resp.StatusCode, body)
+	}
+	resp, _ = http.Post(follower+"/set", "application/json", strings.NewReader(`{"key":"c","value":"3"}`))
+	var errBody errorResponse
+	if json.NewDecoder(resp.Body).Decode(&errBody); resp.StatusCode != http.StatusMisdirectedRequest || errBody.Error.Code != "not_leader" || resp.Header.Get("X-GoDB-Leader") != leader.id {
+		t.Fatalf("Expected 421 not_leader with the leader, got %d %+v %v", resp.StatusCode, errBody, resp.Header)
+	}
+	resp.Body.Close()
+
+	// The other reads and writes also go through the log
+	resp, _ = http.Post(leader.id+"/batch", "application/json", strings.NewReader(`[{"op":"set","key":"r1","value":"1"},{"op":"set","key":"r2","value":"2"}]`))
+	resp.Body.Close()
+	resp, _ = http.Post(follower+"/mget", "application/json", strings.NewReader(`["b","r1","z"]`))
+	var values multiGetResponse
+	if json.NewDecoder(resp.Body).Decode(&values); resp.StatusCode != http.StatusOK || values.Values["r1"] != "1" || fmt.Sprint(values.Missing) != "[z]" {
+		t.Fatalf("Unexpected mget response from the follower %d %+v", resp.StatusCode, values)
+	}
+	resp.Body.Close()
+	resp, _ = http.Get(follower + "/scan?prefix=r")
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"r1"`) || !strings.Contains(string(body), `"r2"`) {
+		t.Fatalf("Expected r1 and r2 in the scan of the follower, got %d %s", resp.StatusCode, body)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, leader.id+"/delrange?start=r&end=s", nil)
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	commit := leader.Status().CommitIndex
+	for _, node := range nodes {
+		waitFor(t, node.id+" to apply the log", func() bool { return node.Status().LastApplied >= commit })
+		if _, err := node.db.Get("r1"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Expected the range deletion to be applied on %s, got %v", node.id, err)
+		}
+	}
+	resp, _ = http.Get(follower + "/ttl?key=b")
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "-1" {
+		t.Fatalf("Expected the TTL of b from the follower, got %d %q", resp.StatusCode, body)
+	}
+
+	// The v2 API used by the client
+	for _, want := range []int{http.StatusCreated, http.StatusNoContent} {
+		req, _ := http.NewRequest(http.MethodPut, leader.id+keysV2Prefix+"k", strings.NewReader("v"))
+		resp, _ := http.DefaultClient.Do(req)
+		resp.Body.Close()
+		if resp.StatusCode != want || resp.Header.Get("ETag") == "" {
+			t.Fatalf("Expected %d with an ETag, got %d %v", want, resp.StatusCode, resp.Header)
+		}
+	}
+	resp, _ = http.Get(follower + keysV2Prefix + "k")
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "v" {
+		t.Fatalf("Expected k=v from the follower, got %d %q", resp.StatusCode, body)
+	}
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodDelete, leader.id+keysV2Prefix+"k", nil)
+		resp, _ := http.DefaultClient.Do(req)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("Expected the deletion of k to answer %d, got %d", want, resp.StatusCode)
+		}
+	}
+
+	// The writes that would need to read and write atomically are rejected, rather than refused as read-only
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodPost, "/incr?key=n"},
+		{http.MethodPost, "/decr?key=n"},
+		{http.MethodPost, "/txn/begin"},
+		{http.MethodPost, "/cf?name=sessions"},
+		{http.MethodGet, "/webhooks"},
+	} {
+		req, _ := http.NewRequest(tc.method, leader.id+tc.path, nil)
+		resp, _ := http.DefaultClient.Do(req)
+		json.NewDecoder(resp.Body).Decode(&errBody)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotImplemented || errBody.Error.Code != "not_supported" {
+			t.Fatalf("%s %s: expected 501 not_supported, got %d %+v", tc.method, tc.path, resp.StatusCode, errBody)
+		}
+	}
+
+	var status RaftStatus
+	resp, _ = http.Get(follower + "/cluster/status")
+	if json.NewDecoder(resp.Body).Decode(&status); status.State != StateFollower || status.Leader != leader.id || len(status.Members) != 3 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	resp.Body.Close()
+
+	// The cf parameter selects the column family of reads and writes
+	resp, _ = http.Post(leader.id+"/set?cf=users", "application/json", strings.NewReader(`{"key":"alice","value":"admin"}`))
+	resp.Body.Close()
+	resp, _ = http.Post(leader.id+"/batch?cf=users", "application/json", strings.NewReader(`[{"op":"set","key":"bob","value":"guest"}]`))
+	resp.Body.Close()
+	for key, want := range map[string]string{"alice": "admin", "bob": "guest"} {
+		resp, _ = http.Get(follower + "/get?cf=users&key=" + key)
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Fatalf("Expected %s=%s in users from the follower, got %d %q", key, want, resp.StatusCode, body)
+		}
+	}
+	req, _ = http.NewRequest(http.MethodDelete, leader.id+"/del?cf=users&key=alice", nil)
+	resp, _ = http.DefaultClient.Do(req)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "Key deleted successfully. Value: admin" {
+		t.Fatalf("Expected the deletion of alice from users, got %d %q", resp.StatusCode, body)
+	}
+
+	// Conditional writes are rejected rather than applied unconditionally
+	for _, tc := range []struct{ method, path, header string }{
+		{http.MethodPost, "/set", "If-Match"},
+		{http.MethodPost, "/set", "If-None-Match"},
+		{http.MethodDelete, "/del?key=b", "If-Match"},
+	} {
+		req, _ := http.NewRequest(tc.method, leader.id+tc.path, strings.NewReader(`{"key":"b","value":"3"}`))
+		req.Header.Set(tc.header, "*")
+		resp, _ := http.DefaultClient.Do(req)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s %s with %s: expected 400, got %d", tc.method, tc.path, tc.header, resp.StatusCode)
+		}
+	}
+	if val, err := leader.Get("b"); err != nil || string(val) != "2" {
+		t.Fatalf("Expected b=2 to be left unchanged, got %q (%v)", val, err)
+	}
+
+	// Edge cases
+	for _, tc := range []struct {
+		method, url string
+		status      int
+	}{
+		{http.MethodGet, leader.id + "/get?key=a", http.StatusNotFound},
+		{http.MethodGet, leader.id + "/get?key=bob", http.StatusNotFound},
+		{http.MethodGet, leader.id + "/get?cf=missing&key=b", http.StatusNotFound},
+		{http.MethodPost, leader.id + "/set?cf=missing", http.StatusNotFound},
+		{http.MethodDelete, leader.id + "/del?cf=missing&key=b", http.StatusNotFound},
+		{http.MethodPost, leader.id + "/batch?cf=missing", http.StatusNotFound},
+		{http.MethodDelete, leader.id + "/del?cf=raft&key=b", http.StatusBadRequest},
+		{http.MethodPut, follower + keysV2Prefix + "k", http.StatusMisdirectedRequest},
+		{http.MethodPost, follower + "/delrange?start=a&end=b", http.StatusMisdirectedRequest},
+		{http.MethodPost, leader.id + "/delrange?start=b&end=a", http.StatusBadRequest},
+		{http.MethodGet, follower + "/cf", http.StatusOK},
+		{http.MethodGet, leader.id + "/get", http.StatusBadRequest},
+		{http.MethodDelete, leader.id + "/del?key=b", http.StatusOK},
+		{http.MethodPost, leader.id + "/cluster/members", http.StatusBadRequest},
+		{http.MethodPost, leader.id + "/cluster/members?id=" + follower, http.StatusBadRequest},
+		{http.MethodPut, leader.id + "/cluster/members?id=x", http.StatusMethodNotAllowed},
+		{http.MethodDelete, follower + "/cluster/members?id=" + follower, http.StatusMisdirectedRequest},
+		{http.MethodGet, leader.id + raftPath, http.StatusMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s %s: expected %d, got %d", tc.method, tc.url, tc.status, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// DeleteRange deletes all the keys from start, included, to end, excluded, in the Memtable and the Write-Ahead Log.
+// The deletion is recorded as a single range tombstone: no key is read, whatever the number of keys in the range.
+// Keys written afterwards in the range are not affected.
+// Returns any encountered error during the process.
+func (mem *fileDB) DeleteRange(start, end string) error {
+	return mem.DeleteRangeContext(context.Background(), start, end)
+}
+
+// DeleteRangeContext is like DeleteRange, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) DeleteRangeContext(ctx context.Context, start, end string) error {
+	if start >= end {
+		return fmt.Errorf("%w: start must be less than end", ErrInvalidArgument)
+	}
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	b := WriteBatch{}
+	b.DeleteRange(start, end)
+	return mem.write(ctx, &b)
+}
+
+// covers reports whether the range tombstone r deletes the versions of key written before it.
+func (r kvEntry) covers(key string) bool {
+	return key >= r.key && key < string(r.val)
+}
+
+// coveringRangeDel looks up the newest range tombstone covering key whose sequence number is at most seq.
+// Returns it as a deletion of key, so that it can be compared with the point versions of key, and whether one was found.
+func coveringRangeDel(rangeDels []kvEntry, key string, seq uint64) (kvEntry, bool) {
+	var newest kvEntry
+	found := false
+	for _, r := range rangeDels {
+		if r.seq <= seq && r.covers(key) && (!found || r.seq > newest.seq) {
+			newest, found = r, true
+		}
+	}
+	if !found {
+		return kvEntry{}, false
+	}
+	return kvEntry{internalKey{key, newest.seq}, value{del, nil, 0}}, true
+}
+
+// withRangeDels adds a deletion of the key of versions for each range tombstone covering it.
+// versions hold the versions of a single key; the result is sorted from the newest to the oldest version.
+func withRangeDels(versions []kvEntry, rangeDels []kvEntry) []kvEntry {
+	if len(versions) == 0 {
+		return versions
+	}
+	key := versions[0].key
+	for _, r := range rangeDels {
+		if r.covers(key) {
+			versions = append(versions, kvEntry{internalKey{key, r.seq}, value{del, nil, 0}})
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].seq > versions[j].seq })
+	return versions
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteRange(t *testing.T) {
+	db := newTestDB(t)
+
+	// Spread the keys over SST files and the Memtable
+	for i := 0; i < 15; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	snap := db.NewSnapshot()
+	defer snap.Release()
+
+	if err := db.DeleteRange("key03", "key12"); err != nil {
+		t.Fatalf("Error deleting range: %s", err)
+	}
+	// A key written after the tombstone is not deleted
+	if err := db.Set("key05", []byte("new")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 15; i++ {
+			key := fmt.Sprintf("key%02d", i)
+			val, err := db.Get(key)
+			switch {
+			case key == "key05":
+				if err != nil || string(val) != "new" {
+					t.Fatalf("Expected new for %s, got %s (%v)", key, val, err)
+				}
+			case key >= "key03" && key < "key12":
+				if err == nil {
+					t.Fatalf("Expected %s to be deleted, got %s", key, val)
+				}
+			default:
+				if err != nil || string(val) != fmt.Sprint(i) {
+					t.Fatalf("Expected %d for %s, got %s (%v)", i, key, val, err)
+				}
+			}
+		}
+
+		it, err := db.NewIterator(&IterOptions{Prefix: "key"})
+		if err != nil {
+			t.Fatalf("Error creating iterator: %s", err)
+		}
+		defer it.Close()
+		var keys []string
+		for ok := it.First(); ok; ok = it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if fmt.Sprint(keys) != "[key00 key01 key02 key05 key12 key13 key14]" {
+			t.Fatalf("Unexpected keys %v", keys)
+		}
+
+		// The snapshot taken before the deletion still sees the whole range
+		if val, err := snap.Get("key07"); err != nil || string(val) != "7" {
+			t.Fatalf("Expected 7 in the snapshot, got %s (%v)", val, err)
+		}
+	}
+	check()
+
+	// The tombstone survives flushes and compactions
+	for i := 0; i < memLimit*compactingSize; i++ {
+		if err := db.Set(fmt.Sprintf("other%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	check()
+
+	// Edge case: an empty range is rejected
+	if err := db.DeleteRange("b", "a"); err == nil {
+		t.Fatal("Expected an error for an empty range")
+	}
+}
+
+func TestDeleteRangeCompaction(t *testing.T) {
+	db := newTestDB(t)
+
+	for i := 0; i < memLimit; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	if err := db.DeleteRange("key00", "key99"); err != nil {
+		t.Fatalf("Error deleting range: %s", err)
+	}
+	for i := 0; i < memLimit*compactingSize; i++ {
+		if err := db.Set(fmt.Sprintf("other%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+
+	// Without snapshots, compaction drops both the tombstone and the keys it deleted
+	files, err := filepath.Glob("db_*.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		table, err := readSST(file)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", file, err)
+		}
+		if len(table.rangeDels) != 0 {
+			t.Fatalf("Expected no range tombstone in %s", file)
+		}
+		for _, entry := range table.entries {
+			if entry.key < "key99" && entry.key >= "key00" {
+				t.Fatalf("Expected %s to be compacted away from %s", entry.key, file)
+			}
+		}
+	}
+}
+
+func TestDeleteRangeRecovery(t *testing.T) {
+	db := newTestDB(t)
+	db.mergeOperator = Int64AddOperator{}
+
+	if err := db.Set("a", []byte("1")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if err := db.Merge("b", []byte("5")); err != nil {
+		t.Fatalf("Error merging key: %s", err)
+	}
+	if err := db.DeleteRange("a", "c"); err != nil {
+		t.Fatalf("Error deleting range: %s", err)
+	}
+	// Merge operands written after the tombstone do not apply to the deleted value
+	if err := db.Merge("b", []byte("2")); err != nil {
+		t.Fatalf("Error merging key: %s", err)
+	}
+	db.wal.Close()
+
+	reopened, err := newDBWithOptions(Options{MergeOperator: Int64AddOperator{}})
+	if err != nil {
+		t.Fatal("Error reopening the DB:", err)
+	}
+	defer reopened.wal.Close()
+	if err := reopened.recoverWAL(); err != nil {
+		t.Fatalf("Error recovering the WAL: %s", err)
+	}
+	if _, err := reopened.Get("a"); err == nil {
+		t.Fatal("Expected a to be deleted")
+	}
+	if val, err := reopened.Get("b"); err != nil || string(val) != "2" {
+		t.Fatalf("Expected 2, got %s (%v)", val, err)
+	}
+}
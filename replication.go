@@ -0,0 +1,530 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	replicationHeartbeat  = time.Second     // Interval of the heartbeats written to idle replication streams
+	replicationTimeout    = 5 * time.Second // A follower reconnects once its stream stayed silent for this long
+	replicationRetryDelay = time.Second     // Delay before a follower reconnects after an error
+
+	replicationStreamPath     = "/replication/stream"
+	replicationCheckpointPath = "/replication/checkpoint"
+
+	replicationHeaderSize   = 12      // Sequence number of the last write of the primary (8 bytes) and record length (4 bytes)
+	maxReplicatedRecordSize = 1 << 30 // Largest WAL record accepted in a replication stream, in bytes
+)
+
+// ErrReadOnly is returned when writing to a follower that was not promoted.
+var ErrReadOnly = errors.New("Read-only follower")
+
+// Roles of a database in ReplicationStatus.
+const (
+	RolePrimary  = "primary"
+	RoleFollower = "follower"
+)
+
+// ReplicationStatus describes the replication of a database, as reported by ReplicationStatus and the
+// "/replication/status" endpoint.
+type ReplicationStatus struct {
+	Role            string     `json:"role"`                      // RolePrimary or RoleFollower
+	Sequence        uint64     `json:"sequence"`                  // Sequence number of the last write applied
+	Followers       int        `json:"followers,omitempty"`       // Replication streams served to followers
+	Primary         string     `json:"primary,omitempty"`         // URL of the primary followed
+	PrimarySequence uint64     `json:"primarySequence,omitempty"` // Last write of the primary, as last heard
+	Lag             uint64     `json:"lag"`                       // Writes of the primary not applied yet
+	LastContact     *time.Time `json:"lastContact,omitempty"`     // Time of the last frame received from the primary
+	Connected       bool       `json:"connected"`                 // Whether the follower is streaming from the primary
+}
+
+// sequence returns the sequence number of the last write.
+func (mem *fileDB) sequence() uint64 {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	return mem.seq
+}
+
+// logTail receives the batches committed to a database, as logged to its Write-Ahead Log, to stream them
+// to a follower.
+type logTail struct {
+	feed    *changeFeed
+	backlog []walBatch    // Batches replayed from the Write-Ahead Logs, delivered before the new ones
+	batches chan walBatch // New batches
+	done    chan struct{}
+	err     error // Reason why the logTail was unregistered, set before done is closed
+}
+
+// removeTail unregisters a logTail, whose next then fails with err once its buffered batches are read.
+// The caller must hold feed.mu.
+func (feed *changeFeed) removeTail(t *logTail, err error) {
+	if _, ok := feed.tails[t]; !ok {
+		return
+	}
+	delete(feed.tails, t)
+	t.err = err
+	close(t.done)
+}
+
+// next returns the next batch, waiting for it until ctx is done.
+// Returns ErrLagging if the logTail fell behind, ErrClosed if it or the database was closed, or the error of ctx.
+func (t *logTail) next(ctx context.Context) (walBatch, error) {
+	if len(t.backlog) > 0 {
+		wb := t.backlog[0]
+		t.backlog = t.backlog[1:]
+		return wb, nil
+	}
+	select {
+	case wb := <-t.batches:
+		return wb, nil
+	case <-t.done:
+		select {
+		case wb := <-t.batches:
+			return wb, nil
+		default:
+			return walBatch{}, t.err
+		}
+	case <-ctx.Done():
+		return walBatch{}, ctx.Err()
+	}
+}
+
+// close unregisters the logTail.
+func (t *logTail) close() {
+	t.feed.mu.Lock()
+	defer t.feed.mu.Unlock()
+	t.feed.removeTail(t, ErrClosed)
+}
+
+// tailLog returns a logTail of the batches committed after the sequence number after, replaying first the ones
+// retained in the archived and current Write-Ahead Logs.
+// Returns the logTail, or an error wrapping ErrTrimmed if the batches after after are no longer retained.
+func (mem *fileDB) tailLog(after uint64) (*logTail, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	if mem.closed {
+		return nil, ErrClosed
+	}
+	if after > mem.seq {
+		return nil, fmt.Errorf("%w: sequence number %d is after the last write %d", ErrInvalidArgument, after, mem.seq)
+	}
+
+	t := &logTail{mem.feed, nil, make(chan walBatch, watchBufferSize), make(chan struct{}), nil}
+	if after < mem.seq {
+		batches, err := mem.retainedBatches(after)
+		if err != nil {
+			return nil, err
+		}
+		t.backlog = batches
+	}
+
+	// Holding mem.mu keeps writers out, so that no batch is missed or repeated between the replay and now
+	mem.feed.mu.Lock()
+	mem.feed.tails[t] = struct{}{}
+	mem.feed.mu.Unlock()
+	return t, nil
+}
+
+// writeReplicationFrame writes a frame of a replication stream: the sequence number of the last write of the primary,
+// the length of the WAL record and the record, built by batchToRecord. Heartbeats are frames without a record.
+// Returns any encountered error.
+func writeReplicationFrame(w io.Writer, primarySeq uint64, record []byte) error {
+	header := make([]byte, replicationHeaderSize)
+	binary.LittleEndian.PutUint64(header[0:8], primarySeq)
+	binary.LittleEndian.PutUint32(header[8:12], uint32(len(record)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(record)
+	return err
+}
+
+// readReplicationFrame reads a frame written by writeReplicationFrame.
+// Returns the sequence number of the primary, the record, nil for a heartbeat, and any encountered error.
+func readReplicationFrame(r io.Reader) (uint64, []byte, error) {
+	header := make([]byte, replicationHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	primarySeq := binary.LittleEndian.Uint64(header[0:8])
+	length := binary.LittleEndian.Uint32(header[8:12])
+	if length == 0 {
+		return primarySeq, nil, nil
+	}
+	if length > maxReplicatedRecordSize {
+		return 0, nil, fmt.Errorf("%w: %d-byte replication record", ErrCorruption, length)
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return 0, nil, err
+	}
+	return primarySeq, record, nil
+}
+
+// checkpoint flushes the Memtables, so that every write is in the SST files, and reads the SST files of all
+// the column families.
+// Returns the sequence number of the last write, the content of the files by path relative to the database
+// directory, with slashes, and any encountered error.
+func (mem *fileDB) checkpoint() (uint64, map[string][]byte, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return 0, nil, ErrClosed
+	}
+	for _, family := range mem.families {
+		if family.memSize() > 0 {
+			if err := mem.flush(); err != nil {
+				return 0, nil, err
+			}
+			break
+		}
+	}
+
+	files := make(map[string][]byte)
+	for name, family := range mem.families {
+		ssts, err := family.sstFiles()
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, file := range ssts {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return 0, nil, err
+			}
+			rel := filepath.Base(file)
+			if name != defaultColumnFamily {
+				rel = path.Join(columnFamilyDirPrefix+name, rel)
+			}
+			files[rel] = data
+		}
+	}
+	return mem.seq, files, nil
+}
+
+// installCheckpoint replaces the content of the database with a checkpoint of the primary taken at the sequence
+// number seq: the SST files, Memtables, Write-Ahead Log and WAL archive are discarded, then the files of the
+// checkpoint are written in the order of their names, renamed so that they sort before the SST files flushed later.
+// The watchers are closed with ErrTrimmed, since the changes up to seq are not replayed to them.
+// A crash while installing a checkpoint leaves the database partially replaced: its directory should then be emptied.
+// Returns an error wrapping ErrCorruption if a file name is invalid, or any encountered error.
+func (mem *fileDB) installCheckpoint(seq uint64, files map[string][]byte) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		dir, file := path.Split(name)
+		family := strings.TrimPrefix(strings.TrimSuffix(dir, "/"), columnFamilyDirPrefix)
+		valid, _ := path.Match("db_*.sst", file)
+		if !valid || (dir != "" && (!strings.HasPrefix(dir, columnFamilyDirPrefix) || !validColumnFamilyName(family))) {
+			return fmt.Errorf("%w: invalid checkpoint file %q", ErrCorruption, name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return ErrClosed
+	}
+
+	// Discard the current content
+	for _, family := range mem.families {
+		ssts, err := family.sstFiles()
+		if err != nil {
+			return err
+		}
+		for _, file := range ssts {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+		family.values.Clear()
+		family.rangeDels = nil
+	}
+	archives, err := mem.archivedWALs()
+	if err != nil {
+		return err
+	}
+	for _, archive := range archives {
+		if err := os.Remove(archive); err != nil {
+			return err
+		}
+	}
+	mem.wal.Close()
+	if err := os.Remove(mem.path(walFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	wal, err := openWAL(mem.path(walFileName))
+	if err != nil {
+		return err
+	}
+	mem.wal = wal
+
+	// Write the checkpoint, numbering the files from now so that they keep their order
+	base := time.Now().UnixNano()
+	for i, name := range names {
+		family := mem.families[defaultColumnFamily]
+		if dir := path.Dir(name); dir != "." {
+			var err error
+			if family, err = mem.openReplayedColumnFamily(strings.TrimPrefix(dir, columnFamilyDirPrefix)); err != nil {
+				return err
+			}
+		}
+		file := filepath.Join(family.dir, fmt.Sprintf(sstFileName, strconv.FormatInt(base+int64(i), 10)))
+		if err := os.WriteFile(file, files[name], 0644); err != nil {
+			return err
+		}
+	}
+	mem.seq = seq
+	mem.feed.closeAll(ErrTrimmed)
+	return nil
+}
+
+// applyReplicated logs and applies a batch received from the primary, whose operations are numbered from the
+// sequence number first and name their column family, like the batches of the Write-Ahead Log during recovery.
+// Batches already applied are skipped.
+// Returns an error wrapping ErrCorruption if writes are missing before the batch, or any encountered error.
+func (mem *fileDB) applyReplicated(first uint64, b *WriteBatch) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return ErrClosed
+	}
+	if (walBatch{first, b}).last() <= mem.seq {
+		return nil
+	}
+	if first != mem.seq+1 {
+		return fmt.Errorf("%w: expected write %d from the primary, got %d", ErrCorruption, mem.seq+1, first)
+	}
+	return mem.commit(first, b)
+}
+
+// follower replicates a primary into a database, which rejects the other writes meanwhile.
+type follower struct {
+	primary  string // Base URL of the primary
+	client   *http.Client
+	cancel   context.CancelFunc // Stops the replication
+	done     chan struct{}      // Closed once the replication stopped
+	promoted chan struct{}      // Closed once the database was promoted
+
+	mu          sync.Mutex
+	primarySeq  uint64
+	lastContact time.Time
+	connected   bool
+}
+
+// Follow makes the database a read-only follower of the primary server whose base URL is primary.
+// The writes of the primary are streamed over HTTP from the sequence number of the last write of the database,
+// and applied in order; when they are no longer retained by the primary, the database is replaced by a checkpoint
+// of the primary first. Writes are rejected with ErrReadOnly until Promote is called.
+// Returns an error wrapping ErrInvalidArgument if the database is already a follower, or ErrClosed.
+func (mem *fileDB) Follow(primary string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.closed {
+		return ErrClosed
+	}
+	if mem.follower != nil {
+		return fmt.Errorf("%w: already following %s", ErrInvalidArgument, mem.follower.primary)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		primary:  strings.TrimSuffix(primary, "/"),
+		client:   &http.Client{},
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		promoted: make(chan struct{}),
+	}
+	mem.follower = f
+	go f.run(ctx, mem)
+	return nil
+}
+
+// Promote stops the replication of a follower, which then accepts writes, numbered after the last write applied.
+// The former primary must no longer be written to, or the databases diverge.
+// Returns an error wrapping ErrInvalidArgument if the database is not a follower.
+func (mem *fileDB) Promote() error {
+	mem.mu.RLock()
+	f := mem.follower
+	mem.mu.RUnlock()
+	if f == nil {
+		return fmt.Errorf("%w: not a follower", ErrInvalidArgument)
+	}
+	f.cancel()
+	<-f.done
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if mem.follower == f {
+		mem.follower = nil
+		close(f.promoted)
+	}
+	return nil
+}
+
+// promotion returns a channel closed once the database is promoted, or nil if it is not a follower.
+func (mem *fileDB) promotion() <-chan struct{} {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	if mem.follower == nil {
+		return nil
+	}
+	return mem.follower.promoted
+}
+
+// ReplicationStatus returns the role of the database and, for a follower, how far behind the primary it is.
+func (mem *fileDB) ReplicationStatus() ReplicationStatus {
+	mem.mu.RLock()
+	seq, f := mem.seq, mem.follower
+	mem.mu.RUnlock()
+
+	if f == nil {
+		mem.feed.mu.Lock()
+		defer mem.feed.mu.Unlock()
+		return ReplicationStatus{Role: RolePrimary, Sequence: seq, Followers: len(mem.feed.tails)}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := ReplicationStatus{
+		Role:            RoleFollower,
+		Sequence:        seq,
+		Primary:         f.primary,
+		PrimarySequence: f.primarySeq,
+		Connected:       f.connected,
+	}
+	if f.primarySeq > seq {
+		status.Lag = f.primarySeq - seq
+	}
+	if !f.lastContact.IsZero() {
+		lastContact := f.lastContact
+		status.LastContact = &lastContact
+	}
+	return status
+}
+
+// run replicates the primary into db until ctx is done or db is closed, reconnecting after errors.
+func (f *follower) run(ctx context.Context, db *fileDB) {
+	defer close(f.done)
+	for {
+		err := f.stream(ctx, db)
+		if errors.Is(err, ErrTrimmed) {
+			if err = f.catchUp(ctx, db); err == nil {
+				continue
+			}
+		}
+		f.mu.Lock()
+		f.connected = false
+		f.mu.Unlock()
+		if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+			return
+		}
+		fmt.Printf("Error replicating from %s: %s\n", f.primary, err)
+		if !sleepContext(ctx, replicationRetryDelay) {
+			return
+		}
+	}
+}
+
+// stream applies the writes streamed by the primary after the last write of db.
+// Returns the error ending the stream, wrapping ErrTrimmed if the primary no longer retains the writes to stream.
+func (f *follower) stream(ctx context.Context, db *fileDB) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	url := fmt.Sprintf("%s%s?after=%d", f.primary, replicationStreamPath, db.sequence())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return fmt.Errorf("%w: the primary needs to send a checkpoint", ErrTrimmed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Primary answered %s", resp.Status)
+	}
+
+	// The primary sends heartbeats: give up on a silent connection
+	idle := time.AfterFunc(replicationTimeout, cancel)
+	defer idle.Stop()
+	r := bufio.NewReader(resp.Body)
+	for {
+		primarySeq, record, err := readReplicationFrame(r)
+		if err != nil {
+			return err
+		}
+		idle.Reset(replicationTimeout)
+		f.mu.Lock()
+		f.primarySeq, f.lastContact, f.connected = primarySeq, time.Now(), true
+		f.mu.Unlock()
+		if record == nil {
+			continue
+		}
+
+		position := 0
+		first, b, err := recordToBatch(record, &position)
+		if err != nil {
+			return err
+		}
+		if err := db.applyReplicated(first, b); err != nil {
+			return err
+		}
+	}
+}
+
+// catchUp replaces the content of db with a checkpoint of the primary.
+// Returns any encountered error.
+func (f *follower) catchUp(ctx context.Context, db *fileDB) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.primary+replicationCheckpointPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Primary answered %s to the checkpoint request", resp.Status)
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get("X-GoDB-Seq"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid checkpoint sequence number: %w", err)
+	}
+
+	files := make(map[string][]byte)
+	archive := tar.NewReader(resp.Body)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return err
+		}
+		files[header.Name] = data
+	}
+	fmt.Printf("Installing a checkpoint of %s at sequence number %d\n", f.primary, seq)
+	return db.installCheckpoint(seq, files)
+}
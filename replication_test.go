@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPrimaryServer serves db, closed at the end of the test once the followers registered later are closed.
+func newPrimaryServer(t *testing.T, db *fileDB) *httptest.Server {
+	srv := httptest.NewServer(handleFunction(db, nil))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newFollower opens a database in dir following the primary server srv, closed at the end of the test.
+func newFollower(t *testing.T, dir string, srv *httptest.Server) *fileDB {
+	t.Helper()
+	db, err := openDB(dir, Options{})
+	if err != nil {
+		t.Fatalf("Error opening the follower: %s", err)
+	}
+	if err := db.Follow(srv.URL); err != nil {
+		t.Fatalf("Error following: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// waitForSequence waits until the follower applied every write of the primary.
+func waitForSequence(t *testing.T, follower, primary *fileDB) {
+	t.Helper()
+	waitFor(t, "the follower to catch up", func() bool { return follower.sequence() == primary.sequence() })
+}
+
+func TestReplication(t *testing.T) {
+	primary := newTestDB(t)
+	users, _ := primary.CreateColumnFamily("users", Options{})
+	primary.Set("a", []byte("1"))
+	b := NewWriteBatch()
+	b.Set("b", []byte("2"))
+	b.SetCF(users, "alice", []byte("admin"))
+	primary.Write(b)
+	primary.SetWithTTL("c", []byte("3"), time.Hour)
+	primary.DeleteRange("a", "b")
+
+	srv := newPrimaryServer(t, primary)
+	follower := newFollower(t, t.TempDir(), srv)
+	waitForSequence(t, follower, primary)
+
+	// The writes are replayed in order, with their column family
+	for key, want := range map[string]string{"b": "2", "c": "3"} {
+		if val, err := follower.Get(key); err != nil || string(val) != want {
+			t.Fatalf("Expected %s=%s on the follower, got %q (%v)", key, want, val, err)
+		}
+	}
+	if _, err := follower.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected the range deletion to be replicated, got %v", err)
+	}
+	if ttl, ok, _ := follower.TTL("c"); !ok || ttl <= 0 {
+		t.Fatalf("Expected the TTL to be replicated, got %v %v", ttl, ok)
+	}
+	if val, err := follower.ColumnFamily("users").Get("alice"); err != nil || string(val) != "admin" {
+		t.Fatalf("Expected alice=admin on the follower, got %q (%v)", val, err)
+	}
+
+	// Followers are read-only
+	if err := follower.Set("x", []byte("y")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+	if _, err := follower.CreateColumnFamily("other", Options{}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+
+	// New writes are streamed, across flushes on both sides
+	for i := 0; i < 2*memLimit; i++ {
+		primary.Set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprint(i)))
+	}
+	waitForSequence(t, follower, primary)
+	if val, err := follower.Get("key19"); err != nil || string(val) != "19" {
+		t.Fatalf("Expected key19=19 on the follower, got %q (%v)", val, err)
+	}
+
+	// A column family created by the primary meanwhile is registered on the follower by its first write
+	sessions, err := primary.CreateColumnFamily("sessions", Options{})
+	if err != nil {
+		t.Fatalf("Error creating column family: %s", err)
+	}
+	sessions.Set("s1", []byte("bob"))
+	waitForSequence(t, follower, primary)
+	if family := follower.ColumnFamily("sessions"); family == nil {
+		t.Fatalf("Expected the sessions column family on the follower, got %v", follower.ColumnFamilies())
+	} else if val, err := family.Get("s1"); err != nil || string(val) != "bob" {
+		t.Fatalf("Expected s1=bob on the follower, got %q (%v)", val, err)
+	}
+	status := follower.ReplicationStatus()
+	if status.Role != RoleFollower || status.Lag != 0 || !status.Connected || status.LastContact == nil || status.Primary != srv.URL {
+		t.Fatalf("Unexpected follower status %+v", status)
+	}
+	if status := primary.ReplicationStatus(); status.Role != RolePrimary || status.Followers != 1 {
+		t.Fatalf("Unexpected primary status %+v", status)
+	}
+
+	// A promoted follower accepts writes, numbered after the replicated ones
+	if err := follower.Promote(); err != nil {
+		t.Fatalf("Error promoting: %s", err)
+	}
+	if err := follower.Set("x", []byte("y")); err != nil {
+		t.Fatalf("Error writing to the promoted follower: %s", err)
+	}
+	if seq := follower.sequence(); seq != primary.sequence()+1 {
+		t.Fatalf("Expected sequence number %d, got %d", primary.sequence()+1, seq)
+	}
+	if err := follower.Promote(); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("Expected ErrInvalidArgument, got %v", err)
+	}
+}
+
+func TestReplicationCheckpoint(t *testing.T) {
+	primary := newTestDB(t)
+	users, _ := primary.CreateColumnFamily("users", Options{})
+	for i := 0; i < 3*memLimit; i++ {
+		primary.Set(fmt.Sprintf("key%02d", i), []byte(fmt.Sprint(i)))
+	}
+	users.Set("alice", []byte("admin"))
+	primary.Del("key00")
+	archives, _ := primary.archivedWALs()
+	for _, archive := range archives {
+		os.Remove(archive)
+	}
+
+	// The writes are no longer retained: the follower starts from a checkpoint
+	srv := newPrimaryServer(t, primary)
+	dir := t.TempDir()
+	follower := newFollower(t, dir, srv)
+	waitForSequence(t, follower, primary)
+	if val, err := follower.Get("key29"); err != nil || string(val) != "29" {
+		t.Fatalf("Expected key29=29 on the follower, got %q (%v)", val, err)
+	}
+	if _, err := follower.Get("key00"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected key00 to be deleted, got %v", err)
+	}
+	if val, err := follower.ColumnFamily("users").Get("alice"); err != nil || string(val) != "admin" {
+		t.Fatalf("Expected alice=admin on the follower, got %q (%v)", val, err)
+	}
+	if names := follower.ColumnFamilies(); fmt.Sprint(names) != "[default users]" {
+		t.Fatalf("Expected the users column family to be registered, got %v", names)
+	}
+
+	// A restarted follower resumes from its last write
+	primary.Set("live", []byte("1"))
+	waitForSequence(t, follower, primary)
+	f := follower.follower
+	follower.Close()
+	<-f.done
+	primary.Set("missed", []byte("2"))
+	follower = newFollower(t, dir, srv)
+	primary.Set("new", []byte("3"))
+	waitForSequence(t, follower, primary)
+	for _, key := range []string{"live", "missed", "new", "key29"} {
+		if _, err := follower.Get(key); err != nil {
+			t.Fatalf("Expected %s on the restarted follower, got %v", key, err)
+		}
+	}
+	if val, err := follower.ColumnFamily("users").Get("alice"); err != nil || string(val) != "admin" {
+		t.Fatalf("Expected alice=admin on the restarted follower, got %q (%v)", val, err)
+	}
+}
+
+func TestHandleReplication(t *testing.T) {
+	primary := newTestDB(t)
+	primary.Set("a", []byte("1"))
+	follower := newFollower(t, t.TempDir(), newPrimaryServer(t, primary))
+	waitForSequence(t, follower, primary)
+	srv := httptest.NewServer(handleFunction(follower, nil))
+	defer srv.Close()
+
+	resp, _ := http.Post(srv.URL+"/set", "application/json", strings.NewReader(`{"key":"b","value":"2"}`))
+	var body errorResponse
+	if json.NewDecoder(resp.Body).Decode(&body); resp.StatusCode != http.StatusForbidden || body.Error.Code != "read_only" {
+		t.Fatalf("Expected 403 read_only, got %d %+v", resp.StatusCode, body)
+	}
+	resp.Body.Close()
+
+	resp, _ = http.Get(srv.URL + "/replication/status")
+	var status ReplicationStatus
+	if json.NewDecoder(resp.Body).Decode(&status); status.Role != RoleFollower || status.Sequence != 1 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	resp.Body.Close()
+
+	if resp, _ := http.Get(srv.URL + "/replication/promote"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405, got %d", resp.StatusCode)
+	}
+	resp, _ = http.Post(srv.URL+"/replication/promote", "", nil)
+	if json.NewDecoder(resp.Body).Decode(&status); resp.StatusCode != http.StatusOK || status.Role != RolePrimary {
+		t.Fatalf("Unexpected promotion response %d %+v", resp.StatusCode, status)
+	}
+	resp.Body.Close()
+	if resp, _ := http.Post(srv.URL+"/set", "application/json", strings.NewReader(`{"key":"b","value":"2"}`)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the promoted follower to accept writes, got %d", resp.StatusCode)
+	}
+
+	// Edge cases: invalid and future sequence numbers
+	for query, want := range map[string]int{"after=abc": http.StatusBadRequest, "after=100": http.StatusBadRequest} {
+		if resp, _ := http.Get(srv.URL + replicationStreamPath + "?" + query); resp.StatusCode != want {
+			t.Fatalf("%s: expected %d, got %d", query, want, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxRESPArgs       = 1 << 20          // Largest number of arguments of a command
+	respArgsPrealloc  = 16               // Arguments allocated ahead of their arrival, whatever the announced count
+	maxRESPBulkLength = maxValueSize + 1 // Largest argument, in bytes
+	maxRESPInlineSize = 64 << 10         // Largest inline command, in bytes
+)
+
+// errRESPProtocol is returned when a client sends a malformed command. The connection is closed afterwards.
+var errRESPProtocol = errors.New("Protocol error")
+
+// respServer serves the Redis serialization protocol (RESP2 and RESP3) over TCP, so that Redis clients can use the database.
+// Each connection is served by its own goroutine, and starts with RESP2 until the client switches with HELLO 3.
+type respServer struct {
+	db      *fileDB
+	timeout time.Duration // Maximum duration of a command, 0 for no limit
+	cursors *scanCursors
+
+	clients  atomic.Int64 // Open connections
+	commands atomic.Int64 // Commands processed since the start
+	started  time.Time
+	nextID   atomic.Int64 // Id of the last connection
+}
+
+// newRESPServer creates a respServer for db, whose commands give up after timeout.
+func newRESPServer(db *fileDB, timeout time.Duration) *respServer {
+	return &respServer{db: db, timeout: timeout, cursors: newScanCursors(), started: time.Now()}
+}
+
+// serve accepts connections on ln and serves each of them in its own goroutine.
+// Returns when ln is closed, with the error of Accept.
+func (srv *respServer) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.handleConn(conn)
+	}
+}
+
+// respConn is the state of a client connection.
+type respConn struct {
+	id     int64
+	reader *bufio.Reader
+	writer *respWriter
+	quit   bool // Set by QUIT, the connection is closed once the reply is written
+}
+
+// handleConn reads the commands of a connection and writes their replies until the client disconnects or sends QUIT.
+// Replies are flushed once no more pipelined command is buffered.
+func (srv *respServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	srv.clients.Add(1)
+	defer srv.clients.Add(-1)
+
+	c := &respConn{
+		id:     srv.nextID.Add(1),
+		reader: bufio.NewReader(conn),
+		writer: &respWriter{bufio.NewWriter(conn), 2},
+	}
+	for !c.quit {
+		args, err := readRESPCommand(c.reader)
+		if errors.Is(err, errRESPProtocol) {
+			c.writer.errorReply("ERR " + err.Error())
+			c.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) > 0 {
+			srv.commands.Add(1)
+			srv.execute(c, args)
+		}
+		if c.reader.Buffered() == 0 || c.quit {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execute runs a command and writes its reply, within the command timeout of the server.
+func (srv *respServer) execute(c *respConn, args [][]byte) {
+	ctx := context.Background()
+	if srv.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.timeout)
+		defer cancel()
+	}
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := respCommands[name]
+	if !ok {
+		c.writer.errorReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		c.writer.errorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	cmd.run(ctx, srv, c, args[1:])
+}
+
+// readRESPCommand reads a command, either as an array of bulk strings, as sent by Redis clients,
+// or as an inline command of space-separated words, as typed in a telnet session.
+// Returns the arguments of the command, empty for a blank line, and any encountered error.
+func readRESPCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, word := range strings.Fields(string(line)) {
+			args = append(args, []byte(word))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	args := make([][]byte, 0, min(max(n, 0), respArgsPrealloc))
+	for i := 0; i < n; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxRESPBulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errRESPProtocol)
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// readRESPLine reads a line terminated by CRLF, or by a single LF for inline commands.
+// Returns the line without its terminator and any encountered error.
+func readRESPLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxRESPInlineSize {
+			return nil, fmt.Errorf("%w: too big inline request", errRESPProtocol)
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+// respWriter encodes replies in the protocol version chosen by the client: 2 (RESP2) or 3 (RESP3).
+// RESP3 has dedicated types for null values and maps, which RESP2 encodes as a null bulk string and a flat array.
+type respWriter struct {
+	*bufio.Writer
+	proto int
+}
+
+// simpleString writes a status reply such as OK or PONG.
+func (w *respWriter) simpleString(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+// errorReply writes an error reply. Its first word is the error code, ERR for generic errors.
+func (w *respWriter) errorReply(s string) {
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(s) + "\r\n")
+}
+
+// integer writes an integer reply.
+func (w *respWriter) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// bulk writes a binary-safe string reply.
+func (w *respWriter) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+// null writes the reply of a missing value.
+func (w *respWriter) null() {
+	if w.proto >= 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+// array writes the header of an array reply of n elements, which must follow.
+func (w *respWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// mapHeader writes the header of a map reply of n pairs, whose keys and values must follow.
+func (w *respWriter) mapHeader(n int) {
+	if w.proto >= 3 {
+		w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	w.array(2 * n)
+}
+
+// scanCursors maps the numeric cursors returned by SCAN, which Redis clients parse as integers, to the last key
+// returned by the call. Cursors are shared by all the connections, as clients may continue a scan on any connection
+// of their pool. Only the last maxScanCursors cursors are kept.
+type scanCursors struct {
+	mu    sync.Mutex
+	next  uint64
+	keys  map[uint64]string
+	order []uint64 // Cursors from the oldest to the newest one
+}
+
+const maxScanCursors = 4096
+
+// newScanCursors creates an empty scanCursors.
+func newScanCursors() *scanCursors {
+	return &scanCursors{keys: make(map[uint64]string)}
+}
+
+// add records a scan that stopped after key.
+// Returns its cursor, which is never 0, the cursor of the start and end of a scan.
+func (sc *scanCursors) add(key string) uint64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.next++
+	sc.keys[sc.next] = key
+	sc.order = append(sc.order, sc.next)
+	if len(sc.order) > maxScanCursors {
+		delete(sc.keys, sc.order[0])
+		sc.order = sc.order[1:]
+	}
+	return sc.next
+}
+
+// get returns the key after which the scan of cursor resumes, and whether the cursor is known.
+func (sc *scanCursors) get(cursor uint64) (string, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	key, ok := sc.keys[cursor]
+	return key, ok
+}
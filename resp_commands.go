@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultScanCount = 10 // Keys examined by a SCAN call without COUNT
+	respVersion      = "7.0.0"
+)
+
+// respCommand describes a command of the RESP server.
+// The number of arguments includes the command name; a maxArgs of -1 means no limit.
+type respCommand struct {
+	minArgs int
+	maxArgs int
+	run     func(ctx context.Context, srv *respServer, c *respConn, args [][]byte)
+}
+
+// respCommands are the supported commands, by lowercase name.
+var respCommands = map[string]respCommand{
+	"ping":   {1, 2, respPing},
+	"hello":  {1, -1, respHello},
+	"quit":   {1, 1, respQuit},
+	"info":   {1, -1, respInfo},
+	"get":    {2, 2, respGet},
+	"set":    {3, -1, respSet},
+	"del":    {2, -1, respDel},
+	"exists": {2, -1, respExists},
+	"mget":   {2, -1, respMGet},
+	"mset":   {3, -1, respMSet},
+	"incr":   {2, 2, respIncr},
+	"ttl":    {2, 2, respTTL},
+	"scan":   {2, -1, respScan},
+}
+
+// respPing replies PONG, or echoes its argument.
+func respPing(_ context.Context, _ *respServer, c *respConn, args [][]byte) {
+	if len(args) == 1 {
+		c.writer.bulk(args[0])
+		return
+	}
+	c.writer.simpleString("PONG")
+}
+
+// respHello switches the connection to the given protocol version, 2 or 3, and describes the server.
+// The AUTH and SETNAME options are accepted and ignored.
+func respHello(_ context.Context, srv *respServer, c *respConn, args [][]byte) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			c.writer.errorReply("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if proto != 2 && proto != 3 {
+			c.writer.errorReply("NOPROTO unsupported protocol version")
+			return
+		}
+		c.writer.proto = proto
+	}
+
+	w := c.writer
+	w.mapHeader(7)
+	w.bulk([]byte("server"))
+	w.bulk([]byte("goDB"))
+	w.bulk([]byte("version"))
+	w.bulk([]byte(respVersion))
+	w.bulk([]byte("proto"))
+	w.integer(int64(w.proto))
+	w.bulk([]byte("id"))
+	w.integer(c.id)
+	w.bulk([]byte("mode"))
+	w.bulk([]byte("standalone"))
+	w.bulk([]byte("role"))
+	w.bulk([]byte("master"))
+	w.bulk([]byte("modules"))
+	w.array(0)
+}
+
+// respQuit replies OK and closes the connection.
+func respQuit(_ context.Context, _ *respServer, c *respConn, _ [][]byte) {
+	c.writer.simpleString("OK")
+	c.quit = true
+}
+
+// respInfo describes the server in the sections requested, or in all of them: server, clients and stats.
+func respInfo(_ context.Context, srv *respServer, c *respConn, args [][]byte) {
+	sections := []struct {
+		name   string
+		fields [][2]string
+	}{
+		{"server", [][2]string{
+			{"redis_version", respVersion},
+			{"redis_mode", "standalone"},
+			{"server_name", "goDB"},
+			{"uptime_in_seconds", strconv.FormatInt(int64(time.Since(srv.started).Seconds()), 10)},
+		}},
+		{"clients", [][2]string{
+			{"connected_clients", strconv.FormatInt(srv.clients.Load(), 10)},
+		}},
+		{"stats", [][2]string{
+			{"total_commands_processed", strconv.FormatInt(srv.commands.Load(), 10)},
+			{"last_sequence_number", strconv.FormatUint(srv.sequence(), 10)},
+		}},
+	}
+
+	requested := make(map[string]bool)
+	for _, arg := range args {
+		requested[strings.ToLower(string(arg))] = true
+	}
+	all := len(requested) == 0 || requested["all"] || requested["default"] || requested["everything"]
+
+	var b strings.Builder
+	for _, section := range sections {
+		if !all && !requested[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+		for _, field := range section.fields {
+			fmt.Fprintf(&b, "%s:%s\r\n", field[0], field[1])
+		}
+	}
+	c.writer.bulk([]byte(b.String()))
+}
+
+// sequence returns the sequence number of the last write to the database.
+func (srv *respServer) sequence() uint64 {
+	srv.db.mu.RLock()
+	defer srv.db.mu.RUnlock()
+	return srv.db.seq
+}
+
+// respGet replies the value of a key, or null if it does not exist.
+func respGet(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	val, err := srv.db.GetContext(ctx, string(args[0]))
+	if errors.Is(err, ErrNotFound) {
+		c.writer.null()
+		return
+	}
+	if err != nil {
+		respError(c.writer, err)
+		return
+	}
+	c.writer.bulk(val)
+}
+
+// respSet stores a key-value pair: SET key value [EX seconds | PX milliseconds] [NX | XX].
+// NX only sets a missing key and XX an existing one; when the condition does not hold, the reply is null instead of OK.
+func respSet(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	key, val := string(args[0]), args[1]
+	var ttl time.Duration
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToLower(string(args[i])); {
+		case option == "nx" && !xx:
+			nx = true
+		case option == "xx" && !nx:
+			xx = true
+		case (option == "ex" || option == "px") && ttl == 0 && i+1 < len(args):
+			unit := time.Second
+			if option == "px" {
+				unit = time.Millisecond
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				c.writer.errorReply("ERR value is not an integer or out of range")
+				return
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				c.writer.errorReply("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			c.writer.errorReply("ERR syntax error")
+			return
+		}
+	}
+
+	v := value{set, val, 0}
+	if ttl > 0 {
+		v.expiry = time.Now().Add(ttl).UnixNano()
+	}
+	_, err := srv.db.writeIf(ctx, key, v, func(_ []byte, _ uint64, exists bool) bool {
+		return (!nx || !exists) && (!xx || exists)
+	})
+	if errors.Is(err, ErrConditionFailed) {
+		c.writer.null()
+		return
+	}
+	if err != nil {
+		respError(c.writer, err)
+		return
+	}
+	c.writer.simpleString("OK")
+}
+
+// respDel deletes keys and replies the number of keys that existed.
+func respDel(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	deleted := int64(0)
+	for _, key := range args {
+		_, err := srv.db.DelContext(ctx, string(key))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			respError(c.writer, err)
+			return
+		}
+		deleted++
+	}
+	c.writer.integer(deleted)
+}
+
+// respExists replies the number of given keys that exist, a key given twice being counted twice.
+func respExists(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	values, err := srv.db.MultiGetContext(ctx, respStrings(args))
+	if err != nil {
+		respError(c.writer, err)
+		return
+	}
+	count := int64(0)
+	for _, key := range args {
+		if _, ok := values[string(key)]; ok {
+			count++
+		}
+	}
+	c.writer.integer(count)
+}
+
+// respMGet replies the values of the given keys, in order, with null for the missing ones.
+func respMGet(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	values, err := srv.db.MultiGetContext(ctx, respStrings(args))
+	if err != nil {
+		respError(c.writer, err)
+		return
+	}
+	c.writer.array(len(args))
+	for _, key := range args {
+		if val, ok := values[string(key)]; ok {
+			c.writer.bulk(val)
+		} else {
+			c.writer.null()
+		}
+	}
+}
+
+// respMSet stores several key-value pairs atomically: MSET key value [key value ...].
+func respMSet(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	if len(args)%2 != 0 {
+		c.writer.errorReply("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	b := WriteBatch{}
+	for i := 0; i < len(args); i += 2 {
+		b.Set(string(args[i]), args[i+1])
+	}
+	if err := srv.db.WriteContext(ctx, &b); err != nil {
+		respError(c.writer, err)
+		return
+	}
+	c.writer.simpleString("OK")
+}
+
+// respIncr increments the counter at a key, starting from 0, and replies its new value.
+func respIncr(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	counter, err := srv.db.IncrementContext(ctx, string(args[0]), 1, 0)
+	switch {
+	case errors.Is(err, ErrNotACounter):
+		c.writer.errorReply("ERR value is not an integer or out of range")
+	case errors.Is(err, ErrOverflow):
+		c.writer.errorReply("ERR increment or decrement would overflow")
+	case err != nil:
+		respError(c.writer, err)
+	default:
+		c.writer.integer(counter)
+	}
+}
+
+// respTTL replies the remaining lifetime of a key in seconds, rounded up, -1 if it never expires and -2 if it does not exist.
+func respTTL(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	ttl, expires, err := srv.db.TTLContext(ctx, string(args[0]))
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.writer.integer(-2)
+	case err != nil:
+		respError(c.writer, err)
+	case !expires:
+		c.writer.integer(-1)
+	default:
+		c.writer.integer(int64((ttl + time.Second - 1) / time.Second))
+	}
+}
+
+// respScan iterates over the keys in sorted order: SCAN cursor [MATCH pattern] [COUNT count] [TYPE string].
+// Each call examines up to count keys after the cursor and replies the next cursor, 0 once the scan is over,
+// with the examined keys matching the glob pattern. Every key is a string, so the TYPE of other types matches nothing.
+func respScan(ctx context.Context, srv *respServer, c *respConn, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		c.writer.errorReply("ERR invalid cursor")
+		return
+	}
+	pattern, count, onlyStrings := "*", defaultScanCount, true
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.writer.errorReply("ERR syntax error")
+			return
+		}
+		switch option, arg := strings.ToLower(string(args[i])), string(args[i+1]); option {
+		case "match":
+			pattern = arg
+		case "count":
+			if count, err = strconv.Atoi(arg); err != nil || count <= 0 {
+				c.writer.errorReply("ERR syntax error")
+				return
+			}
+			count = min(count, maxScanLimit)
+		case "type":
+			onlyStrings = strings.EqualFold(arg, "string")
+		default:
+			c.writer.errorReply("ERR syntax error")
+			return
+		}
+	}
+
+	after, resuming := "", false
+	if cursor != 0 {
+		if after, resuming = srv.cursors.get(cursor); !resuming {
+			c.writer.errorReply("ERR invalid cursor")
+			return
+		}
+	}
+
+	it, err := srv.db.NewIteratorContext(ctx, &IterOptions{Prefix: globPrefix(pattern)})
+	if err != nil {
+		respError(c.writer, err)
+		return
+	}
+	defer it.Close()
+	ok := it.First()
+	if resuming {
+		if ok = it.Seek(after); ok && it.Key() == after {
+			ok = it.Next()
+		}
+	}
+	var keys []string
+	last := ""
+	for examined := 0; ok && examined < count; examined++ {
+		if last = it.Key(); onlyStrings && globMatch(pattern, last) {
+			keys = append(keys, last)
+		}
+		ok = it.Next()
+	}
+	if err := it.Err(); err != nil {
+		respError(c.writer, err)
+		return
+	}
+
+	next := uint64(0)
+	if ok {
+		next = srv.cursors.add(last)
+	}
+	c.writer.array(2)
+	c.writer.bulk([]byte(strconv.FormatUint(next, 10)))
+	c.writer.array(len(keys))
+	for _, key := range keys {
+		c.writer.bulk([]byte(key))
+	}
+}
+
+// respError writes the error reply of an error returned by the database.
+func respError(w *respWriter, err error) {
+	w.errorReply("ERR " + err.Error())
+}
+
+// respStrings converts the arguments of a command to strings.
+func respStrings(args [][]byte) []string {
+	s := make([]string, len(args))
+	for i, arg := range args {
+		s[i] = string(arg)
+	}
+	return s
+}
+
+// globPrefix returns the literal prefix of a glob pattern, which every matching key starts with.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch reports whether s matches the glob pattern, with the syntax of Redis:
+// * matches any sequence, ? any character, [abc], [^abc] and [a-z] a character of a set, and \ escapes a character.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			matched, rest := matchGlobClass(pattern[1:], s[0])
+			if !matched {
+				return false
+			}
+			pattern, s = rest, s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchGlobClass matches c against the character class at the start of pattern, just after its '['.
+// An unterminated class extends to the end of the pattern.
+// Returns whether c belongs to the class and the pattern following the class.
+func matchGlobClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:] // Skip the closing ']'
+	}
+	return matched != negate, pattern
+}
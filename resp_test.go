@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respClient is a raw TCP client of the RESP server, checking the exact bytes of the replies.
+type respClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// newRESPClient starts a RESP server for db on a random port and connects to it.
+func newRESPClient(t *testing.T, db *fileDB) *respClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go newRESPServer(db, time.Second).serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &respClient{t, conn, bufio.NewReader(conn)}
+}
+
+// send writes a command as an array of bulk strings.
+func (rc *respClient) send(args ...string) {
+	rc.t.Helper()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := rc.conn.Write([]byte(b.String())); err != nil {
+		rc.t.Fatalf("Error sending %q: %s", args, err)
+	}
+}
+
+// expect reads a reply and checks that it is exactly want.
+func (rc *respClient) expect(want string) {
+	rc.t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(rc.reader, got); err != nil {
+		rc.t.Fatalf("Error reading %q: %s (got %q)", want, err, got)
+	}
+	if string(got) != want {
+		rc.t.Fatalf("Expected %q, got %q", want, got)
+	}
+}
+
+// do sends a command and checks its reply.
+func (rc *respClient) do(want string, args ...string) {
+	rc.t.Helper()
+	rc.send(args...)
+	rc.expect(want)
+}
+
+// reply reads and decodes a reply: a string, an int64, nil or a []interface{}.
+func (rc *respClient) reply() interface{} {
+	rc.t.Helper()
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		rc.t.Fatalf("Error reading reply: %s", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-':
+		return line
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.reader, b); err != nil {
+			rc.t.Fatalf("Error reading reply: %s", err)
+		}
+		return string(b[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = rc.reply()
+		}
+		return items
+	}
+	rc.t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
+
+func TestRESPCommands(t *testing.T) {
+	rc := newRESPClient(t, newTestDB(t))
+
+	rc.do("+PONG\r\n", "PING")
+	rc.do("$5\r\nhello\r\n", "PING", "hello")
+	rc.do("+OK\r\n", "SET", "user", "bob")
+	rc.do("$3\r\nbob\r\n", "GET", "user")
+	rc.do("$-1\r\n", "GET", "missing")
+
+	// Binary-safe values
+	rc.do("+OK\r\n", "SET", "bin", "a\r\nb")
+	rc.do("$4\r\na\r\nb\r\n", "GET", "bin")
+
+	// NX and XX conditions
+	rc.do("$-1\r\n", "SET", "user", "alice", "NX")
+	rc.do("+OK\r\n", "SET", "user", "alice", "XX")
+	rc.do("$-1\r\n", "SET", "nobody", "x", "XX")
+	rc.do("+OK\r\n", "SET", "nobody", "x", "nx")
+	rc.do("-ERR syntax error\r\n", "SET", "user", "x", "NX", "XX")
+
+	// Expiry
+	rc.do("+OK\r\n", "SET", "session", "abc", "EX", "100")
+	rc.do(":100\r\n", "TTL", "session")
+	rc.do("+OK\r\n", "SET", "short", "abc", "PX", "50")
+	rc.do(":-1\r\n", "TTL", "user")
+	rc.do(":-2\r\n", "TTL", "missing")
+	rc.do("-ERR invalid expire time in 'set' command\r\n", "SET", "user", "x", "EX", "0")
+	time.Sleep(100 * time.Millisecond)
+	rc.do("$-1\r\n", "GET", "short")
+
+	// Several keys
+	rc.do("+OK\r\n", "MSET", "a", "1", "b", "2")
+	rc.do("*3\r\n$1\r\n1\r\n$-1\r\n$1\r\n2\r\n", "MGET", "a", "missing", "b")
+	rc.do(":3\r\n", "EXISTS", "a", "b", "a", "missing")
+	rc.do(":2\r\n", "DEL", "a", "b", "missing")
+	rc.do(":0\r\n", "EXISTS", "a")
+
+	// Counters
+	rc.do(":1\r\n", "INCR", "counter")
+	rc.do(":2\r\n", "INCR", "counter")
+	rc.do("-ERR value is not an integer or out of range\r\n", "INCR", "user")
+
+	// Errors keep the connection open
+	rc.do("-ERR unknown command 'FLUSHALL'\r\n", "FLUSHALL")
+	rc.do("-ERR wrong number of arguments for 'get' command\r\n", "GET")
+	rc.do("-ERR wrong number of arguments for 'mset' command\r\n", "MSET", "a", "1", "b")
+
+	// Inline commands, as typed in a telnet session
+	rc.conn.Write([]byte("GET user\r\n"))
+	rc.expect("$5\r\nalice\r\n")
+
+	rc.do("+OK\r\n", "QUIT")
+	if _, err := rc.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestRESPHello(t *testing.T) {
+	rc := newRESPClient(t, newTestDB(t))
+
+	rc.do("-NOPROTO unsupported protocol version\r\n", "HELLO", "4")
+
+	// RESP3 replies with a map and has a dedicated null type
+	rc.send("HELLO", "3")
+	hello := rc.reply().([]interface{})
+	fields := make(map[string]interface{})
+	for i := 0; i < len(hello); i += 2 {
+		fields[hello[i].(string)] = hello[i+1]
+	}
+	if fields["proto"] != int64(3) || fields["server"] != "goDB" {
+		t.Fatalf("Unexpected HELLO reply %v", fields)
+	}
+	rc.do("_\r\n", "GET", "missing")
+
+	// Back to RESP2
+	rc.send("HELLO", "2")
+	rc.reply()
+	rc.do("$-1\r\n", "GET", "missing")
+
+	rc.send("INFO", "server")
+	info := rc.reply().(string)
+	if !strings.HasPrefix(info, "# Server\r\n") || !strings.Contains(info, "redis_version:") || strings.Contains(info, "# Stats") {
+		t.Fatalf("Unexpected INFO reply %q", info)
+	}
+}
+
+func TestRESPPipelining(t *testing.T) {
+	rc := newRESPClient(t, newTestDB(t))
+
+	// All the commands are written before any reply is read
+	var b strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&b, "*3\r\n$3\r\nSET\r\n$5\r\nkey%02d\r\n$1\r\nv\r\n", i)
+	}
+	b.WriteString("*2\r\n$4\r\nINCR\r\n$1\r\nn\r\n*2\r\n$4\r\nINCR\r\n$1\r\nn\r\n")
+	rc.conn.Write([]byte(b.String()))
+	rc.expect(strings.Repeat("+OK\r\n", 100) + ":1\r\n:2\r\n")
+}
+
+func TestRESPScan(t *testing.T) {
+	db := newTestDB(t)
+	for i := 0; i < 25; i++ {
+		if err := db.Set(fmt.Sprintf("user:%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	if err := db.Set("other", []byte("v")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	rc := newRESPClient(t, db)
+
+	// Follow the cursors until the scan is over
+	var keys []string
+	cursor, calls := "0", 0
+	for {
+		rc.send("SCAN", cursor, "MATCH", "user:?[0-4]", "COUNT", "10")
+		res := rc.reply().([]interface{})
+		for _, key := range res[1].([]interface{}) {
+			keys = append(keys, key.(string))
+		}
+		calls++
+		if cursor = res[0].(string); cursor == "0" {
+			break
+		}
+	}
+	if calls != 3 || len(keys) != 15 || keys[0] != "user:00" || keys[14] != "user:24" {
+		t.Fatalf("Unexpected scan of %d calls: %v", calls, keys)
+	}
+
+	// Edge cases: unknown cursors and types
+	rc.do("-ERR invalid cursor\r\n", "SCAN", "12345")
+	rc.do("*2\r\n$1\r\n0\r\n*0\r\n", "SCAN", "0", "TYPE", "hash", "COUNT", "100")
+}
+
+func TestRESPProtocolError(t *testing.T) {
+	rc := newRESPClient(t, newTestDB(t))
+
+	rc.conn.Write([]byte("*1\r\n$abc\r\n"))
+	rc.expect("-ERR Protocol error: invalid bulk length\r\n")
+	if _, err := rc.reader.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+
+	// The argument count announced by a client is not allocated before the arguments arrive
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readRESPCommand(bufio.NewReader(strings.NewReader(fmt.Sprintf("*%d\r\n", maxRESPArgs))))
+	runtime.ReadMemStats(&after)
+	if err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<10 {
+		t.Fatalf("Expected the arguments to be allocated as they arrive, %d bytes allocated", allocated)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:42", true},
+		{"user:*", "users", false},
+		{"*:42", "user:42", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+	} {
+		if got := globMatch(tc.pattern, tc.s); got != tc.match {
+			t.Fatalf("globMatch(%q, %q) = %v, expected %v", tc.pattern, tc.s, got, tc.match)
+		}
+	}
+}
@@ -1,28 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
 
 	"github.com/emirpasic/gods/maps/treemap"
 )
 
-// kvToEntry converts a key-value pair to a byte slice for storage.
+// kvToEntry converts a key-value pair and its sequence number to a byte slice for storage.
 // Returns the serialized byte slice.
-func kvToEntry(key string, val value) []byte {
+func kvToEntry(key string, seq uint64, val value) []byte {
+	sequence := make([]byte, 8) // 8 bytes for the sequence number
+	binary.LittleEndian.PutUint64(sequence, seq)
+
 	keyLength := make([]byte, 4) // 4 bytes for the key length
 	binary.LittleEndian.PutUint32(keyLength, uint32(len([]byte(key))))
-	entry := append(keyLength, []byte(key)...)
+	entry := append(sequence, keyLength...)
+	entry = append(entry, []byte(key)...)
 
 	flag := val.flag
-	// If it's a delete operation, store: flag, key length, key
+	// If it's a delete operation, store: flag, sequence number, key length, key
 	if flag == del {
 		res := append([]byte{flag}, entry...)
 		return res
 	}
-	// Otherwise, store: flag, key length, key, value length, value
+	// If it's a set with an expiry time, store it right after the key
+	if flag == set && val.expiry != 0 {
+		flag = setWithExpiry
+		expiry := make([]byte, 8) // 8 bytes for the expiry time
+		binary.LittleEndian.PutUint64(expiry, uint64(val.expiry))
+		entry = append(entry, expiry...)
+	}
+	// Otherwise, store: flag, sequence number, key length, key, value length, value
 	valueLength := make([]byte, 4) // 4 bytes for the value length
 	binary.LittleEndian.PutUint32(valueLength, uint32(len(val.val)))
 	entry = append(entry, valueLength...)
@@ -32,10 +50,42 @@ func kvToEntry(key string, val value) []byte {
 }
 
 // entryToKv converts a byte slice to a key-value pair.
-// It extracts the flag, key, and value from the serialized byte slice.
+// It extracts the flag, sequence number, key, value, and expiry time from the serialized byte slice.
 // The position parameter is used to keep track of the parsing position.
+// Returns the flag, sequence number, key, value, and expiry time (0 if the value never expires).
+func entryToKv(entry []byte, position *int) (flag byte, seq uint64, key, val []byte, expiry int64) {
+	flag = entry[*position]
+	*position++
+
+	seq = binary.LittleEndian.Uint64(entry[*position : *position+8])
+	*position += 8
+
+	keyLength := binary.LittleEndian.Uint32(entry[*position : *position+4])
+	*position += 4
+	key = entry[*position : *position+int(keyLength)]
+	*position += int(keyLength)
+
+	if flag == del {
+		return
+	}
+
+	if flag == setWithExpiry {
+		flag = set
+		expiry = int64(binary.LittleEndian.Uint64(entry[*position : *position+8]))
+		*position += 8
+	}
+
+	valueLength := binary.LittleEndian.Uint32(entry[*position : *position+4])
+	*position += 4
+	val = entry[*position : *position+int(valueLength)]
+	*position += int(valueLength)
+	return
+}
+
+// legacyEntryToKv converts a byte slice written before sequence numbers were introduced to a key-value pair.
+// Such entries are stored as: flag, key length, key, and for set operations, value length, value.
 // Returns the flag, key, and value.
-func entryToKv(entry []byte, position *int) (flag byte, key, val []byte) {
+func legacyEntryToKv(entry []byte, position *int) (flag byte, key, val []byte) {
 	flag = entry[*position]
 	*position++
 
@@ -55,6 +105,76 @@ func entryToKv(entry []byte, position *int) (flag byte, key, val []byte) {
 	return
 }
 
+// batchToRecord converts a WriteBatch whose operations are numbered from the sequence number first to a WAL record.
+// The record stores: flag, first sequence number, operation count, entries length, entries, and a checksum
+// of everything that precedes it, so that a partially written record can be detected.
+// When an operation targets another column family than the default one, each entry is preceded by the length
+// and the name of its column family, and the flag is cfBatch instead of batch.
+// Returns the serialized byte slice.
+func batchToRecord(first uint64, b *WriteBatch) []byte {
+	flag := batch
+	for _, op := range b.ops {
+		if op.family != "" && op.family != defaultColumnFamily {
+			flag = cfBatch
+		}
+	}
+
+	var entries []byte
+	for i, op := range b.ops {
+		if flag == cfBatch {
+			familyLength := make([]byte, 4) // 4 bytes for the column family name length
+			binary.LittleEndian.PutUint32(familyLength, uint32(len(op.family)))
+			entries = append(entries, familyLength...)
+			entries = append(entries, op.family...)
+		}
+		entries = append(entries, kvToEntry(op.key, first+uint64(i), op.value)...)
+	}
+
+	header := make([]byte, 1+8+4+4)
+	header[0] = flag                                                   // 1 byte for the flag
+	binary.LittleEndian.PutUint64(header[1:9], first)                  // 8 bytes for the first sequence number
+	binary.LittleEndian.PutUint32(header[9:13], uint32(b.Len()))       // 4 bytes for the operation count
+	binary.LittleEndian.PutUint32(header[13:17], uint32(len(entries))) // 4 bytes for the entries length
+
+	record := append(header, entries...)
+	return append(record, calculateChecksum(record)...) // 4 bytes for the checksum
+}
+
+// recordToBatch converts a WAL record built by batchToRecord back to a WriteBatch, whose operations name their column family.
+// The position parameter is used to keep track of the parsing position; it is only moved if the record is valid.
+// Returns the first sequence number, the batch, and an error if the record is truncated or corrupted.
+func recordToBatch(wal []byte, position *int) (first uint64, b *WriteBatch, err error) {
+	start := *position
+	if len(wal)-start < 1+8+4+4 || (wal[start] != batch && wal[start] != cfBatch) {
+		return 0, nil, fmt.Errorf("%w: truncated batch record", ErrCorruption)
+	}
+	first = binary.LittleEndian.Uint64(wal[start+1 : start+9])
+	count := binary.LittleEndian.Uint32(wal[start+9 : start+13])
+	length := int(binary.LittleEndian.Uint32(wal[start+13 : start+17]))
+	end := start + 17 + length
+	if end+4 > len(wal) {
+		return 0, nil, fmt.Errorf("%w: truncated batch record", ErrCorruption)
+	}
+	if !bytes.Equal(calculateChecksum(wal[start:end]), wal[end:end+4]) {
+		return 0, nil, fmt.Errorf("%w: batch record checksum mismatch", ErrCorruption)
+	}
+
+	b = &WriteBatch{}
+	entryPosition := start + 17
+	for i := 0; i < int(count); i++ {
+		family := defaultColumnFamily
+		if wal[start] == cfBatch {
+			familyLength := int(binary.LittleEndian.Uint32(wal[entryPosition : entryPosition+4]))
+			family = string(wal[entryPosition+4 : entryPosition+4+familyLength])
+			entryPosition += 4 + familyLength
+		}
+		flag, _, keyBytes, valueBytes, expiry := entryToKv(wal[:end], &entryPosition)
+		b.ops = append(b.ops, batchOp{family, string(keyBytes), value{flag, valueBytes, expiry}})
+	}
+	*position = end + 4
+	return first, b, nil
+}
+
 // calculateChecksum calculates the CRC32 checksum for a given byte slice.
 // Returns a 4-byte checksum.
 func calculateChecksum(data []byte) []byte {
@@ -64,11 +184,14 @@ func calculateChecksum(data []byte) []byte {
 	return checksumBytes
 }
 
-// writeToBuffer creates a byte buffer from the contents of the treemap.
-// It includes metadata such as magic number, entry count, smallest and largest keys, version, key-value tuples, and checksum.
-// The isFlush parameter indicates whether the function is called from flush() or compact().
-// Returns the resulting byte buffer.
-func writeToBuffer(treemap *treemap.Map, isFlush bool) (buffer bytes.Buffer) {
+// writeToBuffer creates a byte buffer from the contents of the treemap, whose keys are internal keys, and the range tombstones.
+// It includes metadata such as magic number, entry count, smallest and largest keys, version, largest sequence number,
+// key-value tuples, and checksum. The range tombstones are stored after the other entries, and the key range of the file
+// is widened to the keys they cover.
+// The entries are split into blocks of about sstBlockEntries entries, the versions of a key staying in the same block,
+// and the range tombstones start a block of their own, so that compressSST can compress each block separately.
+// Returns the resulting byte buffer and its blocks, the header preceding the first one.
+func writeToBuffer(treemap *treemap.Map, rangeDels []kvEntry) (buffer bytes.Buffer, blocks []sstBlock) {
 	// 4 bytes for the Magic Number
 	mag := make([]byte, 4)
 	binary.LittleEndian.PutUint32(mag, magicNumber)
@@ -76,46 +199,477 @@ func writeToBuffer(treemap *treemap.Map, isFlush bool) (buffer bytes.Buffer) {
 
 	// 4 bytes for the Entry Count
 	ent := make([]byte, 4)
-	binary.LittleEndian.PutUint32(ent, uint32(treemap.Size()))
+	binary.LittleEndian.PutUint32(ent, uint32(treemap.Size()+len(rangeDels)))
 	buffer.Write(ent)
 
+	var sKey, lKey string
+	if !treemap.Empty() {
+		min, _ := treemap.Min()
+		max, _ := treemap.Max()
+		sKey, lKey = min.(internalKey).key, max.(internalKey).key
+	}
+	for i, r := range rangeDels {
+		if (treemap.Empty() && i == 0) || r.key < sKey {
+			sKey = r.key
+		}
+		if (treemap.Empty() && i == 0) || string(r.val) > lKey {
+			lKey = string(r.val)
+		}
+	}
+
 	// 4 bytes for the smallest key's length
 	sKeyLength := make([]byte, 4)
-	sKey, _ := treemap.Min()
-	binary.LittleEndian.PutUint32(sKeyLength, uint32(len(fmt.Sprint(sKey))))
+	binary.LittleEndian.PutUint32(sKeyLength, uint32(len(sKey)))
 	buffer.Write(sKeyLength)
 
 	// Smallest Key
-	buffer.Write([]byte(fmt.Sprint(sKey)))
+	buffer.Write([]byte(sKey))
 
 	// 4 bytes for the largest key's length
 	lKeyLength := make([]byte, 4)
-	lKey, _ := treemap.Max()
-	binary.LittleEndian.PutUint32(lKeyLength, uint32(len(fmt.Sprint(lKey))))
+	binary.LittleEndian.PutUint32(lKeyLength, uint32(len(lKey)))
 	buffer.Write(lKeyLength)
 
 	// Largest Key
-	buffer.Write([]byte(fmt.Sprint(lKey)))
+	buffer.Write([]byte(lKey))
 
 	// 2 bytes for the version
 	ver := make([]byte, 2)
-	binary.LittleEndian.PutUint16(ver, version) // Version 1
+	binary.LittleEndian.PutUint16(ver, version)
 	buffer.Write(ver)
 
-	// Key-value entries
+	// Key-value entries, each version of a key being stored from the newest to the oldest one
+	var maxSeq uint64
+	var entries bytes.Buffer
+	ordinal, size := 0, 0 // Number of entries written, and in the current block
+	previous := ""
 	iterator := treemap.Iterator()
 	for iterator.Next() {
-		key := iterator.Key().(string)
-		val := iterator.Value().(value)
-		if isFlush || val.flag != del {
-			entry := kvToEntry(key, val)
-			buffer.Write(entry)
+		ik := iterator.Key().(internalKey)
+		if ordinal == 0 || (size >= sstBlockEntries && ik.key != previous) {
+			blocks = append(blocks, sstBlock{key: ik.key, start: entries.Len(), ordinal: ordinal})
+			size = 0
 		}
+		entries.Write(kvToEntry(ik.key, ik.seq, iterator.Value().(value)))
+		maxSeq = max(maxSeq, ik.seq)
+		ordinal, size, previous = ordinal+1, size+1, ik.key
 	}
+	for i, r := range rangeDels {
+		if i == 0 {
+			blocks = append(blocks, sstBlock{key: r.key, start: entries.Len(), ordinal: ordinal, rangeDels: true})
+		}
+		entries.Write(kvToEntry(r.key, r.seq, r.value))
+		maxSeq = max(maxSeq, r.seq)
+	}
+
+	// 8 bytes for the largest sequence number
+	seq := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seq, maxSeq)
+	buffer.Write(seq)
+
+	for i := range blocks {
+		blocks[i].start += buffer.Len()
+	}
+	buffer.Write(entries.Bytes())
 
 	// Checksum
 	checksum := calculateChecksum(buffer.Bytes()) // 4 bytes
 	buffer.Write(checksum)
 
-	return buffer
+	return buffer, blocks
+}
+
+// sstBlockHeaderSize is the size of the start of the SST files compressed by compressSST: sstBlockMagic and the
+// offset of their index on 8 bytes.
+const sstBlockHeaderSize = len(sstBlockMagic) + 8
+
+// sstBlock is a block of the entries of an SST file, compressed separately from the other blocks by compressSST.
+type sstBlock struct {
+	key       string // First key of the block
+	start     int    // Offset of the block in the content written by writeToBuffer
+	offset    int64  // Offset of the compressed block in the file
+	ordinal   int    // Number of entries of the file before the block
+	rangeDels bool   // Whether the block holds the range tombstones, stored after the other entries
+}
+
+// sstIndex is the sparse index of an SST file compressed by compressSST, read by readSSTIndex.
+type sstIndex struct {
+	blocks    []sstBlock // Blocks of the entries other than range tombstones, sorted by key
+	rangeDels *sstBlock  // Block of the range tombstones, nil if there are none
+	end       int64      // Offset of the index in the file, where the compressed blocks end
+}
+
+// sstIndexToBytes serializes the index of the blocks of an SST file. It stores the number of blocks, then for each
+// block: a flag (rangeDel for the block of the range tombstones, set otherwise), its offset in the file on 8 bytes,
+// the number of entries before it on 4 bytes, the length of its first key on 4 bytes and the key.
+// Returns the serialized byte slice.
+func sstIndexToBytes(blocks []sstBlock) []byte {
+	index := binary.LittleEndian.AppendUint32(nil, uint32(len(blocks)))
+	for _, block := range blocks {
+		flag := set
+		if block.rangeDels {
+			flag = rangeDel
+		}
+		index = append(index, flag)
+		index = binary.LittleEndian.AppendUint64(index, uint64(block.offset))
+		index = binary.LittleEndian.AppendUint32(index, uint32(block.ordinal))
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(block.key)))
+		index = append(index, block.key...)
+	}
+	return index
+}
+
+// readSSTIndex reads the sparse index of an SST file compressed by compressSST.
+// Returns the index, nil for a file compressed in one piece, and any encountered error, wrapping ErrCorruption
+// if the index cannot be decompressed or decoded.
+func readSSTIndex(file *os.File) (*sstIndex, error) {
+	header := make([]byte, sstBlockHeaderSize)
+	if n, err := file.ReadAt(header, 0); n < len(header) || string(header[:len(sstBlockMagic)]) != sstBlockMagic {
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, nil
+	}
+	corrupted := fmt.Errorf("%w: invalid block index in %s", ErrCorruption, file.Name())
+	end := int64(binary.LittleEndian.Uint64(header[len(sstBlockMagic):]))
+	gz, err := gzip.NewReader(io.NewSectionReader(file, end, math.MaxInt64))
+	if err != nil {
+		return nil, corrupted
+	}
+	content, err := io.ReadAll(gz)
+	if err != nil || len(content) < 4 {
+		return nil, corrupted
+	}
+
+	index := &sstIndex{end: end}
+	position := 4
+	for i := 0; i < int(binary.LittleEndian.Uint32(content)); i++ {
+		if len(content) < position+17 {
+			return nil, corrupted
+		}
+		block := sstBlock{
+			offset:    int64(binary.LittleEndian.Uint64(content[position+1 : position+9])),
+			ordinal:   int(binary.LittleEndian.Uint32(content[position+9 : position+13])),
+			rangeDels: content[position] == rangeDel,
+		}
+		keyLength := int(binary.LittleEndian.Uint32(content[position+13 : position+17]))
+		position += 17
+		if len(content) < position+keyLength || block.offset < int64(sstBlockHeaderSize) || block.offset > end {
+			return nil, corrupted
+		}
+		block.key = string(content[position : position+keyLength])
+		position += keyLength
+		if block.rangeDels {
+			index.rangeDels = &block
+			continue
+		}
+		index.blocks = append(index.blocks, block)
+	}
+	return index, nil
+}
+
+// sstContent returns the compressed blocks of an SST file compressed by compressSST, without its header and its
+// index, so that decompressing them gives the content written by writeToBuffer. Files compressed in one piece are
+// returned unchanged, and nil is returned if the offset of the index is invalid.
+func sstContent(data []byte) []byte {
+	if len(data) < sstBlockHeaderSize || string(data[:len(sstBlockMagic)]) != sstBlockMagic {
+		return data
+	}
+	end := binary.LittleEndian.Uint64(data[len(sstBlockMagic):sstBlockHeaderSize])
+	if end < uint64(sstBlockHeaderSize) || end > uint64(len(data)) {
+		return nil
+	}
+	return data[sstBlockHeaderSize:end]
+}
+
+// kvEntry is a version of a key decoded from an SST file or copied out of the Memtable.
+type kvEntry struct {
+	internalKey
+	value
+}
+
+// sstable holds the decoded content of an SST file: its key range, its largest sequence number,
+// its entries sorted by internal key and its range tombstones.
+type sstable struct {
+	name      string
+	sKey      string
+	lKey      string
+	maxSeq    uint64
+	entries   []kvEntry
+	rangeDels []kvEntry
+}
+
+// readSST reads, decompresses and validates an SST file, then decodes all of its entries.
+// Returns the decoded table and any encountered read error, wrapping ErrCorruption for files that cannot be decompressed
+// or have a wrong magic number, a bad checksum or an unknown version.
+func readSST(file string) (*sstable, error) {
+	fileContent, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	fileContent, err = decompress(sstContent(fileContent))
+	if err != nil || len(fileContent) < 8 {
+		return nil, fmt.Errorf("%w: cannot decompress %s", ErrCorruption, file)
+	}
+
+	position := 0
+	// Check the magic number
+	retrievedMag := binary.LittleEndian.Uint32(fileContent[position : position+4])
+	position += 4
+	if retrievedMag != magicNumber {
+		return nil, fmt.Errorf("%w: wrong magic number in %s", ErrCorruption, file)
+	}
+
+	// Check the checksum
+	checksum := calculateChecksum(fileContent[0 : len(fileContent)-4])
+	retrievedChecksum := fileContent[len(fileContent)-4:]
+	if !bytes.Equal(checksum, retrievedChecksum) {
+		return nil, fmt.Errorf("%w: checksum mismatch in %s", ErrCorruption, file)
+	}
+
+	entryCount := binary.LittleEndian.Uint32(fileContent[position : position+4])
+	position += 4
+
+	sKeyLength := binary.LittleEndian.Uint32(fileContent[position : position+4])
+	position += 4
+	sKey := fileContent[position : position+int(sKeyLength)]
+	position += int(sKeyLength)
+
+	lKeyLength := binary.LittleEndian.Uint32(fileContent[position : position+4])
+	position += 4
+	lKey := fileContent[position : position+int(lKeyLength)]
+	position += int(lKeyLength)
+
+	table := &sstable{
+		name:    file,
+		sKey:    string(sKey),
+		lKey:    string(lKey),
+		entries: make([]kvEntry, 0, entryCount),
+	}
+
+	// Check the version
+	retrievedVersion := binary.LittleEndian.Uint16(fileContent[position : position+2])
+	position += 2
+	switch retrievedVersion {
+	case version:
+		table.maxSeq = binary.LittleEndian.Uint64(fileContent[position : position+8])
+		position += 8
+		for i := 0; i < int(entryCount); i++ {
+			flag, seq, keyBytes, valueBytes, expiry := entryToKv(fileContent, &position)
+			entry := kvEntry{internalKey{string(keyBytes), seq}, value{flag, valueBytes, expiry}}
+			if flag == rangeDel {
+				table.rangeDels = append(table.rangeDels, entry)
+				continue
+			}
+			table.entries = append(table.entries, entry)
+		}
+	case legacyVersion:
+		// Files written before sequence numbers hold a single version per key, read as sequence number 0
+		for i := 0; i < int(entryCount); i++ {
+			flag, keyBytes, valueBytes := legacyEntryToKv(fileContent, &position)
+			table.entries = append(table.entries, kvEntry{internalKey{string(keyBytes), 0}, value{flag, valueBytes, 0}})
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown version %d of %s", ErrCorruption, retrievedVersion, file)
+	}
+	return table, nil
+}
+
+// sstStream decodes an SST file one entry at a time, so that only the entries kept by the caller are held in memory.
+// Unlike readSST, the checksum can only be checked once every entry was read, by verify.
+type sstStream struct {
+	r       *bufio.Reader
+	crc     hash.Hash32 // Checksum of the decompressed bytes read so far
+	name    string
+	count   int // Number of entries left to decode, range tombstones included
+	sKey    string
+	lKey    string
+	version uint16
+}
+
+// openSSTStream starts decoding the SST file name, whose compressed content is read from r, and decodes its header.
+// Returns the stream positioned on the first entry and any encountered error, wrapping ErrCorruption for files
+// that cannot be decompressed or have a wrong magic number or an unknown version.
+func openSSTStream(r io.Reader, name string) (*sstStream, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decompress %s", ErrCorruption, name)
+	}
+	s := &sstStream{r: bufio.NewReader(gz), crc: crc32.NewIEEE(), name: name}
+
+	header, err := s.read(8)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != magicNumber {
+		return nil, fmt.Errorf("%w: wrong magic number in %s", ErrCorruption, name)
+	}
+	s.count = int(binary.LittleEndian.Uint32(header[4:8]))
+	sKey, err := s.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	lKey, err := s.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	s.sKey, s.lKey = string(sKey), string(lKey)
+
+	ver, err := s.read(2)
+	if err != nil {
+		return nil, err
+	}
+	s.version = binary.LittleEndian.Uint16(ver)
+	switch s.version {
+	case version:
+		// The largest sequence number is not needed to merge the entries
+		if _, err := s.read(8); err != nil {
+			return nil, err
+		}
+	case legacyVersion:
+	default:
+		return nil, fmt.Errorf("%w: unknown version %d of %s", ErrCorruption, s.version, name)
+	}
+	return s, nil
+}
+
+// openSSTEntries starts decoding the entries of an SST file from the ordinal-th one, at the start of a block
+// compressed by compressSST whose compressed content, followed by the next blocks, is read from r. The header of the
+// file was decoded by header. The checksum of the file cannot be verified, but the blocks are checked against the
+// checksum of their gzip member as they are decompressed.
+// Returns the stream positioned on the entry and any encountered error.
+func openSSTEntries(r io.Reader, header *sstStream, ordinal int) (*sstStream, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decompress %s", ErrCorruption, header.name)
+	}
+	return &sstStream{
+		r:       bufio.NewReader(gz),
+		crc:     crc32.NewIEEE(),
+		name:    header.name,
+		count:   header.count - ordinal,
+		sKey:    header.sKey,
+		lKey:    header.lKey,
+		version: header.version,
+	}, nil
+}
+
+// read reads the next n decompressed bytes of the file and adds them to the checksum. The bytes are copied as they
+// arrive, so that a corrupted length does not allocate more than the file holds.
+// Returns the bytes and any encountered error, wrapping ErrCorruption if the file is truncated.
+func (s *sstStream) read(n int) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, s.r, int64(n)); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%w: truncated %s", ErrCorruption, s.name)
+		}
+		return nil, err
+	}
+	s.crc.Write(buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// readBytes reads a length on 4 bytes followed by as many bytes.
+// Returns the bytes and any encountered error.
+func (s *sstStream) readBytes() ([]byte, error) {
+	length, err := s.read(4)
+	if err != nil {
+		return nil, err
+	}
+	return s.read(int(binary.LittleEndian.Uint32(length)))
+}
+
+// next decodes the next entry of the file, in the format of kvToEntry, or of legacyEntryToKv for legacy files.
+// Returns the entry and any encountered error.
+func (s *sstStream) next() (kvEntry, error) {
+	var entry kvEntry
+	s.count--
+	flag, err := s.read(1)
+	if err != nil {
+		return entry, err
+	}
+	entry.flag = flag[0]
+	if s.version == version {
+		seq, err := s.read(8)
+		if err != nil {
+			return entry, err
+		}
+		entry.seq = binary.LittleEndian.Uint64(seq)
+	}
+	key, err := s.readBytes()
+	if err != nil {
+		return entry, err
+	}
+	entry.key = string(key)
+	if entry.flag == del {
+		return entry, nil
+	}
+	if entry.flag == setWithExpiry {
+		entry.flag = set
+		expiry, err := s.read(8)
+		if err != nil {
+			return entry, err
+		}
+		entry.expiry = int64(binary.LittleEndian.Uint64(expiry))
+	}
+	entry.val, err = s.readBytes()
+	return entry, err
+}
+
+// verify reads the checksum following the last entry and compares it with the checksum of the bytes read.
+// Returns any encountered error, wrapping ErrCorruption on a mismatch.
+func (s *sstStream) verify() error {
+	checksum := make([]byte, 4)
+	if _, err := io.ReadFull(s.r, checksum); err != nil {
+		return fmt.Errorf("%w: truncated %s", ErrCorruption, s.name)
+	}
+	if binary.LittleEndian.Uint32(checksum) != s.crc.Sum32() {
+		return fmt.Errorf("%w: checksum mismatch in %s", ErrCorruption, s.name)
+	}
+	return nil
+}
+
+// find looks up the newest version of a key whose sequence number is at most seq,
+// using a binary search over the sorted entries.
+// Returns the entry and whether it was found.
+func (table *sstable) find(key string, seq uint64) (kvEntry, bool) {
+	return findVersion(table.entries, key, seq)
+}
+
+// findAt looks up the newest version of a key whose sequence number is at most seq, range tombstones included.
+// Keys outside the range of the file are skipped without searching.
+// Returns the entry and whether it was found.
+func (table *sstable) findAt(key string, seq uint64) (kvEntry, bool) {
+	if key < table.sKey || key > table.lKey {
+		return kvEntry{}, false
+	}
+	entry, found := table.find(key, seq)
+	if tombstone, ok := coveringRangeDel(table.rangeDels, key, seq); ok && (!found || tombstone.seq > entry.seq) {
+		entry, found = tombstone, true
+	}
+	return entry, found
+}
+
+// findVersion looks up the newest version of a key whose sequence number is at most seq in entries sorted by internal key.
+// Returns the entry and whether it was found.
+func findVersion(entries []kvEntry, key string, seq uint64) (kvEntry, bool) {
+	target := internalKey{key, seq}
+	i := sort.Search(len(entries), func(i int) bool { return compareInternalKeys(entries[i].internalKey, target) >= 0 })
+	if i < len(entries) && entries[i].key == key {
+		return entries[i], true
+	}
+	return kvEntry{}, false
+}
+
+// findVersions returns all the versions of a key whose sequence numbers are at most seq in entries sorted by internal key,
+// from the newest to the oldest one.
+func findVersions(entries []kvEntry, key string, seq uint64) []kvEntry {
+	target := internalKey{key, seq}
+	i := sort.Search(len(entries), func(i int) bool { return compareInternalKeys(entries[i].internalKey, target) >= 0 })
+	j := i
+	for j < len(entries) && entries[j].key == key {
+		j++
+	}
+	return entries[i:j]
 }
@@ -26,3 +26,20 @@ func TestCalculateChecksum(t *testing.T) {
 		t.Error("Expected zero checksum for nil data")
 	}
 }
+
+func TestEntryRoundTrip(t *testing.T) {
+	// Normal case: a set entry keeps its sequence number, key and value
+	position := 0
+	flag, seq, key, val, _ := entryToKv(kvToEntry("key", 42, value{set, []byte("value"), 0}), &position)
+	if flag != set || seq != 42 || string(key) != "key" || string(val) != "value" {
+		t.Errorf("Unexpected set entry: %d %d %s %s", flag, seq, key, val)
+	}
+
+	// Edge case: a delete entry has no value
+	entry := kvToEntry("key", 1<<40, value{del, []byte("ignored"), 0})
+	position = 0
+	flag, seq, key, val, _ = entryToKv(entry, &position)
+	if flag != del || seq != 1<<40 || string(key) != "key" || val != nil || position != len(entry) {
+		t.Errorf("Unexpected delete entry: %d %d %s %s", flag, seq, key, val)
+	}
+}
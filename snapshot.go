@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// errSnapshotReleased is returned when reading from a released snapshot.
+var errSnapshotReleased = fmt.Errorf("%w: snapshot released", ErrClosed)
+
+// Snapshot is a point-in-time, read-only view of the database.
+// It pins the sequence number of the last write at its creation: versions written afterwards are not visible through it,
+// and compaction keeps the versions it can still read. A snapshot must be released with Release once it is no longer needed.
+type Snapshot struct {
+	db       *fileDB
+	seq      uint64
+	released bool
+}
+
+// NewSnapshot creates a Snapshot of the current state of the database.
+func (mem *fileDB) NewSnapshot() *Snapshot {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	snap := &Snapshot{
+		db:  mem,
+		seq: mem.seq,
+	}
+	mem.snapshots[snap] = struct{}{}
+	return snap
+}
+
+// Sequence returns the sequence number pinned by the snapshot.
+func (snap *Snapshot) Sequence() uint64 {
+	return snap.seq
+}
+
+// Get retrieves the value a key had when the snapshot was created.
+// Returns the value associated with the key and any encountered error.
+func (snap *Snapshot) Get(key string) ([]byte, error) {
+	return snap.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but stops looking up the SST files with the error of ctx once it is done.
+func (snap *Snapshot) GetContext(ctx context.Context, key string) ([]byte, error) {
+	snap.db.mu.RLock()
+	defer snap.db.mu.RUnlock()
+
+	if snap.released {
+		return nil, errSnapshotReleased
+	}
+	return snap.db.getAt(ctx, key, snap.seq)
+}
+
+// NewIterator creates an Iterator over the keys as they were when the snapshot was created.
+// Returns the Iterator and any encountered error.
+func (snap *Snapshot) NewIterator(opts *IterOptions) (*Iterator, error) {
+	return snap.NewIteratorContext(context.Background(), opts)
+}
+
+// NewIteratorContext is like NewIterator, but the Iterator stops with the error of ctx once it is done.
+func (snap *Snapshot) NewIteratorContext(ctx context.Context, opts *IterOptions) (*Iterator, error) {
+	snap.db.mu.RLock()
+	defer snap.db.mu.RUnlock()
+
+	if snap.released {
+		return nil, errSnapshotReleased
+	}
+	return snap.db.newIterator(ctx, snap.seq, opts)
+}
+
+// Release releases the snapshot, so that the next compaction can drop the versions only it could read.
+// Releasing a snapshot twice has no effect.
+func (snap *Snapshot) Release() {
+	snap.db.mu.Lock()
+	defer snap.db.mu.Unlock()
+
+	snap.released = true
+	delete(snap.db.snapshots, snap)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.Set("stable", []byte("old")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if err := db.Set("gone", []byte("old")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	snap := db.NewSnapshot()
+	defer snap.Release()
+
+	// Overwrite, delete and add keys, with enough writes to flush and compact
+	if err := db.Set("stable", []byte("new")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if _, err := db.Del("gone"); err != nil {
+		t.Fatalf("Error deleting key: %s", err)
+	}
+	for i := 0; i < memLimit*compactingSize; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	if files, _ := filepath.Glob("db_*.sst"); len(files) >= compactingSize {
+		t.Fatalf("Expected a compaction, got %d SST files", len(files))
+	}
+
+	// The snapshot still sees the old state, the database the new one
+	if val, err := snap.Get("stable"); err != nil || string(val) != "old" {
+		t.Fatalf("Expected old value from snapshot, got %s (%v)", val, err)
+	}
+	if val, err := snap.Get("gone"); err != nil || string(val) != "old" {
+		t.Fatalf("Expected deleted key to be visible from snapshot, got %s (%v)", val, err)
+	}
+	if val, err := db.Get("stable"); err != nil || string(val) != "new" {
+		t.Fatalf("Expected new value, got %s (%v)", val, err)
+	}
+	if _, err := db.Get("gone"); err == nil {
+		t.Fatal("Expected deleted key to be missing")
+	}
+	if _, err := snap.Get("key00"); err == nil {
+		t.Fatal("Expected key written after the snapshot to be invisible")
+	}
+	it, err := snap.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("Error creating iterator: %s", err)
+	}
+	var keys []string
+	for ok := it.First(); ok; ok = it.Next() {
+		keys = append(keys, it.Key())
+	}
+	it.Close()
+	if fmt.Sprint(keys) != "[gone stable]" {
+		t.Fatalf("Unexpected snapshot keys: %v", keys)
+	}
+
+	// Edge case: a released snapshot cannot be read
+	snap.Release()
+	if _, err := snap.Get("stable"); err == nil {
+		t.Fatal("Expected error reading a released snapshot")
+	}
+}
+
+func TestVisibleVersions(t *testing.T) {
+	versions := []kvEntry{
+		{internalKey{"k", 9}, value{set, []byte("9"), 0}},
+		{internalKey{"k", 7}, value{del, nil, 0}},
+		{internalKey{"k", 5}, value{set, []byte("5"), 0}},
+		{internalKey{"k", 3}, value{set, []byte("3"), 0}},
+		{internalKey{"k", 1}, value{del, nil, 0}},
+	}
+
+	// Without snapshots only the newest version is kept
+	if kept, _ := visibleVersions(versions, nil, nil); len(kept) != 1 || kept[0].seq != 9 {
+		t.Fatalf("Unexpected versions: %v", kept)
+	}
+	// Each snapshot keeps the newest version it can see
+	if kept, _ := visibleVersions(versions, []uint64{8, 4}, nil); len(kept) != 3 || kept[1].seq != 7 || kept[2].seq != 3 {
+		t.Fatalf("Unexpected versions: %v", kept)
+	}
+	// Edge case: a deletion at the bottom is dropped
+	if kept, _ := visibleVersions(versions[1:], []uint64{2}, nil); len(kept) != 0 {
+		t.Fatalf("Unexpected versions: %v", kept)
+	}
+}
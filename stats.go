@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"sort"
+)
+
+// Stats describes the state of a database, as reported by Stats and the "/stats" endpoint.
+type Stats struct {
+	Sequence       uint64        `json:"sequence"`       // Sequence number of the last write
+	Snapshots      int           `json:"snapshots"`      // Live snapshots
+	ColumnFamilies []FamilyStats `json:"columnFamilies"` // Column families, sorted by name
+}
+
+// FamilyStats describes the state of a column family.
+type FamilyStats struct {
+	Name            string `json:"name"`
+	MemtableEntries int    `json:"memtableEntries"` // Versions held by the Memtable, tombstones included
+	RangeTombstones int    `json:"rangeTombstones"` // Range tombstones held by the Memtable
+	SSTFiles        int    `json:"sstFiles"`
+	SSTBytes        int64  `json:"sstBytes"` // Compressed size of the SST files
+}
+
+// Stats returns the state of the database and of all its column families.
+func (mem *fileDB) Stats() (Stats, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+	if mem.closed {
+		return Stats{}, ErrClosed
+	}
+
+	stats := Stats{mem.seq, len(mem.snapshots), make([]FamilyStats, 0, len(mem.families))}
+	for name, family := range mem.families {
+		files, err := family.sstFiles()
+		if err != nil {
+			return Stats{}, err
+		}
+		var size int64
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return Stats{}, err
+			}
+			size += info.Size()
+		}
+		stats.ColumnFamilies = append(stats.ColumnFamilies, FamilyStats{name, family.values.Size(), len(family.rangeDels), len(files), size})
+	}
+	sort.Slice(stats.ColumnFamilies, func(i, j int) bool {
+		return stats.ColumnFamilies[i].Name < stats.ColumnFamilies[j].Name
+	})
+	return stats, nil
+}
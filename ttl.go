@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SetWithTTL stores a key-value pair that expires after ttl: from then on, the key reads as not found,
+// and the next compaction removes it.
+// Returns any encountered error during the process.
+func (mem *fileDB) SetWithTTL(key string, val []byte, ttl time.Duration) error {
+	return mem.SetWithTTLContext(context.Background(), key, val, ttl)
+}
+
+// SetWithTTLContext is like SetWithTTL, but gives up with the error of ctx if it is done before the write starts.
+func (mem *fileDB) SetWithTTLContext(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: TTL must be positive", ErrInvalidArgument)
+	}
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	b := WriteBatch{}
+	b.SetWithTTL(key, val, ttl)
+	return mem.write(ctx, &b)
+}
+
+// TTL returns the remaining lifetime of a key.
+// Returns the remaining lifetime, false if the key never expires, and any encountered error.
+func (mem *fileDB) TTL(key string) (time.Duration, bool, error) {
+	return mem.TTLContext(context.Background(), key)
+}
+
+// TTLContext is like TTL, but stops looking up the SST files with the error of ctx once it is done.
+func (mem *fileDB) TTLContext(ctx context.Context, key string) (time.Duration, bool, error) {
+	mem.mu.RLock()
+	defer mem.mu.RUnlock()
+
+	entry, found, err := mem.resolveAt(ctx, key, mem.seq)
+	if err != nil {
+		return 0, false, err
+	}
+	if !found {
+		return 0, false, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if entry.expiry == 0 {
+		return 0, false, nil
+	}
+	return time.Until(time.Unix(0, entry.expiry)), true, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSetWithTTL(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.SetWithTTL("session", []byte("abc"), 100*time.Millisecond); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if err := db.Set("user", []byte("bob")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+
+	// Before the expiry, the key is readable and has a remaining lifetime
+	if val, err := db.Get("session"); err != nil || string(val) != "abc" {
+		t.Fatalf("Expected abc, got %s (%v)", val, err)
+	}
+	if ttl, expires, err := db.TTL("session"); err != nil || !expires || ttl <= 0 || ttl > 100*time.Millisecond {
+		t.Fatalf("Unexpected TTL %s, %v (%v)", ttl, expires, err)
+	}
+	if _, expires, err := db.TTL("user"); err != nil || expires {
+		t.Fatalf("Expected no expiry, got %v (%v)", expires, err)
+	}
+
+	// Edge case: a non-positive TTL is rejected
+	if err := db.SetWithTTL("session", []byte("abc"), 0); err == nil {
+		t.Fatal("Expected an error for a zero TTL")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	// After the expiry, the key is gone for Get, TTL and iterators
+	if _, err := db.Get("session"); err == nil {
+		t.Fatal("Expected the key to be expired")
+	}
+	if _, _, err := db.TTL("session"); err == nil {
+		t.Fatal("Expected TTL to fail on an expired key")
+	}
+	it, err := db.NewIterator(nil)
+	if err != nil {
+		t.Fatalf("Error creating iterator: %s", err)
+	}
+	defer it.Close()
+	var keys []string
+	for ok := it.First(); ok; ok = it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if len(keys) != 1 || keys[0] != "user" {
+		t.Fatalf("Expected only user, got %v", keys)
+	}
+}
+
+func TestTTLCompactionAndRecovery(t *testing.T) {
+	db := newTestDB(t)
+
+	if err := db.SetWithTTL("short", []byte("x"), 50*time.Millisecond); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	if err := db.SetWithTTL("long", []byte("y"), time.Hour); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	db.wal.Close()
+
+	// The expiry times survive a WAL recovery
+	db, err := newDB()
+	if err != nil {
+		t.Fatal("Error reopening the DB:", err)
+	}
+	t.Cleanup(func() { db.wal.Close() })
+	if err := db.recoverWAL(); err != nil {
+		t.Fatalf("Error recovering the WAL: %s", err)
+	}
+	if ttl, expires, err := db.TTL("long"); err != nil || !expires || ttl < 59*time.Minute {
+		t.Fatalf("Expected about an hour, got %s, %v (%v)", ttl, expires, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Enough writes to flush to SST files and compact them: the expired key is dropped
+	for i := 0; i < memLimit*compactingSize; i++ {
+		if err := db.Set(fmt.Sprintf("key%02d", i), []byte("v")); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
+	files, err := filepath.Glob("db_*.sst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		table, err := readSST(file)
+		if err != nil {
+			t.Fatalf("Error reading %s: %s", file, err)
+		}
+		if _, ok := table.find("short", db.seq); ok {
+			t.Fatalf("Expected the expired key to be compacted away from %s", file)
+		}
+	}
+	if val, err := db.Get("long"); err != nil || string(val) != "y" {
+		t.Fatalf("Expected y, got %s (%v)", val, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrTxnConflict is returned by Txn.Commit when a key read or written by the transaction was modified
+// by another writer after the transaction began.
+var ErrTxnConflict = errors.New("Transaction conflict")
+
+// ErrTxnDone is returned when using a transaction that was already committed or rolled back.
+var ErrTxnDone = errors.New("Transaction already committed or rolled back")
+
+// Txn is an optimistic read-modify-write transaction.
+// Reads see the database as it was when the transaction began, plus the transaction's own writes.
+// Writes are buffered until Commit, which fails with ErrTxnConflict if any key read or written by the transaction
+// was modified in the meantime. A transaction must end with Commit or Rollback.
+type Txn struct {
+	db     *fileDB
+	snap   *Snapshot
+	writes map[string]value    // Pending writes, by key
+	order  []string            // Keys in the order of their first write
+	keys   map[string]struct{} // Keys read or written, checked for conflicts at commit
+	done   bool
+}
+
+// Begin starts a new transaction reading from a snapshot of the current state of the database.
+func (mem *fileDB) Begin() *Txn {
+	return &Txn{
+		db:     mem,
+		snap:   mem.NewSnapshot(),
+		writes: make(map[string]value),
+		keys:   make(map[string]struct{}),
+	}
+}
+
+// Get retrieves the value of a key, as written by the transaction or as it was when the transaction began.
+// Returns the value associated with the key and any encountered error.
+func (txn *Txn) Get(key string) ([]byte, error) {
+	return txn.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but stops looking up the SST files with the error of ctx once it is done.
+func (txn *Txn) GetContext(ctx context.Context, key string) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	txn.keys[key] = struct{}{}
+	if v, ok := txn.writes[key]; ok {
+		if v.flag == del {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return v.val, nil
+	}
+	return txn.snap.GetContext(ctx, key)
+}
+
+// Set buffers the storage of a key-value pair until the transaction commits.
+// Returns an error if the transaction is over.
+func (txn *Txn) Set(key string, val []byte) error {
+	return txn.put(key, value{set, val, 0})
+}
+
+// Del buffers the deletion of a key until the transaction commits.
+// Returns an error if the transaction is over.
+func (txn *Txn) Del(key string) error {
+	return txn.put(key, value{del, nil, 0})
+}
+
+// put buffers a write, keeping only the last one for each key.
+func (txn *Txn) put(key string, v value) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if _, ok := txn.writes[key]; !ok {
+		txn.order = append(txn.order, key)
+	}
+	txn.writes[key] = v
+	txn.keys[key] = struct{}{}
+	return nil
+}
+
+// Commit checks that no key read or written by the transaction was modified since it began,
+// then applies its writes atomically as a single WriteBatch.
+// The transaction is over afterwards, whether it succeeds or not.
+// Returns ErrTxnConflict on a conflict, or any encountered error.
+func (txn *Txn) Commit() error {
+	return txn.CommitContext(context.Background())
+}
+
+// CommitContext is like Commit, but gives up with the error of ctx if it is done before the writes are applied.
+// The transaction is over afterwards in any case.
+func (txn *Txn) CommitContext(ctx context.Context) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	defer txn.Rollback()
+
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+
+	// A key was modified if its newest version was written after the snapshot
+	for key := range txn.keys {
+		entry, found, err := txn.db.findAt(ctx, key, txn.db.seq)
+		if err != nil {
+			return err
+		}
+		if found && entry.seq > txn.snap.seq {
+			return ErrTxnConflict
+		}
+	}
+
+	b := WriteBatch{}
+	for _, key := range txn.order {
+		b.ops = append(b.ops, batchOp{"", key, txn.writes[key]})
+	}
+	return txn.db.write(ctx, &b)
+}
+
+// Rollback discards the writes of the transaction and releases its snapshot.
+// Rolling back a transaction that is over has no effect.
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.done = true
+	txn.snap.Release()
+	txn.writes, txn.keys, txn.order = nil, nil, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTxnCommit(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.Set("balance", []byte("10")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+
+	// Normal case: reads see the transaction's own writes, other readers only see them after commit
+	txn := db.Begin()
+	if val, err := txn.Get("balance"); err != nil || string(val) != "10" {
+		t.Fatalf("Expected value 10, got %s (%v)", val, err)
+	}
+	txn.Set("balance", []byte("20"))
+	txn.Del("other")
+	if val, err := txn.Get("balance"); err != nil || string(val) != "20" {
+		t.Fatalf("Expected own write 20, got %s (%v)", val, err)
+	}
+	if val, _ := db.Get("balance"); string(val) != "10" {
+		t.Fatalf("Expected uncommitted write to be invisible, got %s", val)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Error committing: %s", err)
+	}
+	if val, _ := db.Get("balance"); string(val) != "20" {
+		t.Fatalf("Expected committed value 20, got %s", val)
+	}
+
+	// Edge case: a finished transaction cannot be reused
+	if err := txn.Set("balance", []byte("30")); err != ErrTxnDone {
+		t.Fatalf("Expected ErrTxnDone, got %v", err)
+	}
+}
+
+func TestTxnConflict(t *testing.T) {
+	db := newTestDB(t)
+	if err := db.Set("counter", []byte("1")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+
+	first := db.Begin()
+	second := db.Begin()
+	first.Get("counter")
+	second.Get("counter")
+	first.Set("counter", []byte("2"))
+	second.Set("counter", []byte("3"))
+
+	if err := first.Commit(); err != nil {
+		t.Fatalf("Error committing: %s", err)
+	}
+	// The second transaction read a key modified by the first one
+	if err := second.Commit(); err != ErrTxnConflict {
+		t.Fatalf("Expected ErrTxnConflict, got %v", err)
+	}
+	if val, _ := db.Get("counter"); string(val) != "2" {
+		t.Fatalf("Expected value 2, got %s", val)
+	}
+
+	// Rolled back writes are discarded
+	third := db.Begin()
+	third.Set("counter", []byte("4"))
+	third.Rollback()
+	if val, _ := db.Get("counter"); string(val) != "2" {
+		t.Fatalf("Expected value 2, got %s", val)
+	}
+	if len(db.snapshots) != 0 {
+		t.Fatalf("Expected all snapshots to be released, got %d", len(db.snapshots))
+	}
+}
@@ -2,53 +2,134 @@
 package main
 
 import (
-	"errors"
+	"encoding/binary"
+	"fmt"
 	"os"
 )
 
-// appendToWAL appends a key-value entry to the Write-Ahead Logging file.
-// It serializes the key and value, appends the entry to the WAL file, and returns any encountered error.
-func (mem *fileDB) appendToWAL(key string, val value) error {
+// walHeaderSize is the size of the WAL header: 4 bytes for the magic number and 2 bytes for the version.
+const walHeaderSize = 6
+
+// openWAL opens the Write-Ahead Log file at path in append-only mode, creating it if it does not exist.
+// A new WAL starts with a header holding the magic number and the version, so that its format can be recognized.
+// Returns the opened file and any encountered error.
+func openWAL(path string) (*os.File, error) {
+	wal, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		header := make([]byte, walHeaderSize)
+		binary.LittleEndian.PutUint32(header[0:4], magicNumber)
+		binary.LittleEndian.PutUint16(header[4:6], version)
+		if _, err := wal.Write(header); err != nil {
+			wal.Close()
+			return nil, err
+		}
+	}
+	return wal, nil
+}
+
+// appendBatchToWAL appends a WriteBatch, whose operations are numbered from the sequence number first,
+// to the Write-Ahead Logging file as a single record.
+// Returns any encountered error.
+func (mem *fileDB) appendBatchToWAL(first uint64, b *WriteBatch) error {
+	return mem.writeWAL(batchToRecord(first, b))
+}
+
+// writeWAL appends a serialized record to the Write-Ahead Logging file in a single write.
+// Returns any encountered error.
+func (mem *fileDB) writeWAL(record []byte) error {
 
 	// Check if the WAL exists. Otherwise, create it in append-only mode.*
-	if _, err := os.Stat(walFileName); os.IsNotExist(err) {
-		mem.wal, _ = os.OpenFile(walFileName, os.O_APPEND|os.O_CREATE, 0755)
+	if _, err := os.Stat(mem.path(walFileName)); os.IsNotExist(err) {
+		wal, err := openWAL(mem.path(walFileName))
+		if err != nil {
+			return err
+		}
+		mem.wal = wal
 	}
 
-	res := kvToEntry(key, val)
-	if _, err := mem.wal.Write(res); err != nil {
+	if _, err := mem.wal.Write(record); err != nil {
 		return err
 	}
 	return nil
 }
 
-// recoverWAL reads the contents of the Write-Ahead Log file and write its entries to the Memtable.
+// recoverWAL reads the contents of the Write-Ahead Log file and write its entries and batches to the Memtable.
+// A batch record that was only partially written is ignored along with the rest of the WAL.
+// Entries keep the sequence number they were logged with; entries of a WAL written before sequence numbers
+// were introduced are numbered in order after the last flushed write.
 // If the Memtable size exceeds a limit, it triggers a flush to disk.
 // Returns any encountered error during the recovery process.
 func (mem *fileDB) recoverWAL() error {
 	// Read the WAL file
-	wal, err := os.ReadFile(walFileName)
+	wal, err := os.ReadFile(mem.path(walFileName))
 	if err != nil {
 		return err
 	}
-	if len(wal) > 0 {
-		position := 0
-		for position < len(wal) {
 
-			flag, keyBytes, valueBytes := entryToKv(wal, &position)
+	position := 0
+	legacy := true
+	if len(wal) >= walHeaderSize && binary.LittleEndian.Uint32(wal[0:4]) == magicNumber {
+		position = walHeaderSize
+		legacy = false
+	}
+	if position == len(wal) {
+		return fmt.Errorf("%w: empty WAL file", ErrCorruption)
+	}
+
+	for position < len(wal) {
+		if !legacy && (wal[position] == batch || wal[position] == cfBatch) {
+			first, b, err := recordToBatch(wal, &position)
+			if err != nil {
+				// A crash while appending the record: the batch was never acknowledged, drop it
+				// so that new records are not appended after it
+				fmt.Println("Ignoring the end of the WAL:", err)
+				if err := os.Truncate(mem.path(walFileName), int64(position)); err != nil {
+					return err
+				}
+				break
+			}
+			if err := mem.openBatchFamilies(b); err != nil {
+				return err
+			}
+			mem.applyBatch(first, b)
+		} else {
+			var flag byte
+			var seq uint64
+			var keyBytes, valueBytes []byte
+			var expiry int64
+			if legacy {
+				flag, keyBytes, valueBytes = legacyEntryToKv(wal, &position)
+				seq = mem.seq + 1
+			} else {
+				flag, seq, keyBytes, valueBytes, expiry = entryToKv(wal, &position)
+			}
 
-			mem.values.Put(string(keyBytes), value{
+			mem.seq = max(mem.seq, seq)
+			mem.put(internalKey{string(keyBytes), seq}, value{
 				flag,
 				valueBytes,
+				expiry,
 			})
-			// Check if the number
-			if mem.values.Size() == memLimit {
-				if err := mem.flush(); err != nil {
-					return errors.New("Error while flushing Memtable to disk.")
-				}
+		}
+		// Check if the number
+		if mem.needsFlush() {
+			if err := mem.flush(); err != nil {
+				return fmt.Errorf("Error while flushing Memtable to disk: %w", err)
 			}
 		}
-		return nil
 	}
-	return errors.New("Empty WAL file")
+
+	// Flush a legacy WAL right away, so that new entries are never appended to it in the new format
+	if legacy {
+		return mem.flush()
+	}
+	return nil
 }
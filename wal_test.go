@@ -1,33 +1,74 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"testing"
 )
 
-func TestAppendToWAL(t *testing.T) {
-	db, err := newDB()
-	if err != nil {
-		t.Fatal("Error creating a new DB:", err)
+func TestAppendBatchToWAL(t *testing.T) {
+	db := newTestDB(t)
+
+	// Normal case: a write is logged before it is acknowledged
+	if err := db.Set("wal_key", []byte("wal_value")); err != nil {
+		t.Fatalf("Error setting key: %s", err)
 	}
-	defer db.wal.Close()
 
-	// Normal case: Append to WAL
-	key := "wal_key"
-	value := value{
-		flag: set,
-		val:  []byte("wal_value"),
+	// Edge case: a write to a WAL file that no longer exists creates it
+	db.wal.Close()
+	os.Remove(walFileName)
+	if err := db.Set("wal_key2", []byte("wal_value2")); err != nil {
+		t.Fatalf("Error setting key with a non-existent WAL file: %s", err)
 	}
+	db.wal.Close()
 
-	if err := db.appendToWAL(key, value); err != nil {
-		t.Fatalf("Error appending to WAL: %s", err)
+	reopened, err := newDB()
+	if err != nil {
+		t.Fatal("Error reopening the DB:", err)
+	}
+	defer reopened.wal.Close()
+	if err := reopened.recoverWAL(); err != nil {
+		t.Fatalf("Error recovering the WAL: %s", err)
+	}
+	if val, err := reopened.Get("wal_key2"); err != nil || string(val) != "wal_value2" {
+		t.Fatalf("Expected wal_key2=wal_value2 to be recovered, got %q (%v)", val, err)
 	}
+}
+
+func TestRecoverWALSequence(t *testing.T) {
+	db := newTestDB(t)
 
-	// Edge case: Append to non-existent WAL file
+	// Enough writes to flush once and leave entries in the WAL
+	for i := 0; i < memLimit+3; i++ {
+		if err := db.Set("key", []byte{byte('a' + i)}); err != nil {
+			t.Fatalf("Error setting key: %s", err)
+		}
+	}
 	db.wal.Close()
-	os.Remove(walFileName)
 
-	if err := db.appendToWAL(key, value); err != nil {
-		t.Fatalf("Error appending to non-existent WAL file: %s", err)
+	// Reopen: the sequence number resumes from the SST files and the WAL
+	reopened, err := newDB()
+	if err != nil {
+		t.Fatal("Error reopening the DB:", err)
+	}
+	defer reopened.wal.Close()
+	if err := reopened.recoverWAL(); err != nil {
+		t.Fatalf("Error recovering the WAL: %s", err)
+	}
+	if reopened.seq != memLimit+3 {
+		t.Fatalf("Expected sequence number %d, got %d", memLimit+3, reopened.seq)
+	}
+	if val, err := reopened.Get("key"); err != nil || val[0] != byte('a'+memLimit+2) {
+		t.Fatalf("Expected the last value, got %s (%v)", val, err)
+	}
+
+	// Edge case: a WAL holding no record cannot be recovered
+	empty, err := openDB(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal("Error opening the DB:", err)
+	}
+	defer empty.Close()
+	if err := empty.recoverWAL(); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Expected ErrCorruption, got %v", err)
 	}
 }
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// webhooksColumnFamily is the column family storing the webhooks, their delivery cursors and their dead letters,
+// under the keys "hook/<id>", "cursor/<id>" and "dead/<id>/<sequence number>". It is created by the first webhook.
+const webhooksColumnFamily = "webhooks"
+
+// webhookOptions configures the delivery of the webhooks.
+type webhookOptions struct {
+	timeout     time.Duration // Maximum duration of a POST request
+	minBackoff  time.Duration // Delay before the first retry of a change, doubled at each retry
+	maxBackoff  time.Duration // Longest delay between two retries
+	maxAttempts int           // Attempts to deliver a change before it is moved to the dead letters
+
+	cursorInterval time.Duration // Longest delay before the cursor of the changes delivered is stored
+}
+
+// defaultWebhookOptions retry a change for about half an hour before giving up, and store the cursors every second.
+var defaultWebhookOptions = webhookOptions{10 * time.Second, time.Second, 5 * time.Minute, 12, time.Second}
+
+// webhook is a registered webhook: the changes to the keys of the column family CF starting with Prefix
+// are POSTed to URL.
+type webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Prefix  string    `json:"prefix"`
+	CF      string    `json:"cf,omitempty"` // Column family, the default one if empty
+	Created time.Time `json:"created"`
+}
+
+// webhookEvent is the JSON body POSTed to a webhook for a change.
+type webhookEvent struct {
+	Hook string `json:"hook"`
+	watchEvent
+}
+
+// deadLetter is a change that could not be delivered to a webhook.
+type deadLetter struct {
+	Hook     string     `json:"hook"`
+	Event    watchEvent `json:"event"`
+	Attempts int        `json:"attempts"`
+	Error    string     `json:"error"`
+	Time     time.Time  `json:"time"`
+}
+
+// webhookManager delivers the changes of a database to its webhooks, at least once and in order.
+// Each webhook has its own goroutine watching the changes from its delivery cursor, the sequence number of
+// the last change delivered or given up. The cursor is stored in the database at most every cursorInterval
+// while changes are delivered, so that a burst of changes does not write as many cursors to the Write-Ahead Log.
+// The changes delivered since are thus delivered again if the process stops before the cursor is stored.
+// The receivers may use the sequence number to detect such duplicates.
+// The stored cursors pin the archived Write-Ahead Logs, beyond walArchiveRetention if need be, so that the
+// changes still owed to a webhook are replayed however long its receiver or the server was down. If they are
+// missing all the same, the webhook fails: its delivery stops for good rather than skipping them.
+// Since the cursors and the dead letters are written to the database, the deliveries only run on a database
+// accepting writes: a follower leaves them to its primary until it is promoted, and a node of a Raft cluster,
+// whose writes go through the Raft log, has no webhookManager.
+type webhookManager struct {
+	db     *fileDB // Default column family of the database
+	opts   webhookOptions
+	client *http.Client
+
+	mu      sync.Mutex
+	workers map[string]context.CancelFunc // Cancels the delivery of each webhook, by id
+	failed  map[string]error              // Error that stopped the delivery of each failed webhook, by id
+	stopped bool                          // Once set by stop, no delivery starts
+	done    chan struct{}                 // Closed by stop
+	running sync.WaitGroup
+}
+
+// newWebhookManager creates a webhookManager for db and starts delivering the changes to the registered webhooks.
+// The webhooks of a follower, replicated from its primary, are left to the primary until the follower is promoted.
+// The deliveries run until stop is called.
+func newWebhookManager(db *fileDB, opts webhookOptions) *webhookManager {
+	m := &webhookManager{
+		db:      db,
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.timeout},
+		workers: make(map[string]context.CancelFunc),
+		failed:  make(map[string]error),
+		done:    make(chan struct{}),
+	}
+	if promoted := db.promotion(); promoted != nil {
+		go func() {
+			select {
+			case <-promoted:
+				m.startAll()
+			case <-m.done:
+			}
+		}()
+		return m
+	}
+	m.startAll()
+	return m
+}
+
+// startAll pins the Write-Ahead Logs after the cursors of the registered webhooks and starts delivering
+// the changes to them.
+func (m *webhookManager) startAll() {
+	hooks, err := m.list()
+	if err != nil {
+		fmt.Println("Error loading the webhooks:", err)
+	}
+	for _, hook := range hooks {
+		cursor, err := m.cursor(hook.ID)
+		if err != nil {
+			fmt.Printf("Error loading the cursor of webhook %s: %s\n", hook.ID, err)
+			continue
+		}
+		m.db.pinWAL(hook.ID, cursor)
+		m.start(hook)
+	}
+}
+
+// family returns the column family of the webhooks, creating it if create is set.
+// Returns nil without error if it does not exist and create is not set.
+func (m *webhookManager) family(create bool) (*fileDB, error) {
+	if family := m.db.ColumnFamily(webhooksColumnFamily); family != nil || !create {
+		return family, nil
+	}
+	return m.db.OpenColumnFamily(webhooksColumnFamily, Options{})
+}
+
+// register stores a new webhook and starts delivering to it the changes committed from now on.
+// Returns the webhook, with its id, or an error wrapping ErrInvalidArgument if its URL or column family is invalid.
+func (m *webhookManager) register(hook webhook) (webhook, error) {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return webhook{}, fmt.Errorf("%w: invalid webhook URL %q", ErrInvalidArgument, hook.URL)
+	}
+	if hook.CF == webhooksColumnFamily {
+		return webhook{}, fmt.Errorf("%w: the %s column family cannot be watched", ErrInvalidArgument, webhooksColumnFamily)
+	}
+	if hook.CF != "" && m.db.ColumnFamily(hook.CF) == nil {
+		return webhook{}, fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, hook.CF)
+	}
+	family, err := m.family(true)
+	if err != nil {
+		return webhook{}, err
+	}
+
+	raw := make([]byte, 8)
+	if _, err := rand.Read(raw); err != nil {
+		return webhook{}, err
+	}
+	hook.ID = hex.EncodeToString(raw)
+	hook.Created = time.Now().UTC()
+	data, err := json.Marshal(hook)
+	if err != nil {
+		return webhook{}, err
+	}
+
+	if err := family.Set("hook/"+hook.ID, data); err != nil {
+		return webhook{}, err
+	}
+	// The webhook receives the changes committed from now on. Without a cursor, it only gets live changes.
+	if err := m.setCursor(hook.ID, m.db.sequence()); err != nil {
+		return webhook{}, err
+	}
+	m.start(hook)
+	return hook, nil
+}
+
+// remove stops delivering to a webhook and deletes it, along with its cursor and its dead letters.
+// Returns an error wrapping ErrNotFound if the webhook does not exist.
+func (m *webhookManager) remove(id string) error {
+	family, err := m.family(false)
+	if err != nil {
+		return err
+	}
+	if family == nil {
+		return fmt.Errorf("%w: webhook %s", ErrNotFound, id)
+	}
+	if _, err := family.Get("hook/" + id); err != nil {
+		return fmt.Errorf("%w: webhook %s", err, id)
+	}
+
+	m.mu.Lock()
+	if cancel, ok := m.workers[id]; ok {
+		cancel()
+		delete(m.workers, id)
+	}
+	delete(m.failed, id)
+	m.mu.Unlock()
+	m.db.unpinWAL(id)
+
+	b := NewWriteBatch()
+	b.DelCF(family, "hook/"+id)
+	b.DelCF(family, "cursor/"+id)
+	if err := m.db.Write(b); err != nil {
+		return err
+	}
+	return m.purge(id)
+}
+
+// list returns the registered webhooks, sorted by id.
+func (m *webhookManager) list() ([]webhook, error) {
+	family, err := m.family(false)
+	if err != nil || family == nil {
+		return nil, err
+	}
+	it, err := family.NewIterator(&IterOptions{Prefix: "hook/"})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var hooks []webhook
+	for ok := it.First(); ok; ok = it.Next() {
+		var hook webhook
+		if err := json.Unmarshal(it.Value(), &hook); err != nil {
+			return nil, fmt.Errorf("%w: webhook %s: %s", ErrCorruption, it.Key(), err)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, it.Err()
+}
+
+// webhookStatus is a webhook along with the progress of its delivery.
+type webhookStatus struct {
+	webhook
+	Cursor      uint64 `json:"cursor"` // Sequence number of the last change delivered or given up, as stored
+	DeadLetters int    `json:"deadLetters"`
+	Failed      string `json:"failed,omitempty"` // Error that stopped the delivery for good
+}
+
+// status returns the registered webhooks along with their cursor, their number of dead letters and the error
+// that stopped their delivery if they failed, sorted by id.
+func (m *webhookManager) status() ([]webhookStatus, error) {
+	hooks, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]webhookStatus, len(hooks))
+	for i, hook := range hooks {
+		cursor, err := m.cursor(hook.ID)
+		if err != nil {
+			return nil, err
+		}
+		letters, err := m.deadLetters(hook.ID)
+		if err != nil {
+			return nil, err
+		}
+		statuses[i] = webhookStatus{hook, cursor, len(letters), ""}
+		m.mu.Lock()
+		if err := m.failed[hook.ID]; err != nil {
+			statuses[i].Failed = err.Error()
+		}
+		m.mu.Unlock()
+	}
+	return statuses, nil
+}
+
+// cursor returns the delivery cursor of a webhook.
+func (m *webhookManager) cursor(id string) (uint64, error) {
+	family, err := m.family(false)
+	if err != nil || family == nil {
+		return 0, err
+	}
+	val, err := family.Get("cursor/" + id)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(val), 10, 64)
+}
+
+// deadLetters returns the dead letters of a webhook, or of all of them if id is empty, in order.
+func (m *webhookManager) deadLetters(id string) ([]deadLetter, error) {
+	family, err := m.family(false)
+	if err != nil || family == nil {
+		return nil, err
+	}
+	prefix := "dead/"
+	if id != "" {
+		prefix += id + "/"
+	}
+	it, err := family.NewIterator(&IterOptions{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	letters := []deadLetter{}
+	for ok := it.First(); ok; ok = it.Next() {
+		var letter deadLetter
+		if err := json.Unmarshal(it.Value(), &letter); err != nil {
+			return nil, fmt.Errorf("%w: dead letter %s: %s", ErrCorruption, it.Key(), err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, it.Err()
+}
+
+// purge deletes the dead letters of a webhook.
+func (m *webhookManager) purge(id string) error {
+	family, err := m.family(false)
+	if err != nil || family == nil {
+		return err
+	}
+	prefix := "dead/" + id + "/"
+	return family.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// start starts delivering the changes to a webhook in its own goroutine, unless the manager is stopped.
+func (m *webhookManager) start(hook webhook) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		cancel()
+		return
+	}
+	m.workers[hook.ID] = cancel
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		m.run(ctx, hook)
+	}()
+}
+
+// stop stops delivering the changes to the webhooks and waits for the deliveries in progress to end.
+// The webhooks stay registered, and are delivered again by the next webhookManager of the database.
+func (m *webhookManager) stop() {
+	m.mu.Lock()
+	if !m.stopped {
+		m.stopped = true
+		close(m.done)
+	}
+	for id, cancel := range m.workers {
+		cancel()
+		delete(m.workers, id)
+	}
+	m.mu.Unlock()
+	m.running.Wait()
+}
+
+// run delivers the changes to a webhook until ctx is done, the database is closed or the webhook fails.
+// The delivery resumes from the cursor after any other error, right away if the watcher fell behind.
+func (m *webhookManager) run(ctx context.Context, hook webhook) {
+	for {
+		err := m.deliverFrom(ctx, hook)
+		if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+			return
+		}
+		if errors.Is(err, ErrTrimmed) {
+			m.fail(hook.ID, err)
+			return
+		}
+		if errors.Is(err, ErrLagging) {
+			continue
+		}
+		fmt.Printf("Error delivering to webhook %s: %s\n", hook.ID, err)
+		if !sleepContext(ctx, m.opts.maxBackoff) {
+			return
+		}
+	}
+}
+
+// deliverFrom watches the changes after the cursor of a webhook and delivers them one at a time, storing the
+// cursor every cursorInterval and when the delivery stops. Changes that cannot be delivered are moved to the
+// dead letters.
+// Returns the error that stopped the delivery, wrapping ErrTrimmed if the changes after the cursor are no longer
+// retained.
+func (m *webhookManager) deliverFrom(ctx context.Context, hook webhook) (err error) {
+	family := m.db
+	if hook.CF != "" {
+		if family = m.db.ColumnFamily(hook.CF); family == nil {
+			return fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, hook.CF)
+		}
+	}
+	cursor, err := m.cursor(hook.ID)
+	if err != nil {
+		return err
+	}
+	w, err := family.Watch(hook.Prefix, cursor)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	delivered, stored := cursor, time.Now()
+	store := func() error {
+		if err := m.setCursor(hook.ID, delivered); err != nil {
+			return err
+		}
+		cursor, stored = delivered, time.Now()
+		return nil
+	}
+	defer func() {
+		// A removed webhook has no cursor to store, and a closed database cannot store it
+		if delivered != cursor && !errors.Is(err, ErrClosed) && (ctx.Err() == nil || m.isStopped()) {
+			if storeErr := store(); err == nil {
+				err = storeErr
+			}
+		}
+	}()
+
+	for {
+		// Wait for the next change until the cursor of the changes delivered is due to be stored
+		next, cancel := ctx, context.CancelFunc(func() {})
+		if delivered != cursor {
+			next, cancel = context.WithDeadline(ctx, stored.Add(m.opts.cursorInterval))
+		}
+		c, err := w.Next(next)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			if err := store(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		attempts, err := m.deliver(ctx, hook, c)
+		if ctx.Err() != nil {
+			return ctx.Err() // Delivered again after a restart, since the cursor was not moved
+		}
+		if err != nil {
+			// The dead letter is stored along with the cursor
+			if err := m.bury(hook, c, attempts, err); err != nil {
+				return err
+			}
+			cursor, delivered, stored = c.Seq, c.Seq, time.Now()
+			continue
+		}
+		delivered = c.Seq
+		if time.Since(stored) >= m.opts.cursorInterval {
+			if err := store(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deliver POSTs a change to a webhook, retrying with exponential backoff up to maxAttempts times.
+// Returns the number of attempts and the error of the last one if none succeeded.
+func (m *webhookManager) deliver(ctx context.Context, hook webhook, c Change) (int, error) {
+	body, err := json.Marshal(webhookEvent{hook.ID, newWatchEvent(c)})
+	if err != nil {
+		return 0, err
+	}
+	backoff := m.opts.minBackoff
+	for attempt := 1; ; attempt++ {
+		err := m.post(ctx, hook, c.Seq, body)
+		if err == nil || attempt >= m.opts.maxAttempts {
+			return attempt, err
+		}
+		if !sleepContext(ctx, backoff) {
+			return attempt, ctx.Err()
+		}
+		backoff = min(2*backoff, m.opts.maxBackoff)
+	}
+}
+
+// post sends the body of a change to a webhook. The receiver acknowledges it with a 2xx status.
+func (m *webhookManager) post(ctx context.Context, hook webhook, seq uint64, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GoDB-Hook", hook.ID)
+	req.Header.Set("X-GoDB-Seq", strconv.FormatUint(seq, 10))
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// bury stores a change that could not be delivered to a webhook as a dead letter, and moves the cursor of
+// the webhook to it.
+func (m *webhookManager) bury(hook webhook, c Change, attempts int, cause error) error {
+	family, err := m.family(false)
+	if err != nil || family == nil {
+		return err
+	}
+	data, err := json.Marshal(deadLetter{hook.ID, newWatchEvent(c), attempts, cause.Error(), time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	b := NewWriteBatch()
+	b.SetCF(family, fmt.Sprintf("dead/%s/%020d", hook.ID, c.Seq), data)
+	b.SetCF(family, "cursor/"+hook.ID, []byte(strconv.FormatUint(c.Seq, 10)))
+	if err := m.db.Write(b); err != nil {
+		return err
+	}
+	m.db.pinWAL(hook.ID, c.Seq)
+	return nil
+}
+
+// setCursor stores the delivery cursor of a webhook, and pins the Write-Ahead Logs holding the changes after it.
+func (m *webhookManager) setCursor(id string, seq uint64) error {
+	family, err := m.family(false)
+	if err != nil || family == nil {
+		return err
+	}
+	if err := family.Set("cursor/"+id, []byte(strconv.FormatUint(seq, 10))); err != nil {
+		return err
+	}
+	m.db.pinWAL(id, seq)
+	return nil
+}
+
+// fail stops delivering to a webhook for good after err, reported by status, and unpins the Write-Ahead Logs
+// after its cursor. The webhook has to be removed and registered again.
+func (m *webhookManager) fail(id string, err error) {
+	fmt.Printf("Webhook %s failed: %s\n", id, err)
+	m.mu.Lock()
+	m.failed[id] = err
+	m.mu.Unlock()
+	m.db.unpinWAL(id)
+}
+
+// isStopped returns whether stop was called.
+func (m *webhookManager) isStopped() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopped
+}
+
+// sleepContext waits for d, or until ctx is done.
+// Returns false if ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhookOptions retry quickly, so that the tests run fast.
+var testWebhookOptions = webhookOptions{time.Second, 5 * time.Millisecond, 20 * time.Millisecond, 3, 10 * time.Millisecond}
+
+// receiver is a webhook receiver recording the events it acknowledges. It fails the requests while failures is
+// positive, decrementing it, or always if it is negative.
+type receiver struct {
+	mu       sync.Mutex
+	events   []webhookEvent
+	headers  []http.Header
+	failures int
+}
+
+// newReceiver starts a receiver, closed at the end of the test.
+func newReceiver(t *testing.T, failures int) (*receiver, *httptest.Server) {
+	r := &receiver{failures: failures}
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.failures != 0 {
+			r.failures--
+			http.Error(resp, "Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var event webhookEvent
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.events = append(r.events, event)
+		r.headers = append(r.headers, req.Header)
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+// received returns the events acknowledged so far.
+func (r *receiver) received() []webhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhookEvent(nil), r.events...)
+}
+
+// waitFor polls cond until it holds, failing the test after two seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	db := newTestDB(t)
+	r, srv := newReceiver(t, 2)
+	m := newWebhookManager(db, testWebhookOptions)
+	defer m.stop()
+	hook, err := m.register(webhook{URL: srv.URL, Prefix: "user:"})
+	if err != nil {
+		t.Fatalf("Error registering webhook: %s", err)
+	}
+
+	// The changes to the watched keys are delivered in order, the first one after two failures
+	db.Set("user:1", []byte("bob"))
+	db.Set("other", []byte("x"))
+	db.Del("user:1")
+	waitFor(t, "2 events", func() bool { return len(r.received()) == 2 })
+	events := r.received()
+	if events[0].Hook != hook.ID || events[0].Op != ChangeSet || events[0].Key != "user:1" || *events[0].Value != "bob" {
+		t.Fatalf("Unexpected event %+v", events[0])
+	}
+	if events[1].Op != ChangeDelete || events[1].Seq <= events[0].Seq {
+		t.Fatalf("Unexpected event %+v", events[1])
+	}
+	if h := r.headers[1]; h.Get("X-GoDB-Hook") != hook.ID || h.Get("X-GoDB-Seq") != strconv.FormatUint(events[1].Seq, 10) {
+		t.Fatalf("Unexpected headers %v", h)
+	}
+	waitFor(t, "the cursor", func() bool { cursor, _ := m.cursor(hook.ID); return cursor == events[1].Seq })
+
+	// Edge cases: invalid URLs and column families
+	for _, invalid := range []webhook{{URL: "ftp://host"}, {URL: "no url"}, {URL: srv.URL, CF: webhooksColumnFamily}} {
+		if _, err := m.register(invalid); err == nil {
+			t.Fatalf("Expected an error registering %+v", invalid)
+		}
+	}
+	if _, err := m.register(webhook{URL: srv.URL, CF: "missing"}); err == nil {
+		t.Fatal("Expected an error for a missing column family")
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	r, srv := newReceiver(t, -1)
+	m := newWebhookManager(db, testWebhookOptions)
+	defer m.stop()
+	hook, err := m.register(webhook{URL: srv.URL})
+	if err != nil {
+		t.Fatalf("Error registering webhook: %s", err)
+	}
+
+	// A change is given up after maxAttempts, and the delivery goes on with the next one
+	db.Set("a", []byte("1"))
+	db.Set("b", []byte("2"))
+	var letters []deadLetter
+	waitFor(t, "2 dead letters", func() bool { letters, _ = m.deadLetters(hook.ID); return len(letters) == 2 })
+	if l := letters[0]; l.Hook != hook.ID || l.Event.Key != "a" || l.Attempts != 3 || !strings.Contains(l.Error, "503") {
+		t.Fatalf("Unexpected dead letter %+v", l)
+	}
+	if letters[1].Event.Key != "b" || len(r.received()) != 0 {
+		t.Fatalf("Unexpected dead letters %+v", letters)
+	}
+
+	// The dead letters are purged along with the webhook
+	if err := m.remove(hook.ID); err != nil {
+		t.Fatalf("Error removing webhook: %s", err)
+	}
+	if letters, _ := m.deadLetters(""); len(letters) != 0 {
+		t.Fatalf("Expected no dead letters, got %+v", letters)
+	}
+	if hooks, _ := m.list(); len(hooks) != 0 {
+		t.Fatalf("Expected no webhooks, got %+v", hooks)
+	}
+}
+
+func TestWebhookRestart(t *testing.T) {
+	db := newTestDB(t)
+	r, srv := newReceiver(t, 0)
+	m := newWebhookManager(db, testWebhookOptions)
+	hook, err := m.register(webhook{URL: srv.URL, Prefix: "user:"})
+	if err != nil {
+		t.Fatalf("Error registering webhook: %s", err)
+	}
+	db.Set("user:1", []byte("bob"))
+	waitFor(t, "the cursor", func() bool { cursor, _ := m.cursor(hook.ID); return cursor == 3 })
+	m.stop()
+	// Edge case: a stopped manager starts no delivery
+	m.start(hook)
+	if len(m.workers) != 0 {
+		t.Fatalf("Expected no delivery after stop, got %d", len(m.workers))
+	}
+	db.Close()
+
+	// The changes committed while the webhooks were down are delivered after the restart, and only them
+	db, err = newDB()
+	if err != nil {
+		t.Fatalf("Error reopening the database: %s", err)
+	}
+	defer db.Close()
+	for i := 0; i < memLimit; i++ {
+		db.Set("other", []byte("x"))
+	}
+	db.Set("user:2", []byte("alice"))
+	m = newWebhookManager(db, testWebhookOptions)
+	defer m.stop()
+	db.Set("user:3", []byte("carol"))
+	waitFor(t, "3 events", func() bool { return len(r.received()) >= 3 })
+	time.Sleep(20 * time.Millisecond)
+	events := r.received()
+	if len(events) != 3 || events[1].Key != "user:2" || events[2].Key != "user:3" {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+}
+
+func TestWebhookOutage(t *testing.T) {
+	db := newTestDB(t)
+	r, srv := newReceiver(t, -1)
+	opts := testWebhookOptions
+	opts.maxAttempts = 1 << 30
+	m := newWebhookManager(db, opts)
+	defer m.stop()
+	hook, err := m.register(webhook{URL: srv.URL, Prefix: "k"})
+	if err != nil {
+		t.Fatalf("Error registering webhook: %s", err)
+	}
+
+	// The receiver is down for longer than the archived logs retain
+	const count = (walArchiveRetention + 2) * memLimit
+	for i := 0; i < count; i++ {
+		db.Set(fmt.Sprintf("k%04d", i), []byte("v"))
+	}
+	if archives, _ := db.archivedWALs(); len(archives) <= walArchiveRetention {
+		t.Fatalf("Expected the logs owed to the webhook to be kept, got %d archived logs", len(archives))
+	}
+	r.mu.Lock()
+	r.failures = 0
+	r.mu.Unlock()
+
+	// Every change is delivered once the receiver is back, in order
+	waitFor(t, "every event", func() bool { return len(r.received()) == count })
+	events := r.received()
+	for i, event := range events {
+		if event.Key != fmt.Sprintf("k%04d", i) {
+			t.Fatalf("Unexpected event %+v at position %d", event, i)
+		}
+	}
+	waitFor(t, "the cursor", func() bool { cursor, _ := m.cursor(hook.ID); return cursor == events[count-1].Seq })
+	for i := 0; i < memLimit; i++ {
+		db.Set("other", []byte("x"))
+	}
+	if archives, _ := db.archivedWALs(); len(archives) != walArchiveRetention {
+		t.Fatalf("Expected %d archived logs once delivered, got %d", walArchiveRetention, len(archives))
+	}
+
+	// Edge case: changes lost all the same fail the webhook instead of being skipped
+	m.stop()
+	for i := 0; i < 2*memLimit; i++ {
+		db.Set("k", []byte("lost"))
+	}
+	if err := os.RemoveAll(db.path(walArchiveDir)); err != nil {
+		t.Fatal(err)
+	}
+	cursor, _ := m.cursor(hook.ID)
+	m = newWebhookManager(db, opts)
+	defer m.stop()
+	var statuses []webhookStatus
+	waitFor(t, "the failure", func() bool { statuses, _ = m.status(); return len(statuses) == 1 && statuses[0].Failed != "" })
+	db.Set("k", []byte("after"))
+	time.Sleep(20 * time.Millisecond)
+	if !strings.Contains(statuses[0].Failed, "no longer retained") || statuses[0].Cursor != cursor || len(r.received()) != count {
+		t.Fatalf("Unexpected status %+v after %d events", statuses[0], len(r.received()))
+	}
+}
+
+func TestHandleWebhooks(t *testing.T) {
+	db := newTestDB(t)
+	_, receiverSrv := newReceiver(t, -1)
+	hooks := newWebhookManager(db, testWebhookOptions)
+	t.Cleanup(hooks.stop)
+	srv := httptest.NewServer(handleFunction(db, hooks))
+	defer srv.Close()
+
+	do := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %s", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/webhooks", `{"url":"`+receiverSrv.URL+`","prefix":"k"}`)
+	var hook webhook
+	if json.NewDecoder(resp.Body).Decode(&hook); resp.StatusCode != http.StatusCreated || hook.ID == "" {
+		t.Fatalf("Unexpected response %d %+v", resp.StatusCode, hook)
+	}
+	db.Set("k", []byte("v"))
+	waitFor(t, "a dead letter", func() bool { letters, _ := hooks.deadLetters(hook.ID); return len(letters) == 1 })
+
+	var statuses []webhookStatus
+	json.NewDecoder(do(http.MethodGet, "/webhooks", "").Body).Decode(&statuses)
+	if len(statuses) != 1 || statuses[0].ID != hook.ID || statuses[0].DeadLetters != 1 || statuses[0].Cursor == 0 {
+		t.Fatalf("Unexpected webhooks %+v", statuses)
+	}
+	var letters []deadLetter
+	json.NewDecoder(do(http.MethodGet, "/webhooks/dead?id="+hook.ID, "").Body).Decode(&letters)
+	if len(letters) != 1 || letters[0].Event.Key != "k" {
+		t.Fatalf("Unexpected dead letters %+v", letters)
+	}
+	if resp := do(http.MethodDelete, "/webhooks/dead?id="+hook.ID, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", resp.StatusCode)
+	}
+	if letters, _ := hooks.deadLetters(hook.ID); len(letters) != 0 {
+		t.Fatalf("Expected the dead letters to be purged, got %+v", letters)
+	}
+
+	// Edge cases
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/webhooks", `{"url":"nowhere"}`, http.StatusBadRequest},
+		{http.MethodPost, "/webhooks", `not json`, http.StatusBadRequest},
+		{http.MethodPost, "/webhooks", `{"url":"http://host","cf":"missing"}`, http.StatusNotFound},
+		{http.MethodDelete, "/webhooks", "", http.StatusBadRequest},
+		{http.MethodPut, "/webhooks", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/webhooks/other", "", http.StatusNotFound},
+		{http.MethodDelete, "/webhooks?id=" + hook.ID, "", http.StatusNoContent},
+		{http.MethodDelete, "/webhooks?id=" + hook.ID, "", http.StatusNotFound},
+	} {
+		if resp := do(tc.method, tc.path, tc.body); resp.StatusCode != tc.status {
+			t.Fatalf("%s %s: expected %d, got %d", tc.method, tc.path, tc.status, resp.StatusCode)
+		}
+	}
+
+	// Edge case: a server without webhookManager, such as a cluster node, does not manage webhooks
+	rec := httptest.NewRecorder()
+	handleFunction(db, nil)(rec, httptest.NewRequest(http.MethodGet, "/webhooks", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected 501, got %d", rec.Code)
+	}
+}